@@ -3,7 +3,7 @@ module cf.plugin.ref/requires
 go 1.16
 
 require (
-	code.cloudfoundry.org/bytefmt v0.0.0-20210608160410-67692ebc98de // indirect
+	code.cloudfoundry.org/bytefmt v0.0.0-20210608160410-67692ebc98de
 	code.cloudfoundry.org/cli v7.1.0+incompatible
 	github.com/SAP/cf-cli-java-plugin v0.0.0-20210701123331-dc7334389e07
 	github.com/SermoDigital/jose v0.9.1 // indirect
@@ -23,6 +23,7 @@ require (
 	github.com/vito/go-interact v1.0.0 // indirect
 	golang.org/x/tools v0.1.5 // indirect
 	gopkg.in/cheggaaa/pb.v1 v1.0.28 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 	utils v1.0.0
 )
 
@@ -0,0 +1,34 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package main
+
+import (
+	"cf.plugin.ref/requires/pkg/javadiag"
+
+	"code.cloudfoundry.org/cli/plugin"
+)
+
+// Unlike most Go programs, the `Main()` function will not be used to run all of the
+// commands provided in your plugin. Main will be used to initialize the plugin
+// process, as well as any dependencies you might require for your
+// plugin.
+//
+// The plugin is a thin wrapper around the javadiag package, which other tools can import to run its commands
+// without shelling out to cf java.
+func main() {
+	// Any initialization for your plugin can be handled here
+	//
+	// Note: to run the plugin.Start method, we pass in a pointer to the struct
+	// implementing the interface defined at "code.cloudfoundry.org/cli/plugin/plugin.go"
+	//
+	// Note: The plugin's main() method is invoked at install time to collect
+	// metadata. The plugin will exit 0 and the Run([]string) method will not be
+	// invoked.
+	plugin.Start(new(javadiag.JavaPlugin))
+	// Plugin code should be written in the Run([]string) method,
+	// ensuring the plugin environment is bootstrapped.
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"utils"
+)
+
+// signalSentMarker is printed by the remote command once it sent SIGQUIT to the JVM, which then prints the thread dump
+// into the app logs instead of the output of the command
+const signalSentMarker = "cf-java-plugin: SIGQUIT sent"
+
+// signalDumpDelay is the time given to the JVM and the logging of Cloud Foundry before the thread dump is read from
+// the recent logs
+const signalDumpDelay = 5 * time.Second
+
+// appLogPattern matches the lines of the app instances in the output of cf logs, e.g.,
+// "2024-05-01T10:00:00.12+0000 [APP/PROC/WEB/0] OUT Full thread dump", with the instance and the message
+var appLogPattern = regexp.MustCompile(`^\s*\S+ \[APP/PROC/WEB/(\d+)\] (?:OUT|ERR) ?(.*)$`)
+
+// threadDumpFromLogs returns the last thread dump that the app instance printed into the given lines of cf logs, or
+// an empty string if there is none
+func threadDumpFromLogs(lines []string, applicationInstance int) string {
+	if applicationInstance < 0 {
+		applicationInstance = 0
+	}
+
+	var dump []string
+	complete := false
+	for _, line := range lines {
+		match := appLogPattern.FindStringSubmatch(line)
+		if match == nil || match[1] != strconv.Itoa(applicationInstance) {
+			continue
+		}
+
+		message := match[2]
+		switch {
+		case strings.HasPrefix(message, "Full thread dump"):
+			dump, complete = []string{message}, false
+		case dump != nil && !complete:
+			dump = append(dump, message)
+			// HotSpot ends the thread dump with the count of the JNI references
+			complete = strings.HasPrefix(message, "JNI global ref")
+		}
+	}
+
+	return strings.Join(dump, "\n")
+}
+
+// readSignalDump waits for the JVM to print the thread dump triggered with SIGQUIT and returns it from the recent logs
+// of the app
+func readSignalDump(util utils.CfJavaPluginUtil, applicationName string, applicationInstance int) (string, error) {
+	sleep(signalDumpDelay)
+
+	lines, err := util.GetRecentLogs(applicationName)
+	if err != nil {
+		return "", err
+	}
+
+	dump := threadDumpFromLogs(lines, applicationInstance)
+	if dump == "" {
+		return "", errors.New("The JVM was sent SIGQUIT, but its thread dump was not found in the recent logs, run `cf logs " + utils.ShellWord(applicationName) + " --recent` to look for it")
+	}
+
+	return dump, nil
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// archiveFiles packs the downloaded files into the zip archive <localDir>/<name>-<timestamp>.zip and removes the
+// loose files once the archive is complete
+func archiveFiles(localDir string, name string, files []string, messages io.Writer) error {
+	timestamp, err := formatTimestamp(now(), "iso")
+	if err != nil {
+		return err
+	}
+	archivePath := filepath.Join(localDir, name+"-"+timestamp+".zip")
+
+	if err := writeZip(archivePath, files); err != nil {
+		os.Remove(archivePath)
+		return errors.New("Error creating the archive " + archivePath + ": " + err.Error())
+	}
+
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			return errors.New("Error removing the archived file " + file + ": " + err.Error())
+		}
+	}
+
+	fmt.Fprintln(messages, "Files archived to: "+archivePath)
+	linkLatest(archivePath, messages)
+	return nil
+}
+
+// writeZip writes the files, by their base names, into a new zip archive
+func writeZip(archivePath string, files []string) error {
+	out, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	archive := zip.NewWriter(out)
+	for _, file := range files {
+		if err := addToZip(archive, file); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// addToZip compresses the file into the archive
+func addToZip(archive *zip.Writer, file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Method = zip.Deflate
+
+	entry, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, in)
+	return err
+}
@@ -0,0 +1,31 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+// cdsArchivesInUse is the command printing the CDS archives and AOT caches the JVM was started with; it needs
+// JCMD_COMMAND
+func cdsArchivesInUse(shell shellDialect) string {
+	return "echo 'Archives in use:'; ${JCMD_COMMAND} " + shell.javaPID + " VM.command_line | grep -o -- '-XX:\\(SharedArchiveFile\\|AOTCache\\|ArchiveClassesAtExit\\|AOTMode\\)=[^ ]*' || echo 'none given on the command line, the default CDS archive of the JDK is used, if any'"
+}
+
+// cdsCommands returns the remote commands dumping the classes loaded by the JVM into a CDS archive with jcmd VM.cds,
+// a static one or, for JVMs started with -XX:+RecordDynamicDumpInfo, a dynamic one on top of the archive in use
+func cdsCommands(shell shellDialect, archiveFileName string, dynamic bool) []string {
+	dump := "static_dump"
+	if dynamic {
+		dump = "dynamic_dump"
+	}
+
+	return []string{
+		"JCMD_COMMAND=`" + shell.findExecutable("jcmd") + " | head -1 | tr -d [:space:]`",
+		"if [ -z \"${JCMD_COMMAND}\" ]; then echo >&2 'jcmd is required for dumping CDS archives, please make sure that the app runs on a full JDK'; exit 1; fi",
+		cdsArchivesInUse(shell),
+		"OUTPUT=$( ${JCMD_COMMAND} " + shell.javaPID + " VM.cds " + dump + " " + archiveFileName + " ) || STATUS_CODE=$?",
+		"if [ ! -s " + archiveFileName + " ]; then echo >&2 ${OUTPUT}; exit 1; fi",
+		"if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi",
+	}
+}
@@ -0,0 +1,1961 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"github.com/SAP/cf-cli-java-plugin/cmd"
+	"github.com/SAP/cf-cli-java-plugin/uuid"
+
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"code.cloudfoundry.org/cli/cf/terminal"
+	"code.cloudfoundry.org/cli/cf/trace"
+	"code.cloudfoundry.org/cli/plugin"
+
+	"utils"
+
+	guuid "github.com/satori/go.uuid"
+	"github.com/simonleung8/flags"
+)
+
+// The JavaPlugin is a cf cli plugin that supports taking heap and thread dumps on demand
+type JavaPlugin struct {
+	// stdout receives the messages of the commands and stderr their progress events, os.Stdout and os.Stderr unless
+	// set, e.g., by serve for the commands it runs for its clients
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// messageOutput returns the writer receiving the messages of the commands
+func (c *JavaPlugin) messageOutput() io.Writer {
+	if c.stdout == nil {
+		return os.Stdout
+	}
+	return c.stdout
+}
+
+// progressOutput returns the writer receiving the progress events, on stderr so that they do not mix with the output
+// of the command
+func (c *JavaPlugin) progressOutput() io.Writer {
+	if c.stderr == nil {
+		return os.Stderr
+	}
+	return c.stderr
+}
+
+// InvalidUsageError errors mean that the arguments passed in input to the command are invalid
+type InvalidUsageError struct {
+	message string
+}
+
+func (e InvalidUsageError) Error() string {
+	return e.message
+}
+
+type commandExecutorImpl struct {
+	cliConnection CliConnection
+}
+
+// scriptArguments returns args with the remote command, thousands of characters long, uploaded as a script rather than
+// passed on the command line. Until the script is done, interrupting the plugin stops it in the container, along with
+// the JDK tools it runs; the returned function is to be called once it succeeded. Should the command fail, e.g., as
+// the session broke off, the script may still run in the container and is stopped by the cleanup of the command.
+func scriptArguments(args []string) ([]string, func(), error) {
+	if len(args) > 2 && args[0] == "ssh" && args[len(args)-2] == "--command" {
+		id := guuid.NewV4().String()
+		sshArguments := args[:len(args)-1]
+		if err := uploadScript(sshArguments, args[len(args)-1], remoteScriptPath(id)); err != nil {
+			return nil, nil, err
+		}
+		cleanup.addRemoteScript(sshArguments, id)
+		return append(append([]string{}, sshArguments...), remoteScript(id)), cleanup.settleRemoteScript, nil
+	}
+	return args, func() {}, nil
+}
+
+// Execute runs the cf CLI, showing the output in the terminal once the command is done. The output of the remote
+// commands starting with the KeepaliveCommand is shown by the plugin rather than by the cf CLI, without the NUL bytes
+// of the keepalive, which would otherwise end up in the terminal and in the logs capturing it.
+func (c commandExecutorImpl) Execute(args []string) ([]string, error) {
+	keepalive := len(args) > 0 && strings.HasPrefix(args[len(args)-1], KeepaliveCommand)
+	args, done, err := scriptArguments(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var output []string
+	if keepalive {
+		output, err = c.cliConnection.CliCommandWithoutTerminalOutput(args...)
+		output = withoutKeepalive(output)
+		if len(output) > 0 {
+			fmt.Println(strings.Join(output, "\n"))
+		}
+	} else {
+		output, err = c.cliConnection.CliCommand(args...)
+	}
+	if err == nil {
+		done()
+	}
+
+	return output, err
+}
+
+// ExecuteStreaming runs the cf CLI with the output piped to the terminal, as CliCommand shows the output only once the
+// command is done
+func (c commandExecutorImpl) ExecuteStreaming(args []string) ([]string, error) {
+	args, done, err := scriptArguments(args)
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := &streamBuffer{}
+	cf := utils.CfCommand(args...)
+	cf.Stdin = os.Stdin
+	cf.Stdout = streamWriter{terminal: os.Stdout, buffer: buffer}
+	cf.Stderr = streamWriter{terminal: os.Stderr, buffer: buffer}
+	err = cf.Run()
+	if err == nil {
+		done()
+	}
+
+	return buffer.lines(), err
+}
+
+type uuidGeneratorImpl struct {
+}
+
+func (u uuidGeneratorImpl) Generate() string {
+	return guuid.NewV4().String()
+}
+
+const (
+	// JavaDetectionCommand is the prologue command to detect on the Garden container if it contains a Java app. Visible for tests
+	JavaDetectionCommand = "if ! pgrep -x \"java\" > /dev/null; then echo \"No 'java' process found running. Are you sure this is a Java app?\" >&2; exit 1; fi"
+	// KeepaliveCommand is the prologue command of long-running remote commands: until they exit, it writes a NUL byte to
+	// stderr every 30 seconds, so that the idle timeouts of the load balancers in front of the ssh proxy do not cut the
+	// session, e.g., while jmap writes a large heap dump. Visible for tests
+	KeepaliveCommand     = "(while sleep 30 < /dev/null > /dev/null 2>&1; do printf '\\0' >&2; done) < /dev/null > /dev/null & trap \"kill $! 2> /dev/null\" EXIT"
+	heapDumpCommand      = "heap-dump"
+	threadDumpCommand    = "thread-dump"
+	signalDumpCommand    = "signal-dump"
+	remoteCleanCommand   = "remote-clean"
+	remoteListCommand    = "remote-list"
+	downloadCommand      = "download"
+	cpCommand            = "cp"
+	pushFileCommand      = "push-file"
+	execCommand          = "exec"
+	sshCommand           = "ssh"
+	whereIsCommand       = "where-is"
+	runtimeInfoCommand   = "runtime-info"
+	memoryAdviseCommand  = "memory-advise"
+	vitalsHistoryCommand = "vitals-history"
+	verifyInstallCommand = "verify-install"
+	vmLogCommand         = "vm-log"
+	gcLogsCommand        = "gc-logs"
+	crashReportCommand   = "crash-report"
+	histoDiffCommand     = "histo-diff"
+	attachAgentCommand   = "attach-agent"
+	jolokiaCommand       = "jolokia"
+	monitorCommand       = "monitor"
+	watchOOMCommand      = "watch-oom"
+	checkpointCommand    = "checkpoint"
+	cracStatusCommand    = "crac-status"
+	cdsCommand           = "cds"
+)
+
+// newCommandFlags returns the flags of all commands, ready for parsing
+func newCommandFlags() flags.FlagContext {
+	commandFlags := flags.New()
+
+	commandFlags.NewIntFlagWithDefault("app-instance-index", "i", "application `instance` to connect to", -1)
+	commandFlags.NewBoolFlag("keep", "k", "whether to `keep` the heap/thread-dump on the container of the application instance after having downloaded it locally")
+	commandFlags.NewBoolFlag("dry-run", "n", "triggers the `dry-run` mode to show only the cf-ssh command that would have been executed")
+	commandFlags.NewStringFlag("container-dir", "cd", "specify the folder path where the dump file should be stored in the container, or auto:largest for the one with the most free space")
+	commandFlags.NewStringFlag("local-dir", "ld", "specify the folder where the dump file will be downloaded to, dump file wil not be copied to local if this parameter  was not set")
+	commandFlags.NewStringFlag("limit-rate", "lr", "limit the download speed of the dump file to the given amount of bytes per second, e.g., 2M")
+	commandFlags.NewBoolFlag("no-create", "nc", "do not create the local directory specified with `local-dir` if it does not exist")
+	commandFlags.NewBoolFlag("force", "f", "overwrite the local dump file if it already exists")
+	commandFlags.NewStringFlag("guid", "g", "the `guid` of the application, to be used instead of its name")
+	commandFlags.NewStringFlag("route", "rt", "a route mapped to the application, e.g., api.example.com, to be used instead of its name")
+	commandFlags.NewBoolFlag("delete", "rm", "delete the file from the container after having downloaded it")
+	commandFlags.NewStringFlag("older-than", "ot", "only list or remove the files in the container that are older than the given age, e.g., 7d")
+	commandFlags.NewBoolFlag("verbose", "v", "report additional details, like the directory chosen in the container")
+	commandFlags.NewBoolFlag("json", "j", "with commands, print the table of commands as JSON")
+	commandFlags.NewBoolFlag("help", "h", "show the help of the command")
+	commandFlags.NewBoolFlag("no-uuid", "nu", "name the heap dump after the app only, without a UUID, replacing the previous one")
+	commandFlags.NewStringFlag("timestamp", "ts", "include the time in the name of the heap dump, in the given strftime-like format or 'iso'")
+	commandFlags.NewBoolFlag("archive", "ar", "pack the downloaded files into a single zip archive")
+	commandFlags.NewBoolFlag("redact", "rd", "zero the contents of char and byte arrays in the downloaded heap dump")
+	commandFlags.NewStringFlag("what", "w", "the unified logging configuration to enable, e.g., gc=debug")
+	commandFlags.NewStringFlag("output", "o", "the file in the container that the JVM logs into, or - for heap-dump to write the heap dump to stdout")
+	commandFlags.NewBoolFlag("disable", "d", "disable the logging into the file in the container")
+	commandFlags.NewBoolFlag("follow", "fo", "print the GC log as the JVM writes it")
+	commandFlags.NewStringFlag("record", "rc", "the local directory to record the remote commands and their output into")
+	commandFlags.NewStringFlag("interval", "iv", "the time between the two class histograms compared, e.g., 5m")
+	commandFlags.NewStringFlag("baseline", "bl", "a local class histogram to compare with instead of taking a first one")
+	commandFlags.NewStringFlag("save", "sv", "the local file to save the class histogram into, for later comparisons")
+	commandFlags.NewStringFlag("jar", "ja", "the local jar file of the Java agent to load")
+	commandFlags.NewStringFlag("options", "op", "the options passed to the Java agent")
+	commandFlags.NewStringFlag("local-port", "lp", "the local port forwarded to the Jolokia agent")
+	commandFlags.NewStringFlag("duration", "du", "how long to sample the metrics of the JVM, e.g., 30m")
+	commandFlags.NewStringFlag("out", "ou", "the local file to write the sampled metrics or the SapMachine Vitals into, as CSV")
+	commandFlags.NewStringFlag("alert", "al", "fail if the sampled metrics breach any of the given thresholds, e.g., heap>90%,threads>500")
+	commandFlags.NewStringFlag("max-size", "ms", "the maximum size of the file to upload, e.g., 500M")
+	commandFlags.NewBoolFlag("resume", "rs", "keep the chunks of the local file downloaded before and download only the missing ones")
+	commandFlags.NewBoolFlag("organize", "og", "download the files into <local-dir>/<app>/<instance>/<date> and link the newest one as <local-dir>/<app>/latest")
+	commandFlags.NewBoolFlag("dynamic", "dy", "dump a dynamic CDS archive on top of the one in use instead of a static one")
+	commandFlags.NewBoolFlag("no-cache", "nca", "look for the tools in the container again instead of using their cached paths")
+	commandFlags.NewStringSliceFlag("args", "a", "the arguments inserted for @ARGS into the command of a custom command, can be given more than once")
+	commandFlags.NewStringFlag("progress", "pg", "emit progress events in the given format, json for newline-delimited JSON")
+	commandFlags.NewBoolFlag("all-instances", "ai", "run the command on all running instances of the app")
+	commandFlags.NewStringFlag("socket", "sk", "the local socket to serve the commands on")
+
+	return commandFlags
+}
+
+// isBoolFlag tells whether the flag with the given name or short name takes no value
+func isBoolFlag(name string) bool {
+	return newCommandFlags().Parse("-"+name) == nil
+}
+
+// parseCommandFlags parses args into commandFlags. The flag library rewrites "-flag=value" within args, and takes
+// "-flag=false" for a bool flag as set, while the plugin tells whether bool flags are on with IsSet; so the arguments
+// are normalized into a copy beforehand, with "-flag=value" split, the bool flags turned off by "=false" or a
+// following "false" left out, and the values of the other flags passed on as they are, even if they start with "-".
+func parseCommandFlags(commandFlags flags.FlagContext, args []string) error {
+	// The flag library takes an argument following a bool flag as its value if strconv.ParseBool accepts it, so the
+	// bool flags are passed after the arguments, followed only by a last flag missing its value
+	var normalized, boolFlags, last []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) < 2 || !strings.HasPrefix(arg, "-") {
+			normalized = append(normalized, arg)
+			continue
+		}
+
+		nameAndValue := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)
+		name := nameAndValue[0]
+		switch {
+		case isBoolFlag(name) && len(nameAndValue) == 2:
+			enabled, err := strconv.ParseBool(nameAndValue[1])
+			if err != nil {
+				return fmt.Errorf("Invalid value %q for the flag %q: expected true or false", nameAndValue[1], name)
+			}
+			if enabled {
+				boolFlags = append(boolFlags, "-"+name)
+			}
+		case isBoolFlag(name):
+			// Like the flag library, a following true or false is the value of the flag. Other values that
+			// strconv.ParseBool accepts, like 1 or t, are left as arguments, as they may be an instance index or an
+			// app name.
+			enabled := true
+			if i+1 < len(args) && (args[i+1] == "true" || args[i+1] == "false") {
+				enabled = args[i+1] == "true"
+				i++
+			}
+			if enabled {
+				boolFlags = append(boolFlags, "-"+name)
+			}
+		case len(nameAndValue) == 2:
+			normalized = append(normalized, "-"+name, nameAndValue[1])
+		case i+1 < len(args):
+			normalized = append(normalized, "-"+name, args[i+1])
+			i++
+		default:
+			last = []string{arg}
+		}
+	}
+
+	return commandFlags.Parse(append(append(normalized, boolFlags...), last...)...)
+}
+
+// environmentArguments returns the flags, with their values, that are not set on the command line but in environment
+// variables named after them, e.g., CF_JAVA_LOCAL_DIR for local-dir, so that CI jobs and shared jump hosts can
+// configure defaults. Only the flags supported by the command are considered.
+func environmentArguments(commandFlags flags.FlagContext, command Command) ([]string, error) {
+	var environmentArgs []string
+	for _, flag := range command.Flags {
+		if flag == "help" || flag == "guid" || flag == "route" {
+			continue
+		}
+		if commandFlags.IsSet(flag) && (flag != "app-instance-index" || commandFlags.Int(flag) >= 0) {
+			continue
+		}
+		// An instance given on the command line overrides running on all instances by default, and the other way round
+		if flag == "all-instances" && commandFlags.Int("app-instance-index") >= 0 || flag == "app-instance-index" && commandFlags.IsSet("all-instances") {
+			continue
+		}
+
+		variable := "CF_JAVA_" + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+		value, ok := os.LookupEnv(variable)
+		if !ok {
+			continue
+		}
+
+		if isBoolFlag(flag) {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, &InvalidUsageError{message: fmt.Sprintf("Invalid value %q for the environment variable %s: expected true or false", value, variable)}
+			}
+			if enabled {
+				environmentArgs = append(environmentArgs, "-"+flag)
+			}
+		} else {
+			environmentArgs = append(environmentArgs, "-"+flag, value)
+		}
+	}
+
+	return environmentArgs, nil
+}
+
+// versionLabel turns the version of an app into a part of a file name, shortening commit hashes
+func versionLabel(version string) string {
+	if len(version) == 40 && strings.Trim(strings.ToLower(version), "0123456789abcdef") == "" {
+		version = version[:12]
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, version)
+}
+
+// existingHeapDumpCommand returns the command dealing with a heap dump left at the given path: heap dumps named
+// without UUID replace the previous one, while a clash of names with UUID means something is off
+func existingHeapDumpCommand(heapdumpFileName string, noUUID bool) string {
+	if noUUID {
+		return "rm -f " + heapdumpFileName
+	}
+
+	return "if [ -f " + heapdumpFileName + " ]; then echo >&2 'Heap dump " + heapdumpFileName + " already exists'; exit 1; fi"
+}
+
+// checkUnsupportedFlags returns an InvalidUsageError if any of the given flags, which are not supported
+// by the command described by commandDescription, has been set
+func checkUnsupportedFlags(commandFlags flags.FlagContext, commandDescription string, unsupportedFlags ...string) error {
+	for _, flag := range unsupportedFlags {
+		if commandFlags.IsSet(flag) {
+			return &InvalidUsageError{message: fmt.Sprintf("The flag %q is not supported for %s", flag, commandDescription)}
+		}
+	}
+
+	return nil
+}
+
+// parseAge parses durations like "7d", "12h" or "30m"; on top of the units supported by
+// time.ParseDuration, it accepts "d" for days
+func parseAge(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days < 0 {
+			return 0, errors.New("expected a positive amount of days, hours or minutes, e.g., 7d, 12h or 30m")
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, errors.New("expected a positive amount of days, hours or minutes, e.g., 7d, 12h or 30m")
+	}
+	return age, nil
+}
+
+// pushFileMaxSize is the default limit of the size of the files uploaded with push-file
+const pushFileMaxSize = 100 * bytefmt.MEGABYTE
+
+// now returns the current time, visible for tests
+var now = time.Now
+
+// formatTimestamp formats the time in UTC according to a strftime-like format supporting %Y, %y, %m, %d, %H, %M,
+// %S, %j and %%, or "iso" for the ISO 8601 basic format %Y%m%dT%H%M%SZ, which is also safe in file names on Windows
+func formatTimestamp(t time.Time, format string) (string, error) {
+	if format == "iso" {
+		format = "%Y%m%dT%H%M%SZ"
+	}
+
+	t = t.UTC()
+	var formatted strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			formatted.WriteByte(format[i])
+			continue
+		}
+		if i+1 == len(format) {
+			return "", errors.New("the format ends with an incomplete directive")
+		}
+		i++
+		switch format[i] {
+		case 'Y':
+			fmt.Fprintf(&formatted, "%04d", t.Year())
+		case 'y':
+			fmt.Fprintf(&formatted, "%02d", t.Year()%100)
+		case 'm':
+			fmt.Fprintf(&formatted, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&formatted, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&formatted, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&formatted, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&formatted, "%02d", t.Second())
+		case 'j':
+			fmt.Fprintf(&formatted, "%03d", t.YearDay())
+		case '%':
+			formatted.WriteByte('%')
+		default:
+			return "", fmt.Errorf("unsupported directive %%%c, supported are %%Y, %%y, %%m, %%d, %%H, %%M, %%S, %%j and %%%%", format[i])
+		}
+	}
+
+	if strings.ContainsAny(formatted.String(), "/\\:") {
+		return "", errors.New("the timestamp must not contain '/', '\\' or ':'")
+	}
+	return formatted.String(), nil
+}
+
+// remoteArtifactsCommand returns the command that runs action (a find action like -print) on the files in dir
+// created by this plugin which have not been modified in the given amount of time
+func remoteArtifactsCommand(dir string, olderThan time.Duration, action string) string {
+	age := ""
+	if minutes := int(olderThan.Minutes()); minutes > 0 {
+		age = " -mmin +" + strconv.Itoa(minutes)
+	}
+
+	return "find " + dir + " -maxdepth 1 -type f \\( -name '*-heapdump*.hprof' -o -name '*-heapdump*.phd' -o -name 'java_pid*.hprof' \\)" + age + " " + action
+}
+
+// remoteArtifactsCommands returns the remoteArtifactsCommand for each directory in which the plugin may have
+// created files, i.e., the container directory in use and /tmp
+func remoteArtifactsCommands(fspath string, olderThan time.Duration, action string) []string {
+	commands := []string{remoteArtifactsCommand(fspath, olderThan, action)}
+	if fspath != "/tmp" {
+		commands = append(commands, remoteArtifactsCommand("/tmp", olderThan, action))
+	}
+
+	return commands
+}
+
+// validateHeapDump checks the downloaded heap dump at localFile and prints a summary of it
+func validateHeapDump(util utils.CfJavaPluginUtil, localFile string, messages io.Writer) error {
+	progress.started("validate", localFile)
+	summary, err := util.ValidateHeapDump(localFile)
+	progress.finished("validate", localFile, err)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(messages, "Heap dump file verified: HPROF %s, %s, %d records\n", summary.Version, bytefmt.ByteSize(uint64(summary.Size)), summary.Records)
+	return nil
+}
+
+// availablePath returns the directory of the container of the app instance that the args of cf ssh select to use for
+// dump files, reporting it in verbose mode
+func availablePath(util utils.CfJavaPluginUtil, cfSSHArguments []string, applicationName string, remoteDir string, verbose bool, messages io.Writer) (string, error) {
+	fspath, err := util.GetAvailablePath(applicationName, cfSSHArguments, remoteDir)
+	if err != nil {
+		return "", err
+	}
+
+	if verbose {
+		fmt.Fprintln(messages, "Using the container directory "+fspath)
+	}
+	return fspath, nil
+}
+
+// download copies the newest remote file matching pattern into localDir, or the working directory if localDir is empty,
+// and returns the path of the local file
+func download(util utils.CfJavaPluginUtil, cfSSHArguments []string, pattern string, localDir string, copyOptions utils.CopyOptions, deleteAfterDownload bool, messages io.Writer) (string, error) {
+	remoteFile, err := findRemoteFile(util, cfSSHArguments, pattern)
+	if err != nil {
+		return "", err
+	}
+
+	if localDir == "" {
+		localDir = "."
+	}
+
+	localFileFullPath := localDir + "/" + path.Base(remoteFile)
+	return localFileFullPath, fetchFile(util, cfSSHArguments, remoteFile, localFileFullPath, copyOptions, deleteAfterDownload, messages)
+}
+
+// findRemoteFile returns the newest remote file matching pattern, or an error if there is none
+func findRemoteFile(util utils.CfJavaPluginUtil, cfSSHArguments []string, pattern string) (string, error) {
+	remoteFile, err := util.FindRemoteFile(cfSSHArguments, pattern)
+	if err != nil {
+		return "", err
+	}
+	if remoteFile == "" {
+		return "", errors.New("No file matching " + pattern + " found in application container")
+	}
+
+	return remoteFile, nil
+}
+
+// fetchFile copies remoteFile into localFile, validating heap dumps, and deletes remoteFile afterwards if asked to
+func fetchFile(util utils.CfJavaPluginUtil, cfSSHArguments []string, remoteFile string, localFile string, copyOptions utils.CopyOptions, deleteAfterDownload bool, messages io.Writer) error {
+	copyOptions.Progress = progress.transferred("download", remoteFile)
+	progress.started("download", remoteFile)
+	err := copyOverCat(util, cfSSHArguments, remoteFile, localFile, copyOptions, messages)
+	progress.finished("download", remoteFile, err)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(messages, "File "+remoteFile+" saved to: "+localFile)
+	linkLatest(localFile, messages)
+
+	if strings.HasSuffix(localFile, ".hprof") {
+		err = validateHeapDump(util, localFile, messages)
+		if err != nil {
+			return err
+		}
+	}
+
+	if deleteAfterDownload {
+		progress.started("delete", remoteFile)
+		err = util.DeleteRemoteFile(cfSSHArguments, remoteFile)
+		progress.finished("delete", remoteFile, err)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(messages, "File "+remoteFile+" deleted in app container")
+	}
+
+	return nil
+}
+
+// pushFile uploads localFile into remoteDir, a writable directory of the container or auto:largest, refusing files
+// larger than maxSize, 100M unless given
+func pushFile(util utils.CfJavaPluginUtil, cfSSHArguments []string, applicationName string, localFile string, remoteDir string, maxSize string, verbose bool, messages io.Writer) error {
+	limit := uint64(pushFileMaxSize)
+	if maxSize != "" {
+		var err error
+		if limit, err = bytefmt.ToBytes(maxSize); err != nil {
+			return &InvalidUsageError{message: fmt.Sprintf("Invalid value %q for the flag %q: %v", maxSize, "max-size", err)}
+		}
+	}
+
+	info, err := os.Stat(localFile)
+	if err != nil || info.IsDir() {
+		return errors.New("The local file " + localFile + " does not exist or is not a file")
+	}
+	if uint64(info.Size()) > limit {
+		return errors.New("The local file " + localFile + " is " + bytefmt.ByteSize(uint64(info.Size())) + ", more than the limit of " + bytefmt.ByteSize(limit) + ", raise it with the flag \"max-size\" if the container has the space")
+	}
+
+	dir, err := availablePath(util, cfSSHArguments, applicationName, remoteDir, verbose, messages)
+	if err != nil {
+		return err
+	}
+
+	remoteFile := dir + "/" + filepath.Base(localFile)
+	progress.started("upload", localFile)
+	err = util.UploadFile(cfSSHArguments, localFile, remoteFile)
+	progress.finished("upload", localFile, err)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(messages, "File "+localFile+" uploaded to: "+remoteFile)
+	return nil
+}
+
+// execTools are the tools whose paths exec exports to the command it runs, as <TOOL>_COMMAND
+var execTools = []string{"jcmd", "jmap", "jstack", "jstat", "jvmmon", "asprof"}
+
+// execEnvironment returns the commands exporting the PID of the java process as JAVA_PID and the paths of the execTools,
+// empty for those not found in the container, for the command run by exec
+func execEnvironment(shell shellDialect) []string {
+	commands := []string{"export JAVA_PID=" + shell.javaPID}
+	for _, tool := range execTools {
+		commands = append(commands, "export "+strings.ToUpper(tool)+"_COMMAND=`"+shell.findExecutable(tool)+" | head -1 | tr -d [:space:]`")
+	}
+
+	return commands
+}
+
+// whereIsCommands returns the remote commands printing the absolute path of the binary of the JVM and of each of the
+// execTools as resolved by the plugin, i.e., the first one found in the container, with symbolic links resolved
+func whereIsCommands(shell shellDialect) []string {
+	commands := []string{"echo \"java: $(readlink -f /proc/" + shell.javaPID + "/exe)\""}
+	for _, tool := range execTools {
+		commands = append(commands, "TOOL=`"+shell.findExecutable(tool)+" | head -1 | tr -d [:space:]`; if [ -n \"${TOOL}\" ]; then echo \""+tool+": $(readlink -f ${TOOL})\"; else echo '"+tool+": not found'; fi")
+	}
+
+	return commands
+}
+
+// interactiveShellCommands returns the remote commands that, after execEnvironment, put the directories of the JDK
+// tools and asprof in front of the PATH and replace themselves with an interactive shell, bash if there is one
+func interactiveShellCommands() []string {
+	return []string{
+		"for TOOL in ${ASPROF_COMMAND} ${JCMD_COMMAND}; do PATH=$(cd $(dirname ${TOOL}) && pwd):${PATH}; done",
+		"export PATH",
+		"echo \"The JVM runs with PID ${JAVA_PID}, in JAVA_PID, and the JDK tools found in the container are on the PATH\"",
+		"if command -v bash > /dev/null; then exec bash; fi",
+		"exec sh",
+	}
+}
+
+// copyTarget returns the local file to copy remoteFile into with cp: localPath itself, or the file named like
+// remoteFile in it if it is a directory, or the working directory if localPath is empty
+func copyTarget(remoteFile string, localPath string) string {
+	if localPath == "" {
+		return path.Base(remoteFile)
+	}
+	if info, err := os.Stat(localPath); strings.HasSuffix(localPath, "/") || err == nil && info.IsDir() {
+		return filepath.Join(localPath, path.Base(remoteFile))
+	}
+
+	return localPath
+}
+
+// instanceFlag returns the option selecting the app instance in the instructions printed for the user, which is
+// empty for the first instance
+func instanceFlag(applicationInstance int) string {
+	if applicationInstance > 0 {
+		return " -i " + strconv.Itoa(applicationInstance)
+	}
+	return ""
+}
+
+// downloadInstructions returns the command that fetches a file left in the container of the app instance
+func downloadInstructions(applicationName string, applicationInstance int, remoteFile string) string {
+	return "cf java download " + utils.ShellWord(applicationName) + instanceFlag(applicationInstance) + " " + utils.ShellWord(remoteFile) + " -local-dir ."
+}
+
+// crashFileDirs returns the directories of the container in which the JVM may have written hs_err and replay files,
+// i.e., the container directory in use, in case -XX:ErrorFile points there, its working directory and /tmp
+func crashFileDirs(fspath string) []string {
+	dirs := []string{fspath}
+	for _, dir := range []string{"/home/vcap/app", "/tmp"} {
+		if dir != fspath {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs
+}
+
+// downloadCrashReport downloads the newest hs_err file found in dirs, together with the replay file of the same crash,
+// and returns the paths of the local files
+func downloadCrashReport(util utils.CfJavaPluginUtil, cfSSHArguments []string, dirs []string, localDir string, copyOptions utils.CopyOptions, deleteAfterDownload bool, messages io.Writer) ([]string, error) {
+	patterns := make([]string, len(dirs))
+	for i, dir := range dirs {
+		patterns[i] = dir + "/hs_err_pid*.log"
+	}
+
+	errorFile, err := util.FindRemoteFile(cfSSHArguments, strings.Join(patterns, " "))
+	if err != nil {
+		return nil, err
+	}
+	if errorFile == "" {
+		return nil, errors.New("No hs_err file found in the application container in " + strings.Join(dirs, ", "))
+	}
+
+	files := []string{errorFile}
+	replayFile, err := util.FindRemoteFile(cfSSHArguments, path.Dir(errorFile)+"/"+strings.Replace(path.Base(errorFile), "hs_err_pid", "replay_pid", 1))
+	if err != nil {
+		return nil, err
+	}
+	if replayFile != "" {
+		files = append(files, replayFile)
+	}
+
+	localFiles := make([]string, len(files))
+	for i, file := range files {
+		if localFiles[i], err = download(util, cfSSHArguments, file, localDir, copyOptions, deleteAfterDownload, messages); err != nil {
+			return nil, err
+		}
+	}
+
+	return localFiles, nil
+}
+
+// classHistogramDiff compares a class histogram of the app with the local baseline file or, without one, with a
+// class histogram taken the given interval before, and prints the classes with the biggest growth
+func classHistogramDiff(util utils.CfJavaPluginUtil, cfSSHArguments []string, interval string, baseline string, save string, messages io.Writer) (string, error) {
+	var before string
+	if baseline != "" {
+		content, err := os.ReadFile(baseline)
+		if err != nil {
+			return "", errors.New("Error reading the class histogram " + baseline + ": " + err.Error())
+		}
+		before = string(content)
+	} else {
+		wait := 30 * time.Second
+		if interval != "" {
+			var err error
+			wait, err = parseAge(interval)
+			if err != nil {
+				return "", &InvalidUsageError{message: fmt.Sprintf("Invalid value %q for the flag %q: %v", interval, "interval", err)}
+			}
+		}
+
+		histogram, err := util.GetClassHistogram(cfSSHArguments)
+		if err != nil {
+			return "", err
+		}
+		before = histogram
+
+		fmt.Fprintln(messages, "Taking the second class histogram in "+wait.String())
+		sleep(wait)
+	}
+
+	after, err := util.GetClassHistogram(cfSSHArguments)
+	if err != nil {
+		return "", err
+	}
+
+	if save != "" {
+		if err := os.WriteFile(save, []byte(after), 0644); err != nil {
+			return "", errors.New("Error saving the class histogram to " + save + ": " + err.Error())
+		}
+		fmt.Fprintln(messages, "Class histogram saved to: "+save)
+	}
+
+	return formatHistogramGrowth(histogramGrowth(parseClassHistogram(before), parseClassHistogram(after))), nil
+}
+
+// Run must be implemented by any plugin because it is part of the
+// plugin interface defined by the core CLI.
+//
+// Run(....) is the entry point when the core CLI is invoking a command defined
+// by a plugin. The first parameter, plugin.CliConnection, is a struct that can
+// be used to invoke cli commands. The second paramter, args, is a slice of
+// strings. args[0] will be the name of the command, and will be followed by
+// any additional arguments a cli user typed in.
+//
+// Any error handling should be handled with the plugin itself (this means printing
+// user facing errors). The CLI will exit 0 if the plugin exits 0 and will exit
+// 1 should the plugin exit nonzero.
+func (c *JavaPlugin) Run(cliConnection plugin.CliConnection, args []string) {
+	// The downloads and uploads run cf processes of their own, with the cf CLI running the plugin
+	utils.UseParentCf()
+
+	dir, args, err := splitCfHome(args)
+	if err == nil && dir != "" {
+		var exitCode int
+		if exitCode, err = runWithCfHome(dir, args); err == nil {
+			os.Exit(exitCode)
+		}
+	}
+	if err != nil {
+		traceLogger := trace.NewLogger(os.Stdout, true, os.Getenv("CF_TRACE"), "")
+		terminal.NewUI(os.Stdin, os.Stdout, terminal.NewTeePrinter(os.Stdout), traceLogger).Failed("%s", err.Error())
+		os.Exit(1)
+	}
+
+	util := utils.CfJavaPluginUtilImpl{CliConnection: cliConnection, AppGUIDs: appGUIDs(cliConnection), SpaceGUID: spaceGUID(cliConnection)}
+	stopHandlingInterrupts := handleInterrupts(util)
+	_, err = c.DoRun(&commandExecutorImpl{cliConnection: cliConnection}, &uuidGeneratorImpl{}, util, args)
+	stopHandlingInterrupts()
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// appGUIDs returns the cache of the app GUIDs, which are looked up once per run, and kept next to the plugins of the cf
+// CLI for the targeted space for a short while, see utils.AppGUIDTTL
+func appGUIDs(cliConnection plugin.CliConnection) *utils.AppGUIDs {
+	guids := &utils.AppGUIDs{}
+	endpoint, endpointErr := cliConnection.ApiEndpoint()
+	space, spaceErr := cliConnection.GetCurrentSpace()
+	dir, dirErr := pluginsDir()
+	if endpointErr == nil && spaceErr == nil && dirErr == nil && space.Guid != "" {
+		guids.Target = endpoint + "/" + space.Guid
+		guids.File = filepath.Join(dir, "cf-java-plugin-app-guids.json")
+	}
+
+	return guids
+}
+
+// runMutex runs one command at a time, as the running command keeps its state in the package, i.e., progress,
+// cleanup, latestLink, recorder and the commands loaded. The commands are not reentrant: a
+// command must not run another one through DoRun, but through execute, like the flag "all-instances" does.
+var runMutex sync.Mutex
+
+// DoRun is an internal method that we use to wrap the cmd package with CommandExecutor for test purposes
+func (c *JavaPlugin) DoRun(commandExecutor cmd.CommandExecutor, uuidGenerator uuid.UUIDGenerator, util utils.CfJavaPluginUtil, args []string) (string, error) {
+	runMutex.Lock()
+	defer runMutex.Unlock()
+
+	// The command may send its messages to stderr, see the flag "output" of heap-dump
+	defer func(stdout io.Writer) {
+		c.stdout = stdout
+	}(c.stdout)
+
+	output, err := c.execute(commandExecutor, uuidGenerator, util, args)
+
+	messages := c.messageOutput()
+	traceLogger := trace.NewLogger(messages, true, os.Getenv("CF_TRACE"), "")
+	ui := terminal.NewUI(os.Stdin, messages, terminal.NewTeePrinter(messages), traceLogger)
+	if err != nil {
+		ui.Failed("%s", err.Error())
+		cleanup.run(util, messages)
+
+		if _, invalidUsageErr := err.(*InvalidUsageError); invalidUsageErr {
+			fmt.Fprintln(messages)
+			fmt.Fprintln(messages)
+			commandExecutor.Execute([]string{"help", "java"})
+		}
+	} else if output != "" {
+		ui.Say(output)
+	}
+
+	return output, err
+}
+
+func (c *JavaPlugin) execute(commandExecutor cmd.CommandExecutor, uuidGenerator uuid.UUIDGenerator, util utils.CfJavaPluginUtil, args []string) (string, error) {
+	progress = progressEvents{}
+	cleanup.reset()
+	latestLink = ""
+	// A broken definition of custom commands must not keep the commands of the plugin from working
+	if err := loadCommands(); err != nil {
+		fmt.Fprintln(c.messageOutput(), err.Error())
+	}
+	if len(args) == 0 {
+		return "", &InvalidUsageError{message: "No command provided"}
+	}
+	invocation := args
+
+	switch args[0] {
+	case "CLI-MESSAGE-UNINSTALL":
+		// Nothing to uninstall, we keep no local state
+		return "", nil
+	case "java":
+		break
+	default:
+		if !strings.HasPrefix(args[0], pluginCommandPrefix) {
+			return "", &InvalidUsageError{message: fmt.Sprintf("Unexpected command name '%s' (expected : 'java')", args[0])}
+		}
+		// The commands registered on their own, e.g., cf java-heap-dump my_app, run like cf java heap-dump my_app
+		args = append([]string{"java", strings.TrimPrefix(args[0], pluginCommandPrefix)}, args[1:]...)
+	}
+
+	// Everything after "--" is the command run by exec, with its own flags
+	var passthrough []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, passthrough = args[:i], args[i+1:]
+			break
+		}
+	}
+
+	commandFlags := newCommandFlags()
+	parseErr := parseCommandFlags(commandFlags, args[1:])
+	if parseErr == nil && len(commandFlags.Args()) > 0 {
+		// Environment variables provide defaults for the flags supported by the command
+		if commandInfo, found := findCommand(commandFlags.Args()[0]); found {
+			environmentArgs, err := environmentArguments(commandFlags, commandInfo)
+			if err != nil {
+				return "", err
+			}
+			if len(environmentArgs) > 0 {
+				commandFlags = newCommandFlags()
+				parseErr = parseCommandFlags(commandFlags, append(append([]string{}, args[1:]...), environmentArgs...))
+			}
+		}
+	}
+	if parseErr != nil {
+		return "", &InvalidUsageError{message: fmt.Sprintf("Error while parsing command arguments: %v", parseErr)}
+	}
+
+	applicationInstance := commandFlags.Int("app-instance-index")
+	keepAfterDownload := commandFlags.IsSet("keep")
+	verbose := commandFlags.IsSet("verbose")
+
+	remoteDir := commandFlags.String("container-dir")
+	localDir := commandFlags.String("local-dir")
+
+	copyToLocal := len(localDir) > 0
+
+	var err error
+	progress, err = newProgressEvents(commandFlags.String("progress"), c.progressOutput())
+	if err != nil {
+		return "", err
+	}
+
+	var limitRate int64
+	if commandFlags.IsSet("limit-rate") {
+		rate, err := bytefmt.ToBytes(commandFlags.String("limit-rate"))
+		if err != nil {
+			return "", &InvalidUsageError{message: fmt.Sprintf("Invalid value %q for the flag %q: %v", commandFlags.String("limit-rate"), "limit-rate", err)}
+		}
+		limitRate = int64(rate)
+	}
+
+	arguments := commandFlags.Args()
+	argumentLen := len(arguments)
+
+	if argumentLen < 1 {
+		return "", &InvalidUsageError{message: fmt.Sprintf("No command provided")}
+	}
+
+	command := arguments[0]
+	commandInfo, found := findCommand(command)
+	if !found {
+		return "", &InvalidUsageError{message: fmt.Sprintf("Unrecognized command %q: supported commands are %s (see cf help)", command, commandNames())}
+	}
+
+	options := c.metadata().Commands[0].UsageDetails.Options
+	if commandFlags.IsSet("help") {
+		return commandInfo.help(options), nil
+	}
+
+	if err := checkSupportedFlags(commandFlags, commandInfo, sortedKeys(options)); err != nil {
+		return "", err
+	}
+
+	if dir := commandFlags.String("record"); dir != "" && recorder == nil {
+		return c.executeRecording(commandExecutor, uuidGenerator, util, invocation, dir)
+	}
+
+	// With "-output -", the heap dump is written to stdout, to be piped into other tools, and the messages to stderr
+	var stdout io.Writer
+	if command == heapDumpCommand && commandFlags.IsSet("output") {
+		if commandFlags.String("output") != "-" {
+			return "", &InvalidUsageError{message: "The flag \"output\" of heap-dump only takes \"-\", to write the heap dump to stdout"}
+		}
+		if copyToLocal {
+			return "", &InvalidUsageError{message: "The flags \"output\" and \"local-dir\" cannot be used together"}
+		}
+		stdout, c.stdout = c.messageOutput(), os.Stderr
+	}
+	messages := c.messageOutput()
+
+	if commandInfo.passthrough() && len(passthrough) == 0 {
+		return "", &InvalidUsageError{message: "No command provided after \"--\""}
+	} else if !commandInfo.passthrough() && commandInfo.custom == nil && passthrough != nil {
+		return "", &InvalidUsageError{message: fmt.Sprintf("Unexpected arguments after \"--\": only %s passes a command to the container, and the custom commands arguments for @ARGS", execCommand)}
+	} else if commandInfo.custom != nil && passthrough != nil {
+		if commandFlags.IsSet("args") {
+			return "", &InvalidUsageError{message: "The flag \"args\" and the arguments after \"--\" cannot be used together, pass the arguments either way"}
+		} else if !strings.Contains(commandInfo.custom.Command, argsPlaceholder) {
+			return "", &InvalidUsageError{message: fmt.Sprintf("Unexpected arguments after \"--\": the command %s takes none, it has no %s", command, argsPlaceholder)}
+		}
+	}
+
+	// The commands not related to an app take at most optional arguments, or any number of files
+	if !commandInfo.appCommand() {
+		if argumentLen > 1+len(commandInfo.Arguments) && !commandInfo.variadic() {
+			return "", &InvalidUsageError{message: fmt.Sprintf("Too many arguments provided: %v", strings.Join(arguments[1+len(commandInfo.Arguments):], ", "))}
+		}
+		optionalArgument := ""
+		if argumentLen > 1 {
+			optionalArgument = arguments[1]
+		}
+
+		switch command {
+		case verifyInstallCommand:
+			version := c.metadata().Version
+			return "", verifyInstall(fmt.Sprintf("%d.%d.%d", version.Major, version.Minor, version.Build), messages)
+		case commandsCommand:
+			if optionalArgument != "" {
+				return checkCommands(util, optionalArgument, applicationInstance, commandFlags.IsSet("json"))
+			}
+			return listCommands(commandFlags.IsSet("json"))
+		case examplesCommand:
+			return listExamples(optionalArgument)
+		case threadAnalysisCommand:
+			return analyzeThreadDumps(arguments[1:])
+		case lintCommandsCommand:
+			return lintCommands(optionalArgument)
+		case serveCommand:
+			return "", c.serve(commandExecutor, uuidGenerator, util, commandFlags.String("socket"))
+		}
+	}
+
+	var olderThan time.Duration
+	if commandFlags.IsSet("older-than") {
+		age, err := parseAge(commandFlags.String("older-than"))
+		if err != nil {
+			return "", &InvalidUsageError{message: fmt.Sprintf("Invalid value %q for the flag %q: %v", commandFlags.String("older-than"), "older-than", err)}
+		}
+		olderThan = age
+	}
+
+	// The remaining commands take the application name, unless it is identified by its GUID or a route,
+	// and download and cp also take the path of the remote file, cp optionally the local path
+	if commandFlags.IsSet("guid") && commandFlags.IsSet("route") {
+		return "", &InvalidUsageError{message: "The flags \"guid\" and \"route\" cannot be used together"}
+	}
+	appIdentified := commandFlags.IsSet("guid") || commandFlags.IsSet("route")
+	expectedArgumentLen := 1 + len(commandInfo.Arguments)
+	if appIdentified {
+		expectedArgumentLen--
+	}
+	if commandInfo.passthrough() {
+		expectedArgumentLen--
+	}
+	optionalArgumentLen := commandInfo.optionalArguments()
+	localPath := ""
+	if optionalArgumentLen > 0 && argumentLen == expectedArgumentLen {
+		localPath = arguments[argumentLen-1]
+	}
+	expectedArgumentLen -= optionalArgumentLen
+
+	if argumentLen == 1 && !appIdentified {
+		return "", &InvalidUsageError{message: fmt.Sprintf("No application name provided")}
+	} else if argumentLen < expectedArgumentLen && command == pushFileCommand {
+		return "", &InvalidUsageError{message: "No local file or remote directory provided"}
+	} else if argumentLen < expectedArgumentLen {
+		return "", &InvalidUsageError{message: fmt.Sprintf("No remote file provided")}
+	} else if argumentLen > expectedArgumentLen+optionalArgumentLen {
+		return "", &InvalidUsageError{message: fmt.Sprintf("Too many arguments provided: %v", strings.Join(arguments[expectedArgumentLen+optionalArgumentLen:], ", "))}
+	}
+
+	var applicationName string
+	if commandFlags.IsSet("guid") {
+		name, err := util.GetAppName(commandFlags.String("guid"))
+		if err != nil {
+			return "", err
+		}
+		applicationName = name
+	} else if commandFlags.IsSet("route") {
+		name, err := util.GetAppNameByRoute(commandFlags.String("route"))
+		if err != nil {
+			return "", err
+		}
+		applicationName = name
+		fmt.Fprintln(messages, "The route "+commandFlags.String("route")+" is mapped to the app "+applicationName)
+	} else {
+		applicationName = arguments[1]
+	}
+
+	if commandFlags.IsSet("all-instances") {
+		if applicationInstance >= 0 {
+			return "", &InvalidUsageError{message: "The flags \"all-instances\" and \"app-instance-index\" cannot be used together"}
+		}
+		return c.executeOnAllInstances(commandExecutor, uuidGenerator, util, invocation, command, applicationName)
+	}
+
+	if !commandFlags.IsSet("dry-run") {
+		if verbose {
+			if err := reportInstances(util, applicationName, messages); err != nil {
+				return "", err
+			}
+		}
+
+		// Without an instance given, the only running one is used rather than the first one, which would fail
+		if applicationInstance < 0 {
+			running, found, err := onlyRunningInstance(util, applicationName)
+			if err != nil {
+				return "", err
+			}
+			if found && running > 0 {
+				fmt.Fprintf(messages, "Using instance %d, the only running instance of %s, run with -i to choose another one\n", running, applicationName)
+				applicationInstance = running
+			}
+		}
+
+		instance := applicationInstance
+		if instance < 0 {
+			instance = 0
+		}
+
+		err := util.CheckAppInstance(applicationName, instance)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	cfSSHArguments := []string{"ssh", applicationName}
+	if applicationInstance > 0 {
+		cfSSHArguments = append(cfSSHArguments, "--app-instance-index", strconv.Itoa(applicationInstance))
+	}
+
+	shell := fullShell
+	runtime := utils.RuntimeHotSpot
+	if !commandFlags.IsSet("dry-run") && commandInfo.inspectsRuntime {
+		portable, detectedRuntime, err := util.InspectContainer(append(cfSSHArguments, "--command"))
+		if err != nil {
+			return "", err
+		}
+		if portable {
+			shell = portableShell
+		}
+		runtime = detectedRuntime
+
+		shell, err = withCachedTools(util, append(cfSSHArguments, "--command"), applicationName, applicationInstance, shell, commandFlags.IsSet("no-cache"), verbose, messages)
+		if err != nil {
+			return "", err
+		}
+	}
+	openJ9 := runtime == utils.RuntimeOpenJ9
+
+	copyOptions := utils.CopyOptions{LimitRate: limitRate, CreateLocalDir: !commandFlags.IsSet("no-create"), Force: commandFlags.IsSet("force"), Resume: commandFlags.IsSet("resume")}
+	if commandFlags.IsSet("organize") {
+		if !copyToLocal {
+			return "", &InvalidUsageError{message: "The flag \"organize\" requires the flag \"local-dir\", the directory to organize the downloaded files in"}
+		}
+		// The directories below the local one are the plugin's own to create
+		if _, err := os.Stat(localDir); err == nil {
+			copyOptions.CreateLocalDir = true
+		}
+		latestLink = filepath.Join(localDir, fileSafeName(applicationName), "latest")
+		localDir = organizedDir(localDir, applicationName, applicationInstance, now())
+	}
+
+	var remoteCommandTokens = []string{shell.javaDetection}
+	heapdumpFileName := ""
+	heapdumpBaseName := ""
+	vmLogFileName := ""
+	generatedFileName := ""
+	// remoteTemporaries are the files and directories the remote command writes and removes once done
+	var remoteTemporaries []string
+	jolokiaForward := ""
+	var alertRules []alertRule
+	fspath := remoteDir
+	switch command {
+	case heapDumpCommand:
+		if commandFlags.IsSet("redact") && !copyToLocal {
+			return "", &InvalidUsageError{message: "The flag \"redact\" requires the flag \"local-dir\", as only the downloaded heap dump is redacted"}
+		}
+		if commandFlags.IsSet("redact") && openJ9 {
+			return "", errors.New("Only heap dumps in the HPROF format can be redacted, OpenJ9 writes them in the PHD format")
+		}
+
+		if runtime == utils.RuntimeNativeImage {
+			return "", errors.New("Heap dumps of GraalVM native images cannot be created with jmap. Build the image with '--enable-monitoring=heapdump' to have it write a heap dump into its working directory upon 'kill -USR1', then fetch it with `cf java download " + utils.ShellWord(applicationName) + " '/home/vcap/app/svm-heapdump-*.hprof'`")
+		}
+
+		supported, err := util.CheckRequiredTools(applicationName, append(cfSSHArguments, "--command"))
+		if err != nil || !supported {
+			return "required tools checking failed", err
+		}
+
+		fspath, err = availablePath(util, append(cfSSHArguments, "--command"), applicationName, remoteDir, verbose, messages)
+		if err != nil {
+			return "", err
+		}
+		invocationID := uuidGenerator.Generate()
+		heapdumpBaseName = fileSafeName(applicationName) + "-heapdump"
+		// Labelling the heap dump with the version of the app allows matching it to the deployed build later
+		if appVersion, err := util.GetAppVersion(applicationName); err == nil && appVersion != "" {
+			fmt.Fprintln(messages, "App version: "+appVersion)
+			heapdumpBaseName += "-" + versionLabel(appVersion)
+		}
+		if commandFlags.IsSet("timestamp") {
+			timestamp, err := formatTimestamp(now(), commandFlags.String("timestamp"))
+			if err != nil {
+				return "", &InvalidUsageError{message: fmt.Sprintf("Invalid value %q for the flag %q: %v", commandFlags.String("timestamp"), "timestamp", err)}
+			}
+			heapdumpBaseName += "-" + timestamp
+		}
+		if !commandFlags.IsSet("no-uuid") {
+			heapdumpBaseName += "-" + invocationID
+		}
+
+		if openJ9 {
+			// OpenJ9 writes heap dumps in its own PHD format and has no jmap able to create them
+			heapdumpFileName = fspath + "/" + heapdumpBaseName + ".phd"
+
+			remoteCommandTokens = append(remoteCommandTokens,
+				existingHeapDumpCommand(heapdumpFileName, commandFlags.IsSet("no-uuid")),
+				"JCMD_COMMAND=`"+shell.findExecutable("jcmd")+" | head -1 | tr -d [:space:]`",
+				"if [ -z \"${JCMD_COMMAND}\" ]; then echo >&2 'jcmd is required for generating heap dumps of OpenJ9, please make sure that the app runs on a full JDK'; exit 1; fi",
+				"OUTPUT=$( ${JCMD_COMMAND} "+shell.javaPID+" Dump.heap "+heapdumpFileName+" ) || STATUS_CODE=$?",
+				"if [ ! -s "+heapdumpFileName+" ]; then echo >&2 ${OUTPUT}; exit 1; fi",
+				"if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi")
+			break
+		}
+
+		heapdumpFileName = fspath + "/" + heapdumpBaseName + ".hprof"
+		// jvmmon picks the name of the heap dump itself, so it writes into a directory of its own, which keeps
+		// concurrent invocations from picking up each other's heap dumps
+		workDir := fspath + "/cf-java-" + invocationID
+		remoteTemporaries = append(remoteTemporaries, workDir)
+
+		remoteCommandTokens = append(remoteCommandTokens,
+			// Check file does not already exist
+			existingHeapDumpCommand(heapdumpFileName, commandFlags.IsSet("no-uuid")),
+			/*
+			 * If there is not enough space on the filesystem to write the dump, jmap will create a file
+			 * with size 0, output something about not enough space left on device and exit with status code 0.
+			 * Because YOLO.
+			 *
+			 * Also: if the heap dump file already exists, jmap will output something about the file already
+			 * existing and exit with status code 0. At least it is consistent.
+			 */
+			// OpenJDK: Wrap everything in an if statement in case jmap is available
+			"JMAP_COMMAND=`"+shell.findExecutable("jmap")+" | head -1 | tr -d [:space:]`",
+			// SAP JVM: Wrap everything in an if statement in case jvmmon is available
+			"JVMMON_COMMAND=`"+shell.findExecutable("jvmmon")+" | head -1 | tr -d [:space:]`",
+			// Slim JREs: jcmd is often there without jmap, and jattach comes with some images instead of any JDK tool
+			"JCMD_COMMAND=`"+shell.findExecutable("jcmd")+" | head -1 | tr -d [:space:]`",
+			"JATTACH_COMMAND=`"+shell.findExecutable("jattach")+" | head -1 | tr -d [:space:]`",
+			"if [ -n \"${JMAP_COMMAND}\" ]; then true",
+			"OUTPUT=$( ${JMAP_COMMAND} -dump:format=b,file="+heapdumpFileName+" "+shell.javaPID+" ) || STATUS_CODE=$?",
+			"if [ ! -s "+heapdumpFileName+" ]; then echo >&2 ${OUTPUT}; exit 1; fi",
+			"if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi",
+			"elif [ -n \"${JVMMON_COMMAND}\" ]; then true",
+			"mkdir -p "+workDir,
+			"echo -e 'change command line flag flags=-XX:HeapDumpOnDemandPath="+workDir+"\ndump heap' > "+workDir+"/setHeapDumpOnDemandPath.sh",
+			"OUTPUT=$( ${JVMMON_COMMAND} -pid "+shell.javaPID+" -cmd \""+workDir+"/setHeapDumpOnDemandPath.sh\" ) || STATUS_CODE=$?",
+			"sleep 5", // Writing the heap dump is triggered asynchronously -> give the jvm some time to create the file
+			"HEAP_DUMP_NAME=`"+shell.newestFile(workDir, "java_pid*.hprof")+"`",
+			"SIZE=-1; OLD_SIZE=$("+shell.fileSize("\"${HEAP_DUMP_NAME}\"")+"); while [ ${SIZE} != ${OLD_SIZE} ]; do OLD_SIZE=${SIZE}; sleep 3; SIZE=$("+shell.fileSize("\"${HEAP_DUMP_NAME}\"")+"); done",
+			"if [ ! -s \"${HEAP_DUMP_NAME}\" ]; then echo >&2 ${OUTPUT}; rm -rf "+workDir+"; exit 1; fi",
+			"if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; rm -rf "+workDir+"; exit ${STATUS_CODE}; fi",
+			"mv \"${HEAP_DUMP_NAME}\" "+heapdumpFileName+"; rm -rf "+workDir,
+			"elif [ -n \"${JCMD_COMMAND}\" ]; then true",
+			"OUTPUT=$( ${JCMD_COMMAND} "+shell.javaPID+" GC.heap_dump "+heapdumpFileName+" ) || STATUS_CODE=$?",
+			"if [ ! -s "+heapdumpFileName+" ]; then echo >&2 ${OUTPUT}; exit 1; fi",
+			"if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi",
+			"elif [ -n \"${JATTACH_COMMAND}\" ]; then true",
+			"OUTPUT=$( ${JATTACH_COMMAND} "+shell.javaPID+" dumpheap "+heapdumpFileName+" ) || STATUS_CODE=$?",
+			"if [ ! -s "+heapdumpFileName+" ]; then echo >&2 ${OUTPUT}; exit 1; fi",
+			"if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi",
+			"else echo >&2 'jmap, jvmmon, jcmd or jattach is required for generating heap dumps, please make sure that the app runs on a full JDK'; exit 1",
+			"fi")
+
+	case vmLogCommand:
+		if runtime != utils.RuntimeHotSpot {
+			return "", errors.New("The unified logging of the JVM can only be controlled on HotSpot-based JVMs like OpenJDK and SapMachine")
+		}
+
+		what := commandFlags.String("what")
+		if what != "" && commandFlags.IsSet("disable") {
+			return "", &InvalidUsageError{message: "The flags \"what\" and \"disable\" cannot be used together"}
+		}
+
+		vmLogFileName = commandFlags.String("output")
+		if vmLogFileName == "" {
+			vmLogFileName = "/tmp/" + fileSafeName(applicationName) + "-vm.log"
+		}
+
+		// Without a configuration to enable or disable, VM.log lists the current one. The values given by the user are
+		// quoted, as the remote shell would run their quotes, semicolons or $(...)
+		vmLogArguments := "list"
+		if what != "" {
+			vmLogArguments = utils.ShellQuote("output="+vmLogFileName) + " " + utils.ShellQuote("what="+what)
+		} else if commandFlags.IsSet("disable") {
+			// Switching off all tags of the output leaves the other outputs, like stdout, untouched
+			vmLogArguments = utils.ShellQuote("output="+vmLogFileName) + " what=all=off"
+		}
+
+		remoteCommandTokens = append(remoteCommandTokens,
+			"JCMD_COMMAND=`"+shell.findExecutable("jcmd")+" | head -1 | tr -d [:space:]`",
+			"if [ -z \"${JCMD_COMMAND}\" ]; then echo >&2 'jcmd is required for controlling the logging of the JVM, please make sure that the app runs on a full JDK'; exit 1; fi",
+			"${JCMD_COMMAND} "+shell.javaPID+" VM.log "+vmLogArguments)
+
+	case gcLogsCommand:
+		if commandFlags.IsSet("archive") && !copyToLocal {
+			return "", &InvalidUsageError{message: "The flag \"archive\" requires the flag \"local-dir\""}
+		}
+		if commandFlags.IsSet("follow") && copyToLocal {
+			return "", &InvalidUsageError{message: "The flags \"follow\" and \"local-dir\" cannot be used together"}
+		}
+
+		sshArguments := append(cfSSHArguments, "--command")
+		patterns, err := util.FindGCLogs(sshArguments)
+		if err != nil {
+			return "", err
+		}
+
+		var gcLogFiles []string
+		for _, pattern := range patterns {
+			// Placeholders like %t in the name of the GC log are resolved to the newest matching file
+			gcLogFile, err := util.FindRemoteFile(sshArguments, pattern)
+			if err != nil {
+				return "", err
+			}
+			if gcLogFile != "" {
+				gcLogFiles = append(gcLogFiles, gcLogFile)
+			}
+		}
+		if len(gcLogFiles) == 0 {
+			return "", errors.New("No GC log file found in the container: start the JVM with, e.g., '-Xlog:gc*:file=/tmp/gc.log', or enable GC logging at runtime with `cf java vm-log " + utils.ShellWord(applicationName) + " -what 'gc*=info'`")
+		}
+
+		if copyToLocal {
+			localFiles := make([]string, len(gcLogFiles))
+			for i, gcLogFile := range gcLogFiles {
+				if localFiles[i], err = download(util, sshArguments, gcLogFile, localDir, copyOptions, false, messages); err != nil {
+					return "", err
+				}
+			}
+			if commandFlags.IsSet("archive") {
+				return "", archiveFiles(localDir, fileSafeName(applicationName)+"-gc-logs", localFiles, messages)
+			}
+			return "", nil
+		}
+
+		if commandFlags.IsSet("follow") {
+			remoteCommandTokens = []string{"tail -f " + strings.Join(gcLogFiles, " ")}
+		} else {
+			remoteCommandTokens = []string{"ls -l " + strings.Join(gcLogFiles, " ")}
+		}
+
+	case crashReportCommand:
+		fspath, err := availablePath(util, append(cfSSHArguments, "--command"), applicationName, remoteDir, verbose, messages)
+		if err != nil {
+			return "", err
+		}
+		dirs := crashFileDirs(fspath)
+		if commandFlags.IsSet("archive") && !copyToLocal {
+			return "", &InvalidUsageError{message: "The flag \"archive\" requires the flag \"local-dir\""}
+		}
+
+		if copyToLocal {
+			localFiles, err := downloadCrashReport(util, append(cfSSHArguments, "--command"), dirs, localDir, copyOptions, commandFlags.IsSet("delete"), messages)
+			if err == nil && commandFlags.IsSet("archive") {
+				err = archiveFiles(localDir, fileSafeName(applicationName)+"-crash-report", localFiles, messages)
+			}
+			return "", err
+		}
+
+		remoteCommandTokens = []string{"for D in " + strings.Join(dirs, " ") + "; do if [ -d ${D} ]; then find ${D} -maxdepth 1 -type f \\( -name 'hs_err_pid*.log' -o -name 'replay_pid*.log' \\) -exec ls -l {} \\;; fi; done"}
+
+	case watchOOMCommand:
+		if runtime == utils.RuntimeNativeImage {
+			return "", errors.New("GraalVM native images write no heap dump upon an OutOfMemoryError")
+		}
+
+		fspath, err = availablePath(util, append(cfSSHArguments, "--command"), applicationName, remoteDir, verbose, messages)
+		if err != nil {
+			return "", err
+		}
+		id := uuidGenerator.Generate()
+		marker := fspath + "/.cf-java-watch-" + id
+		remoteTemporaries = append(remoteTemporaries, marker)
+		remoteCommandTokens = append(remoteCommandTokens, watchOOMCommands(shell, crashFileDirs(fspath), marker, fspath+"/"+fileSafeName(applicationName)+"-threaddump-"+id+".txt")...)
+
+	case checkpointCommand, cracStatusCommand:
+		if runtime != utils.RuntimeHotSpot {
+			return "", errors.New("CRaC is only available on HotSpot-based JVMs like SapMachine")
+		}
+		if command == cracStatusCommand {
+			remoteCommandTokens = append(remoteCommandTokens, cracStatusCommands(shell)...)
+			break
+		}
+
+		// Checkpointing stops the JVM, which takes down an app running a single instance until it is restarted
+		if !commandFlags.IsSet("force") && !commandFlags.IsSet("dry-run") {
+			running, err := util.GetRunningInstances(applicationName)
+			if err != nil {
+				return "", err
+			}
+			if len(running) < 2 {
+				return "", errors.New("Checkpointing stops the JVM, and " + applicationName + " has no other running instance to serve requests until Cloud Foundry restarts it, run with -force to checkpoint anyway")
+			}
+		}
+		remoteCommandTokens = append(remoteCommandTokens, checkpointCommands(shell)...)
+
+	case cdsCommand:
+		if runtime != utils.RuntimeHotSpot {
+			return "", errors.New("CDS archives can only be dumped at runtime by HotSpot-based JVMs like OpenJDK and SapMachine")
+		}
+
+		fspath, err = availablePath(util, append(cfSSHArguments, "--command"), applicationName, remoteDir, verbose, messages)
+		if err != nil {
+			return "", err
+		}
+		generatedFileName = fspath + "/" + fileSafeName(applicationName) + "-cds-" + uuidGenerator.Generate() + ".jsa"
+		remoteCommandTokens = append(remoteCommandTokens, cdsCommands(shell, generatedFileName, commandFlags.IsSet("dynamic"))...)
+
+	case attachAgentCommand, jolokiaCommand:
+		if runtime != utils.RuntimeHotSpot {
+			return "", errors.New("Java agents can only be loaded at runtime into HotSpot-based JVMs like OpenJDK and SapMachine")
+		}
+
+		agentJar := commandFlags.String("jar")
+		agentOptions := commandFlags.String("options")
+		if command == jolokiaCommand {
+			localPort, err := jolokiaLocalPort(commandFlags.String("local-port"))
+			if err != nil {
+				return "", err
+			}
+			jolokiaForward = localPort + ":localhost:" + jolokiaPort
+
+			if agentJar == "" {
+				agentJar = jolokiaAgentJar()
+				if !commandFlags.IsSet("dry-run") {
+					if agentJar, err = fetchJolokiaAgent(messages); err != nil {
+						return "", err
+					}
+				}
+			}
+			// The agent listens on the loopback interface only, it is reached through the forwarded port
+			jolokiaOptions := "port=" + jolokiaPort + ",host=127.0.0.1"
+			if agentOptions != "" {
+				jolokiaOptions += "," + agentOptions
+			}
+			agentOptions = jolokiaOptions
+		}
+
+		if agentJar == "" {
+			return "", &InvalidUsageError{message: "No agent jar provided, please specify it with the flag \"jar\""}
+		}
+		if _, err := os.Stat(agentJar); err != nil && !commandFlags.IsSet("dry-run") {
+			return "", errors.New("The agent jar " + agentJar + " cannot be read: " + err.Error())
+		}
+
+		fspath, err := availablePath(util, append(cfSSHArguments, "--command"), applicationName, remoteDir, verbose, messages)
+		if err != nil {
+			return "", err
+		}
+		remoteJar := fspath + "/" + filepath.Base(agentJar)
+
+		if !commandFlags.IsSet("dry-run") {
+			if err := util.UploadFile(append(cfSSHArguments, "--command"), agentJar, remoteJar); err != nil {
+				return "", err
+			}
+			fmt.Fprintln(messages, "Agent jar uploaded to: "+remoteJar)
+		}
+
+		// The options given by the user are quoted, as the remote shell would expand their $ or run their quotes
+		agentLoad := "${JCMD_COMMAND} " + shell.javaPID + " JVMTI.agent_load " + utils.ShellQuote(remoteJar)
+		if agentOptions != "" {
+			agentLoad += " " + utils.ShellQuote(agentOptions)
+		}
+		remoteCommandTokens = append(remoteCommandTokens,
+			"JCMD_COMMAND=`"+shell.findExecutable("jcmd")+" | head -1 | tr -d [:space:]`",
+			"if [ -z \"${JCMD_COMMAND}\" ]; then echo >&2 'jcmd is required for loading Java agents, please make sure that the app runs on a full JDK'; exit 1; fi",
+			agentLoad)
+
+	case monitorCommand:
+		if runtime != utils.RuntimeHotSpot {
+			return "", errors.New("jstat can only sample HotSpot-based JVMs like OpenJDK and SapMachine")
+		}
+
+		duration, interval, err := monitorDurations(commandFlags.String("duration"), commandFlags.String("interval"))
+		if err != nil {
+			return "", err
+		}
+		if commandFlags.IsSet("alert") {
+			if alertRules, err = parseAlertRules(commandFlags.String("alert")); err != nil {
+				return "", err
+			}
+		}
+		remoteCommandTokens = append(remoteCommandTokens, monitorCommands(shell, duration, interval)...)
+		if !commandFlags.IsSet("dry-run") {
+			fmt.Fprintln(messages, "Sampling the metrics of the JVM every "+interval.String()+" for "+duration.String())
+		}
+
+	case histoDiffCommand:
+		return classHistogramDiff(util, append(cfSSHArguments, "--command"), commandFlags.String("interval"), commandFlags.String("baseline"), commandFlags.String("save"), messages)
+
+	case execCommand:
+		remoteCommandTokens = append(remoteCommandTokens, execEnvironment(shell)...)
+		remoteCommandTokens = append(remoteCommandTokens, strings.Join(passthrough, " "))
+
+	case signalDumpCommand:
+		if openJ9 {
+			return "", errors.New("OpenJ9 writes the thread dump upon SIGQUIT into a javacore file instead of the app logs, run `cf java thread-dump " + utils.ShellWord(applicationName) + instanceFlag(applicationInstance) + "` to print it")
+		}
+		// The JVM prints the thread dump into the app logs, see readSignalDump
+		remoteCommandTokens = append(remoteCommandTokens, "kill -3 "+shell.javaPID+" && echo '"+signalSentMarker+"'")
+
+	case whereIsCommand:
+		remoteCommandTokens = append(remoteCommandTokens, whereIsCommands(shell)...)
+
+	case runtimeInfoCommand:
+		remoteCommandTokens = append(remoteCommandTokens, runtimeInfoCommands(shell)...)
+
+	case memoryAdviseCommand:
+		if runtime != utils.RuntimeHotSpot {
+			return "", errors.New("The memory settings can only be read from HotSpot-based JVMs like OpenJDK and SapMachine")
+		}
+		remoteCommandTokens = append(remoteCommandTokens, memoryAdviseCommands(shell)...)
+
+	case vitalsHistoryCommand:
+		if runtime != utils.RuntimeHotSpot {
+			return "", errors.New("The SapMachine Vitals are only available in SapMachine")
+		}
+		remoteCommandTokens = append(remoteCommandTokens, vitalsHistoryCommands(shell)...)
+
+	case sshCommand:
+		remoteCommandTokens = append(remoteCommandTokens, execEnvironment(shell)...)
+		remoteCommandTokens = append(remoteCommandTokens, interactiveShellCommands()...)
+
+	case remoteCleanCommand:
+		fspath, err := availablePath(util, append(cfSSHArguments, "--command"), applicationName, remoteDir, verbose, messages)
+		if err != nil {
+			return "", err
+		}
+
+		remoteCommandTokens = remoteArtifactsCommands(fspath, olderThan, "-print -exec rm -f {} \\;")
+
+	case remoteListCommand:
+		fspath, err := availablePath(util, append(cfSSHArguments, "--command"), applicationName, remoteDir, verbose, messages)
+		if err != nil {
+			return "", err
+		}
+
+		remoteCommandTokens = remoteArtifactsCommands(fspath, olderThan, "-exec ls -l {} \\;")
+
+	case threadDumpCommand:
+		if runtime == utils.RuntimeNativeImage {
+			// Native images have no attach API, so we fall back to native debuggers
+			remoteCommandTokens = []string{nativeImageDetection,
+				"if command -v eu-stack > /dev/null; then eu-stack -p ${NATIVE_PID}; exit 0; fi",
+				"if command -v gdb > /dev/null; then gdb -p ${NATIVE_PID} -batch -ex 'thread apply all bt'; exit 0; fi",
+				"echo >&2 \"Neither eu-stack nor gdb found in the container. Build the image with '--enable-monitoring=threaddump' to have it print a thread dump into the app logs upon 'kill -QUIT ${NATIVE_PID}'\"; exit 1"}
+			break
+		}
+
+		if openJ9 {
+			// OpenJ9 writes thread dumps as javacore files, which we print and remove right away
+			javacoreFileName := "/tmp/" + fileSafeName(applicationName) + "-javacore-" + uuidGenerator.Generate() + ".txt"
+			remoteCommandTokens = append(remoteCommandTokens,
+				"JCMD_COMMAND=`"+shell.findExecutable("jcmd")+" | head -1`",
+				"if [ -n \"${JCMD_COMMAND}\" ]; then ${JCMD_COMMAND} "+shell.javaPID+" Dump.java "+javacoreFileName+" > /dev/null; JAVACORE_NAME="+javacoreFileName,
+				// Without jcmd, the JVM writes the javacore into its working directory upon SIGQUIT
+				"else kill -3 "+shell.javaPID+"; sleep 3; JAVACORE_NAME=`"+shell.newestFile("/home/vcap/app", "javacore.*.txt")+"`; fi",
+				"if [ ! -s \"${JAVACORE_NAME}\" ]; then echo >&2 'Failed to create javacore'; exit 1; fi",
+				"cat \"${JAVACORE_NAME}\"; rm -f \"${JAVACORE_NAME}\"")
+			break
+		}
+
+		// OpenJDK
+		remoteCommandTokens = append(remoteCommandTokens, "JSTACK_COMMAND=`"+shell.findExecutable("jstack")+" | head -1`; if [ -n \"${JSTACK_COMMAND}\" ]; then ${JSTACK_COMMAND} "+shell.javaPID+"; exit 0; fi")
+		// SAP JVM
+		remoteCommandTokens = append(remoteCommandTokens, "JVMMON_COMMAND=`"+shell.findExecutable("jvmmon")+" | head -1`; if [ -n \"${JVMMON_COMMAND}\" ]; then ${JVMMON_COMMAND} -pid "+shell.javaPID+" -c \"print stacktrace\"; exit 0; fi")
+		// Slim JREs often ship jcmd without jstack
+		remoteCommandTokens = append(remoteCommandTokens, "JCMD_COMMAND=`"+shell.findExecutable("jcmd")+" | head -1`; if [ -n \"${JCMD_COMMAND}\" ]; then ${JCMD_COMMAND} "+shell.javaPID+" Thread.print -l; exit 0; fi")
+		// Without any tool, the JVM prints the thread dump into the app logs upon SIGQUIT, see readSignalDump
+		remoteCommandTokens = append(remoteCommandTokens, "kill -3 "+shell.javaPID+" && echo '"+signalSentMarker+"'")
+	}
+
+	// The commands defined by the user run like the one of exec
+	if custom := commandInfo.custom; custom != nil {
+		if custom.GenerateFiles {
+			fspath, err = availablePath(util, append(cfSSHArguments, "--command"), applicationName, remoteDir, verbose, messages)
+			if err != nil {
+				return "", err
+			}
+			generatedFileName = fspath + "/" + fileSafeName(applicationName) + "-" + custom.Name + "-" + uuidGenerator.Generate() + custom.FileExtension
+		}
+
+		remoteCommandTokens = append(remoteCommandTokens, execEnvironment(shell)...)
+		remoteCommandTokens = append(remoteCommandTokens, custom.remoteCommands(generatedFileName, strings.Join(commandFlags.StringSlice("args"), " "), passthrough)...)
+		if custom.GenerateFiles {
+			remoteCommandTokens = append(remoteCommandTokens, "if [ ! -s "+generatedFileName+" ]; then echo >&2 'The command "+custom.Name+" wrote no file "+generatedFileName+"'; exit 1; fi")
+		}
+	}
+
+	// The size and checksums needed for the download are computed in the session creating the heap dump
+	if command == heapDumpCommand && copyToLocal {
+		remoteCommandTokens = append(remoteCommandTokens, utils.ManifestCommand(heapdumpFileName))
+	}
+
+	if command == sshCommand {
+		cfSSHArguments = append(cfSSHArguments, "--request-pseudo-tty")
+	}
+	cfSSHArguments = append(cfSSHArguments, "--command")
+
+	if command == downloadCommand {
+		_, err := download(util, cfSSHArguments, arguments[expectedArgumentLen-1], localDir, copyOptions, commandFlags.IsSet("delete"), messages)
+		return "", err
+	}
+	if command == pushFileCommand {
+		return "", pushFile(util, cfSSHArguments, applicationName, arguments[expectedArgumentLen-2], arguments[expectedArgumentLen-1], commandFlags.String("max-size"), verbose, messages)
+	}
+	if command == cpCommand {
+		remoteFile, err := findRemoteFile(util, cfSSHArguments, arguments[expectedArgumentLen-1])
+		if err != nil {
+			return "", err
+		}
+		return "", fetchFile(util, cfSSHArguments, remoteFile, copyTarget(remoteFile, localPath), copyOptions, commandFlags.IsSet("delete"), messages)
+	}
+	if commandInfo.keepalive {
+		remoteCommandTokens = append([]string{KeepaliveCommand}, remoteCommandTokens...)
+	}
+	remoteCommand := strings.Join(remoteCommandTokens, "; ")
+
+	// The port forwarding to the Jolokia agent runs in a cf ssh session of its own, without a command
+	var forwardArguments []string
+	if command == jolokiaCommand {
+		forwardArguments = append(append([]string{}, cfSSHArguments[:len(cfSSHArguments)-1]...), "-N", "-L", jolokiaForward)
+	}
+
+	if commandFlags.IsSet("dry-run") {
+		// When printing out the entire command line for separate execution, we wrap the remote command in single quotes
+		// to prevent the shell processing it from running it in local
+		quoted := make([]string, len(cfSSHArguments))
+		for i, argument := range cfSSHArguments {
+			quoted[i] = utils.ShellWord(argument)
+		}
+		quoted = append(quoted, "'"+remoteCommand+"'")
+		if command == jolokiaCommand {
+			return "cf " + strings.Join(quoted, " ") + "\n" + commandLine(forwardArguments), nil
+		}
+		return "cf " + strings.Join(quoted, " "), nil
+	}
+
+	for _, path := range remoteTemporaries {
+		cleanup.addRemotePath(cfSSHArguments, path)
+	}
+	// A heap dump, CDS archive or file of a custom command written halfway is of no use
+	if command == heapDumpCommand && !keepAfterDownload {
+		cleanup.addRemotePath(cfSSHArguments, heapdumpFileName)
+	}
+	if generatedFileName != "" && !keepAfterDownload {
+		cleanup.addRemotePath(cfSSHArguments, generatedFileName)
+	}
+	fullCommand := append(cfSSHArguments, remoteCommand)
+
+	// The output of the commands running for as long as the user wants is shown as it is produced
+	streamer, streaming := commandExecutor.(streamingCommandExecutor)
+	streaming = streaming && (command == execCommand || command == gcLogsCommand && commandFlags.IsSet("follow") || commandInfo.custom != nil)
+
+	progress.started(command, "")
+	started := now()
+	var output []string
+	if streaming {
+		output, err = streamer.ExecuteStreaming(fullCommand)
+	} else {
+		output, err = commandExecutor.Execute(fullCommand)
+	}
+	progress.finished(command, "", err)
+	if err == nil {
+		cleanup.settle(remoteTemporaries...)
+	}
+
+	// The session ends with the JVM once the checkpoint is written
+	if command == checkpointCommand && (err == nil || brokenSession(output, err)) {
+		fmt.Fprintln(messages, strings.Join(output, "\n"))
+		return checkpointNotice(applicationName), nil
+	}
+
+	if command != sshCommand && brokenSession(output, err) {
+		return "", diagnoseBrokenSession(util, applicationName, applicationInstance, started, commandLine(invocation))
+	}
+
+	// The session of ssh has already been shown in the terminal
+	if command == sshCommand {
+		return "", err
+	}
+
+	if command == jolokiaCommand && err == nil {
+		fmt.Fprintln(messages, "Jolokia is available at http://localhost:"+strings.Split(jolokiaForward, ":")[0]+"/jolokia/ until interrupted with Ctrl+C")
+		var forwardOutput []string
+		forwardOutput, err = commandExecutor.Execute(forwardArguments)
+		output = append(output, forwardOutput...)
+	}
+
+	if command == monitorCommand && err == nil {
+		series, err := parseMonitorOutput(output)
+		if err != nil {
+			return "", err
+		}
+
+		warnings, err := checkAlertRules(alertRules, series)
+		if err != nil {
+			return "", err
+		}
+
+		metrics := formatMonitorCSV(series)
+		if out := commandFlags.String("out"); out != "" {
+			if err := os.WriteFile(out, []byte(metrics+"\n"), 0644); err != nil {
+				return "", errors.New("Error writing the metrics to " + out + ": " + err.Error())
+			}
+			fmt.Fprintf(messages, "%d samples saved to: %s\n", len(series.Samples), out)
+			metrics = ""
+		}
+
+		if len(warnings) == 0 {
+			return metrics, nil
+		}
+		if metrics != "" {
+			fmt.Fprintln(messages, metrics)
+		}
+		for _, warning := range warnings {
+			fmt.Fprintln(messages, warning)
+			progress.warning(warning)
+		}
+		return "", fmt.Errorf("%d of %d alert rules breached", len(warnings), len(alertRules))
+	}
+
+	if command == watchOOMCommand && err == nil {
+		files := foundFiles(output)
+		fmt.Fprintln(messages, "The JVM wrote "+strings.Join(files, ", ")+", downloading before the container is recycled")
+		for _, file := range files {
+			if _, err := download(util, cfSSHArguments, file, localDir, copyOptions, commandFlags.IsSet("delete"), messages); err != nil {
+				return "", err
+			}
+		}
+		return "", nil
+	}
+
+	if command == threadDumpCommand && err == nil && containsString(output, signalSentMarker) {
+		fmt.Fprintln(messages, "Neither jstack, jvmmon nor jcmd found in the app container, reading the thread dump the JVM printed upon SIGQUIT from the recent logs")
+		return readSignalDump(util, applicationName, applicationInstance)
+	}
+
+	if command == signalDumpCommand && err == nil {
+		return readSignalDump(util, applicationName, applicationInstance)
+	}
+
+	if command == runtimeInfoCommand && err == nil {
+		return runtimeInfoReport(util, applicationName, output)
+	}
+
+	if command == memoryAdviseCommand && err == nil {
+		return memoryAdvice(applicationName, output)
+	}
+
+	if command == vitalsHistoryCommand && err == nil {
+		if !copyToLocal {
+			localDir = ""
+		}
+		return reportVitalsHistory(util, cfSSHArguments, applicationName, applicationInstance, output, commandFlags.String("out"), localDir, copyOptions, messages)
+	}
+
+	if command == vmLogCommand && err == nil {
+		if commandFlags.IsSet("what") {
+			fmt.Fprintln(messages, "The JVM logs into "+vmLogFileName+" in the app container, run `cf java vm-log "+utils.ShellWord(applicationName)+instanceFlag(applicationInstance)+" -disable -output "+utils.ShellWord(vmLogFileName)+" -local-dir .` to stop logging and fetch the log")
+		}
+
+		if copyToLocal {
+			// Once disabled, the log is complete and can be removed from the container
+			_, err = download(util, cfSSHArguments, vmLogFileName, localDir, copyOptions, commandFlags.IsSet("disable") && !keepAfterDownload, messages)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if command == heapDumpCommand {
+		manifest, rest := utils.ParseManifest(output)
+		output = rest
+
+		finalFile := heapdumpFileName
+		if manifest == nil {
+			finalFile, err = util.FindDumpFile(cfSSHArguments, heapdumpFileName, fspath)
+		}
+		if err == nil && finalFile != "" {
+			if finalFile != heapdumpFileName && !keepAfterDownload {
+				cleanup.settle(heapdumpFileName)
+				cleanup.addRemotePath(cfSSHArguments, finalFile)
+			}
+			heapdumpFileName = finalFile
+			fmt.Fprintln(messages, "Successfully created heap dump in application container at: "+heapdumpFileName)
+		} else {
+			fmt.Fprintln(messages, "Failed to find heap dump in application container")
+			fmt.Fprintln(messages, finalFile)
+			fmt.Fprintln(messages, heapdumpFileName)
+			fmt.Fprintln(messages, fspath)
+			return "", err
+		}
+
+		if copyToLocal {
+			localFileFullPath := localDir + "/" + heapdumpBaseName + path.Ext(heapdumpFileName)
+			copyOptions.Manifest = manifest
+			copyOptions.Progress = progress.transferred("download", heapdumpFileName)
+			progress.started("download", heapdumpFileName)
+			err = copyOverCat(util, cfSSHArguments, heapdumpFileName, localFileFullPath, copyOptions, messages)
+			progress.finished("download", heapdumpFileName, err)
+			if err == nil {
+				fmt.Fprintln(messages, "Heap dump file saved to: "+localFileFullPath)
+				linkLatest(localFileFullPath, messages)
+			} else {
+				switch err.(type) {
+				case *utils.TransferError:
+					cleanup.settle(heapdumpFileName)
+					fmt.Fprintln(messages, "The heap dump is kept in the app container, to resume its download, run: "+resumeInstructions(applicationName, applicationInstance, heapdumpFileName, localDir))
+				case *utils.InsufficientSpaceError:
+					cleanup.settle(heapdumpFileName)
+					fmt.Fprintln(messages, "The heap dump is kept in the app container, to download it once there is enough space, run: "+downloadInstructions(applicationName, applicationInstance, heapdumpFileName))
+				}
+				return "", err
+			}
+
+			if !openJ9 {
+				err = validateHeapDump(util, localFileFullPath, messages)
+				if err != nil {
+					return "", err
+				}
+			}
+
+			if commandFlags.IsSet("redact") {
+				progress.started("redact", localFileFullPath)
+				redacted, err := util.RedactHeapDump(localFileFullPath)
+				progress.finished("redact", localFileFullPath, err)
+				if err != nil {
+					return "", err
+				}
+				fmt.Fprintf(messages, "Heap dump file redacted: the contents of %d char and byte arrays were zeroed\n", redacted)
+			}
+		} else if stdout != nil {
+			copyOptions.Manifest = manifest
+			copyOptions.Progress = progress.transferred("download", heapdumpFileName)
+			progress.started("download", heapdumpFileName)
+			err = util.StreamFile(cfSSHArguments, heapdumpFileName, stdout, copyOptions)
+			progress.finished("download", heapdumpFileName, err)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintln(messages, "Heap dump written to stdout")
+		} else {
+			fmt.Fprintln(messages, "Heap dump will not be copied as parameter `local-dir` was not set")
+			progress.warning("Heap dump will not be copied as parameter `local-dir` was not set")
+		}
+
+		if !keepAfterDownload {
+			progress.started("delete", heapdumpFileName)
+			err = util.DeleteRemoteFile(cfSSHArguments, heapdumpFileName)
+			progress.finished("delete", heapdumpFileName, err)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintln(messages, "Heap dump file deleted in app container")
+		} else {
+			fmt.Fprintln(messages, "Heap dump file kept in app container, run `cf java remote-clean "+utils.ShellWord(applicationName)+"` to remove the files left behind by this plugin")
+			fmt.Fprintln(messages, "To fetch it later, run: "+downloadInstructions(applicationName, applicationInstance, heapdumpFileName))
+		}
+	}
+	if generatedFileName != "" && err == nil {
+		fmt.Fprintln(messages, "Successfully created the file "+generatedFileName+" in the app container")
+		if copyToLocal {
+			err = fetchFile(util, cfSSHArguments, generatedFileName, filepath.Join(localDir, path.Base(generatedFileName)), copyOptions, !keepAfterDownload, messages)
+			if _, transferFailed := err.(*utils.TransferError); transferFailed {
+				cleanup.settle(generatedFileName)
+				fmt.Fprintln(messages, "The file is kept in the app container, to resume its download, run: "+resumeInstructions(applicationName, applicationInstance, generatedFileName, localDir))
+			}
+			if err != nil {
+				return "", err
+			}
+		} else if !keepAfterDownload {
+			fmt.Fprintln(messages, "The file will not be copied as parameter `local-dir` was not set")
+			progress.warning("The file will not be copied as parameter `local-dir` was not set")
+			if err = util.DeleteRemoteFile(cfSSHArguments, generatedFileName); err != nil {
+				return "", err
+			}
+			fmt.Fprintln(messages, "File "+generatedFileName+" deleted in app container")
+		} else {
+			fmt.Fprintln(messages, "To fetch it later, run: "+downloadInstructions(applicationName, applicationInstance, generatedFileName))
+		}
+	}
+
+	// The output streamed has already been shown in the terminal
+	if streaming {
+		return "", err
+	}
+
+	// We keep this around to make the compiler happy, but commandExecutor.Execute will cause an os.Exit
+	return strings.Join(output, "\n"), err
+}
+
+// GetMetadata must be implemented as part of the plugin interface
+// defined by the core CLI.
+//
+// GetMetadata() returns a PluginMetadata struct. The first field, Name,
+// determines the name of the plugin which should generally be without spaces.
+// If there are spaces in the name a user will need to properly quote the name
+// during uninstall otherwise the name will be treated as seperate arguments.
+// The second value is a slice of Command structs. Our slice only contains one
+// Command Struct, but could contain any number of them. The first field Name
+// defines the command `cf heapdump` once installed into the CLI. The
+// second field, HelpText, is used by the core CLI to display help information
+// to the user in the core commands `cf help`, `cf`, or `cf -h`.
+func (c *JavaPlugin) GetMetadata() plugin.PluginMetadata {
+	runMutex.Lock()
+	defer runMutex.Unlock()
+
+	// The usage shown by cf help java includes the custom commands; a broken definition of them leaves the built-in ones
+	if err := loadCommands(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+
+	return c.metadata()
+}
+
+// metadata returns the metadata of the plugin with the commands loaded, like GetMetadata, from within a running command
+func (c *JavaPlugin) metadata() plugin.PluginMetadata {
+	metadata := plugin.PluginMetadata{
+		Name: "java",
+		Version: plugin.VersionType{
+			Major: 3,
+			Minor: 0,
+			Build: 3,
+		},
+		MinCliVersion: plugin.VersionType{
+			Major: 6,
+			Minor: 7,
+			Build: 0,
+		},
+		Commands: []plugin.Command{
+			{
+				Name:     "java",
+				HelpText: "Obtain a heap-dump or thread-dump from a running, SSH-enabled Java application, or list, download and remove the files left behind in its container.",
+
+				// UsageDetails is optional
+				// It is used to show help of usage of each command
+				UsageDetails: plugin.Usage{
+					Usage: commandsUsage(),
+					Options: map[string]string{
+						"app-instance-index": "-i [index], select to which instance of the app to connect",
+						"guid":               "-g [guid], identify the app by its GUID instead of APP_NAME",
+						"route":              "-rt [route], identify the app by a route mapped to it, e.g., api.example.com, instead of APP_NAME",
+						"keep":               "-k, keep the heap dump in the container; by default the heap dump will be deleted from the container's filesystem after been downloaded",
+						"dry-run":            "-n, just output to command line what would be executed",
+						"container-dir":      "-cd, the directory path in the container that the heap dump file will be saved to, or auto:largest for the one with the most free space",
+						"local-dir":          "-ld, the local directory path that the dump file will be saved to; download uses the current directory if not set",
+						"limit-rate":         "-lr [rate], limit the download speed of the dump file, e.g., 2M for 2 megabytes per second",
+						"no-create":          "-nc, fail if the local directory does not exist instead of creating it",
+						"force":              "-f, overwrite the local dump file if it already exists, with checkpoint, also checkpoint the only running instance",
+						"delete":             "-rm, with download, cp, crash-report and watch-oom, delete the file from the container after having downloaded it",
+						"older-than":         "-ot [age], with remote-list and remote-clean, only list or remove the files older than the given age, e.g., 7d",
+						"verbose":            "-v, report additional details, like the directory chosen in the container",
+						"json":               "-j, with commands, print the table of commands as JSON for external tools",
+						"no-uuid":            "-nu, name the heap dump after the app only, e.g., my_app-heapdump.hprof, replacing the previous one",
+						"timestamp":          "-ts [format], include the UTC time in the name of the heap dump, in a strftime-like format, e.g., %Y-%m-%d, or iso for %Y%m%dT%H%M%SZ",
+						"max-size":           "-ms [size], with push-file, the maximum size of the file to upload, 100M by default",
+						"resume":             "-rs, with download and cp, keep the chunks of the local file downloaded before, e.g., by a download that failed midway, and download only the missing ones",
+						"args":               "-a [arguments], with custom commands, the arguments inserted for @ARGS into their command, joined if repeated, or give them after --",
+						"organize":           "-og, with local-dir, download the files into <local-dir>/<app>/<instance>/<date> and link the newest one as <local-dir>/<app>/latest",
+						"dynamic":            "-dy, with cds, dump a dynamic archive on top of the one in use, for JVMs started with -XX:+RecordDynamicDumpInfo, instead of a static one",
+						"no-cache":           "-nca, look for the Java tools in the container again instead of using their paths cached for the droplet of the app",
+						"all-instances":      "-ai, with thread-dump, signal-dump, crac-status, where-is, runtime-info, memory-advise and exec, run the command on all running instances of the app, with the output prefixed by the instance, e.g., [inst 0]",
+						"progress":           "-pg [format], with heap-dump, thread-dump, vm-log, gc-logs, crash-report, monitor, vitals-history, download, cp and push-file, emit progress events on stderr, json for newline-delimited JSON",
+						"archive":            "-ar, with gc-logs and crash-report, pack the downloaded files into a single timestamped zip archive",
+						"redact":             "-rd, zero the contents of char and byte arrays, e.g., strings, in the downloaded heap dump, before sharing it",
+						"what":               "-w [selection], with vm-log, the unified logging configuration to enable, e.g., gc=debug or gc*=info,safepoint=debug",
+						"output":             "-o [file], with vm-log, the file in the container that the JVM logs into, by default /tmp/APP_NAME-vm.log; with heap-dump, - writes the heap dump to stdout and the messages to stderr",
+						"disable":            "-d, with vm-log, stop logging into the file; with -local-dir, also fetch and remove it",
+						"local-port":         "-lp [port], with jolokia, the local port forwarded to the Jolokia agent, 8778 by default",
+						"interval":           "-iv [duration], with histo-diff, the time between the two class histograms compared, 30s by default; with monitor, the time between two samples, 10s by default",
+						"duration":           "-du [duration], with monitor, how long to sample the metrics of the JVM, 5m by default",
+						"out":                "-ou [file], with monitor and vitals-history, the local file to write the sampled metrics or the SapMachine Vitals into as CSV, instead of printing them",
+						"alert":              "-al [rules], with monitor, fail if the metrics breach any of the given thresholds, e.g., heap>90%,heap>2G,threads>500,cpu>80%",
+						"baseline":           "-bl [file], with histo-diff, a local class histogram, e.g., saved with -save, to compare with instead of taking a first one",
+						"save":               "-sv [file], with histo-diff, save the class histogram taken into the given local file",
+						"jar":                "-ja [file], with attach-agent, the local jar file of the Java agent to upload and load",
+						"options":            "-op [options], with attach-agent, the options passed to the Java agent, e.g., port=8778",
+						"follow":             "-fo, with gc-logs, print the GC log as the JVM writes it, until interrupted",
+						"record":             "-rc [dir], record the remote commands and their output, with secrets masked, into <dir>/recording.json, e.g., to attach to a bug report",
+						"socket":             "-sk [path], with serve, the local socket to serve the commands on, cf-java-plugin.sock next to the plugins of the cf CLI by default",
+						cfHomeFlag:           "-ch [dir], run the command with the configuration of the cf CLI in the given directory instead of CF_HOME, e.g., to target another foundation",
+					},
+				},
+			},
+		},
+	}
+
+	// Each command is also registered on its own, so that cf help lists it and shows the options it supports
+	options := metadata.Commands[0].UsageDetails.Options
+	for _, command := range commands {
+		metadata.Commands = append(metadata.Commands, command.pluginCommand(options))
+	}
+
+	return metadata
+}
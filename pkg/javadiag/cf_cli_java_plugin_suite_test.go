@@ -1,4 +1,4 @@
-package main
+package javadiag
 
 import (
 	ginkgo "github.com/onsi/ginkgo"
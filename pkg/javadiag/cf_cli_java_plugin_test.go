@@ -0,0 +1,4932 @@
+package javadiag
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"utils"
+	. "utils/fakes"
+
+	io_helpers "code.cloudfoundry.org/cli/cf/util/testhelpers/io"
+	"code.cloudfoundry.org/cli/plugin/models"
+	"code.cloudfoundry.org/cli/plugin/pluginfakes"
+	. "github.com/SAP/cf-cli-java-plugin/cmd/fakes"
+	. "github.com/SAP/cf-cli-java-plugin/uuid/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/simonleung8/flags"
+)
+
+type commandOutput struct {
+	out string
+	err error
+}
+
+func captureOutput(closure func() (string, error)) (string, error, string) {
+	cliOutputChan := make(chan []string)
+	defer close(cliOutputChan)
+
+	cmdOutputChan := make(chan *commandOutput)
+	defer close(cmdOutputChan)
+
+	go func() {
+		cliOutput := io_helpers.CaptureOutput(func() {
+			output, err := closure()
+			cmdOutputChan <- &commandOutput{out: output, err: err}
+		})
+		cliOutputChan <- cliOutput
+	}()
+
+	var cliOutput []string
+	var cmdOutput *commandOutput
+
+	Eventually(cmdOutputChan, 5).Should(Receive(&cmdOutput))
+
+	Eventually(cliOutputChan).Should(Receive(&cliOutput))
+
+	cliOutputString := strings.Join(cliOutput, "|")
+
+	return cmdOutput.out, cmdOutput.err, cliOutputString
+}
+
+// fakeStreamingExecutor adds to the fake the streaming of the output, counting how often it is used
+type fakeStreamingExecutor struct {
+	*FakeCommandExecutor
+	calls int
+}
+
+func (e *fakeStreamingExecutor) ExecuteStreaming(args []string) ([]string, error) {
+	e.calls++
+	return e.Execute(args)
+}
+
+// recordingUtil adds to the fake the recording of the cleanup in the container, in the order it happens
+type recordingUtil struct {
+	FakeCfJavaPluginUtil
+	calls *[]string
+}
+
+func (u recordingUtil) StopRemoteProcesses(args []string, pattern string) error {
+	*u.calls = append(*u.calls, "stop "+pattern)
+	return nil
+}
+
+func (u recordingUtil) DeleteRemotePaths(args []string, paths []string) error {
+	*u.calls = append(*u.calls, "delete "+strings.Join(paths, " "))
+	return nil
+}
+
+// partialDownloadUtil adds to the fake a download failing halfway, after it wrote part of the local file. Like the
+// download does, it refuses to write into an existing file unless forced to.
+type partialDownloadUtil struct {
+	recordingUtil
+}
+
+func (u partialDownloadUtil) CopyOverCat(args []string, src string, dest string, options utils.CopyOptions) error {
+	if _, err := os.Stat(dest); err == nil && !options.Force {
+		return errors.New("The local file " + dest + " already exists. Please remove it, or use the flag `force` to overwrite it.")
+	}
+	if err := os.WriteFile(dest, []byte("JAVA PROFILE"), 0644); err != nil {
+		return err
+	}
+	return errors.New("error occured while writing the local file: " + dest)
+}
+
+var _ = Describe("CfJavaPlugin", func() {
+
+	Describe("Run", func() {
+
+		var (
+			subject         *JavaPlugin
+			commandExecutor *FakeCommandExecutor
+			uuidGenerator   *FakeUUIDGenerator
+			pluginUtil      FakeCfJavaPluginUtil
+		)
+
+		BeforeEach(func() {
+			subject = &JavaPlugin{}
+			commandExecutor = new(FakeCommandExecutor)
+			uuidGenerator = new(FakeUUIDGenerator)
+			uuidGenerator.GenerateReturns("cdc8cea3-92e6-4f92-8dc7-c4952dd67be5")
+			pluginUtil = FakeCfJavaPluginUtil{SshEnabled: true, Jmap_jvmmon_present: true, Container_path_valid: true, Fspath: "/tmp", LocalPathValid: true, UUID: uuidGenerator.Generate(), OutputFileName: "java_pid0_0.hprof"}
+		})
+
+		Context("when invoked without arguments", func() {
+
+			It("outputs an error and does not invoke cf ssh", func() {
+
+				output, err, cliOutput := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err.Error()).To(ContainSubstring("No command provided"))
+				Expect(cliOutput).To(ContainSubstring("No command provided"))
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+			})
+
+		})
+
+		Context("when invoked with too many arguments", func() {
+
+			It("outputs an error and does not invoke cf ssh", func() {
+
+				output, err, cliOutput := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "ciao"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err.Error()).To(ContainSubstring("Too many arguments provided: ciao"))
+				Expect(cliOutput).To(ContainSubstring("Too many arguments provided: ciao"))
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+			})
+
+		})
+
+		Context("when invoked with an unknown command", func() {
+
+			It("outputs an error and does not invoke cf ssh", func() {
+
+				output, err, cliOutput := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "UNKNOWN_COMMAND"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err.Error()).To(ContainSubstring("Unrecognized command \"UNKNOWN_COMMAND\": supported commands are 'heap-dump', 'thread-dump', 'signal-dump', 'vm-log', 'gc-logs', 'crash-report', 'attach-agent', 'jolokia', 'histo-diff', 'monitor', 'watch-oom', 'checkpoint', 'crac-status', 'cds', 'remote-list', 'remote-clean', 'download', 'cp', 'push-file', 'exec', 'ssh', 'where-is', 'runtime-info', 'memory-advise', 'vitals-history', 'verify-install', 'thread-analysis', 'commands', 'examples', 'lint-commands' and 'serve'"))
+				Expect(cliOutput).To(ContainSubstring("Unrecognized command \"UNKNOWN_COMMAND\": supported commands are 'heap-dump', 'thread-dump', 'signal-dump', 'vm-log', 'gc-logs', 'crash-report', 'attach-agent', 'jolokia', 'histo-diff', 'monitor', 'watch-oom', 'checkpoint', 'crac-status', 'cds', 'remote-list', 'remote-clean', 'download', 'cp', 'push-file', 'exec', 'ssh', 'where-is', 'runtime-info', 'memory-advise', 'vitals-history', 'verify-install', 'thread-analysis', 'commands', 'examples', 'lint-commands' and 'serve'"))
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+			})
+
+		})
+
+		Context("when invoked to generate a heap-dump", func() {
+
+			Context("without application name", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("No application name provided"))
+					Expect(cliOutput).To(ContainSubstring("No application name provided"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("with the --help flag", func() {
+
+				It("prints the help of the command without requiring an app", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "--help"})
+						return output, err
+					})
+
+					Expect(err).To(BeNil())
+					Expect(output).To(HavePrefix("heap-dump - Create a heap dump of the app"))
+					Expect(output).To(ContainSubstring("USAGE:\n   cf java heap-dump APP_NAME\n"))
+					Expect(output).To(ContainSubstring("   -local-dir                -ld, the local directory path that the dump file will be saved to"))
+					Expect(output).NotTo(ContainSubstring("-older-than"))
+					Expect(output).To(ContainSubstring("EXAMPLES:\n   cf java heap-dump my_app -local-dir ~/dumps"))
+					Expect(cliOutput).To(ContainSubstring("USAGE:"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("with too many arguments", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "my_file", "ciao"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Too many arguments provided: my_file, ciao"))
+					Expect(cliOutput).To(ContainSubstring("Too many arguments provided: my_file, ciao"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("with just the app name", func() {
+
+				It("invokes cf ssh with the basic commands", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app"})
+						return output, err
+					})
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("Successfully created heap dump in application container at: " + pluginUtil.Fspath + "/" + pluginUtil.OutputFileName + "|Heap dump will not be copied as parameter `local-dir` was not set|Heap dump file deleted in app container|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh",
+						"my_app",
+						"--command",
+						KeepaliveCommand + "; if ! pgrep -x \"java\" > /dev/null; then echo \"No 'java' process found running. Are you sure this is a Java app?\" >&2; exit 1; fi; if [ -f /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 'Heap dump /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof already exists'; exit 1; fi; JMAP_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jmap app/.java-buildpack/*/bin/jmap /layers/*/jre/bin/jmap /layers/*/jdk/bin/jmap; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jmap) | head -1 | tr -d [:space:]`; JVMMON_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jvmmon app/.java-buildpack/*/bin/jvmmon /layers/*/jre/bin/jvmmon /layers/*/jdk/bin/jvmmon; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jvmmon) | head -1 | tr -d [:space:]`; JCMD_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jcmd app/.java-buildpack/*/bin/jcmd /layers/*/jre/bin/jcmd /layers/*/jdk/bin/jcmd; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jcmd) | head -1 | tr -d [:space:]`; JATTACH_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jattach app/.java-buildpack/*/bin/jattach /layers/*/jre/bin/jattach /layers/*/jdk/bin/jattach; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jattach) | head -1 | tr -d [:space:]`; if [ -n \"${JMAP_COMMAND}\" ]; then true; OUTPUT=$( ${JMAP_COMMAND} -dump:format=b,file=/tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof $(pidof java) ) || STATUS_CODE=$?; if [ ! -s /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 ${OUTPUT}; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi; elif [ -n \"${JVMMON_COMMAND}\" ]; then true; mkdir -p /tmp/cf-java-" + pluginUtil.UUID + "; echo -e 'change command line flag flags=-XX:HeapDumpOnDemandPath=/tmp/cf-java-" + pluginUtil.UUID + "\ndump heap' > /tmp/cf-java-" + pluginUtil.UUID + "/setHeapDumpOnDemandPath.sh; OUTPUT=$( ${JVMMON_COMMAND} -pid $(pidof java) -cmd \"/tmp/cf-java-" + pluginUtil.UUID + "/setHeapDumpOnDemandPath.sh\" ) || STATUS_CODE=$?; sleep 5; HEAP_DUMP_NAME=`find /tmp/cf-java-" + pluginUtil.UUID + " -name 'java_pid*.hprof' -printf '%T@ %p\\0' | sort -zk 1nr | sed -z 's/^[^ ]* //' | tr '\\0' '\\n' | head -n 1`; SIZE=-1; OLD_SIZE=$(stat -c '%s' \"${HEAP_DUMP_NAME}\"); while [ ${SIZE} != ${OLD_SIZE} ]; do OLD_SIZE=${SIZE}; sleep 3; SIZE=$(stat -c '%s' \"${HEAP_DUMP_NAME}\"); done; if [ ! -s \"${HEAP_DUMP_NAME}\" ]; then echo >&2 ${OUTPUT}; rm -rf /tmp/cf-java-" + pluginUtil.UUID + "; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; rm -rf /tmp/cf-java-" + pluginUtil.UUID + "; exit ${STATUS_CODE}; fi; mv \"${HEAP_DUMP_NAME}\" /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof; rm -rf /tmp/cf-java-" + pluginUtil.UUID + "; elif [ -n \"${JCMD_COMMAND}\" ]; then true; OUTPUT=$( ${JCMD_COMMAND} $(pidof java) GC.heap_dump /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ) || STATUS_CODE=$?; if [ ! -s /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 ${OUTPUT}; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi; elif [ -n \"${JATTACH_COMMAND}\" ]; then true; OUTPUT=$( ${JATTACH_COMMAND} $(pidof java) dumpheap /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ) || STATUS_CODE=$?; if [ ! -s /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 ${OUTPUT}; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi; else echo >&2 'jmap, jvmmon, jcmd or jattach is required for generating heap dumps, please make sure that the app runs on a full JDK'; exit 1; fi",
+					}))
+
+				})
+
+			})
+
+			Context("for a GraalVM native image", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					pluginUtil.Runtime = utils.RuntimeNativeImage
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Heap dumps of GraalVM native images cannot be created with jmap"))
+					Expect(cliOutput).To(ContainSubstring("--enable-monitoring=heapdump"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("for an app running on OpenJ9", func() {
+
+				It("invokes cf ssh with jcmd and keeps the PHD heap dump unvalidated", func() {
+
+					pluginUtil.Runtime = utils.RuntimeOpenJ9
+					pluginUtil.OutputFileName = "my_app-heapdump-" + pluginUtil.UUID + ".phd"
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-ld", "/tmp"})
+						return output, err
+					})
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("Successfully created heap dump in application container at: /tmp/my_app-heapdump-" + pluginUtil.UUID + ".phd|Heap dump file saved to: /tmp/my_app-heapdump-" + pluginUtil.UUID + ".phd|Heap dump file deleted in app container|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh",
+						"my_app",
+						"--command",
+						KeepaliveCommand + "; " + JavaDetectionCommand + "; if [ -f /tmp/my_app-heapdump-" + pluginUtil.UUID + ".phd ]; then echo >&2 'Heap dump /tmp/my_app-heapdump-" + pluginUtil.UUID + ".phd already exists'; exit 1; fi; JCMD_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jcmd app/.java-buildpack/*/bin/jcmd /layers/*/jre/bin/jcmd /layers/*/jdk/bin/jcmd; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jcmd) | head -1 | tr -d [:space:]`; if [ -z \"${JCMD_COMMAND}\" ]; then echo >&2 'jcmd is required for generating heap dumps of OpenJ9, please make sure that the app runs on a full JDK'; exit 1; fi; OUTPUT=$( ${JCMD_COMMAND} $(pidof java) Dump.heap /tmp/my_app-heapdump-" + pluginUtil.UUID + ".phd ) || STATUS_CODE=$?; if [ ! -s /tmp/my_app-heapdump-" + pluginUtil.UUID + ".phd ]; then echo >&2 ${OUTPUT}; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi; " +
+							"SIZE=$(wc -c < /tmp/my_app-heapdump-" + pluginUtil.UUID + ".phd); CHECKSUMS=; i=0; while [ $((i*67108864)) -lt ${SIZE} ]; do CHECKSUMS=\"${CHECKSUMS} $(dd if=/tmp/my_app-heapdump-" + pluginUtil.UUID + ".phd bs=1048576 skip=$((i*64)) count=64 2>/dev/null | md5sum | cut -d ' ' -f 1)\"; i=$((i+1)); done; echo \"FILE_MANIFEST ${SIZE}${CHECKSUMS}\"",
+					}))
+
+				})
+
+			})
+
+			Context("for an app with spaces, umlauts and shell metacharacters in its name", func() {
+
+				It("passes the name to cf ssh as it is and keeps it out of the file names", func() {
+
+					pluginUtil.OutputFileName = "Mein_B_ro___id_-heapdump-" + pluginUtil.UUID + ".hprof"
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "Mein Büro $(id)", "-k"})
+						return output, err
+					})
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring("|Heap dump file kept in app container, run `cf java remote-clean 'Mein Büro $(id)'` to remove the files left behind by this plugin|To fetch it later, run: cf java download 'Mein Büro $(id)' /tmp/" + pluginUtil.OutputFileName + " -local-dir .|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[:3]).To(Equal([]string{"ssh", "Mein Büro $(id)", "--command"}))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(ContainSubstring("if [ -f /tmp/Mein_B_ro___id_-heapdump-" + pluginUtil.UUID + ".hprof ]"))
+				})
+
+			})
+
+			Context("with the flags given as -flag=value between the arguments", func() {
+
+				It("downloads the heap dump into the given local directory", func() {
+
+					pluginUtil.OutputFileName = "unexpected.hprof"
+					pluginUtil.RemoteFile = "/tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof"
+					commandExecutor.ExecuteReturns([]string{"FILE_MANIFEST 1024 0f343b0931126a20f133d67c2b018a3b"}, nil)
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "--local-dir=/tmp", "my_app", "-k=false"})
+						return output, err
+					})
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring("|Heap dump file saved to: /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof|"))
+					Expect(cliOutput).To(HaveSuffix("|Heap dump file deleted in app container|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[:3]).To(Equal([]string{"ssh", "my_app", "--command"}))
+				})
+
+			})
+
+			Context("with the size and checksums of the heap dump computed in the same session", func() {
+
+				It("downloads the heap dump without looking for it again", func() {
+
+					pluginUtil.OutputFileName = "unexpected.hprof"
+					pluginUtil.RemoteFile = "/tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof"
+					commandExecutor.ExecuteReturns([]string{"FILE_MANIFEST 1024 0f343b0931126a20f133d67c2b018a3b"}, nil)
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-ld", "/tmp"})
+						return output, err
+					})
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(HavePrefix("Successfully created heap dump in application container at: /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof|Heap dump file saved to: /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof|"))
+					Expect(cliOutput).To(HaveSuffix("|Heap dump file deleted in app container|"))
+					Expect(cliOutput).NotTo(ContainSubstring("FILE_MANIFEST"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(HaveSuffix("; SIZE=$(wc -c < /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof); CHECKSUMS=; i=0; while [ $((i*67108864)) -lt ${SIZE} ]; do CHECKSUMS=\"${CHECKSUMS} $(dd if=/tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof bs=1048576 skip=$((i*64)) count=64 2>/dev/null | md5sum | cut -d ' ' -f 1)\"; i=$((i+1)); done; echo \"FILE_MANIFEST ${SIZE}${CHECKSUMS}\""))
+				})
+
+			})
+
+			Context("for a container with index > 0", func() {
+
+				It("invokes cf ssh with the basic commands", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-i", "4"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("Successfully created heap dump in application container at: " + pluginUtil.Fspath + "/" + pluginUtil.OutputFileName + "|Heap dump will not be copied as parameter `local-dir` was not set|Heap dump file deleted in app container|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{
+						"ssh",
+						"my_app",
+						"--app-instance-index",
+						"4",
+						"--command",
+						KeepaliveCommand + "; if ! pgrep -x \"java\" > /dev/null; then echo \"No 'java' process found running. Are you sure this is a Java app?\" >&2; exit 1; fi; if [ -f /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 'Heap dump /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof already exists'; exit 1; fi; JMAP_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jmap app/.java-buildpack/*/bin/jmap /layers/*/jre/bin/jmap /layers/*/jdk/bin/jmap; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jmap) | head -1 | tr -d [:space:]`; JVMMON_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jvmmon app/.java-buildpack/*/bin/jvmmon /layers/*/jre/bin/jvmmon /layers/*/jdk/bin/jvmmon; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jvmmon) | head -1 | tr -d [:space:]`; JCMD_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jcmd app/.java-buildpack/*/bin/jcmd /layers/*/jre/bin/jcmd /layers/*/jdk/bin/jcmd; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jcmd) | head -1 | tr -d [:space:]`; JATTACH_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jattach app/.java-buildpack/*/bin/jattach /layers/*/jre/bin/jattach /layers/*/jdk/bin/jattach; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jattach) | head -1 | tr -d [:space:]`; if [ -n \"${JMAP_COMMAND}\" ]; then true; OUTPUT=$( ${JMAP_COMMAND} -dump:format=b,file=/tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof $(pidof java) ) || STATUS_CODE=$?; if [ ! -s /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 ${OUTPUT}; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi; elif [ -n \"${JVMMON_COMMAND}\" ]; then true; mkdir -p /tmp/cf-java-" + pluginUtil.UUID + "; echo -e 'change command line flag flags=-XX:HeapDumpOnDemandPath=/tmp/cf-java-" + pluginUtil.UUID + "\ndump heap' > /tmp/cf-java-" + pluginUtil.UUID + "/setHeapDumpOnDemandPath.sh; OUTPUT=$( ${JVMMON_COMMAND} -pid $(pidof java) -cmd \"/tmp/cf-java-" + pluginUtil.UUID + "/setHeapDumpOnDemandPath.sh\" ) || STATUS_CODE=$?; sleep 5; HEAP_DUMP_NAME=`find /tmp/cf-java-" + pluginUtil.UUID + " -name 'java_pid*.hprof' -printf '%T@ %p\\0' | sort -zk 1nr | sed -z 's/^[^ ]* //' | tr '\\0' '\\n' | head -n 1`; SIZE=-1; OLD_SIZE=$(stat -c '%s' \"${HEAP_DUMP_NAME}\"); while [ ${SIZE} != ${OLD_SIZE} ]; do OLD_SIZE=${SIZE}; sleep 3; SIZE=$(stat -c '%s' \"${HEAP_DUMP_NAME}\"); done; if [ ! -s \"${HEAP_DUMP_NAME}\" ]; then echo >&2 ${OUTPUT}; rm -rf /tmp/cf-java-" + pluginUtil.UUID + "; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; rm -rf /tmp/cf-java-" + pluginUtil.UUID + "; exit ${STATUS_CODE}; fi; mv \"${HEAP_DUMP_NAME}\" /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof; rm -rf /tmp/cf-java-" + pluginUtil.UUID + "; elif [ -n \"${JCMD_COMMAND}\" ]; then true; OUTPUT=$( ${JCMD_COMMAND} $(pidof java) GC.heap_dump /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ) || STATUS_CODE=$?; if [ ! -s /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 ${OUTPUT}; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi; elif [ -n \"${JATTACH_COMMAND}\" ]; then true; OUTPUT=$( ${JATTACH_COMMAND} $(pidof java) dumpheap /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ) || STATUS_CODE=$?; if [ ! -s /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 ${OUTPUT}; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi; else echo >&2 'jmap, jvmmon, jcmd or jattach is required for generating heap dumps, please make sure that the app runs on a full JDK'; exit 1; fi",
+					}))
+
+				})
+
+			})
+
+			Context("for a container with an index out of range", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+					pluginUtil.InstanceCount = 2
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-i", "4"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("instance 4 requested but app 'my_app' has 2 instances"))
+					Expect(cliOutput).To(ContainSubstring("instance 4 requested but app 'my_app' has 2 instances"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("for an app that is not started", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+					pluginUtil.AppState = "STOPPED"
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(Equal("app 'my_app' is stopped; start it before collecting diagnostics"))
+					Expect(cliOutput).To(ContainSubstring("app 'my_app' is stopped; start it before collecting diagnostics"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("for an app without running instances", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+					pluginUtil.Instances = []utils.InstanceInfo{{Index: 0, State: "CRASHED"}, {Index: 1, State: "DOWN"}}
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(Equal("app 'my_app' has no running instance, e.g., as its instances crashed; check `cf app my_app` and `cf logs my_app --recent`, and start it before collecting diagnostics"))
+					Expect(cliOutput).To(ContainSubstring("app 'my_app' has no running instance"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("for an app with only one of its instances running", func() {
+
+				BeforeEach(func() {
+					pluginUtil.Instances = []utils.InstanceInfo{{Index: 0, State: "CRASHED"}, {Index: 1, State: "STARTING"}, {Index: 2, State: "RUNNING"}}
+				})
+
+				It("invokes cf ssh on the running instance with a notice", func() {
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-k"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(HavePrefix("Using instance 2, the only running instance of my_app, run with -i to choose another one|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[:5]).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "2", "--command"}))
+				})
+
+				It("invokes cf ssh on the instance given with --app-instance-index", func() {
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-k", "-i", "1"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).NotTo(ContainSubstring("the only running instance"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[:5]).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "1", "--command"}))
+				})
+
+				It("outputs an error for a crashed instance given with --app-instance-index and does not invoke cf ssh", func() {
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-i", "0"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(Equal("instance 0 of app 'my_app' is not running (state: CRASHED)"))
+					Expect(cliOutput).To(ContainSubstring("instance 0 of app 'my_app' is not running (state: CRASHED)"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("with the --guid flag", func() {
+
+				It("invokes cf ssh on the app with the given GUID", func() {
+					pluginUtil.AppNames = map[string]string{"4a5c7d47-0b6e-4bd6-a3ca-bc4de4fd2b7e": "my_app"}
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "--guid", "4a5c7d47-0b6e-4bd6-a3ca-bc4de4fd2b7e", "-k"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring("Successfully created heap dump in application container at: " + pluginUtil.Fspath + "/" + pluginUtil.OutputFileName))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[0:2]).To(Equal([]string{"ssh", "my_app"}))
+				})
+
+				It("outputs an error for an unknown GUID", func() {
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "--guid", "unknown"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("no app found with GUID: 'unknown'"))
+					Expect(cliOutput).To(ContainSubstring("no app found with GUID: 'unknown'"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+				It("outputs an error if the app name is given too", func() {
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "--guid", "4a5c7d47-0b6e-4bd6-a3ca-bc4de4fd2b7e"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Too many arguments provided: my_app"))
+					Expect(cliOutput).To(ContainSubstring("Too many arguments provided: my_app"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("with the --route flag", func() {
+
+				It("invokes cf ssh on the app mapped to the route", func() {
+					pluginUtil.AppRoutes = map[string]string{"api.example.com": "my_app"}
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "--route", "api.example.com", "-k"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(HavePrefix("The route api.example.com is mapped to the app my_app|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[0:2]).To(Equal([]string{"ssh", "my_app"}))
+				})
+
+				It("outputs an error for a route without an app", func() {
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "-rt", "unknown.example.com"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("no app found for route: 'unknown.example.com'"))
+					Expect(cliOutput).To(ContainSubstring("no app found for route: 'unknown.example.com'"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+				It("outputs an error if the GUID is given too", func() {
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "--route", "api.example.com", "--guid", "4a5c7d47-0b6e-4bd6-a3ca-bc4de4fd2b7e"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(Equal("The flags \"guid\" and \"route\" cannot be used together"))
+					Expect(cliOutput).To(ContainSubstring("The flags \"guid\" and \"route\" cannot be used together"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("with invalid container directory specified", func() {
+
+				It("invoke cf ssh for path check and outputs error", func() {
+					pluginUtil.Container_path_valid = false
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "--container-dir", "/not/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("the container path specified doesn't exist or have no read and write access, please check and try again later"))
+					Expect(cliOutput).To(ContainSubstring("the container path specified doesn't exist or have no read and write access, please check and try again later"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+
+				})
+
+			})
+
+			Context("with invalid local directory specified", func() {
+
+				It("invoke cf ssh for path check and outputs error", func() {
+					pluginUtil.LocalPathValid = false
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "--local-dir", "/not/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Error occured during create desination file: /not/valid/path/my_app-heapdump-" + pluginUtil.UUID + ".hprof, please check you are allowed to create file in the path."))
+					Expect(cliOutput).To(ContainSubstring("Successfully created heap dump in application container at: " + pluginUtil.Fspath + "/" + pluginUtil.OutputFileName + "|FAILED|Error occured during create desination file: /not/valid/path/my_app-heapdump-" + pluginUtil.UUID + ".hprof, please check you are allowed to create file in the path.|"))
+					Expect(cliOutput).To(ContainSubstring("|Removed " + pluginUtil.Fspath + "/" + pluginUtil.OutputFileName + " from the app container|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+
+				})
+
+			})
+
+			Context("with a local directory that does not exist", func() {
+
+				It("creates the local directory and downloads the heap dump", func() {
+					pluginUtil.LocalDirMissing = true
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "--local-dir", "/new/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring("Heap dump file saved to: /new/path/my_app-heapdump-" + pluginUtil.UUID + ".hprof"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				})
+
+				It("outputs an error with the --no-create flag", func() {
+					pluginUtil.LocalDirMissing = true
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "--local-dir", "/new/path", "--no-create"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The local directory /new/path does not exist"))
+					Expect(cliOutput).To(ContainSubstring("The local directory /new/path does not exist"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				})
+
+			})
+
+			Context("with an existing local file", func() {
+
+				It("outputs an error", func() {
+					pluginUtil.LocalFileExists = true
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "--local-dir", "/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The local file /valid/path/my_app-heapdump-" + pluginUtil.UUID + ".hprof already exists"))
+					Expect(cliOutput).To(ContainSubstring("The local file /valid/path/my_app-heapdump-" + pluginUtil.UUID + ".hprof already exists"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				})
+
+				It("overwrites the local file with the --force flag", func() {
+					pluginUtil.LocalFileExists = true
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "--local-dir", "/valid/path", "--force"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring("Heap dump file saved to: /valid/path/my_app-heapdump-" + pluginUtil.UUID + ".hprof"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				})
+
+			})
+
+			Context("with a corrupt heap dump", func() {
+
+				It("outputs an error after the download", func() {
+					pluginUtil.HeapDumpCorrupt = true
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "--local-dir", "/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("is truncated"))
+					Expect(cliOutput).To(ContainSubstring("Heap dump file saved to: /valid/path/my_app-heapdump-" + pluginUtil.UUID + ".hprof|FAILED|The heap dump /valid/path/my_app-heapdump-" + pluginUtil.UUID + ".hprof is truncated"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				})
+
+			})
+
+			Context("with ssh disabled", func() {
+
+				It("invoke cf ssh for path check and outputs error", func() {
+					pluginUtil.SshEnabled = false
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "--local-dir", "/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(ContainSubstring("required tools checking failed"))
+					Expect(err.Error()).To(ContainSubstring("ssh is not enabled for app: 'my_app', please run below 2 shell commands to enable ssh and try again(please note application should be restarted before take effect):\ncf enable-ssh my_app\ncf restart my_app"))
+					Expect(cliOutput).To(ContainSubstring(" please run below 2 shell commands to enable ssh and try again(please note application should be restarted before take effect):|cf enable-ssh my_app|cf restart my_app|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+
+				})
+
+			})
+
+			Context("when the heap dump does not fit into the local directory", func() {
+
+				It("keeps the heap dump in the container", func() {
+
+					pluginUtil.LocalDiskFull = true
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-ld", "/tmp"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(Equal("Not enough space in the local directory /tmp for /tmp/java_pid0_0.hprof: it requires 2.0G, but only 1.0G are available. Please free up space, or download it into another directory."))
+					Expect(cliOutput).To(ContainSubstring("|The heap dump is kept in the app container, to download it once there is enough space, run: cf java download my_app /tmp/java_pid0_0.hprof -local-dir .|"))
+					Expect(cliOutput).NotTo(ContainSubstring("Removed"))
+				})
+
+			})
+
+			Context("when the download fails midway", func() {
+
+				It("resumes the download", func() {
+
+					pluginUtil.TransferFails = true
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-ld", "/tmp"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring("The download of /tmp/java_pid0_0.hprof failed midway, resuming it: error occured during copying dump file: /tmp/java_pid0_0.hprof, chunk 2/3 could not be verified after 3 attempts, please try again.|"))
+					Expect(cliOutput).To(ContainSubstring("|Heap dump file saved to: /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof|"))
+				})
+
+			})
+
+			Context("with the --keep flag", func() {
+
+				It("keeps the heap-dump on the container", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-i", "4", "-k"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("Successfully created heap dump in application container at: " + pluginUtil.Fspath + "/" + pluginUtil.OutputFileName + "|Heap dump will not be copied as parameter `local-dir` was not set|Heap dump file kept in app container, run `cf java remote-clean my_app` to remove the files left behind by this plugin|To fetch it later, run: cf java download my_app -i 4 " + pluginUtil.Fspath + "/" + pluginUtil.OutputFileName + " -local-dir .|"))
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh",
+						"my_app",
+						"--app-instance-index",
+						"4",
+						"--command",
+						KeepaliveCommand + "; if ! pgrep -x \"java\" > /dev/null; then echo \"No 'java' process found running. Are you sure this is a Java app?\" >&2; exit 1; fi; if [ -f /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 'Heap dump /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof already exists'; exit 1; fi; JMAP_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jmap app/.java-buildpack/*/bin/jmap /layers/*/jre/bin/jmap /layers/*/jdk/bin/jmap; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jmap) | head -1 | tr -d [:space:]`; JVMMON_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jvmmon app/.java-buildpack/*/bin/jvmmon /layers/*/jre/bin/jvmmon /layers/*/jdk/bin/jvmmon; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jvmmon) | head -1 | tr -d [:space:]`; JCMD_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jcmd app/.java-buildpack/*/bin/jcmd /layers/*/jre/bin/jcmd /layers/*/jdk/bin/jcmd; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jcmd) | head -1 | tr -d [:space:]`; JATTACH_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jattach app/.java-buildpack/*/bin/jattach /layers/*/jre/bin/jattach /layers/*/jdk/bin/jattach; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jattach) | head -1 | tr -d [:space:]`; if [ -n \"${JMAP_COMMAND}\" ]; then true; OUTPUT=$( ${JMAP_COMMAND} -dump:format=b,file=/tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof $(pidof java) ) || STATUS_CODE=$?; if [ ! -s /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 ${OUTPUT}; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi; elif [ -n \"${JVMMON_COMMAND}\" ]; then true; mkdir -p /tmp/cf-java-" + pluginUtil.UUID + "; echo -e 'change command line flag flags=-XX:HeapDumpOnDemandPath=/tmp/cf-java-" + pluginUtil.UUID + "\ndump heap' > /tmp/cf-java-" + pluginUtil.UUID + "/setHeapDumpOnDemandPath.sh; OUTPUT=$( ${JVMMON_COMMAND} -pid $(pidof java) -cmd \"/tmp/cf-java-" + pluginUtil.UUID + "/setHeapDumpOnDemandPath.sh\" ) || STATUS_CODE=$?; sleep 5; HEAP_DUMP_NAME=`find /tmp/cf-java-" + pluginUtil.UUID + " -name 'java_pid*.hprof' -printf '%T@ %p\\0' | sort -zk 1nr | sed -z 's/^[^ ]* //' | tr '\\0' '\\n' | head -n 1`; SIZE=-1; OLD_SIZE=$(stat -c '%s' \"${HEAP_DUMP_NAME}\"); while [ ${SIZE} != ${OLD_SIZE} ]; do OLD_SIZE=${SIZE}; sleep 3; SIZE=$(stat -c '%s' \"${HEAP_DUMP_NAME}\"); done; if [ ! -s \"${HEAP_DUMP_NAME}\" ]; then echo >&2 ${OUTPUT}; rm -rf /tmp/cf-java-" + pluginUtil.UUID + "; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; rm -rf /tmp/cf-java-" + pluginUtil.UUID + "; exit ${STATUS_CODE}; fi; mv \"${HEAP_DUMP_NAME}\" /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof; rm -rf /tmp/cf-java-" + pluginUtil.UUID + "; elif [ -n \"${JCMD_COMMAND}\" ]; then true; OUTPUT=$( ${JCMD_COMMAND} $(pidof java) GC.heap_dump /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ) || STATUS_CODE=$?; if [ ! -s /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 ${OUTPUT}; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi; elif [ -n \"${JATTACH_COMMAND}\" ]; then true; OUTPUT=$( ${JATTACH_COMMAND} $(pidof java) dumpheap /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ) || STATUS_CODE=$?; if [ ! -s /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 ${OUTPUT}; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi; else echo >&2 'jmap, jvmmon, jcmd or jattach is required for generating heap dumps, please make sure that the app runs on a full JDK'; exit 1; fi"}))
+
+				})
+
+			})
+
+			Context("with an invalid --limit-rate value", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "--local-dir", "/valid/path", "--limit-rate", "fast"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Invalid value \"fast\" for the flag \"limit-rate\""))
+					Expect(cliOutput).To(ContainSubstring("Invalid value \"fast\" for the flag \"limit-rate\""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("with a valid --limit-rate value", func() {
+
+				It("downloads the heap dump", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "--local-dir", "/valid/path", "--limit-rate", "2M"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring("Heap dump file saved to: /valid/path/my_app-heapdump-" + pluginUtil.UUID + ".hprof|Heap dump file verified: HPROF 1.0.2, 1M, 42 records|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				})
+
+			})
+
+			Context("with the --no-uuid flag", func() {
+
+				It("names the heap dump after the app only and replaces the previous one", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-nu", "-ld", "/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring("Heap dump file saved to: /valid/path/my_app-heapdump.hprof|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(HavePrefix(KeepaliveCommand + "; " + JavaDetectionCommand + "; rm -f /tmp/my_app-heapdump.hprof; "))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(ContainSubstring("-dump:format=b,file=/tmp/my_app-heapdump.hprof "))
+				})
+
+			})
+
+			Context("with the --organize flag", func() {
+
+				var localDir string
+
+				BeforeEach(func() {
+					now = func() time.Time { return time.Date(2024, time.June, 1, 12, 30, 5, 0, time.UTC) }
+					localDir = filepath.Join(os.TempDir(), "cf-java-organize-"+uuidGenerator.Generate())
+					// The fake download creates no directories
+					Expect(os.MkdirAll(filepath.Join(localDir, "my_app", "0", "2024-06-01"), 0755)).To(Succeed())
+				})
+
+				AfterEach(func() {
+					now = time.Now
+					os.RemoveAll(localDir)
+				})
+
+				It("downloads the heap dump into the directory of the app, instance and day and links it as latest", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-og", "-ld", localDir})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring("Heap dump file saved to: " + filepath.Join(localDir, "my_app", "0", "2024-06-01", "my_app-heapdump-"+pluginUtil.UUID+".hprof") + "|"))
+
+					target, err := os.Readlink(filepath.Join(localDir, "my_app", "latest"))
+					Expect(err).To(BeNil())
+					Expect(target).To(Equal(filepath.Join("0", "2024-06-01", "my_app-heapdump-"+pluginUtil.UUID+".hprof")))
+				})
+
+				It("requires the flag local-dir", func() {
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-og"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(Equal("The flag \"organize\" requires the flag \"local-dir\", the directory to organize the downloaded files in"))
+				})
+
+			})
+
+			Context("with the --timestamp flag", func() {
+
+				BeforeEach(func() {
+					now = func() time.Time { return time.Date(2024, time.June, 1, 12, 30, 5, 0, time.UTC) }
+				})
+
+				AfterEach(func() {
+					now = time.Now
+				})
+
+				It("includes the time in the name of the heap dump", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-ts", "iso", "-ld", "/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring("Heap dump file saved to: /valid/path/my_app-heapdump-20240601T123005Z-" + pluginUtil.UUID + ".hprof|"))
+				})
+
+				It("supports strftime-like formats", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-ts", "%Y-%m-%d_%H%M", "-nu", "-ld", "/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring("Heap dump file saved to: /valid/path/my_app-heapdump-2024-06-01_1230.hprof|"))
+				})
+
+				It("outputs an error for an unsupported directive", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-ts", "%Q"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Invalid value \"%Q\" for the flag \"timestamp\": unsupported directive %Q"))
+					Expect(cliOutput).To(ContainSubstring("unsupported directive %Q"))
+				})
+
+			})
+
+			Context("with the --progress flag", func() {
+
+				var events *bytes.Buffer
+
+				BeforeEach(func() {
+					events = &bytes.Buffer{}
+					subject = &JavaPlugin{stderr: events}
+					now = func() time.Time { return time.Date(2024, time.June, 1, 12, 30, 5, 0, time.UTC) }
+				})
+
+				AfterEach(func() {
+					now = time.Now
+				})
+
+				It("emits the steps as JSON lines", func() {
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-ld", "/valid/path", "-progress", "json"})
+						return output, err
+					})
+
+					remoteFile := pluginUtil.Fspath + "/" + pluginUtil.OutputFileName
+					localFile := "/valid/path/my_app-heapdump-" + pluginUtil.UUID + ".hprof"
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(strings.Split(strings.TrimSpace(events.String()), "\n")).To(Equal([]string{
+						`{"time":"2024-06-01T12:30:05Z","event":"step-started","step":"heap-dump"}`,
+						`{"time":"2024-06-01T12:30:05Z","event":"step-completed","step":"heap-dump"}`,
+						`{"time":"2024-06-01T12:30:05Z","event":"step-started","step":"download","file":"` + remoteFile + `"}`,
+						`{"time":"2024-06-01T12:30:05Z","event":"step-completed","step":"download","file":"` + remoteFile + `"}`,
+						`{"time":"2024-06-01T12:30:05Z","event":"step-started","step":"validate","file":"` + localFile + `"}`,
+						`{"time":"2024-06-01T12:30:05Z","event":"step-completed","step":"validate","file":"` + localFile + `"}`,
+						`{"time":"2024-06-01T12:30:05Z","event":"step-started","step":"delete","file":"` + remoteFile + `"}`,
+						`{"time":"2024-06-01T12:30:05Z","event":"step-completed","step":"delete","file":"` + remoteFile + `"}`,
+					}))
+				})
+
+				It("reports the step that failed", func() {
+
+					pluginUtil.HeapDumpCorrupt = true
+
+					_, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-ld", "/valid/path", "-progress", "json"})
+						return output, err
+					})
+
+					Expect(err).NotTo(BeNil())
+					Expect(events.String()).To(HaveSuffix(`"event":"step-failed","step":"validate","file":"/valid/path/my_app-heapdump-` + pluginUtil.UUID + `.hprof","message":"` + err.Error() + `"}` + "\n"))
+				})
+
+				It("outputs an error for an unsupported format", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-progress", "xml"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Invalid value \"xml\" for the flag \"progress\": expected json"))
+					Expect(cliOutput).To(ContainSubstring("Invalid value \"xml\" for the flag \"progress\": expected json"))
+					Expect(events.String()).To(BeEmpty())
+				})
+
+			})
+
+			Context("with the --redact flag", func() {
+
+				It("redacts the downloaded heap dump", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-ld", "/valid/path", "-redact"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring("Heap dump file verified: HPROF 1.0.2, 1M, 42 records|Heap dump file redacted: the contents of 7 char and byte arrays were zeroed|Heap dump file deleted in app container|"))
+				})
+
+				It("outputs an error without the --local-dir flag", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-redact"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The flag \"redact\" requires the flag \"local-dir\""))
+					Expect(cliOutput).To(ContainSubstring("The flag \"redact\" requires the flag \"local-dir\""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("with CF_TRACE set to true", func() {
+
+				BeforeEach(func() {
+					os.Setenv("CF_TRACE", "true")
+				})
+
+				AfterEach(func() {
+					os.Unsetenv("CF_TRACE")
+				})
+
+				It("creates and downloads the heap dump", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-ld", "/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring("Heap dump file saved to: /valid/path/my_app-heapdump-" + pluginUtil.UUID + ".hprof"))
+				})
+
+			})
+
+			Context("with the --output flag", func() {
+
+				It("writes the heap dump to stdout and the messages to stderr", func() {
+
+					stderr := os.Stderr
+					messages, err := os.CreateTemp("", "stderr-")
+					Expect(err).To(BeNil())
+					defer os.Remove(messages.Name())
+					os.Stderr = messages
+					defer func() { os.Stderr = stderr }()
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-output", "-"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("JAVA PROFILE 1.0.2"))
+
+					written, err := os.ReadFile(messages.Name())
+					Expect(err).To(BeNil())
+					Expect(string(written)).To(ContainSubstring("Successfully created heap dump in application container at: /tmp/java_pid0_0.hprof\nHeap dump written to stdout\nHeap dump file deleted in app container\n"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[:3]).To(Equal([]string{"ssh", "my_app", "--command"}))
+				})
+
+				It("outputs an error with a file", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-output", "dump.hprof"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(Equal("The flag \"output\" of heap-dump only takes \"-\", to write the heap dump to stdout"))
+					Expect(cliOutput).To(ContainSubstring("The flag \"output\" of heap-dump only takes \"-\""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+				It("outputs an error with the --local-dir flag", func() {
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-output", "-", "-ld", "/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(Equal("The flags \"output\" and \"local-dir\" cannot be used together"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("for an app with a known version", func() {
+
+				It("labels the heap dump with the version", func() {
+					pluginUtil.AppVersion = "3f5893f0a1b2c3d4e5f60718293a4b5c6d7e8f90"
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-nu", "-ld", "/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(HavePrefix("App version: 3f5893f0a1b2c3d4e5f60718293a4b5c6d7e8f90|"))
+					Expect(cliOutput).To(ContainSubstring("Heap dump file saved to: /valid/path/my_app-heapdump-3f5893f0a1b2.hprof|"))
+				})
+
+			})
+
+			Context("with defaults in environment variables", func() {
+
+				AfterEach(func() {
+					os.Unsetenv("CF_JAVA_LOCAL_DIR")
+					os.Unsetenv("CF_JAVA_KEEP")
+				})
+
+				It("uses them for the flags not set on the command line", func() {
+					os.Setenv("CF_JAVA_LOCAL_DIR", "/valid/path")
+					os.Setenv("CF_JAVA_KEEP", "true")
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "--local-dir", "/other/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring("Heap dump file saved to: /other/path/my_app-heapdump-" + pluginUtil.UUID + ".hprof|"))
+					Expect(cliOutput).To(ContainSubstring("Heap dump file kept in app container"))
+				})
+
+				It("outputs an error for an invalid boolean value", func() {
+					os.Setenv("CF_JAVA_KEEP", "maybe")
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Invalid value \"maybe\" for the environment variable CF_JAVA_KEEP"))
+					Expect(cliOutput).To(ContainSubstring("Invalid value \"maybe\" for the environment variable CF_JAVA_KEEP"))
+				})
+
+			})
+
+			Context("with the --dry-run flag", func() {
+
+				It("prints out the command line without executing the command", func() {
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "heap-dump", "my_app", "-i", "4", "-k", "-n"})
+						return output, err
+					})
+					expectedOutput := "cf ssh my_app --app-instance-index 4 --command '" + KeepaliveCommand + "; if ! pgrep -x \"java\" > /dev/null; then echo \"No 'java' process found running. Are you sure this is a Java app?\" >&2; exit 1; fi; if [ -f /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 'Heap dump /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof already exists'; exit 1; fi; JMAP_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jmap app/.java-buildpack/*/bin/jmap /layers/*/jre/bin/jmap /layers/*/jdk/bin/jmap; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jmap) | head -1 | tr -d [:space:]`; JVMMON_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jvmmon app/.java-buildpack/*/bin/jvmmon /layers/*/jre/bin/jvmmon /layers/*/jdk/bin/jvmmon; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jvmmon) | head -1 | tr -d [:space:]`; JCMD_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jcmd app/.java-buildpack/*/bin/jcmd /layers/*/jre/bin/jcmd /layers/*/jdk/bin/jcmd; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jcmd) | head -1 | tr -d [:space:]`; JATTACH_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jattach app/.java-buildpack/*/bin/jattach /layers/*/jre/bin/jattach /layers/*/jdk/bin/jattach; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jattach) | head -1 | tr -d [:space:]`; if [ -n \"${JMAP_COMMAND}\" ]; then true; OUTPUT=$( ${JMAP_COMMAND} -dump:format=b,file=/tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof $(pidof java) ) || STATUS_CODE=$?; if [ ! -s /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 ${OUTPUT}; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi; elif [ -n \"${JVMMON_COMMAND}\" ]; then true; mkdir -p /tmp/cf-java-" + pluginUtil.UUID + "; echo -e 'change command line flag flags=-XX:HeapDumpOnDemandPath=/tmp/cf-java-" + pluginUtil.UUID + "\ndump heap' > /tmp/cf-java-" + pluginUtil.UUID + "/setHeapDumpOnDemandPath.sh; OUTPUT=$( ${JVMMON_COMMAND} -pid $(pidof java) -cmd \"/tmp/cf-java-" + pluginUtil.UUID + "/setHeapDumpOnDemandPath.sh\" ) || STATUS_CODE=$?; sleep 5; HEAP_DUMP_NAME=`find /tmp/cf-java-" + pluginUtil.UUID + " -name 'java_pid*.hprof' -printf '%T@ %p\\0' | sort -zk 1nr | sed -z 's/^[^ ]* //' | tr '\\0' " +
+						"'\\n' | head -n 1`; SIZE=-1; OLD_SIZE=$(stat -c '%s' \"${HEAP_DUMP_NAME}\"); while [ ${SIZE} != ${OLD_SIZE} ]; do OLD_SIZE=${SIZE}; sleep 3; SIZE=$(stat -c '%s' \"${HEAP_DUMP_NAME}\"); done; if [ ! -s \"${HEAP_DUMP_NAME}\" ]; then echo >&2 ${OUTPUT}; rm -rf /tmp/cf-java-" + pluginUtil.UUID + "; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; rm -rf /tmp/cf-java-" + pluginUtil.UUID + "; exit ${STATUS_CODE}; fi; mv \"${HEAP_DUMP_NAME}\" /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof; rm -rf /tmp/cf-java-" + pluginUtil.UUID + "; elif [ -n \"${JCMD_COMMAND}\" ]; then true; OUTPUT=$( ${JCMD_COMMAND} $(pidof java) GC.heap_dump /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ) || STATUS_CODE=$?; if [ ! -s /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 ${OUTPUT}; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi; elif [ -n \"${JATTACH_COMMAND}\" ]; then true; OUTPUT=$( ${JATTACH_COMMAND} $(pidof java) dumpheap /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ) || STATUS_CODE=$?; if [ ! -s /tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof ]; then echo >&2 ${OUTPUT}; exit 1; fi; if [ ${STATUS_CODE:-0} -gt 0 ]; then echo >&2 ${OUTPUT}; exit ${STATUS_CODE}; fi; else echo >&2 'jmap, jvmmon, jcmd or jattach is required for generating heap dumps, please make sure that the app runs on a full JDK'; exit 1; fi'"
+
+					Expect(output).To(Equal(expectedOutput))
+
+					Expect(err).To(BeNil())
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to control the logging of the JVM", func() {
+
+			Context("with the --what flag", func() {
+
+				It("invokes cf ssh to enable logging into the file", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "vm-log", "my_app", "-what", "gc*=debug", "-output", "/tmp/gc.log"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("The JVM logs into /tmp/gc.log in the app container, run `cf java vm-log my_app -disable -output /tmp/gc.log -local-dir .` to stop logging and fetch the log|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--command", JavaDetectionCommand + "; " +
+						"JCMD_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jcmd app/.java-buildpack/*/bin/jcmd /layers/*/jre/bin/jcmd /layers/*/jdk/bin/jcmd; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jcmd) | head -1 | tr -d [:space:]`; " +
+						"if [ -z \"${JCMD_COMMAND}\" ]; then echo >&2 'jcmd is required for controlling the logging of the JVM, please make sure that the app runs on a full JDK'; exit 1; fi; " +
+						"${JCMD_COMMAND} $(pidof java) VM.log 'output=/tmp/gc.log' 'what=gc*=debug'"}))
+				})
+
+			})
+
+			Context("with values holding quotes and shell syntax", func() {
+
+				It("passes them quoted to jcmd", func() {
+
+					_, err, _ := captureOutput(func() (string, error) {
+						return subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "vm-log", "my_app", "-what", "gc\"; rm -rf /; echo \"", "-output", "/tmp/it's $(id).log"})
+					})
+
+					Expect(err).To(BeNil())
+					Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(HaveSuffix("${JCMD_COMMAND} $(pidof java) VM.log 'output=/tmp/it'\\''s $(id).log' 'what=gc\"; rm -rf /; echo \"'"))
+				})
+
+			})
+
+			Context("with the --disable and --local-dir flags", func() {
+
+				It("disables logging into the default file, then fetches and removes it", func() {
+
+					pluginUtil.RemoteFile = "/tmp/my_app-vm.log"
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "vm-log", "my_app", "-disable", "-local-dir", "/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("File /tmp/my_app-vm.log saved to: /valid/path/my_app-vm.log|File /tmp/my_app-vm.log deleted in app container|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(HaveSuffix("${JCMD_COMMAND} $(pidof java) VM.log 'output=/tmp/my_app-vm.log' what=all=off"))
+				})
+
+			})
+
+			Context("with both the --what and --disable flags", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "vm-log", "my_app", "-what", "gc=debug", "-disable"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The flags \"what\" and \"disable\" cannot be used together"))
+					Expect(cliOutput).To(ContainSubstring("The flags \"what\" and \"disable\" cannot be used together"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("for an app running on OpenJ9", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					pluginUtil.Runtime = utils.RuntimeOpenJ9
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "vm-log", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("can only be controlled on HotSpot-based JVMs"))
+					Expect(cliOutput).To(ContainSubstring("can only be controlled on HotSpot-based JVMs"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to get the GC logs", func() {
+
+			BeforeEach(func() {
+				pluginUtil.GCLogs = []string{"/home/vcap/app/gc-*.log"}
+				pluginUtil.RemoteFile = "/home/vcap/app/gc-2024-06-01_12-30-05.log"
+			})
+
+			Context("with just the app name", func() {
+
+				It("invokes cf ssh to list the GC log files", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "gc-logs", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal(""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--command", "ls -l /home/vcap/app/gc-2024-06-01_12-30-05.log"}))
+				})
+
+			})
+
+			Context("with the --follow flag", func() {
+
+				It("invokes cf ssh to tail the GC log files", func() {
+
+					streaming := &fakeStreamingExecutor{FakeCommandExecutor: commandExecutor}
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(streaming, uuidGenerator, pluginUtil, []string{"java", "gc-logs", "my_app", "-i", "2", "-follow"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal(""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "2", "--command", "tail -f /home/vcap/app/gc-2024-06-01_12-30-05.log"}))
+					Expect(streaming.calls).To(Equal(1))
+				})
+
+			})
+
+			Context("with the --local-dir flag", func() {
+
+				It("downloads the GC log files", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "gc-logs", "my_app", "-local-dir", "/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("File /home/vcap/app/gc-2024-06-01_12-30-05.log saved to: /valid/path/gc-2024-06-01_12-30-05.log|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("with the --archive flag", func() {
+
+				var localDir string
+
+				BeforeEach(func() {
+					var err error
+					localDir, err = os.MkdirTemp("", "gc-logs-")
+					Expect(err).To(BeNil())
+					// The fake does not copy anything, so the downloaded file is there already
+					Expect(os.WriteFile(filepath.Join(localDir, "gc-2024-06-01_12-30-05.log"), []byte("[0.010s][info][gc] Using G1\n"), 0644)).To(Succeed())
+					now = func() time.Time { return time.Date(2024, time.June, 1, 12, 30, 5, 0, time.UTC) }
+				})
+
+				AfterEach(func() {
+					now = time.Now
+					os.RemoveAll(localDir)
+				})
+
+				It("packs the GC log files into a zip archive", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "gc-logs", "my_app", "-local-dir", localDir, "-archive"})
+						return output, err
+					})
+
+					archive := filepath.Join(localDir, "my_app-gc-logs-20240601T123005Z.zip")
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(HaveSuffix("|Files archived to: " + archive + "|"))
+					Expect(archive).To(BeARegularFile())
+					Expect(filepath.Join(localDir, "gc-2024-06-01_12-30-05.log")).NotTo(BeAnExistingFile())
+				})
+
+				It("outputs an error without the --local-dir flag", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "gc-logs", "my_app", "-archive"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The flag \"archive\" requires the flag \"local-dir\""))
+					Expect(cliOutput).To(ContainSubstring("The flag \"archive\" requires the flag \"local-dir\""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("for an app without GC log files", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					pluginUtil.GCLogs = nil
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "gc-logs", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("No GC log file found in the container"))
+					Expect(cliOutput).To(ContainSubstring("`cf java vm-log my_app -what 'gc*=info'`"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to get the crash reports", func() {
+
+			Context("with just the app name", func() {
+
+				It("invokes cf ssh to list the hs_err and replay files", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "crash-report", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal(""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--command", "for D in /tmp /home/vcap/app; do if [ -d ${D} ]; then find ${D} -maxdepth 1 -type f \\( -name 'hs_err_pid*.log' -o -name 'replay_pid*.log' \\) -exec ls -l {} \\;; fi; done"}))
+				})
+
+			})
+
+			Context("with the --local-dir flag", func() {
+
+				It("downloads the newest hs_err file", func() {
+
+					pluginUtil.RemoteFile = "/home/vcap/app/hs_err_pid42.log"
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "crash-report", "my_app", "-local-dir", "/valid/path", "-delete"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("File /home/vcap/app/hs_err_pid42.log saved to: /valid/path/hs_err_pid42.log|File /home/vcap/app/hs_err_pid42.log deleted in app container|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+				It("outputs an error if there is no hs_err file", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "crash-report", "my_app", "-local-dir", "/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("No hs_err file found in the application container in /tmp, /home/vcap/app"))
+					Expect(cliOutput).To(ContainSubstring("No hs_err file found in the application container in /tmp, /home/vcap/app"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to attach a Java agent", func() {
+
+			var agentJar string
+
+			BeforeEach(func() {
+				file, err := os.CreateTemp("", "agent-*.jar")
+				Expect(err).To(BeNil())
+				Expect(file.Close()).To(Succeed())
+				agentJar = file.Name()
+			})
+
+			AfterEach(func() {
+				os.Remove(agentJar)
+			})
+
+			Context("with the --jar and --options flags", func() {
+
+				It("uploads the agent jar and invokes cf ssh to load it", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "attach-agent", "my_app", "-jar", agentJar, "-options", "port=8778,host=127.0.0.1"})
+						return output, err
+					})
+
+					remoteJar := "/tmp/" + filepath.Base(agentJar)
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("Agent jar uploaded to: " + remoteJar + "|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--command", JavaDetectionCommand + "; " +
+						"JCMD_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jcmd app/.java-buildpack/*/bin/jcmd /layers/*/jre/bin/jcmd /layers/*/jdk/bin/jcmd; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jcmd) | head -1 | tr -d [:space:]`; " +
+						"if [ -z \"${JCMD_COMMAND}\" ]; then echo >&2 'jcmd is required for loading Java agents, please make sure that the app runs on a full JDK'; exit 1; fi; " +
+						"${JCMD_COMMAND} $(pidof java) JVMTI.agent_load '" + remoteJar + "' 'port=8778,host=127.0.0.1'"}))
+				})
+
+			})
+
+			Context("with options holding quotes and shell syntax", func() {
+
+				It("passes them quoted to jcmd", func() {
+
+					_, err, _ := captureOutput(func() (string, error) {
+						return subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "attach-agent", "my_app", "-jar", agentJar, "-options", "token=$SECRET,name=\"it's\";id"})
+					})
+
+					Expect(err).To(BeNil())
+					Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(HaveSuffix("JVMTI.agent_load '/tmp/" + filepath.Base(agentJar) + "' 'token=$SECRET,name=\"it'\\''s\";id'"))
+				})
+
+			})
+
+			Context("without the --jar flag", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "attach-agent", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("No agent jar provided"))
+					Expect(cliOutput).To(ContainSubstring("No agent jar provided"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("with a jar that does not exist", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "attach-agent", "my_app", "-jar", "/not/there/agent.jar"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The agent jar /not/there/agent.jar cannot be read"))
+					Expect(cliOutput).To(ContainSubstring("The agent jar /not/there/agent.jar cannot be read"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to access the JVM with Jolokia", func() {
+
+			var agentJar string
+
+			BeforeEach(func() {
+				file, err := os.CreateTemp("", "jolokia-*.jar")
+				Expect(err).To(BeNil())
+				Expect(file.Close()).To(Succeed())
+				agentJar = file.Name()
+			})
+
+			AfterEach(func() {
+				os.Remove(agentJar)
+			})
+
+			Context("with the --jar and --local-port flags", func() {
+
+				It("loads the agent and forwards its port", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "jolokia", "my_app", "-i", "1", "-jar", agentJar, "-local-port", "9778"})
+						return output, err
+					})
+
+					remoteJar := "/tmp/" + filepath.Base(agentJar)
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("Agent jar uploaded to: " + remoteJar + "|Jolokia is available at http://localhost:9778/jolokia/ until interrupted with Ctrl+C|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(2))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[5]).To(HaveSuffix("${JCMD_COMMAND} $(pidof java) JVMTI.agent_load '" + remoteJar + "' 'port=8778,host=127.0.0.1'"))
+					Expect(commandExecutor.ExecuteArgsForCall(1)).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "1", "-N", "-L", "9778:localhost:8778"}))
+				})
+
+			})
+
+			Context("with the --dry-run flag", func() {
+
+				It("prints the commands loading the Jolokia agent and forwarding its port", func() {
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "jolokia", "my_app", "-n", "-options", "user=admin"})
+						return output, err
+					})
+
+					Expect(err).To(BeNil())
+					Expect(output).To(HaveSuffix(" JVMTI.agent_load '/tmp/" + filepath.Base(jolokiaAgentURL) + "' 'port=8778,host=127.0.0.1,user=admin''\ncf ssh my_app -N -L 8778:localhost:8778"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("with an invalid --local-port value", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "jolokia", "my_app", "-local-port", "http"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Invalid value \"http\" for the flag \"local-port\": expected a port number"))
+					Expect(cliOutput).To(ContainSubstring("Invalid value \"http\" for the flag \"local-port\": expected a port number"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to compare class histograms", func() {
+
+			var slept time.Duration
+
+			BeforeEach(func() {
+				pluginUtil.ClassHistogram = " num     #instances         #bytes  class name (module)\n" +
+					"-------------------------------------------------------\n" +
+					"   1:          2000         400000  [B (java.base@17.0.2)\n" +
+					"   2:          1500          36000  java.lang.String (java.base@17.0.2)\n" +
+					"   3:           100           3200  com.example.Session\n" +
+					"Total          3600         439200"
+				slept = 0
+				sleep = func(d time.Duration) { slept = d }
+			})
+
+			AfterEach(func() {
+				sleep = time.Sleep
+			})
+
+			Context("with the --interval flag", func() {
+
+				It("takes two class histograms the interval apart", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "histo-diff", "my_app", "-interval", "5m"})
+						return output, err
+					})
+
+					Expect(err).To(BeNil())
+					Expect(output).To(Equal("No class grew between the class histograms"))
+					Expect(cliOutput).To(HavePrefix("Taking the second class histogram in 5m0s|"))
+					Expect(slept).To(Equal(5 * time.Minute))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("with the --baseline flag", func() {
+
+				var baseline string
+
+				BeforeEach(func() {
+					file, err := os.CreateTemp("", "histo-*.txt")
+					Expect(err).To(BeNil())
+					_, err = file.WriteString("   1:          1000         200000  [B (java.base@17.0.2)\n" +
+						"   2:          1500          36000  java.lang.String (java.base@17.0.2)\n")
+					Expect(err).To(BeNil())
+					Expect(file.Close()).To(Succeed())
+					baseline = file.Name()
+				})
+
+				AfterEach(func() {
+					os.Remove(baseline)
+				})
+
+				It("prints the classes that grew since the baseline, the biggest growth first", func() {
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "histo-diff", "my_app", "-baseline", baseline})
+						return output, err
+					})
+
+					Expect(err).To(BeNil())
+					Expect(output).To(Equal("  #instances         #bytes  class name\n" +
+						"       +1000        +200000  [B\n" +
+						"        +100          +3200  com.example.Session"))
+					Expect(slept).To(BeZero())
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("without jcmd and jmap in the container", func() {
+
+				It("outputs an error", func() {
+
+					pluginUtil.ClassHistogram = ""
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "histo-diff", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("jcmd or jmap is required for creating class histograms"))
+					Expect(cliOutput).To(ContainSubstring("jcmd or jmap is required for creating class histograms"))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to monitor the app", func() {
+
+			BeforeEach(func() {
+				commandExecutor.ExecuteReturns([]string{
+					"TICKS 100",
+					"HEADER S0C S1C S0U S1U EC EU OC OU MC MU CCSC CCSU YGC YGCT FGC FGCT CGC CGCT GCT",
+					"SAMPLE 1717245005 1000 200 42 0.0 1024.0 0.0 512.0 8192.0 4096.0 16384.0 2048.0 0.0 0.0 0.0 0.0 10 0.100 0 0.000 2 0.010 0.110",
+					"SAMPLE 1717245015 1300 400 44 0.0 1024.0 0.0 1024.0 8192.0 1024.0 16384.0 4096.0 0.0 0.0 0.0 0.0 12 0.120 0 0.000 2 0.010 0.130",
+				}, nil)
+			})
+
+			Context("with just the app name", func() {
+
+				It("samples the metrics in one ssh session and prints them as CSV", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "monitor", "my_app"})
+						return output, err
+					})
+
+					Expect(err).To(BeNil())
+					Expect(output).To(Equal("timestamp,heap_used_bytes,heap_committed_bytes,gc_count,gc_time_seconds,threads,cpu_percent\n" +
+						"2024-06-01T12:30:05Z,6815744,26214400,12,0.110,42,\n" +
+						"2024-06-01T12:30:15Z,6291456,26214400,14,0.130,44,50.0"))
+					Expect(cliOutput).To(HavePrefix("Sampling the metrics of the JVM every 10s for 5m0s|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(ContainSubstring("END=$(( $(date +%s) + 300 ))"))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(HaveSuffix("; sleep 10; done"))
+				})
+
+			})
+
+			Context("with the --out flag", func() {
+
+				var out string
+
+				BeforeEach(func() {
+					out = filepath.Join(os.TempDir(), "cf-java-metrics-"+uuidGenerator.Generate()+".csv")
+				})
+
+				AfterEach(func() {
+					os.Remove(out)
+				})
+
+				It("writes the metrics into the local file", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "monitor", "my_app", "-duration", "30m", "-interval", "5s", "-out", out})
+						return output, err
+					})
+
+					Expect(err).To(BeNil())
+					Expect(output).To(BeEmpty())
+					Expect(cliOutput).To(Equal("Sampling the metrics of the JVM every 5s for 30m0s|2 samples saved to: " + out + "|"))
+
+					content, err := os.ReadFile(out)
+					Expect(err).To(BeNil())
+					Expect(string(content)).To(HavePrefix("timestamp,heap_used_bytes,"))
+					Expect(strings.Count(string(content), "\n")).To(Equal(3))
+
+					Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(ContainSubstring("END=$(( $(date +%s) + 1800 ))"))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(HaveSuffix("; sleep 5; done"))
+				})
+
+			})
+
+			Context("with the --alert flag", func() {
+
+				It("outputs a warning for each rule breached and an error", func() {
+
+					commandExecutor.ExecuteReturns([]string{
+						"TICKS 100",
+						"MAXHEAP 33554432",
+						"HEADER S0C S1C S0U S1U EC EU OC OU MC MU CCSC CCSU YGC YGCT FGC FGCT CGC CGCT GCT",
+						"SAMPLE 1717245005 1000 200 42 0.0 1024.0 0.0 512.0 8192.0 4096.0 16384.0 2048.0 0.0 0.0 0.0 0.0 10 0.100 0 0.000 2 0.010 0.110",
+						"SAMPLE 1717245015 1300 400 44 0.0 1024.0 0.0 1024.0 8192.0 1024.0 16384.0 4096.0 0.0 0.0 0.0 0.0 12 0.120 0 0.000 2 0.010 0.130",
+					}, nil)
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "monitor", "my_app", "-alert", "heap>20%,threads>43,cpu>60%"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(Equal("2 of 3 alert rules breached"))
+					Expect(cliOutput).To(ContainSubstring("2024-06-01T12:30:15Z,6291456,26214400,14,0.130,44,50.0|"))
+					Expect(cliOutput).To(ContainSubstring("|Alert heap>20% breached at 2024-06-01T12:30:05Z: 20.3% of the maximum heap|Alert threads>43 breached at 2024-06-01T12:30:15Z: 44 threads|"))
+					Expect(cliOutput).NotTo(ContainSubstring("Alert cpu>60%"))
+				})
+
+				It("outputs an error for an invalid rule and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "monitor", "my_app", "-alert", "heap<90%"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Invalid alert rule \"heap<90%\": expected METRIC>THRESHOLD, e.g., heap>90%"))
+					Expect(cliOutput).To(ContainSubstring("Invalid alert rule \"heap<90%\""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("with an invalid interval", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "monitor", "my_app", "-interval", "500ms"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Invalid value \"500ms\" for the flag \"interval\": expected at least one second"))
+					Expect(cliOutput).To(ContainSubstring("Invalid value \"500ms\" for the flag \"interval\": expected at least one second"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("for an OpenJ9 JVM", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					pluginUtil.Runtime = utils.RuntimeOpenJ9
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "monitor", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("jstat can only sample HotSpot-based JVMs"))
+					Expect(cliOutput).To(ContainSubstring("jstat can only sample HotSpot-based JVMs"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to watch for an OutOfMemoryError", func() {
+
+			Context("with the --local-dir flag", func() {
+
+				It("waits for a heap dump in one ssh session and downloads it", func() {
+
+					pluginUtil.RemoteFile = "/tmp/java_pid42.hprof"
+					commandExecutor.ExecuteReturns([]string{"Watching the JVM for an OutOfMemoryError or a crash, until interrupted with Ctrl+C", "FOUND /tmp/java_pid42.hprof"}, nil)
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "watch-oom", "my_app", "-local-dir", "/valid/path", "-delete"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("The JVM wrote /tmp/java_pid42.hprof, downloading before the container is recycled|" +
+						"File /tmp/java_pid42.hprof saved to: /valid/path/java_pid42.hprof|" +
+						"Heap dump file verified: HPROF 1.0.2, 1M, 42 records|" +
+						"File /tmp/java_pid42.hprof deleted in app container|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					remoteCommand := commandExecutor.ExecuteArgsForCall(0)[3]
+					Expect(remoteCommand).To(ContainSubstring("touch /tmp/.cf-java-watch-" + pluginUtil.UUID + ";"))
+					Expect(remoteCommand).To(ContainSubstring("find /tmp /home/vcap/app -maxdepth 1 -type f -newer /tmp/.cf-java-watch-" + pluginUtil.UUID + " \\( -name 'java_pid*.hprof' -o -name 'hs_err_pid*.log' -o -name 'heapdump.*.phd' -o -name 'javacore.*.txt' \\)"))
+					Expect(remoteCommand).To(ContainSubstring("${JSTACK_COMMAND} ${PID} > /tmp/my_app-threaddump-" + pluginUtil.UUID + ".txt"))
+				})
+
+			})
+
+			Context("for a GraalVM native image", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					pluginUtil.Runtime = utils.RuntimeNativeImage
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "watch-oom", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("GraalVM native images write no heap dump upon an OutOfMemoryError"))
+					Expect(cliOutput).To(ContainSubstring("GraalVM native images write no heap dump upon an OutOfMemoryError"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to checkpoint the JVM with CRaC", func() {
+
+			It("checks the CRaC options and checkpoints the JVM with jcmd", func() {
+
+				pluginUtil.InstanceCount = 2
+				commandExecutor.ExecuteReturns([]string{"Checkpointing the JVM into /home/vcap/crac"}, nil)
+
+				output, err, cliOutput := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "checkpoint", "my_app", "-i", "1"})
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(output).To(ContainSubstring("Cloud Foundry restarts the app instance in a new container"))
+				Expect(output).To(ContainSubstring("check `cf logs my_app --recent` for the result of the checkpoint"))
+				Expect(cliOutput).To(HavePrefix("Checkpointing the JVM into /home/vcap/crac|"))
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				remoteCommand := commandExecutor.ExecuteArgsForCall(0)[5]
+				Expect(remoteCommand).To(HavePrefix(KeepaliveCommand + "; " + JavaDetectionCommand + "; JCMD_COMMAND="))
+				Expect(remoteCommand).To(ContainSubstring("CRAC_DIR=`${JCMD_COMMAND} $(pidof java) VM.command_line | grep -o -- '-XX:CRaCCheckpointTo=[^ ]*' | head -1 | cut -d = -f 2`; " +
+					"if [ -z \"${CRAC_DIR}\" ]; then echo >&2 'The JVM was not started with -XX:CRaCCheckpointTo, add it to JAVA_OPTS on a JDK with CRaC, like SapMachine, and restart the app'; exit 1; fi"))
+				Expect(remoteCommand).To(HaveSuffix("; ${JCMD_COMMAND} $(pidof java) JDK.checkpoint"))
+			})
+
+			It("takes the session ending with the JVM as expected", func() {
+
+				pluginUtil.InstanceCount = 2
+				commandExecutor.ExecuteReturns([]string{"Checkpointing the JVM into /home/vcap/crac", "error: unexpected EOF"}, errors.New("exit status 1"))
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "checkpoint", "my_app"})
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(output).To(ContainSubstring("The JVM stops once the checkpoint is written"))
+			})
+
+			It("refuses to stop the only running instance without -force", func() {
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "checkpoint", "my_app"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err.Error()).To(ContainSubstring("Checkpointing stops the JVM, and my_app has no other running instance to serve requests until Cloud Foundry restarts it, run with -force to checkpoint anyway"))
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+			})
+
+			It("stops the only running instance with -force", func() {
+
+				_, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "checkpoint", "my_app", "-force"})
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+			})
+
+			It("prints the CRaC options and the checkpoint directory", func() {
+
+				commandExecutor.ExecuteReturns([]string{"-XX:CRaCCheckpointTo=/home/vcap/crac", "Checkpoint directory /home/vcap/crac:", "(empty)"}, nil)
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "crac-status", "my_app"})
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(output).To(Equal("-XX:CRaCCheckpointTo=/home/vcap/crac\nCheckpoint directory /home/vcap/crac:\n(empty)"))
+				Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(ContainSubstring("if [ -z \"${CRAC_DIR}\" ]; then echo 'CRaC is not enabled: the JVM was not started with -XX:CRaCCheckpointTo'; exit 0; fi"))
+			})
+
+			It("outputs an error on OpenJ9", func() {
+
+				pluginUtil.Runtime = utils.RuntimeOpenJ9
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "checkpoint", "my_app", "-force"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err.Error()).To(ContainSubstring("CRaC is only available on HotSpot-based JVMs like SapMachine"))
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+			})
+
+		})
+
+		Context("when invoked to dump a CDS archive", func() {
+
+			It("dumps a static archive with jcmd and downloads it", func() {
+
+				pluginUtil.RemoteFile = "/tmp/my_app-cds-" + pluginUtil.UUID + ".jsa"
+
+				output, err, cliOutput := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "cds", "my_app", "-ld", "/valid/path"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err).To(BeNil())
+				Expect(cliOutput).To(ContainSubstring("Successfully created the file /tmp/my_app-cds-" + pluginUtil.UUID + ".jsa in the app container|File /tmp/my_app-cds-" + pluginUtil.UUID + ".jsa saved to: /valid/path/my_app-cds-" + pluginUtil.UUID + ".jsa|File /tmp/my_app-cds-" + pluginUtil.UUID + ".jsa deleted in app container|"))
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				remoteCommand := commandExecutor.ExecuteArgsForCall(0)[3]
+				Expect(remoteCommand).To(ContainSubstring("echo 'Archives in use:'; ${JCMD_COMMAND} $(pidof java) VM.command_line | grep -o -- '-XX:\\(SharedArchiveFile\\|AOTCache\\|ArchiveClassesAtExit\\|AOTMode\\)=[^ ]*'"))
+				Expect(remoteCommand).To(ContainSubstring("OUTPUT=$( ${JCMD_COMMAND} $(pidof java) VM.cds static_dump /tmp/my_app-cds-" + pluginUtil.UUID + ".jsa ) || STATUS_CODE=$?; if [ ! -s /tmp/my_app-cds-" + pluginUtil.UUID + ".jsa ]; then echo >&2 ${OUTPUT}; exit 1; fi"))
+			})
+
+			It("dumps a dynamic archive with the --dynamic flag", func() {
+
+				_, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "cds", "my_app", "-dynamic", "-keep"})
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(ContainSubstring("VM.cds dynamic_dump /tmp/my_app-cds-" + pluginUtil.UUID + ".jsa"))
+			})
+
+			It("outputs an error on OpenJ9", func() {
+
+				pluginUtil.Runtime = utils.RuntimeOpenJ9
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "cds", "my_app"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err.Error()).To(ContainSubstring("CDS archives can only be dumped at runtime by HotSpot-based JVMs like OpenJDK and SapMachine"))
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+			})
+
+		})
+
+		Context("when invoked to list the files in the container", func() {
+
+			Context("with just the app name", func() {
+
+				It("lists the files created by the plugin", func() {
+					pluginUtil.Fspath = "/var/fspath"
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "remote-list", "my_app", "-i", "2"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "2", "--command",
+						"find /var/fspath -maxdepth 1 -type f \\( -name '*-heapdump*.hprof' -o -name '*-heapdump*.phd' -o -name 'java_pid*.hprof' \\) -exec ls -l {} \\;; " +
+							"find /tmp -maxdepth 1 -type f \\( -name '*-heapdump*.hprof' -o -name '*-heapdump*.phd' -o -name 'java_pid*.hprof' \\) -exec ls -l {} \\;"}))
+				})
+
+			})
+
+			Context("with the container directory auto:largest", func() {
+
+				It("lists the files in the directory with the most free space", func() {
+					pluginUtil.Fspath = "/var/dumps"
+					pluginUtil.Container_path_valid = false
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "remote-list", "my_app", "-cd", "auto:largest"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--command",
+						"find /var/dumps -maxdepth 1 -type f \\( -name '*-heapdump*.hprof' -o -name '*-heapdump*.phd' -o -name 'java_pid*.hprof' \\) -exec ls -l {} \\;; " +
+							"find /tmp -maxdepth 1 -type f \\( -name '*-heapdump*.hprof' -o -name '*-heapdump*.phd' -o -name 'java_pid*.hprof' \\) -exec ls -l {} \\;"}))
+				})
+
+			})
+
+			Context("with the --verbose flag", func() {
+
+				It("reports the directory chosen in the container", func() {
+					pluginUtil.Fspath = "/home/vcap/tmp"
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "remote-list", "my_app", "-v"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("Instances of my_app:|  #0 RUNNING, up 0s|Using the container directory /home/vcap/tmp|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				})
+
+				It("reports the state, uptime and memory of each instance before running", func() {
+					pluginUtil.Instances = []utils.InstanceInfo{
+						{Index: 0, State: "CRASHED"},
+						{Index: 1, State: "RUNNING", Uptime: 2*time.Hour + 3*time.Minute, MemoryQuota: 1024 * 1024 * 1024, MemoryUsage: 320 * 1024 * 1024},
+						{Index: 2, State: "STARTING", MemoryQuota: 1024 * 1024 * 1024, MemoryUsage: 64 * 1024 * 1024},
+					}
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "remote-list", "my_app", "-v", "-i", "1"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(HavePrefix("Instances of my_app:|  #0 CRASHED|  #1 RUNNING, up 2h3m0s, memory 320M of 1G|  #2 STARTING, memory 64M of 1G|"))
+				})
+
+			})
+
+			Context("with the --local-dir flag", func() {
+
+				It("fails", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "remote-list", "my_app", "--local-dir", "/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The flag \"local-dir\" is not supported for remote-list"))
+					Expect(cliOutput).To(ContainSubstring("The flag \"local-dir\" is not supported for remote-list"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to clean up the container", func() {
+
+			Context("without application name", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "remote-clean"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("No application name provided"))
+					Expect(cliOutput).To(ContainSubstring("No application name provided"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("with just the app name", func() {
+
+				It("removes all the files created by the plugin", func() {
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "remote-clean", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--command",
+						"find /tmp -maxdepth 1 -type f \\( -name '*-heapdump*.hprof' -o -name '*-heapdump*.phd' -o -name 'java_pid*.hprof' \\) -print -exec rm -f {} \\;"}))
+				})
+
+			})
+
+			Context("with the --older-than flag", func() {
+
+				It("removes only the files older than the given age", func() {
+					pluginUtil.Fspath = "/var/fspath"
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "remote-clean", "my_app", "-i", "1", "--older-than", "7d"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "1", "--command",
+						"find /var/fspath -maxdepth 1 -type f \\( -name '*-heapdump*.hprof' -o -name '*-heapdump*.phd' -o -name 'java_pid*.hprof' \\) -mmin +10080 -print -exec rm -f {} \\;; " +
+							"find /tmp -maxdepth 1 -type f \\( -name '*-heapdump*.hprof' -o -name '*-heapdump*.phd' -o -name 'java_pid*.hprof' \\) -mmin +10080 -print -exec rm -f {} \\;"}))
+				})
+
+				It("outputs an error for an invalid age", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "remote-clean", "my_app", "--older-than", "a week"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Invalid value \"a week\" for the flag \"older-than\""))
+					Expect(cliOutput).To(ContainSubstring("Invalid value \"a week\" for the flag \"older-than\""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("with the --keep flag", func() {
+
+				It("fails", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "remote-clean", "my_app", "-k"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The flag \"keep\" is not supported for remote-clean"))
+					Expect(cliOutput).To(ContainSubstring("The flag \"keep\" is not supported for remote-clean"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to download a file from the container", func() {
+
+			BeforeEach(func() {
+				pluginUtil.RemoteFile = "/tmp/my_app-heapdump-" + pluginUtil.UUID + ".hprof"
+			})
+
+			Context("without remote file", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "download", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("No remote file provided"))
+					Expect(cliOutput).To(ContainSubstring("No remote file provided"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("with a pattern matching a file", func() {
+
+				It("downloads the file and keeps it in the container", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "download", "my_app", "/tmp/my_app-heapdump-*", "--local-dir", "/valid/path"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("File " + pluginUtil.RemoteFile + " saved to: /valid/path/my_app-heapdump-" + pluginUtil.UUID + ".hprof|Heap dump file verified: HPROF 1.0.2, 1M, 42 records|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+				It("deletes the file in the container with the --delete flag", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "download", "my_app", "/tmp/my_app-heapdump-*", "--delete"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("File " + pluginUtil.RemoteFile + " saved to: ./my_app-heapdump-" + pluginUtil.UUID + ".hprof|Heap dump file verified: HPROF 1.0.2, 1M, 42 records|File " + pluginUtil.RemoteFile + " deleted in app container|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("with a pattern matching no file", func() {
+
+				It("outputs an error", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "download", "my_app", "/home/vcap/*.jfr"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("No file matching /home/vcap/*.jfr found in application container"))
+					Expect(cliOutput).To(ContainSubstring("No file matching /home/vcap/*.jfr found in application container"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to copy a file from the container", func() {
+
+			BeforeEach(func() {
+				pluginUtil.RemoteFile = "/home/vcap/app/logs/app.log"
+			})
+
+			Context("without local path", func() {
+
+				It("copies the file into the working directory", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "cp", "my_app", "/home/vcap/app/logs/app.log", "-i", "1"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("File /home/vcap/app/logs/app.log saved to: app.log|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("with a local path", func() {
+
+				It("copies the file into the local file", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "cp", "my_app", "/home/vcap/app/logs/app.log", "/valid/path/my_app.log"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("File /home/vcap/app/logs/app.log saved to: /valid/path/my_app.log|"))
+				})
+
+				It("copies the file into the local directory", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "cp", "my_app", "/home/vcap/app/logs/app.log", "/valid/path/", "-delete"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("File /home/vcap/app/logs/app.log saved to: /valid/path/app.log|File /home/vcap/app/logs/app.log deleted in app container|"))
+				})
+
+				It("outputs an error for too many arguments", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "cp", "my_app", "/home/vcap/app/logs/app.log", "app.log", "other.log"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Too many arguments provided: other.log"))
+					Expect(cliOutput).To(ContainSubstring("Too many arguments provided: other.log"))
+				})
+
+			})
+
+			Context("without remote file", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "cp", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("No remote file provided"))
+					Expect(cliOutput).To(ContainSubstring("No remote file provided"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to upload a file into the container", func() {
+
+			var localFile string
+
+			BeforeEach(func() {
+				file, err := os.CreateTemp("", "profile-*.jfc")
+				Expect(err).To(BeNil())
+				file.WriteString("<configuration version=\"2.0\"/>")
+				file.Close()
+				localFile = file.Name()
+			})
+
+			AfterEach(func() {
+				os.Remove(localFile)
+			})
+
+			Context("with a remote directory", func() {
+
+				It("uploads the file into it", func() {
+
+					pluginUtil.Fspath = "/var/files"
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "push-file", "my_app", localFile, "/var/files"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal("File " + localFile + " uploaded to: /var/files/" + filepath.Base(localFile) + "|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+				It("outputs an error for a file larger than the limit", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "push-file", "my_app", localFile, "/tmp", "-max-size", "16B"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The local file " + localFile + " is 30B, more than the limit of 16B"))
+					Expect(cliOutput).To(ContainSubstring("more than the limit of 16B"))
+				})
+
+				It("outputs an error for a directory that is not writable", func() {
+
+					pluginUtil.Container_path_valid = false
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "push-file", "my_app", localFile, "/not/writable"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("the container path specified doesn't exist or have no read and write access"))
+					Expect(cliOutput).To(ContainSubstring("the container path specified doesn't exist or have no read and write access"))
+				})
+
+			})
+
+			Context("without remote directory", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "push-file", "my_app", localFile})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("No local file or remote directory provided"))
+					Expect(cliOutput).To(ContainSubstring("No local file or remote directory provided"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to run a command in the container", func() {
+
+			Context("with a command after --", func() {
+
+				It("invokes cf ssh with the PID and the tools exported", func() {
+
+					streaming := &fakeStreamingExecutor{FakeCommandExecutor: commandExecutor}
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(streaming, uuidGenerator, pluginUtil, []string{"java", "exec", "my_app", "-i", "1", "--", "${JCMD_COMMAND}", "${JAVA_PID}", "VM.uptime", "-i"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "1", "--command", KeepaliveCommand + "; " + JavaDetectionCommand + "; export JAVA_PID=$(pidof java); " +
+						"export JCMD_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jcmd app/.java-buildpack/*/bin/jcmd /layers/*/jre/bin/jcmd /layers/*/jdk/bin/jcmd; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jcmd) | head -1 | tr -d [:space:]`; " +
+						"export JMAP_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jmap app/.java-buildpack/*/bin/jmap /layers/*/jre/bin/jmap /layers/*/jdk/bin/jmap; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jmap) | head -1 | tr -d [:space:]`; " +
+						"export JSTACK_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jstack app/.java-buildpack/*/bin/jstack /layers/*/jre/bin/jstack /layers/*/jdk/bin/jstack; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jstack) | head -1 | tr -d [:space:]`; " +
+						"export JSTAT_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jstat app/.java-buildpack/*/bin/jstat /layers/*/jre/bin/jstat /layers/*/jdk/bin/jstat; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jstat) | head -1 | tr -d [:space:]`; " +
+						"export JVMMON_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jvmmon app/.java-buildpack/*/bin/jvmmon /layers/*/jre/bin/jvmmon /layers/*/jdk/bin/jvmmon; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jvmmon) | head -1 | tr -d [:space:]`; " +
+						"export ASPROF_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/asprof app/.java-buildpack/*/bin/asprof /layers/*/jre/bin/asprof /layers/*/jdk/bin/asprof; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name asprof) | head -1 | tr -d [:space:]`; " +
+						"${JCMD_COMMAND} ${JAVA_PID} VM.uptime -i"}))
+					Expect(streaming.calls).To(Equal(1))
+				})
+
+				It("shows the output as it is produced, and not again once the command is done", func() {
+
+					streaming := &fakeStreamingExecutor{FakeCommandExecutor: commandExecutor}
+
+					commandExecutor.ExecuteStub = func(args []string) ([]string, error) {
+						return []string{"1234:", "5.123 s"}, nil
+					}
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(streaming, uuidGenerator, pluginUtil, []string{"java", "exec", "my_app", "--", "${JCMD_COMMAND}", "${JAVA_PID}", "VM.uptime"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+
+					Expect(streaming.calls).To(Equal(1))
+				})
+
+			})
+
+			Context("without a command", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "exec", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("No command provided after \"--\""))
+					Expect(cliOutput).To(ContainSubstring("No command provided after \"--\""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("with a command after -- for another command", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app", "--", "ls"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Unexpected arguments after \"--\": only exec passes a command to the container"))
+					Expect(cliOutput).To(ContainSubstring("Unexpected arguments after \"--\""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to run a custom command", func() {
+
+			var configDir string
+
+			BeforeEach(func() {
+				var err error
+				configDir, err = os.MkdirTemp("", "custom-commands-")
+				Expect(err).To(BeNil())
+				customCommandsFile = func() (string, error) { return filepath.Join(configDir, "cf-java-plugin.yml"), nil }
+				Expect(os.WriteFile(filepath.Join(configDir, "cf-java-plugin.yml"), []byte(`commands:
+- name: class-histogram-all
+  description: Print the class histogram of the JVM, including the unreachable objects
+  command: ${JCMD_COMMAND} ${JAVA_PID} GC.class_histogram @ARGS
+- name: jfr
+  description: Record the JVM with Java Flight Recorder for a minute
+  command: ${JCMD_COMMAND} ${JAVA_PID} JFR.start duration=60s filename=@FILE_NAME && sleep 65
+  generateFiles: true
+  fileExtension: .jfr
+`), 0644)).To(Succeed())
+			})
+
+			AfterEach(func() {
+				customCommandsFile = defaultCustomCommandsFile
+				os.RemoveAll(configDir)
+			})
+
+			It("runs the command like exec, with the arguments inserted", func() {
+
+				streaming := &fakeStreamingExecutor{FakeCommandExecutor: commandExecutor}
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(streaming, uuidGenerator, pluginUtil, []string{"java", "class-histogram-all", "my_app", "-a", "all"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err).To(BeNil())
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(HavePrefix(KeepaliveCommand + "; " + JavaDetectionCommand + "; export JAVA_PID=$(pidof java); export JCMD_COMMAND="))
+				Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(HaveSuffix("; export CF_JAVA_ARGS='all'; ${JCMD_COMMAND} ${JAVA_PID} GC.class_histogram ${CF_JAVA_ARGS}"))
+				Expect(streaming.calls).To(Equal(1))
+			})
+
+			It("joins the arguments of repeated args flags in order", func() {
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "class-histogram-all", "my_app", "-a", "-all -parallel=2", "-args", "-verbose"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err).To(BeNil())
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(HaveSuffix("; export CF_JAVA_ARGS='-all -parallel=2 -verbose'; ${JCMD_COMMAND} ${JAVA_PID} GC.class_histogram ${CF_JAVA_ARGS}"))
+			})
+
+			It("never runs what the arguments contain", func() {
+
+				for _, args := range []string{"; rm -rf / #", "$(reboot)", "`reboot`", "it's", "a' ; reboot ; '", "\\'; reboot"} {
+					commandExecutor = new(FakeCommandExecutor)
+					_, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "class-histogram-all", "my_app", "-a", args})
+						return output, err
+					})
+
+					Expect(err).To(BeNil())
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(HaveSuffix("; export CF_JAVA_ARGS=" + utils.ShellQuote(args) + "; ${JCMD_COMMAND} ${JAVA_PID} GC.class_histogram ${CF_JAVA_ARGS}"))
+				}
+			})
+
+			It("quotes the arguments for the shell", func() {
+
+				Expect(utils.ShellQuote("all")).To(Equal(`'all'`))
+				Expect(utils.ShellQuote("")).To(Equal(`''`))
+				Expect(utils.ShellQuote("; rm -rf / #")).To(Equal(`'; rm -rf / #'`))
+				Expect(utils.ShellQuote("$(reboot) `reboot`")).To(Equal("'$(reboot) `reboot`'"))
+				Expect(utils.ShellQuote("it's")).To(Equal(`'it'\''s'`))
+				Expect(utils.ShellQuote(`a' ; reboot ; '`)).To(Equal(`'a'\'' ; reboot ; '\'''`))
+				Expect(utils.ShellQuote(`\'; reboot`)).To(Equal(`'\'\''; reboot'`))
+			})
+
+			It("passes the arguments after -- as they are typed", func() {
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "class-histogram-all", "my_app", "--", "-all", "two  spaces", "it's; reboot"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err).To(BeNil())
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(HaveSuffix(`; ${JCMD_COMMAND} ${JAVA_PID} GC.class_histogram '-all' 'two  spaces' 'it'\''s; reboot'`))
+				Expect(commandExecutor.ExecuteArgsForCall(0)[3]).NotTo(ContainSubstring("CF_JAVA_ARGS"))
+			})
+
+			It("rejects the arguments after -- together with the flag args", func() {
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "class-histogram-all", "my_app", "-a", "-all", "--", "-all"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err.Error()).To(ContainSubstring("The flag \"args\" and the arguments after \"--\" cannot be used together"))
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+			})
+
+			It("rejects the arguments after -- for commands without @ARGS", func() {
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "jfr", "my_app", "--", "-all"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err.Error()).To(ContainSubstring("Unexpected arguments after \"--\": the command jfr takes none, it has no @ARGS"))
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+			})
+
+			It("downloads and removes the file generated", func() {
+
+				pluginUtil.RemoteFile = "/tmp/my_app-jfr-" + pluginUtil.UUID + ".jfr"
+
+				output, err, cliOutput := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "jfr", "my_app", "-ld", "/valid/path"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err).To(BeNil())
+				Expect(cliOutput).To(ContainSubstring("Successfully created the file /tmp/my_app-jfr-" + pluginUtil.UUID + ".jfr in the app container|File /tmp/my_app-jfr-" + pluginUtil.UUID + ".jfr saved to: /valid/path/my_app-jfr-" + pluginUtil.UUID + ".jfr|File /tmp/my_app-jfr-" + pluginUtil.UUID + ".jfr deleted in app container|"))
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(HaveSuffix("; ${JCMD_COMMAND} ${JAVA_PID} JFR.start duration=60s filename=/tmp/my_app-jfr-" + pluginUtil.UUID + ".jfr && sleep 65; if [ ! -s /tmp/my_app-jfr-" + pluginUtil.UUID + ".jfr ]; then echo >&2 'The command jfr wrote no file /tmp/my_app-jfr-" + pluginUtil.UUID + ".jfr'; exit 1; fi"))
+			})
+
+			It("lists the commands in the usage", func() {
+
+				Expect(subject.GetMetadata().Commands[0].UsageDetails.Usage).To(ContainSubstring("|class-histogram-all|jfr] APP_NAME"))
+			})
+
+			It("rejects the flags of file downloads for commands generating no file", func() {
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "class-histogram-all", "my_app", "-ld", "/valid/path"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err.Error()).To(Equal("The flag \"local-dir\" is not supported for class-histogram-all"))
+			})
+
+			It("ignores a broken definition and keeps the commands of the plugin working", func() {
+
+				Expect(os.WriteFile(filepath.Join(configDir, "cf-java-plugin.yml"), []byte("commands:\n- name: heap-dump\n  command: jmap\n"), 0644)).To(Succeed())
+
+				output, err, cliOutput := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err).To(BeNil())
+				Expect(cliOutput).To(HavePrefix("Ignoring the custom commands in " + filepath.Join(configDir, "cf-java-plugin.yml") + ": the command \"heap-dump\" would replace the command of the plugin with the same name|"))
+			})
+
+		})
+
+		Context("when invoked to check the custom commands", func() {
+
+			var configFile string
+
+			BeforeEach(func() {
+				configFile = filepath.Join(os.TempDir(), "cf-java-plugin-"+uuidGenerator.Generate()+".yml")
+			})
+
+			AfterEach(func() {
+				os.Remove(configFile)
+			})
+
+			It("reports the problems of the definitions", func() {
+
+				Expect(os.WriteFile(configFile, []byte(`commands:
+- name: jfr
+  command: ${JCMD_COMMAND} ${JAVA_PID} JFR.start filename=@FILE
+  generateFiles: true
+- name: flags
+  command: ${JINFO_COMMAND} -flags ${JAVA_PID} | grep '@ARGS
+  fileExtension: .txt
+`), 0644)).To(Succeed())
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "lint-commands", configFile})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err.Error()).To(Equal("6 problems found in the custom commands in " + configFile + ":\n" +
+					"jfr: unknown placeholder @FILE, supported are @FILE_NAME and @ARGS\n" +
+					"jfr: generateFiles without fileExtension, the file would have none\n" +
+					"jfr: generateFiles without @FILE_NAME in the command, which names the file to write\n" +
+					"flags: unknown variable JINFO_COMMAND, the paths of jcmd, jmap, jstack, jstat, jvmmon, asprof are exported\n" +
+					"flags: fileExtension without generateFiles, it would not be used\n" +
+					"flags: unbalanced single quote in the command"))
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+			})
+
+			It("accepts valid definitions", func() {
+
+				Expect(os.WriteFile(configFile, []byte(`commands:
+- name: jfr
+  command: ${JCMD_COMMAND} ${JAVA_PID} JFR.start duration=60s filename=@FILE_NAME && sleep 65
+  generateFiles: true
+  fileExtension: .jfr
+- name: flags
+  command: ${JCMD_COMMAND} ${JAVA_PID} VM.flags | grep "@ARGS"
+`), 0644)).To(Succeed())
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "lint-commands", configFile})
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(output).To(Equal("2 custom commands defined in " + configFile + ", no problems found"))
+			})
+
+		})
+
+		Context("when invoked to open a shell in the container", func() {
+
+			It("invokes cf ssh with a pseudo-tty and the tools on the PATH", func() {
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "ssh", "my_app", "-i", "1"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err).To(BeNil())
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				sshArguments := commandExecutor.ExecuteArgsForCall(0)
+				Expect(sshArguments[:6]).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "1", "--request-pseudo-tty", "--command"}))
+				Expect(sshArguments[6]).To(HavePrefix(JavaDetectionCommand + "; export JAVA_PID=$(pidof java); "))
+				Expect(sshArguments[6]).To(ContainSubstring("for TOOL in ${ASPROF_COMMAND} ${JCMD_COMMAND}; do PATH=$(cd $(dirname ${TOOL}) && pwd):${PATH}; done; export PATH; "))
+				Expect(sshArguments[6]).To(HaveSuffix("if command -v bash > /dev/null; then exec bash; fi; exec sh"))
+			})
+
+		})
+
+		Context("when invoked to locate the Java tools", func() {
+
+			It("prints the resolved paths of the java binary and the tools", func() {
+
+				commandExecutor.ExecuteReturns([]string{"java: /home/vcap/app/.java-buildpack/open_jdk_jre/bin/java", "jcmd: /home/vcap/app/.java-buildpack/open_jdk_jre/bin/jcmd", "asprof: not found"}, nil)
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "where-is", "my_app"})
+					return output, err
+				})
+
+				Expect(output).To(Equal("java: /home/vcap/app/.java-buildpack/open_jdk_jre/bin/java\njcmd: /home/vcap/app/.java-buildpack/open_jdk_jre/bin/jcmd\nasprof: not found"))
+				Expect(err).To(BeNil())
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--command", JavaDetectionCommand + "; echo \"java: $(readlink -f /proc/$(pidof java)/exe)\"; " +
+					"TOOL=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jcmd app/.java-buildpack/*/bin/jcmd /layers/*/jre/bin/jcmd /layers/*/jdk/bin/jcmd; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jcmd) | head -1 | tr -d [:space:]`; if [ -n \"${TOOL}\" ]; then echo \"jcmd: $(readlink -f ${TOOL})\"; else echo 'jcmd: not found'; fi; " +
+					"TOOL=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jmap app/.java-buildpack/*/bin/jmap /layers/*/jre/bin/jmap /layers/*/jdk/bin/jmap; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jmap) | head -1 | tr -d [:space:]`; if [ -n \"${TOOL}\" ]; then echo \"jmap: $(readlink -f ${TOOL})\"; else echo 'jmap: not found'; fi; " +
+					"TOOL=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jstack app/.java-buildpack/*/bin/jstack /layers/*/jre/bin/jstack /layers/*/jdk/bin/jstack; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jstack) | head -1 | tr -d [:space:]`; if [ -n \"${TOOL}\" ]; then echo \"jstack: $(readlink -f ${TOOL})\"; else echo 'jstack: not found'; fi; " +
+					"TOOL=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jstat app/.java-buildpack/*/bin/jstat /layers/*/jre/bin/jstat /layers/*/jdk/bin/jstat; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jstat) | head -1 | tr -d [:space:]`; if [ -n \"${TOOL}\" ]; then echo \"jstat: $(readlink -f ${TOOL})\"; else echo 'jstat: not found'; fi; " +
+					"TOOL=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jvmmon app/.java-buildpack/*/bin/jvmmon /layers/*/jre/bin/jvmmon /layers/*/jdk/bin/jvmmon; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jvmmon) | head -1 | tr -d [:space:]`; if [ -n \"${TOOL}\" ]; then echo \"jvmmon: $(readlink -f ${TOOL})\"; else echo 'jvmmon: not found'; fi; " +
+					"TOOL=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/asprof app/.java-buildpack/*/bin/asprof /layers/*/jre/bin/asprof /layers/*/jdk/bin/asprof; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name asprof) | head -1 | tr -d [:space:]`; if [ -n \"${TOOL}\" ]; then echo \"asprof: $(readlink -f ${TOOL})\"; else echo 'asprof: not found'; fi"}))
+			})
+
+			Context("on all instances", func() {
+
+				BeforeEach(func() {
+					pluginUtil.InstanceCount = 3
+				})
+
+				It("prefixes the output of each instance and summarizes", func() {
+
+					commandExecutor.ExecuteStub = func(args []string) ([]string, error) {
+						if args[2] == "--app-instance-index" {
+							return []string{"java: /layers/jre/bin/java", "jcmd: not found"}, nil
+						}
+						return []string{"java: /home/vcap/app/.java-buildpack/open_jdk_jre/bin/java", "jcmd: not found"}, nil
+					}
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "where-is", "my_app", "-all-instances"})
+						return output, err
+					})
+
+					Expect(err).To(BeNil())
+					Expect(output).To(Equal("[inst 0] java: /home/vcap/app/.java-buildpack/open_jdk_jre/bin/java\n[inst 0] jcmd: not found\n" +
+						"[inst 1] java: /layers/jre/bin/java\n[inst 1] jcmd: not found\n" +
+						"[inst 2] java: /layers/jre/bin/java\n[inst 2] jcmd: not found\n" +
+						"\n" +
+						"where-is ran on 3 instances of my_app: 3 succeeded"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(3))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[:3]).To(Equal([]string{"ssh", "my_app", "--command"}))
+					Expect(commandExecutor.ExecuteArgsForCall(1)[:5]).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "1", "--command"}))
+					Expect(commandExecutor.ExecuteArgsForCall(2)[:5]).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "2", "--command"}))
+				})
+
+				It("keeps the output of exec until it is prefixed, instead of streaming it", func() {
+
+					streaming := &fakeStreamingExecutor{FakeCommandExecutor: commandExecutor}
+
+					commandExecutor.ExecuteStub = func(args []string) ([]string, error) {
+						return []string{"5.123 s"}, nil
+					}
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(streaming, uuidGenerator, pluginUtil, []string{"java", "exec", "my_app", "-all-instances", "--", "${JCMD_COMMAND}", "${JAVA_PID}", "VM.uptime"})
+						return output, err
+					})
+
+					Expect(err).To(BeNil())
+					Expect(output).To(Equal("[inst 0] 5.123 s\n[inst 1] 5.123 s\n[inst 2] 5.123 s\n\nexec ran on 3 instances of my_app: 3 succeeded"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(3))
+					Expect(streaming.calls).To(Equal(0))
+				})
+
+				It("runs on the other instances when one fails, and fails at the end", func() {
+
+					commandExecutor.ExecuteStub = func(args []string) ([]string, error) {
+						if args[2] == "--app-instance-index" && args[3] == "1" {
+							return []string{"No 'java' process found running. Are you sure this is a Java app?"}, errors.New("exit status 1")
+						}
+						return []string{"java: /layers/jre/bin/java"}, nil
+					}
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "where-is", "my_app", "-ai"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(Equal("where-is ran on 3 instances of my_app: 2 succeeded, failed on instance 1"))
+					Expect(cliOutput).To(ContainSubstring("[inst 0] java: /layers/jre/bin/java|[inst 1] failed: "))
+					Expect(cliOutput).To(ContainSubstring("[inst 2] java: /layers/jre/bin/java"))
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(3))
+				})
+
+				It("cannot be combined with an instance", func() {
+
+					_, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "where-is", "my_app", "-all-instances", "-i", "1"})
+						return output, err
+					})
+
+					Expect(err.Error()).To(Equal("The flags \"all-instances\" and \"app-instance-index\" cannot be used together"))
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+				It("is overridden by an instance on the command line when enabled in the environment", func() {
+
+					os.Setenv("CF_JAVA_ALL_INSTANCES", "true")
+					defer os.Unsetenv("CF_JAVA_ALL_INSTANCES")
+
+					_, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "where-is", "my_app", "-i", "2"})
+						return output, err
+					})
+
+					Expect(err).To(BeNil())
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)[:4]).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "2"}))
+				})
+
+			})
+
+			Context("with a droplet", func() {
+
+				var cacheDir string
+
+				BeforeEach(func() {
+					var err error
+					cacheDir, err = os.MkdirTemp("", "tool-cache-")
+					Expect(err).To(BeNil())
+					toolCacheFile = func() (string, error) { return filepath.Join(cacheDir, "tools.json"), nil }
+					pluginUtil.DropletGUID = "droplet-guid"
+					pluginUtil.ToolPaths = map[string]string{"jcmd": "./app/jdk/bin/jcmd"}
+				})
+
+				AfterEach(func() {
+					toolCacheFile = defaultToolCacheFile
+					os.RemoveAll(cacheDir)
+				})
+
+				It("caches the paths of the tools and reuses them", func() {
+
+					_, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "where-is", "my_app"})
+						return output, err
+					})
+					Expect(err).To(BeNil())
+
+					pluginUtil.ToolPaths = map[string]string{"jcmd": "./other/jdk/bin/jcmd"}
+					_, err, _ = captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "where-is", "my_app"})
+						return output, err
+					})
+					Expect(err).To(BeNil())
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(2))
+					for i := 0; i < 2; i++ {
+						remoteCommand := commandExecutor.ExecuteArgsForCall(i)[3]
+						Expect(remoteCommand).To(ContainSubstring("TOOL=`echo './app/jdk/bin/jcmd' | head -1 | tr -d [:space:]`; "))
+						Expect(remoteCommand).To(ContainSubstring("TOOL=`true | head -1 | tr -d [:space:]`; "))
+						Expect(remoteCommand).NotTo(ContainSubstring("find -executable"))
+					}
+
+					cache, err := os.ReadFile(filepath.Join(cacheDir, "tools.json"))
+					Expect(err).To(BeNil())
+					Expect(string(cache)).To(ContainSubstring("\"my_app-guid/droplet-guid/0\""))
+				})
+
+				It("looks for the tools again with --no-cache", func() {
+
+					_, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "where-is", "my_app"})
+						return output, err
+					})
+					Expect(err).To(BeNil())
+
+					pluginUtil.ToolPaths = map[string]string{"jcmd": "./other/jdk/bin/jcmd"}
+					_, err, _ = captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "where-is", "my_app", "-no-cache"})
+						return output, err
+					})
+					Expect(err).To(BeNil())
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(2))
+					Expect(commandExecutor.ExecuteArgsForCall(1)[3]).To(ContainSubstring("TOOL=`echo './other/jdk/bin/jcmd' | head -1 | tr -d [:space:]`; "))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to report the runtime", func() {
+
+			It("combines the droplet, the JVM and the environment of the app", func() {
+
+				pluginUtil.Droplet = utils.DropletInfo{
+					Stack:        "cflinuxfs4",
+					Buildpacks:   []utils.Buildpack{{Name: "java_buildpack", BuildpackName: "java", Version: "v4.69.0"}},
+					ProcessTypes: map[string]string{"web": "JAVA_OPTS=\"-Djava.io.tmpdir=$TMPDIR\" && CALCULATED_MEMORY=$($PWD/.java-buildpack/open_jdk_jre/bin/java-buildpack-memory-calculator-3.13.0_RELEASE -totMemory=$MEMORY_LIMIT -loadedClasses=14335 -poolType=metaspace -stackThreads=250 -vmOptions=\"$JAVA_OPTS\") && echo JVM Memory Configuration: $CALCULATED_MEMORY"},
+				}
+				pluginUtil.AppEnvironment = map[string]string{"JBP_CONFIG_OPEN_JDK_JRE": "{ jre: { version: 17.+ } }", "JAVA_OPTS": "-Xss512k", "SPRING_PROFILES_ACTIVE": "cloud"}
+				commandExecutor.ExecuteReturns([]string{"JVM: /home/vcap/app/.java-buildpack/open_jdk_jre/bin/java", "   openjdk version \"17.0.9\" 2023-10-17", "Memory limit: 1024m", "JVM memory options: -Xmx455M -Xss512k "}, nil)
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "runtime-info", "my_app"})
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(output).To(Equal("Stack: cflinuxfs4\n" +
+					"Buildpack: java v4.69.0 (java_buildpack)\n" +
+					"JVM: /home/vcap/app/.java-buildpack/open_jdk_jre/bin/java\n" +
+					"   openjdk version \"17.0.9\" 2023-10-17\n" +
+					"Memory limit: 1024m\n" +
+					"JVM memory options: -Xmx455M -Xss512k \n" +
+					"Memory calculator: java-buildpack-memory-calculator-3.13.0_RELEASE -totMemory=$MEMORY_LIMIT -loadedClasses=14335 -poolType=metaspace -stackThreads=250 -vmOptions=\"$JAVA_OPTS\"\n" +
+					"JAVA_OPTS: -Xss512k\n" +
+					"JBP_CONFIG_OPEN_JDK_JRE: { jre: { version: 17.+ } }"))
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--command", JavaDetectionCommand + "; JAVA_BINARY=$(readlink -f /proc/$(pidof java)/exe); echo \"JVM: ${JAVA_BINARY}\"; " +
+					"env -u JAVA_TOOL_OPTIONS -u JDK_JAVA_OPTIONS ${JAVA_BINARY} -version 2>&1 | sed 's/^/   /'; echo \"Memory limit: ${MEMORY_LIMIT:-not set}\"; " +
+					"echo \"JVM memory options: $(tr '\\0' '\\n' < /proc/$(pidof java)/cmdline | grep -E -- '" + jvmMemoryOptionsPattern + "' | tr '\\n' ' ')\""}))
+			})
+
+			It("tells when the app has no buildpack and no memory calculator", func() {
+
+				pluginUtil.Droplet = utils.DropletInfo{ProcessTypes: map[string]string{"web": "java -jar app.jar"}}
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "runtime-info", "my_app"})
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(output).To(HavePrefix("Buildpack: none, the app runs a Docker image\n"))
+				Expect(output).To(HaveSuffix("Memory calculator: not run by the start command\nJBP_CONFIG_* and JAVA_OPTS: none set"))
+			})
+
+		})
+
+		Context("when invoked to advise on the memory settings", func() {
+
+			It("reports the settings and suggests adjustments", func() {
+
+				commandExecutor.ExecuteReturns([]string{
+					"LIMIT 1024m",
+					"CGROUP 1073741824",
+					"FLAGS -XX:MaxHeapSize=268435456 -XX:ReservedCodeCacheSize=251658240 -XX:ThreadStackSize=1024 -XX:+UseSerialGC ",
+					"THREADS 320",
+					"sun.gc.generation.0.space.0.used=52428800",
+					"sun.gc.generation.1.space.0.used=41943040",
+					"sun.gc.metaspace.used=94371840",
+				}, nil)
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "memory-advise", "my_app"})
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(output).To(Equal("Memory limit:     1G\n" +
+					"Heap:             90M used of at most 256M\n" +
+					"Metaspace:        90M used of at most unlimited\n" +
+					"Code cache:       240M\n" +
+					"Thread stacks:    320 threads of 1M\n" +
+					"Direct memory:    up to the maximum heap, MaxDirectMemorySize is not set\n" +
+					"Footprint:        up to 970M, estimated\n" +
+					"\n" +
+					"Suggestions:\n" +
+					"- The heap may take only 25% of the memory limit, and the rest goes unused by most apps: give it more with -XX:MaxRAMPercentage=70 in JAVA_TOOL_OPTIONS\n" +
+					"- The metaspace is unbounded, so a class loader leak takes all memory of the container: bound it with -XX:MaxMetaspaceSize=135M in JAVA_TOOL_OPTIONS\n" +
+					"- The JVM runs 320 threads, more than the 250 the memory calculator of the Java buildpack reserves stack memory for by default: set JBP_CONFIG_OPEN_JDK_JRE to '{ memory_calculator: { stack_threads: 400 } }'\n" +
+					"- The stacks of the 320 threads may take 320M: unless the app recurses deeply, smaller stacks, e.g., -Xss512k in JAVA_TOOL_OPTIONS, leave more memory for the heap"))
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(ContainSubstring("; echo \"FLAGS $(${JCMD_COMMAND} $(pidof java) VM.flags | tr ' ' '\\n' | grep '^-XX:' | tr '\\n' ' ')\"; "))
+			})
+
+			It("warns when the JVM may exceed the memory limit", func() {
+
+				commandExecutor.ExecuteReturns([]string{
+					"LIMIT ",
+					"CGROUP 1073741824",
+					"FLAGS -XX:MaxHeapSize=805306368 -XX:MaxMetaspaceSize=134217728 -XX:ReservedCodeCacheSize=251658240 -XX:ThreadStackSize=1024 -XX:MaxDirectMemorySize=10485760",
+					"THREADS 50",
+					"sun.gc.generation.0.space.0.used=419430400",
+					"sun.gc.metaspace.used=62914560",
+				}, nil)
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "memory-advise", "my_app"})
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(output).To(ContainSubstring("Memory limit:     1G\n"))
+				Expect(output).To(HaveSuffix("Suggestions:\n" +
+					"- The JVM may use up to 1.2G, more than the memory limit of 1G, and be killed by the container: lower the maximum heap with -Xmx532M in JAVA_TOOL_OPTIONS, or raise the memory with `cf scale my_app -m 1260M`"))
+			})
+
+			It("fails without the maximum heap size", func() {
+
+				commandExecutor.ExecuteReturns([]string{"LIMIT 1024m", "FLAGS "}, nil)
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "memory-advise", "my_app"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err.Error()).To(Equal("The maximum heap size could not be read from the flags of the JVM"))
+			})
+
+			It("refuses OpenJ9", func() {
+
+				pluginUtil.Runtime = utils.RuntimeOpenJ9
+
+				_, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "memory-advise", "my_app"})
+					return output, err
+				})
+
+				Expect(err.Error()).To(Equal("The memory settings can only be read from HotSpot-based JVMs like OpenJDK and SapMachine"))
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+			})
+
+		})
+
+		Context("when invoked to read the history of the SapMachine Vitals", func() {
+
+			vitals := []string{
+				"42:",
+				"Last 60 minutes:",
+				"time,proc-rss-all,jvm-heap-comm,jvm-heap-used,jvm-jthr-num",
+				"2024-06-01 12:30:00,300m,256m,100m,40",
+				"2024-06-01 12:29:50,290m,256m,80m,38",
+				"now,,,,",
+				"Last 10 days:",
+				"time,proc-rss-all,jvm-heap-comm,jvm-heap-used,jvm-jthr-num",
+				"2024-06-01 11:00:00,200m,128m,60m,30",
+			}
+
+			It("charts the samples, oldest first", func() {
+
+				commandExecutor.ExecuteReturns(vitals, nil)
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "vitals-history", "my_app"})
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(output).To(Equal("SapMachine Vitals of my_app: 4 samples from 2024-06-01 11:00:00 to now\n" +
+					"proc-rss-all   ▁▇█  min 200M, max 300M, last 300M\n" +
+					"jvm-heap-comm  ▁██  min 128M, max 256M, last 256M\n" +
+					"jvm-heap-used  ▁▄█  min 60M, max 100M, last 100M\n" +
+					"jvm-jthr-num   ▁▆█  min 30, max 40, last 40"))
+				Expect(commandExecutor.ExecuteArgsForCall(0)[3]).To(ContainSubstring("; ${JCMD_COMMAND} $(pidof java) VM.vitals csv now; "))
+			})
+
+			It("saves the samples as CSV and tells how to download the vitals files", func() {
+
+				commandExecutor.ExecuteReturns(append(vitals, "FOUND /home/vcap/app/vitals.csv"), nil)
+				dir, err := os.MkdirTemp("", "cf-java-plugin-vitals-")
+				Expect(err).To(BeNil())
+				defer os.RemoveAll(dir)
+				out := filepath.Join(dir, "vitals.csv")
+
+				output, err, cliOutput := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "vitals-history", "my_app", "-out", out})
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(output).To(BeEmpty())
+				Expect(cliOutput).To(ContainSubstring("The JVM wrote the vitals file /home/vcap/app/vitals.csv, to download it, run: cf java download my_app /home/vcap/app/vitals.csv -local-dir .|4 samples saved to: " + out))
+				content, err := os.ReadFile(out)
+				Expect(err).To(BeNil())
+				Expect(string(content)).To(Equal("time,proc-rss-all,jvm-heap-comm,jvm-heap-used,jvm-jthr-num\n" +
+					"2024-06-01 11:00:00,200m,128m,60m,30\n" +
+					"2024-06-01 12:29:50,290m,256m,80m,38\n" +
+					"2024-06-01 12:30:00,300m,256m,100m,40\n" +
+					"now,,,,\n"))
+			})
+
+			It("fails when the JVM has no vitals", func() {
+
+				commandExecutor.ExecuteReturns([]string{"42:", "Vitals not available"}, nil)
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "vitals-history", "my_app"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err.Error()).To(Equal("No SapMachine Vitals found in the output of jcmd VM.vitals, please check that the JVM does not run with -XX:-EnableVitals"))
+			})
+
+		})
+
+		Context("when invoked to generate a thread-dump", func() {
+
+			Context("without application name", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("No application name provided"))
+					Expect(cliOutput).To(ContainSubstring("No application name provided"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("with too many arguments", func() {
+
+				It("outputs an error and does not invoke cf ssh", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app", "my_file", "ciao"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Too many arguments provided: my_file, ciao"))
+					Expect(cliOutput).To(ContainSubstring("Too many arguments provided: my_file, ciao"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("when the ssh session breaks off", func() {
+
+				It("reports that the app instance crashed", func() {
+
+					pluginUtil.InstanceState = "CRASHED"
+					commandExecutor.ExecuteReturns(nil, errors.New("Error: unexpected EOF"))
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app", "-i", "1"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The connection to the container broke off with \"unexpected EOF\". The app instance is CRASHED now"))
+					Expect(err.Error()).To(HaveSuffix("To try again, run: cf java thread-dump my_app -i 1"))
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				})
+
+				It("reports an idle timeout if the app instance is still running", func() {
+
+					pluginUtil.InstanceUptime = 24 * time.Hour
+					commandExecutor.ExecuteReturns(nil, errors.New("Error: unexpected EOF"))
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The app instance is still running, so the session was most likely cut by the idle timeout of a load balancer or by the network."))
+				})
+
+			})
+
+			Context("with just the app name", func() {
+
+				It("invokes cf ssh with the basic commands", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal(""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--command", JavaDetectionCommand + "; " +
+						"JSTACK_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jstack app/.java-buildpack/*/bin/jstack /layers/*/jre/bin/jstack /layers/*/jdk/bin/jstack; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jstack) | head -1`; if [ -n \"${JSTACK_COMMAND}\" ]; then ${JSTACK_COMMAND} $(pidof java); exit 0; fi; " +
+						"JVMMON_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jvmmon app/.java-buildpack/*/bin/jvmmon /layers/*/jre/bin/jvmmon /layers/*/jdk/bin/jvmmon; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jvmmon) | head -1`; if [ -n \"${JVMMON_COMMAND}\" ]; then ${JVMMON_COMMAND} -pid $(pidof java) -c \"print stacktrace\"; exit 0; fi; " +
+						"JCMD_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jcmd app/.java-buildpack/*/bin/jcmd /layers/*/jre/bin/jcmd /layers/*/jdk/bin/jcmd; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jcmd) | head -1`; if [ -n \"${JCMD_COMMAND}\" ]; then ${JCMD_COMMAND} $(pidof java) Thread.print -l; exit 0; fi; " +
+						"kill -3 $(pidof java) && echo 'cf-java-plugin: SIGQUIT sent'"}))
+				})
+
+			})
+
+			Context("in a container without jstack, jvmmon and jcmd", func() {
+
+				var slept time.Duration
+
+				BeforeEach(func() {
+					commandExecutor.ExecuteReturns([]string{"cf-java-plugin: SIGQUIT sent"}, nil)
+					slept = 0
+					sleep = func(d time.Duration) { slept = d }
+				})
+
+				AfterEach(func() {
+					sleep = time.Sleep
+				})
+
+				It("reads the thread dump of the instance from the recent logs", func() {
+
+					pluginUtil.RecentLogs = []string{
+						"Retrieving logs for app my_app in org my_org / space my_space as admin...",
+						"   2024-05-01T10:00:00.00+0000 [APP/PROC/WEB/0] OUT Full thread dump OpenJDK 64-Bit Server VM (17.0.2+8 mixed mode):",
+						"   2024-05-01T10:00:00.00+0000 [APP/PROC/WEB/0] OUT \"main\" #1 prio=5 os_prio=0 tid=0x1 nid=0x2 waiting on condition",
+						"   2024-05-01T10:05:00.00+0000 [APP/PROC/WEB/0] OUT Full thread dump OpenJDK 64-Bit Server VM (17.0.2+8 mixed mode):",
+						"   2024-05-01T10:05:00.00+0000 [APP/PROC/WEB/1] OUT Full thread dump OpenJDK 64-Bit Server VM (17.0.2+8 mixed mode):",
+						"   2024-05-01T10:05:00.00+0000 [RTR/0] OUT my_app.example.com - [2024-05-01T10:05:00.00+0000] \"GET / HTTP/1.1\" 200",
+						"   2024-05-01T10:05:00.00+0000 [APP/PROC/WEB/0] OUT \"main\" #1 prio=5 os_prio=0 tid=0x1 nid=0x2 runnable",
+						"   2024-05-01T10:05:00.00+0000 [APP/PROC/WEB/0] OUT ",
+						"   2024-05-01T10:05:00.00+0000 [APP/PROC/WEB/0] OUT JNI global refs: 10, weak refs: 0",
+						"   2024-05-01T10:05:01.00+0000 [APP/PROC/WEB/0] OUT Started the next request",
+					}
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app"})
+						return output, err
+					})
+
+					Expect(err).To(BeNil())
+					Expect(output).To(Equal("Full thread dump OpenJDK 64-Bit Server VM (17.0.2+8 mixed mode):\n\"main\" #1 prio=5 os_prio=0 tid=0x1 nid=0x2 runnable\n\nJNI global refs: 10, weak refs: 0"))
+					Expect(cliOutput).To(ContainSubstring("Neither jstack, jvmmon nor jcmd found in the app container, reading the thread dump the JVM printed upon SIGQUIT from the recent logs"))
+					Expect(slept).To(Equal(5 * time.Second))
+				})
+
+				It("fails if the thread dump is not in the recent logs", func() {
+
+					pluginUtil.RecentLogs = []string{"   2024-05-01T10:05:01.00+0000 [APP/PROC/WEB/0] OUT Started the next request"}
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The JVM was sent SIGQUIT, but its thread dump was not found in the recent logs, run `cf logs my_app --recent` to look for it"))
+				})
+
+			})
+
+			Context("for a GraalVM native image", func() {
+
+				It("invokes cf ssh with native debuggers", func() {
+
+					pluginUtil.Runtime = utils.RuntimeNativeImage
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal(""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--command", "NATIVE_PID=; for P in /proc/[0-9]*; do if grep -q -a com.oracle.svm ${P}/exe 2>/dev/null; then NATIVE_PID=${P##*/}; break; fi; done; if [ -z \"${NATIVE_PID}\" ]; then echo \"No GraalVM native image process found running.\" >&2; exit 1; fi; " +
+						"if command -v eu-stack > /dev/null; then eu-stack -p ${NATIVE_PID}; exit 0; fi; " +
+						"if command -v gdb > /dev/null; then gdb -p ${NATIVE_PID} -batch -ex 'thread apply all bt'; exit 0; fi; " +
+						"echo >&2 \"Neither eu-stack nor gdb found in the container. Build the image with '--enable-monitoring=threaddump' to have it print a thread dump into the app logs upon 'kill -QUIT ${NATIVE_PID}'\"; exit 1"}))
+				})
+
+			})
+
+			Context("for an app running on OpenJ9", func() {
+
+				It("invokes cf ssh to print a javacore", func() {
+
+					pluginUtil.Runtime = utils.RuntimeOpenJ9
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal(""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--command", JavaDetectionCommand + "; " +
+						"JCMD_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jcmd app/.java-buildpack/*/bin/jcmd /layers/*/jre/bin/jcmd /layers/*/jdk/bin/jcmd; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jcmd) | head -1`; " +
+						"if [ -n \"${JCMD_COMMAND}\" ]; then ${JCMD_COMMAND} $(pidof java) Dump.java /tmp/my_app-javacore-" + pluginUtil.UUID + ".txt > /dev/null; JAVACORE_NAME=/tmp/my_app-javacore-" + pluginUtil.UUID + ".txt; " +
+						"else kill -3 $(pidof java); sleep 3; JAVACORE_NAME=`find /home/vcap/app -name 'javacore.*.txt' -printf '%T@ %p\\0' | sort -zk 1nr | sed -z 's/^[^ ]* //' | tr '\\0' '\\n' | head -n 1`; fi; " +
+						"if [ ! -s \"${JAVACORE_NAME}\" ]; then echo >&2 'Failed to create javacore'; exit 1; fi; " +
+						"cat \"${JAVACORE_NAME}\"; rm -f \"${JAVACORE_NAME}\""}))
+				})
+
+			})
+
+			Context("in a container without pgrep and pidof", func() {
+
+				It("invokes cf ssh with the portable commands", func() {
+
+					pluginUtil.PortableShell = true
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal(""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--command", "JAVA_PID=$(grep -l '^java$' /proc/[0-9]*/comm 2>/dev/null | head -n 1 | cut -d / -f 3); if [ -z \"${JAVA_PID}\" ]; then echo \"No 'java' process found running. Are you sure this is a Java app?\" >&2; exit 1; fi; " +
+						"JSTACK_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jstack app/.java-buildpack/*/bin/jstack /layers/*/jre/bin/jstack /layers/*/jdk/bin/jstack; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find . -name jstack -perm -100) | head -1`; if [ -n \"${JSTACK_COMMAND}\" ]; then ${JSTACK_COMMAND} ${JAVA_PID}; exit 0; fi; " +
+						"JVMMON_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jvmmon app/.java-buildpack/*/bin/jvmmon /layers/*/jre/bin/jvmmon /layers/*/jdk/bin/jvmmon; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find . -name jvmmon -perm -100) | head -1`; if [ -n \"${JVMMON_COMMAND}\" ]; then ${JVMMON_COMMAND} -pid ${JAVA_PID} -c \"print stacktrace\"; exit 0; fi; " +
+						"JCMD_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jcmd app/.java-buildpack/*/bin/jcmd /layers/*/jre/bin/jcmd /layers/*/jdk/bin/jcmd; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find . -name jcmd -perm -100) | head -1`; if [ -n \"${JCMD_COMMAND}\" ]; then ${JCMD_COMMAND} ${JAVA_PID} Thread.print -l; exit 0; fi; " +
+						"kill -3 ${JAVA_PID} && echo 'cf-java-plugin: SIGQUIT sent'"}))
+				})
+
+			})
+
+			Context("for a container with index > 0", func() {
+
+				It("invokes cf ssh with the basic commands", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app", "-i", "4"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal(""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "4", "--command", JavaDetectionCommand + "; " +
+						"JSTACK_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jstack app/.java-buildpack/*/bin/jstack /layers/*/jre/bin/jstack /layers/*/jdk/bin/jstack; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jstack) | head -1`; if [ -n \"${JSTACK_COMMAND}\" ]; then ${JSTACK_COMMAND} $(pidof java); exit 0; fi; " +
+						"JVMMON_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jvmmon app/.java-buildpack/*/bin/jvmmon /layers/*/jre/bin/jvmmon /layers/*/jdk/bin/jvmmon; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jvmmon) | head -1`; if [ -n \"${JVMMON_COMMAND}\" ]; then ${JVMMON_COMMAND} -pid $(pidof java) -c \"print stacktrace\"; exit 0; fi; " +
+						"JCMD_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jcmd app/.java-buildpack/*/bin/jcmd /layers/*/jre/bin/jcmd /layers/*/jdk/bin/jcmd; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jcmd) | head -1`; if [ -n \"${JCMD_COMMAND}\" ]; then ${JCMD_COMMAND} $(pidof java) Thread.print -l; exit 0; fi; " +
+						"kill -3 $(pidof java) && echo 'cf-java-plugin: SIGQUIT sent'"}))
+				})
+
+			})
+
+			Context("with the --keep flag", func() {
+
+				It("fails", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app", "-i", "4", "-k"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The flag \"keep\" is not supported for thread-dumps"))
+					Expect(cliOutput).To(ContainSubstring("The flag \"keep\" is not supported for thread-dumps"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("with defaults in environment variables for flags it does not support", func() {
+
+				AfterEach(func() {
+					os.Unsetenv("CF_JAVA_KEEP")
+				})
+
+				It("ignores them", func() {
+					os.Setenv("CF_JAVA_KEEP", "true")
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(Equal(""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				})
+
+			})
+
+			Context("with the --limit-rate flag", func() {
+
+				It("fails", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app", "--limit-rate", "2M"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The flag \"limit-rate\" is not supported for thread-dumps"))
+					Expect(cliOutput).To(ContainSubstring("The flag \"limit-rate\" is not supported for thread-dumps"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+			Context("with the --dry-run flag", func() {
+
+				It("prints out the command line without executing the command", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app", "-i", "4", "-n"})
+						return output, err
+					})
+
+					expectedOutput := "cf ssh my_app --app-instance-index 4 --command '" + JavaDetectionCommand + "; " +
+						"JSTACK_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jstack app/.java-buildpack/*/bin/jstack /layers/*/jre/bin/jstack /layers/*/jdk/bin/jstack; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jstack) | head -1`; if [ -n \"${JSTACK_COMMAND}\" ]; then ${JSTACK_COMMAND} $(pidof java); exit 0; fi; " +
+						"JVMMON_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jvmmon app/.java-buildpack/*/bin/jvmmon /layers/*/jre/bin/jvmmon /layers/*/jdk/bin/jvmmon; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jvmmon) | head -1`; if [ -n \"${JVMMON_COMMAND}\" ]; then ${JVMMON_COMMAND} -pid $(pidof java) -c \"print stacktrace\"; exit 0; fi; " +
+						"JCMD_COMMAND=`(for P in ${JAVA_HOME:+${JAVA_HOME}/bin}/jcmd app/.java-buildpack/*/bin/jcmd /layers/*/jre/bin/jcmd /layers/*/jdk/bin/jcmd; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done; find -executable -name jcmd) | head -1`; if [ -n \"${JCMD_COMMAND}\" ]; then ${JCMD_COMMAND} $(pidof java) Thread.print -l; exit 0; fi; " +
+						"kill -3 $(pidof java) && echo 'cf-java-plugin: SIGQUIT sent''"
+
+					Expect(output).To(Equal(expectedOutput))
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring(expectedOutput))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to send SIGQUIT for a thread dump", func() {
+
+			var slept time.Duration
+
+			BeforeEach(func() {
+				commandExecutor.ExecuteReturns([]string{"cf-java-plugin: SIGQUIT sent"}, nil)
+				pluginUtil.RecentLogs = []string{
+					"   2024-05-01T10:05:00.00+0000 [APP/PROC/WEB/1] OUT Full thread dump OpenJDK 64-Bit Server VM (17.0.2+8 mixed mode):",
+					"   2024-05-01T10:05:00.00+0000 [APP/PROC/WEB/1] OUT \"main\" #1 prio=5 os_prio=0 tid=0x1 nid=0x2 runnable",
+					"   2024-05-01T10:05:00.00+0000 [APP/PROC/WEB/1] OUT JNI global refs: 10, weak refs: 0",
+				}
+				slept = 0
+				sleep = func(d time.Duration) { slept = d }
+			})
+
+			AfterEach(func() {
+				sleep = time.Sleep
+			})
+
+			It("sends SIGQUIT to the JVM and prints the thread dump from the recent logs", func() {
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "signal-dump", "my_app", "-i", "1"})
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(output).To(Equal("Full thread dump OpenJDK 64-Bit Server VM (17.0.2+8 mixed mode):\n\"main\" #1 prio=5 os_prio=0 tid=0x1 nid=0x2 runnable\nJNI global refs: 10, weak refs: 0"))
+				Expect(slept).To(Equal(5 * time.Second))
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "1", "--command", JavaDetectionCommand + "; kill -3 $(pidof java) && echo 'cf-java-plugin: SIGQUIT sent'"}))
+			})
+
+			It("outputs an error on OpenJ9", func() {
+
+				pluginUtil.Runtime = utils.RuntimeOpenJ9
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "signal-dump", "my_app"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err.Error()).To(ContainSubstring("OpenJ9 writes the thread dump upon SIGQUIT into a javacore file instead of the app logs, run `cf java thread-dump my_app` to print it"))
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+			})
+
+		})
+
+		Context("when invoked to analyze thread dumps", func() {
+
+			var files []string
+
+			threadDump := func(workerState string, workerFrame string, waiters int) string {
+				dump := "\"worker-1\" #21 prio=5 os_prio=0 tid=0x00007f nid=0x15 runnable\n" +
+					"   java.lang.Thread.State: " + workerState + "\n" +
+					"\tat " + workerFrame + "\n" +
+					"\tat com.example.Worker.run(Worker.java:12)\n" +
+					"\t- locked <0x00000000c0a1b2c3> (a java.lang.Object)\n" +
+					"\n" +
+					"\"http-nio-8080-exec-1\" #30 daemon prio=5 os_prio=0 tid=0x00007f nid=0x1e waiting on condition\n" +
+					"   java.lang.Thread.State: WAITING (parking)\n" +
+					"\tat jdk.internal.misc.Unsafe.park(Native Method)\n" +
+					"\tat java.util.concurrent.ThreadPoolExecutor.getTask(ThreadPoolExecutor.java:1062)\n" +
+					"\n"
+				for i := 1; i <= waiters; i++ {
+					dump += fmt.Sprintf("\"scheduler-%d\" #%d prio=5 os_prio=0 tid=0x00007f nid=0x2%d waiting for monitor entry\n", i, 40+i, i) +
+						"   java.lang.Thread.State: BLOCKED (on object monitor)\n" +
+						"\tat com.example.Cache.get(Cache.java:20)\n" +
+						"\t- waiting to lock <0x00000000c0a1b2c3> (a java.lang.Object)\n" +
+						"\n"
+				}
+				return dump
+			}
+
+			writeThreadDumps := func(dumps ...string) {
+				for _, dump := range dumps {
+					file, err := os.CreateTemp("", "threads-*.txt")
+					Expect(err).To(BeNil())
+					_, err = file.WriteString(dump)
+					Expect(err).To(BeNil())
+					Expect(file.Close()).To(Succeed())
+					files = append(files, file.Name())
+				}
+			}
+
+			AfterEach(func() {
+				for _, file := range files {
+					os.Remove(file)
+				}
+				files = nil
+			})
+
+			It("reports hot threads, contended locks and saturated thread pools", func() {
+
+				writeThreadDumps(threadDump("RUNNABLE", "com.example.Worker.spin(Worker.java:42)", 2), threadDump("RUNNABLE", "com.example.Worker.spin(Worker.java:42)", 3))
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, append([]string{"java", "thread-analysis"}, files...))
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(output).To(Equal("Threads RUNNABLE in the same frames in all 2 thread dumps:\n" +
+					"   \"worker-1\" at com.example.Worker.spin(Worker.java:42)\n" +
+					"\n" +
+					"Contended locks:\n" +
+					"   <0x00000000c0a1b2c3> (a java.lang.Object): up to 3 threads waiting, in 2 of 2 thread dumps, held by \"worker-1\"\n" +
+					"\n" +
+					"Saturated thread pools:\n" +
+					"   scheduler: all 3 threads busy in all 2 thread dumps"))
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+			})
+
+			It("does not report threads that moved on", func() {
+
+				writeThreadDumps(threadDump("RUNNABLE", "com.example.Worker.spin(Worker.java:42)", 0), threadDump("RUNNABLE", "com.example.Worker.write(Worker.java:50)", 0))
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, append([]string{"java", "thread-analysis"}, files...))
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(output).To(HavePrefix("Threads RUNNABLE in the same frames in all 2 thread dumps:\n   none\n"))
+			})
+
+			It("outputs an error with a single thread dump", func() {
+
+				writeThreadDumps(threadDump("RUNNABLE", "com.example.Worker.spin(Worker.java:42)", 0))
+
+				output, err, cliOutput := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, append([]string{"java", "thread-analysis"}, files...))
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err.Error()).To(ContainSubstring("At least two thread dump files are required for the analysis"))
+				Expect(cliOutput).To(ContainSubstring("At least two thread dump files are required for the analysis"))
+			})
+
+		})
+
+		Context("when invoked to list the commands", func() {
+
+			Context("with the --json flag", func() {
+
+				It("prints the table of commands as JSON", func() {
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "commands", "--json"})
+						return output, err
+					})
+
+					Expect(err).To(BeNil())
+
+					var catalog []Command
+					Expect(json.Unmarshal([]byte(output), &catalog)).To(Succeed())
+					Expect(catalog).To(HaveLen(len(commands)))
+					Expect(catalog[0].Name).To(Equal("heap-dump"))
+					Expect(catalog[0].Arguments).To(Equal([]string{"APP_NAME"}))
+					Expect(catalog[0].Flags).To(ContainElement("local-dir"))
+					Expect(catalog[0].OutputFile).NotTo(BeEmpty())
+					Expect(catalog[1].Name).To(Equal("thread-dump"))
+					Expect(catalog[1].Flags).NotTo(ContainElement("local-dir"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("with an app name", func() {
+
+				It("reports which commands work in the container of the app", func() {
+					pluginUtil.Runtime = utils.RuntimeNativeImage
+					pluginUtil.Tools = []string{"jmap"}
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "commands", "my_app"})
+						return output, err
+					})
+
+					Expect(err).To(BeNil())
+					Expect(output).To(Equal("Runtime: native-image\n" +
+						"heap-dump       unavailable: heap dumps of GraalVM native images cannot be created with jmap\n" +
+						"thread-dump     unavailable: neither eu-stack nor gdb found in the container\n" +
+						"signal-dump     available\n" +
+						"vm-log          unavailable: unified logging is only available on HotSpot-based JVMs\n" +
+						"gc-logs         unavailable: GraalVM native images write no GC log files\n" +
+						"crash-report    available\n" +
+						"attach-agent    unavailable: Java agents can only be loaded at runtime into HotSpot-based JVMs\n" +
+						"jolokia         unavailable: Java agents can only be loaded at runtime into HotSpot-based JVMs\n" +
+						"histo-diff      unavailable: GraalVM native images cannot create class histograms\n" +
+						"monitor         unavailable: jstat can only sample HotSpot-based JVMs\n" +
+						"watch-oom       unavailable: GraalVM native images write no heap dump upon an OutOfMemoryError\n" +
+						"checkpoint      unavailable: CRaC is only available on HotSpot-based JVMs like SapMachine\n" +
+						"crac-status     unavailable: CRaC is only available on HotSpot-based JVMs like SapMachine\n" +
+						"cds             unavailable: CDS archives can only be dumped at runtime by HotSpot-based JVMs\n" +
+						"remote-list     available\n" +
+						"remote-clean    available\n" +
+						"download        available\n" +
+						"cp              available\n" +
+						"push-file       available\n" +
+						"exec            available\n" +
+						"ssh             available\n" +
+						"where-is        available\n" +
+						"runtime-info    available\n" +
+						"memory-advise   unavailable: the memory settings can only be read from HotSpot-based JVMs\n" +
+						"vitals-history  unavailable: the SapMachine Vitals are only available in SapMachine"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+				It("reports heap and thread dumps as available with jcmd only", func() {
+					pluginUtil.Tools = []string{"jcmd"}
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "commands", "my_app"})
+						return output, err
+					})
+
+					Expect(err).To(BeNil())
+					Expect(output).To(ContainSubstring("heap-dump       available\nthread-dump     available\n"))
+				})
+
+			})
+
+			Context("with an unsupported flag", func() {
+
+				It("outputs an error and invokes cf java help", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "commands", "-k"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The flag \"keep\" is not supported for commands"))
+					Expect(cliOutput).To(ContainSubstring("The flag \"keep\" is not supported for commands"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+		})
+
+		Context("when invoked as a command registered on its own", func() {
+
+			It("registers each command with its usage and the options it supports", func() {
+
+				metadata := subject.GetMetadata()
+
+				Expect(metadata.Commands).To(HaveLen(1 + len(commands)))
+				Expect(metadata.Commands[0].Name).To(Equal("java"))
+				Expect(metadata.Commands[1].Name).To(Equal("java-heap-dump"))
+				Expect(metadata.Commands[1].HelpText).To(Equal("Create a heap dump of the app and download it if a local directory is given"))
+				Expect(metadata.Commands[1].UsageDetails.Usage).To(Equal("cf java-heap-dump APP_NAME"))
+				Expect(metadata.Commands[1].UsageDetails.Options).To(HaveKeyWithValue("local-dir", metadata.Commands[0].UsageDetails.Options["local-dir"]))
+				Expect(metadata.Commands[1].UsageDetails.Options).NotTo(HaveKey("follow"))
+				Expect(metadata.Commands[1].UsageDetails.Options).To(HaveKeyWithValue("cf-home", metadata.Commands[0].UsageDetails.Options["cf-home"]))
+			})
+
+			It("runs like the command of the plugin", func() {
+
+				output, err, _ := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java-where-is", "my_app", "-i", "1"})
+					return output, err
+				})
+
+				Expect(output).To(BeEmpty())
+				Expect(err).To(BeNil())
+
+				Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+				Expect(commandExecutor.ExecuteArgsForCall(0)[:5]).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "1", "--command"}))
+			})
+
+		})
+
+		Context("when invoked with the --record flag", func() {
+
+			var recordDir string
+
+			BeforeEach(func() {
+				var err error
+				recordDir, err = os.MkdirTemp("", "recording-")
+				Expect(err).To(BeNil())
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(recordDir)
+			})
+
+			It("records the remote commands and their output with the secrets masked", func() {
+
+				commandExecutor.ExecuteStub = func(args []string) ([]string, error) {
+					return []string{"DB_PASSWORD=hunter2", "Authorization: Bearer eyJhbGciOi"}, nil
+				}
+
+				output, err, cliOutput := captureOutput(func() (string, error) {
+					output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "thread-dump", "my_app", "-record", recordDir, "-i", "1"})
+					return output, err
+				})
+
+				Expect(err).To(BeNil())
+				Expect(output).To(Equal("DB_PASSWORD=hunter2\nAuthorization: Bearer eyJhbGciOi"))
+				Expect(cliOutput).To(HavePrefix("Recorded 1 remote commands into " + filepath.Join(recordDir, "recording.json") + ", secrets masked|"))
+
+				recorded, err := loadRecording(recordDir)
+				Expect(err).To(BeNil())
+				Expect(recorded.Invocation).To(Equal([]string{"java", "thread-dump", "my_app", "-i", "1"}))
+				Expect(recorded.Interactions).To(HaveLen(1))
+				Expect(recorded.Interactions[0].Args).To(Equal(commandExecutor.ExecuteArgsForCall(0)))
+				Expect(recorded.Interactions[0].Output).To(Equal([]string{"DB_PASSWORD=***", "Authorization: Bearer ***"}))
+				Expect(recorded.Output).To(Equal("DB_PASSWORD=***\nAuthorization: Bearer ***"))
+			})
+
+			It("replays the recordings in testdata", func() {
+
+				dirs, err := filepath.Glob(filepath.Join("testdata", "recordings", "*"))
+				Expect(err).To(BeNil())
+				Expect(dirs).NotTo(BeEmpty())
+
+				for _, dir := range dirs {
+					recorded, err := loadRecording(dir)
+					Expect(err).To(BeNil())
+
+					replay := &replayExecutor{recording: recorded}
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(replay, uuidGenerator, pluginUtil, recorded.Invocation)
+						return output, err
+					})
+
+					if recorded.Error == "" {
+						Expect(err).To(BeNil(), dir)
+					} else {
+						Expect(err).To(MatchError(recorded.Error), dir)
+					}
+					Expect(output).To(Equal(recorded.Output), dir)
+					Expect(replay.next).To(Equal(len(recorded.Interactions)), dir)
+				}
+			})
+
+		})
+
+		Context("when invoked to print examples", func() {
+
+			Context("for a single command", func() {
+
+				It("prints the examples of the command", func() {
+
+					output, err, _ := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "examples", "remote-list"})
+						return output, err
+					})
+
+					Expect(err).To(BeNil())
+					Expect(output).To(Equal("# List the files left behind by the plugin in the container of the app\ncf java remote-list my_app -older-than 7d"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("for an unknown command", func() {
+
+				It("outputs an error and invokes cf java help", func() {
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "examples", "UNKNOWN_COMMAND"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Unrecognized command \"UNKNOWN_COMMAND\""))
+					Expect(cliOutput).To(ContainSubstring("Unrecognized command \"UNKNOWN_COMMAND\""))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+		})
+
+		Context("when invoked to verify the installation", func() {
+
+			var (
+				repository *httptest.Server
+				checksum   string
+			)
+
+			BeforeEach(func() {
+				executable, err := os.Executable()
+				Expect(err).To(BeNil())
+				checksum, err = fileChecksum(executable)
+				Expect(err).To(BeNil())
+			})
+
+			AfterEach(func() {
+				repository.Close()
+				pluginRepositoryURL = "https://plugins.cloudfoundry.org/list"
+			})
+
+			serveChecksum := func(published string) {
+				repository = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintf(w, `{"plugins":[{"name":"java","version":"3.0.3","binaries":[{"platform":%q,"checksum":%q}]}]}`, releasePlatform(), published)
+				}))
+				pluginRepositoryURL = repository.URL
+			}
+
+			Context("with the binary of a published release", func() {
+
+				It("reports that the binary matches", func() {
+					serveChecksum(checksum)
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "verify-install"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err).To(BeNil())
+					Expect(cliOutput).To(ContainSubstring("Version: 3.0.3|Commit: unknown|Platform: " + releasePlatform() + "|"))
+					Expect(cliOutput).To(ContainSubstring("Checksum (SHA-1): " + checksum + "|The plugin binary matches the published release|"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("with a modified binary", func() {
+
+				It("outputs an error", func() {
+					serveChecksum("da39a3ee5e6b4b0d3255bfef95601890afd80709")
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "verify-install"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("The plugin binary does not match the published release 3.0.3"))
+					Expect(cliOutput).To(ContainSubstring("please reinstall the plugin"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(0))
+				})
+
+			})
+
+			Context("with an app name", func() {
+
+				It("outputs an error and invokes cf java help", func() {
+					serveChecksum(checksum)
+
+					output, err, cliOutput := captureOutput(func() (string, error) {
+						output, err := subject.DoRun(commandExecutor, uuidGenerator, pluginUtil, []string{"java", "verify-install", "my_app"})
+						return output, err
+					})
+
+					Expect(output).To(BeEmpty())
+					Expect(err.Error()).To(ContainSubstring("Too many arguments provided: my_app"))
+					Expect(cliOutput).To(ContainSubstring("Too many arguments provided: my_app"))
+
+					Expect(commandExecutor.ExecuteCallCount()).To(Equal(1))
+					Expect(commandExecutor.ExecuteArgsForCall(0)).To(Equal([]string{"help", "java"}))
+				})
+
+			})
+
+		})
+
+	})
+
+	Describe("parseCommandFlags", func() {
+
+		parse := func(args ...string) (flags.FlagContext, error) {
+			commandFlags := newCommandFlags()
+			err := parseCommandFlags(commandFlags, args)
+			return commandFlags, err
+		}
+
+		It("accepts the values of flags after an equal sign", func() {
+
+			commandFlags, err := parse("heap-dump", "--local-dir=/tmp/x", "my_app", "-i=2", "-container-dir=/tmp/a=b")
+
+			Expect(err).To(BeNil())
+			Expect(commandFlags.Args()).To(Equal([]string{"heap-dump", "my_app"}))
+			Expect(commandFlags.String("local-dir")).To(Equal("/tmp/x"))
+			Expect(commandFlags.Int("app-instance-index")).To(Equal(2))
+			Expect(commandFlags.String("container-dir")).To(Equal("/tmp/a=b"))
+		})
+
+		It("accepts flags between and after the arguments", func() {
+
+			commandFlags, err := parse("-k", "heap-dump", "-ld", "/tmp/x", "my_app", "--dry-run")
+
+			Expect(err).To(BeNil())
+			Expect(commandFlags.Args()).To(Equal([]string{"heap-dump", "my_app"}))
+			Expect(commandFlags.IsSet("keep")).To(BeTrue())
+			Expect(commandFlags.IsSet("dry-run")).To(BeTrue())
+			Expect(commandFlags.String("local-dir")).To(Equal("/tmp/x"))
+		})
+
+		It("takes values starting with a dash as they are", func() {
+
+			commandFlags, err := parse("heap-dump", "my_app", "-output", "-", "-ld", "-all", "-i", "-1")
+
+			Expect(err).To(BeNil())
+			Expect(commandFlags.Args()).To(Equal([]string{"heap-dump", "my_app"}))
+			Expect(commandFlags.String("output")).To(Equal("-"))
+			Expect(commandFlags.String("local-dir")).To(Equal("-all"))
+			Expect(commandFlags.Int("app-instance-index")).To(Equal(-1))
+		})
+
+		It("turns bool flags on and off with true and false", func() {
+
+			commandFlags, err := parse("heap-dump", "my_app", "-k=false", "--dry-run=true", "-verbose", "false", "-f", "true")
+
+			Expect(err).To(BeNil())
+			Expect(commandFlags.Args()).To(Equal([]string{"heap-dump", "my_app"}))
+			Expect(commandFlags.IsSet("keep")).To(BeFalse())
+			Expect(commandFlags.IsSet("dry-run")).To(BeTrue())
+			Expect(commandFlags.IsSet("verbose")).To(BeFalse())
+			Expect(commandFlags.IsSet("force")).To(BeTrue())
+		})
+
+		It("takes a numeric argument after a bool flag as an argument", func() {
+
+			commandFlags, err := parse("download", "-keep", "1", "/tmp/dump.hprof", "-f", "0", "-dry-run", "t")
+
+			Expect(err).To(BeNil())
+			Expect(commandFlags.Args()).To(Equal([]string{"download", "1", "/tmp/dump.hprof", "0", "t"}))
+			Expect(commandFlags.IsSet("keep")).To(BeTrue())
+			Expect(commandFlags.IsSet("force")).To(BeTrue())
+			Expect(commandFlags.IsSet("dry-run")).To(BeTrue())
+		})
+
+		It("rejects other values of bool flags", func() {
+
+			_, err := parse("heap-dump", "my_app", "--keep=maybe")
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(Equal("Invalid value \"maybe\" for the flag \"keep\": expected true or false"))
+		})
+
+		It("leaves the arguments as they are", func() {
+
+			args := []string{"heap-dump", "--local-dir=/tmp/x", "my_app", "-k=true"}
+
+			_, err := parse(args...)
+
+			Expect(err).To(BeNil())
+			Expect(args).To(Equal([]string{"heap-dump", "--local-dir=/tmp/x", "my_app", "-k=true"}))
+		})
+
+	})
+
+	Describe("fileSafeName", func() {
+
+		It("keeps the names of apps that are safe in file names", func() {
+			Expect(fileSafeName("my-app_2.0")).To(Equal("my-app_2.0"))
+		})
+
+		It("replaces spaces, umlauts, path separators and shell metacharacters", func() {
+			Expect(fileSafeName("Mein Büro/app;`id` 'x'")).To(Equal("Mein_B_ro_app__id___x_"))
+		})
+
+	})
+
+	Describe("instructions", func() {
+
+		It("quotes the app name, the remote file and the local directory where the shell would split or expand them", func() {
+			Expect(resumeInstructions("my app $HOME", 1, "/tmp/my app.hprof", "/local/my dumps")).To(Equal("cf java download 'my app $HOME' -i 1 '/tmp/my app.hprof' -local-dir '/local/my dumps' -resume"))
+			Expect(downloadInstructions("my app $HOME", 0, "/tmp/dump-*.hprof")).To(Equal("cf java download 'my app $HOME' '/tmp/dump-*.hprof' -local-dir ."))
+		})
+
+		It("keeps plain names as they are", func() {
+			Expect(resumeInstructions("my_app", 0, "/tmp/dump.hprof", "/local/dumps")).To(Equal("cf java download my_app /tmp/dump.hprof -local-dir /local/dumps -resume"))
+		})
+
+		It("quotes the app name in the command line of a dry run", func() {
+
+			output, err, _ := captureOutput(func() (string, error) {
+				return new(JavaPlugin).DoRun(new(FakeCommandExecutor), new(FakeUUIDGenerator), FakeCfJavaPluginUtil{SshEnabled: true}, []string{"java", "thread-dump", "my app $HOME", "-n"})
+			})
+
+			Expect(err).To(BeNil())
+			Expect(output).To(HavePrefix("cf ssh 'my app $HOME' --command '"))
+		})
+
+	})
+
+	Describe("Execute", func() {
+
+		It("runs a command of the plugin like cf java, here as a dry run", func() {
+
+			cliConnection := &pluginfakes.FakeCliConnection{}
+
+			output, err, _ := captureOutput(func() (string, error) {
+				return Execute(cliConnection, "thread-dump", "my_app", "-n")
+			})
+
+			Expect(err).To(BeNil())
+			Expect(output).To(HavePrefix("cf ssh my_app --command "))
+			Expect(cliConnection.CliCommandCallCount()).To(Equal(0))
+		})
+
+		It("runs one command at a time", func() {
+
+			started, release, secondStarted := make(chan struct{}), make(chan struct{}), make(chan struct{})
+			first := &pluginfakes.FakeCliConnection{}
+			first.CliCommandWithoutTerminalOutputStub = func(args ...string) ([]string, error) {
+				close(started)
+				<-release
+				return nil, errors.New("app not found")
+			}
+			second := &pluginfakes.FakeCliConnection{}
+			second.CliCommandWithoutTerminalOutputStub = func(args ...string) ([]string, error) {
+				close(secondStarted)
+				return nil, errors.New("app not found")
+			}
+
+			done := make(chan struct{}, 2)
+			go func() {
+				defer GinkgoRecover()
+				Execute(first, "thread-dump", "my_app")
+				done <- struct{}{}
+			}()
+			Eventually(started).Should(BeClosed())
+			go func() {
+				defer GinkgoRecover()
+				Execute(second, "thread-dump", "other_app")
+				done <- struct{}{}
+			}()
+
+			Consistently(secondStarted, 0.2).ShouldNot(BeClosed())
+			close(release)
+			Eventually(secondStarted).Should(BeClosed())
+			Eventually(done).Should(Receive())
+			Eventually(done).Should(Receive())
+		})
+
+		It("loads the commands for the metadata while a command runs without a data race", func() {
+
+			cliConnection := &pluginfakes.FakeCliConnection{}
+			cliConnection.CliCommandWithoutTerminalOutputReturns(nil, errors.New("app not found"))
+
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				for i := 0; i < 20; i++ {
+					Execute(cliConnection, "thread-dump", "my_app")
+				}
+			}()
+			for i := 0; i < 20; i++ {
+				Expect((&JavaPlugin{}).GetMetadata().Commands[0].Name).To(Equal("java"))
+			}
+			Eventually(done).Should(BeClosed())
+		})
+
+	})
+
+	Describe("Commands", func() {
+
+		It("returns the catalog of the commands", func() {
+
+			catalog, err := Commands()
+
+			Expect(err).To(BeNil())
+			Expect(catalog[0].Name).To(Equal("heap-dump"))
+			Expect(catalog).To(HaveLen(len(commands)))
+		})
+
+		It("returns the built-in commands and the error with a broken definition of the custom commands", func() {
+
+			configDir := os.TempDir()
+			file := filepath.Join(configDir, "cf-java-plugin-broken.yml")
+			Expect(os.WriteFile(file, []byte("commands: [\n"), 0600)).To(Succeed())
+			defer os.Remove(file)
+			customCommandsFile = func() (string, error) { return file, nil }
+			defer func() { customCommandsFile = defaultCustomCommandsFile }()
+
+			catalog, err := Commands()
+
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("Ignoring the custom commands in " + file))
+			Expect(catalog).To(HaveLen(len(builtinCommands)))
+		})
+
+	})
+
+	Describe("instance selection", func() {
+
+		It("checks the tools and the container directory on the only running instance", func() {
+
+			cliConnection := &pluginfakes.FakeCliConnection{}
+			cliConnection.CliCommandWithoutTerminalOutputStub = func(args ...string) ([]string, error) {
+				switch {
+				case args[0] == "app":
+					return []string{"my-app-guid"}, nil
+				case args[0] == "curl":
+					return []string{`{"state": "STARTED", "enabled": true, "resources": [{"index": 0, "state": "CRASHED"}, {"index": 1, "state": "RUNNING"}]}`}, nil
+				case strings.Contains(args[len(args)-1], "df -Pk"):
+					return []string{"1000 /tmp"}, nil
+				case strings.Contains(args[len(args)-1], "java_pid"):
+					return []string{"/tmp/my_app-heapdump.hprof"}, nil
+				}
+				return []string{"./.java-buildpack/open_jdk_jre/bin/jmap"}, nil
+			}
+			util := utils.CfJavaPluginUtilImpl{CliConnection: cliConnection}
+			commandExecutor := new(FakeCommandExecutor)
+			uuidGenerator := new(FakeUUIDGenerator)
+
+			_, err, cliOutput := captureOutput(func() (string, error) {
+				return new(JavaPlugin).DoRun(commandExecutor, uuidGenerator, util, []string{"java", "heap-dump", "my_app", "-k"})
+			})
+
+			Expect(err).To(BeNil())
+			Expect(cliOutput).To(ContainSubstring("Using instance 1, the only running instance of my_app"))
+			sshCalls := 0
+			for i := 0; i < cliConnection.CliCommandWithoutTerminalOutputCallCount(); i++ {
+				args := cliConnection.CliCommandWithoutTerminalOutputArgsForCall(i)
+				if args[0] == "ssh" {
+					sshCalls++
+					Expect(args[:5]).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "1", "--command"}))
+				}
+			}
+			Expect(sshCalls).To(BeNumerically(">=", 3))
+			Expect(commandExecutor.ExecuteArgsForCall(0)[:5]).To(Equal([]string{"ssh", "my_app", "--app-instance-index", "1", "--command"}))
+		})
+
+	})
+
+	Describe("appGUIDs", func() {
+
+		var (
+			cliConnection *pluginfakes.FakeCliConnection
+			pluginHome    string
+			guidLookups   int
+		)
+
+		BeforeEach(func() {
+			var err error
+			pluginHome, err = os.MkdirTemp("", "cf-java-plugin-home-")
+			Expect(err).To(BeNil())
+			os.Setenv("CF_PLUGIN_HOME", pluginHome)
+
+			guidLookups = 0
+			cliConnection = &pluginfakes.FakeCliConnection{}
+			cliConnection.ApiEndpointReturns("https://api.example.com", nil)
+			cliConnection.GetCurrentSpaceReturns(plugin_models.Space{SpaceFields: plugin_models.SpaceFields{Guid: "space-guid"}}, nil)
+			cliConnection.CliCommandWithoutTerminalOutputStub = func(args ...string) ([]string, error) {
+				if args[0] == "app" {
+					guidLookups++
+					return []string{"my-app-guid"}, nil
+				}
+				return []string{`{"state": "STARTED", "resources": [{"index": 0, "state": "RUNNING"}]}`}, nil
+			}
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("CF_PLUGIN_HOME")
+			os.RemoveAll(pluginHome)
+		})
+
+		It("looks up the GUID of an app once per run and keeps it for the next runs", func() {
+
+			util := utils.CfJavaPluginUtilImpl{CliConnection: cliConnection, AppGUIDs: appGUIDs(cliConnection)}
+			_, err := util.GetInstances("my_app")
+			Expect(err).To(BeNil())
+			Expect(util.CheckAppInstance("my_app", 0)).To(BeNil())
+			Expect(guidLookups).To(Equal(1))
+
+			nextRun := utils.CfJavaPluginUtilImpl{CliConnection: cliConnection, AppGUIDs: appGUIDs(cliConnection)}
+			_, err = nextRun.GetInstances("my_app")
+			Expect(err).To(BeNil())
+			Expect(guidLookups).To(Equal(1))
+			Expect(cliConnection.CliCommandWithoutTerminalOutputArgsForCall(4)).To(Equal([]string{"curl", "/v3/apps/my-app-guid/processes/web/stats"}))
+		})
+
+		It("looks up the GUID again in another space", func() {
+
+			util := utils.CfJavaPluginUtilImpl{CliConnection: cliConnection, AppGUIDs: appGUIDs(cliConnection)}
+			_, err := util.GetInstances("my_app")
+			Expect(err).To(BeNil())
+
+			cliConnection.GetCurrentSpaceReturns(plugin_models.Space{SpaceFields: plugin_models.SpaceFields{Guid: "other-space-guid"}}, nil)
+			otherSpace := utils.CfJavaPluginUtilImpl{CliConnection: cliConnection, AppGUIDs: appGUIDs(cliConnection)}
+			_, err = otherSpace.GetInstances("my_app")
+			Expect(err).To(BeNil())
+			Expect(guidLookups).To(Equal(2))
+		})
+
+	})
+
+	Describe("spaceGUID", func() {
+
+		It("reads the targeted space through the connection", func() {
+
+			cliConnection := &pluginfakes.FakeCliConnection{}
+			cliConnection.GetCurrentSpaceReturns(plugin_models.Space{SpaceFields: plugin_models.SpaceFields{Guid: "space-guid"}}, nil)
+
+			guid, err := spaceGUID(cliConnection)()
+			Expect(err).To(BeNil())
+			Expect(guid).To(Equal("space-guid"))
+			Expect(cliConnection.CliCommandWithoutTerminalOutputCallCount()).To(Equal(0))
+		})
+
+		It("is nil for connections that cannot read the targeted space", func() {
+			Expect(spaceGUID(commandExecutorImpl{})).To(BeNil())
+		})
+
+	})
+
+	Describe("cf-home", func() {
+
+		It("splits the flag off the arguments, in all its forms", func() {
+
+			for _, args := range [][]string{
+				{"java", "-cf-home", "/home/me/.cf-eu10", "thread-dump", "my_app"},
+				{"java", "thread-dump", "my_app", "--cf-home", "/home/me/.cf-eu10"},
+				{"java", "thread-dump", "-cf-home=/home/me/.cf-eu10", "my_app"},
+				{"java", "thread-dump", "my_app", "-ch", "/home/me/.cf-eu10"},
+			} {
+				dir, rest, err := splitCfHome(args)
+				Expect(err).To(BeNil())
+				Expect(dir).To(Equal("/home/me/.cf-eu10"))
+				Expect(rest).To(Equal([]string{"java", "thread-dump", "my_app"}))
+			}
+		})
+
+		It("keeps the arguments without the flag and those of the command run by exec", func() {
+
+			args := []string{"java", "exec", "my_app", "--", "ls", "-cf-home", "/tmp"}
+			dir, rest, err := splitCfHome(args)
+			Expect(err).To(BeNil())
+			Expect(dir).To(BeEmpty())
+			Expect(rest).To(Equal(args))
+		})
+
+		It("fails without a directory", func() {
+
+			for _, args := range [][]string{
+				{"java", "thread-dump", "my_app", "-cf-home"},
+				{"java", "exec", "my_app", "-cf-home", "--", "ls"},
+				{"java", "thread-dump", "my_app", "-cf-home="},
+			} {
+				_, _, err := splitCfHome(args)
+				Expect(err).NotTo(BeNil())
+			}
+		})
+
+		It("runs the plugin again with the configuration directory and the plugins of the invoking cf CLI", func() {
+
+			defer os.Setenv("CF_PLUGIN_HOME", os.Getenv("CF_PLUGIN_HOME"))
+			os.Setenv("CF_PLUGIN_HOME", "/home/me")
+			dir := os.TempDir()
+
+			cmd, err := cfHomeCommand(dir, []string{"java", "thread-dump", "my_app"})
+			Expect(err).To(BeNil())
+			Expect(cmd.Args).To(Equal([]string{"cf", "java", "thread-dump", "my_app"}))
+			Expect(cmd.Env).To(ContainElement("CF_HOME=" + dir))
+			Expect(cmd.Env[len(cmd.Env)-1]).To(Equal("CF_PLUGIN_HOME=/home/me"))
+		})
+
+		It("fails for a configuration directory that does not exist", func() {
+
+			_, err := cfHomeCommand(filepath.Join(os.TempDir(), "cf-java-missing-home"), []string{"java", "thread-dump", "my_app"})
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring("does not exist"))
+		})
+
+	})
+
+	Describe("keepalive", func() {
+
+		var cliConnection *pluginfakes.FakeCliConnection
+
+		BeforeEach(func() {
+			cliConnection = &pluginfakes.FakeCliConnection{}
+			uploadScript = func(args []string, script string, dest string) error { return nil }
+		})
+
+		AfterEach(func() {
+			uploadScript = utils.UploadScript
+		})
+
+		It("keeps the NUL bytes of the keepalive out of the output of commands that are not streamed", func() {
+
+			cliConnection.CliCommandWithoutTerminalOutputReturns([]string{"\x00\x00Dumping heap to /tmp/dump.hprof ...", "\x00", "Heap dump file created"}, nil)
+
+			output, err, cliOutput := captureOutput(func() (string, error) {
+				output, err := commandExecutorImpl{cliConnection: cliConnection}.Execute([]string{"ssh", "my_app", "--command", KeepaliveCommand + "; jmap"})
+				return strings.Join(output, "\n"), err
+			})
+
+			Expect(err).To(BeNil())
+			Expect(output).To(Equal("Dumping heap to /tmp/dump.hprof ...\nHeap dump file created"))
+			Expect(cliOutput).To(Equal("Dumping heap to /tmp/dump.hprof ...|Heap dump file created|"))
+			Expect(cliConnection.CliCommandCallCount()).To(Equal(0))
+		})
+
+		It("leaves the output of the other commands to the cf CLI", func() {
+
+			cliConnection.CliCommandReturns([]string{"Full thread dump"}, nil)
+
+			output, err := commandExecutorImpl{cliConnection: cliConnection}.Execute([]string{"ssh", "my_app", "--command", "jstack"})
+			Expect(err).To(BeNil())
+			Expect(output).To(Equal([]string{"Full thread dump"}))
+			Expect(cliConnection.CliCommandWithoutTerminalOutputCallCount()).To(Equal(0))
+		})
+
+	})
+
+	Describe("remoteScript", func() {
+
+		var (
+			cliConnection *pluginfakes.FakeCliConnection
+			uploads       map[string]string
+		)
+
+		BeforeEach(func() {
+			cliConnection = &pluginfakes.FakeCliConnection{}
+			uploads = map[string]string{}
+			uploadScript = func(args []string, script string, dest string) error {
+				Expect(args).To(Equal([]string{"ssh", "my_app", "--command"}))
+				uploads[dest] = script
+				return nil
+			}
+		})
+
+		AfterEach(func() {
+			uploadScript = utils.UploadScript
+		})
+
+		It("uploads the commands as a script and runs it in the container", func() {
+
+			commands := "echo 'No java process' >&2; OUTPUT=$( ${JMAP_COMMAND} -dump:format=b,file=/tmp/dump.hprof $(pidof java) )"
+			_, err := commandExecutorImpl{cliConnection: cliConnection}.Execute([]string{"ssh", "my_app", "--command", commands})
+			Expect(err).To(BeNil())
+
+			args := cliConnection.CliCommandArgsForCall(0)
+			Expect(args[:3]).To(Equal([]string{"ssh", "my_app", "--command"}))
+			match := regexp.MustCompile(`^SCRIPT=\$\{TMPDIR:-/tmp\}/cf-java-([0-9a-f-]+)\.sh; \$\(command -v bash \|\| command -v sh\) \$\{SCRIPT\}; STATUS=\$\?; rm -f \$\{SCRIPT\}; exit \$\{STATUS\}$`).FindStringSubmatch(args[3])
+			Expect(match).NotTo(BeNil())
+			Expect(uploads).To(Equal(map[string]string{remoteScriptPath(match[1]): commands}))
+		})
+
+		It("runs a command line of the same length whatever the length of the commands", func() {
+
+			executor := commandExecutorImpl{cliConnection: cliConnection}
+			_, err := executor.Execute([]string{"ssh", "my_app", "--command", "jmap"})
+			Expect(err).To(BeNil())
+			_, err = executor.Execute([]string{"ssh", "my_app", "--command", strings.Repeat("echo 'a rather long command'; ", 10000)})
+			Expect(err).To(BeNil())
+
+			short, long := cliConnection.CliCommandArgsForCall(0), cliConnection.CliCommandArgsForCall(1)
+			Expect(len(long[3])).To(Equal(len(short[3])))
+		})
+
+		It("does not run the command if the script cannot be uploaded", func() {
+
+			uploadScript = func(args []string, script string, dest string) error {
+				return errors.New("error occured while uploading the remote command into the container")
+			}
+
+			_, err := commandExecutorImpl{cliConnection: cliConnection}.Execute([]string{"ssh", "my_app", "--command", "jmap"})
+			Expect(err).NotTo(BeNil())
+			Expect(cliConnection.CliCommandCallCount()).To(Equal(0))
+		})
+
+	})
+
+	Describe("cleanup", func() {
+
+		var (
+			cliConnection *pluginfakes.FakeCliConnection
+			calls         []string
+			util          recordingUtil
+		)
+
+		// scriptID returns the id of the remote script the command ran as, see remoteScript
+		scriptID := func() string {
+			var args []string
+			if cliConnection.CliCommandCallCount() > 0 {
+				args = cliConnection.CliCommandArgsForCall(0)
+			} else {
+				args = cliConnection.CliCommandWithoutTerminalOutputArgsForCall(0)
+			}
+			match := regexp.MustCompile(`/cf-java-([0-9a-f-]+)\.sh;`).FindStringSubmatch(args[len(args)-1])
+			Expect(match).NotTo(BeNil())
+			return match[1]
+		}
+
+		BeforeEach(func() {
+			cliConnection = &pluginfakes.FakeCliConnection{}
+			calls = nil
+			util = recordingUtil{FakeCfJavaPluginUtil: FakeCfJavaPluginUtil{SshEnabled: true, Jmap_jvmmon_present: true, Container_path_valid: true, Fspath: "/tmp", LocalPathValid: true, UUID: "cdc8cea3-92e6-4f92-8dc7-c4952dd67be5"}, calls: &calls}
+			uploadScript = func(args []string, script string, dest string) error { return nil }
+		})
+
+		AfterEach(func() {
+			uploadScript = utils.UploadScript
+		})
+
+		It("stops the remote script of a failed command before removing the files in the container", func() {
+
+			// The output of heap-dump, which starts with the keepalive, is shown by the plugin
+			cliConnection.CliCommandWithoutTerminalOutputReturns([]string{"error: unexpected EOF"}, errors.New("exit status 1"))
+			uuidGenerator := new(FakeUUIDGenerator)
+			uuidGenerator.GenerateReturns(util.UUID)
+
+			_, err, _ := captureOutput(func() (string, error) {
+				return new(JavaPlugin).DoRun(commandExecutorImpl{cliConnection: cliConnection}, uuidGenerator, util, []string{"java", "heap-dump", "my_app"})
+			})
+
+			Expect(err).NotTo(BeNil())
+			id := scriptID()
+			Expect(calls).To(Equal([]string{"stop " + remoteScriptPattern(id), "delete /tmp/cf-java-" + util.UUID + " /tmp/my_app-heapdump-" + util.UUID + ".hprof"}))
+			// pgrep -f matches the shell running the script, but not the one looking for it
+			Expect(regexp.MustCompile(remoteScriptPattern(id)).MatchString("bash /tmp/cf-java-" + id + ".sh")).To(BeTrue())
+			Expect(regexp.MustCompile(remoteScriptPattern(id)).MatchString("pgrep -f " + remoteScriptPattern(id))).To(BeFalse())
+		})
+
+		It("stops the remote script when interrupted while it runs, before removing the files in the container", func() {
+
+			cliConnection.CliCommandStub = func(args ...string) ([]string, error) {
+				// As the handler of the interrupt does
+				cleanup.run(util, os.Stdout)
+				return nil, errors.New("interrupted")
+			}
+
+			cleanup.reset()
+			cleanup.addRemotePath([]string{"ssh", "my_app", "--command"}, "/tmp/dump.hprof")
+			commandExecutorImpl{cliConnection: cliConnection}.Execute([]string{"ssh", "my_app", "--command", "jmap"})
+
+			Expect(calls).To(Equal([]string{"stop " + remoteScriptPattern(scriptID()), "delete /tmp/dump.hprof"}))
+		})
+
+		It("removes the temporary files in the container when the command fails", func() {
+
+			commandExecutor := new(FakeCommandExecutor)
+			commandExecutor.ExecuteReturns([]string{"No 'java' process found running"}, errors.New("exit status 1"))
+			uuidGenerator := new(FakeUUIDGenerator)
+			uuidGenerator.GenerateReturns(util.UUID)
+
+			_, err, cliOutput := captureOutput(func() (string, error) {
+				return new(JavaPlugin).DoRun(commandExecutor, uuidGenerator, util, []string{"java", "watch-oom", "my_app"})
+			})
+
+			Expect(err).NotTo(BeNil())
+			Expect(calls).To(Equal([]string{"delete /tmp/.cf-java-watch-" + util.UUID}))
+			Expect(cliOutput).To(ContainSubstring("Removed /tmp/.cf-java-watch-" + util.UUID + " from the app container"))
+		})
+
+		It("removes the heap dump in the container when its download fails", func() {
+
+			util.LocalPathValid = false
+			util.OutputFileName = "java_pid0_0.hprof"
+			uuidGenerator := new(FakeUUIDGenerator)
+			uuidGenerator.GenerateReturns(util.UUID)
+
+			_, err, _ := captureOutput(func() (string, error) {
+				return new(JavaPlugin).DoRun(new(FakeCommandExecutor), uuidGenerator, util, []string{"java", "heap-dump", "my_app", "--local-dir", "/not/valid/path"})
+			})
+
+			Expect(err).NotTo(BeNil())
+			Expect(calls).To(Equal([]string{"delete /tmp/java_pid0_0.hprof"}))
+		})
+
+		Context("when the download fails", func() {
+
+			var (
+				dest         string
+				downloadUtil partialDownloadUtil
+			)
+
+			BeforeEach(func() {
+				dest = filepath.Join(GinkgoT().TempDir(), "my_app-heapdump.hprof")
+				downloadUtil = partialDownloadUtil{recordingUtil: util}
+				cleanup.reset()
+			})
+
+			It("removes the new local file written halfway", func() {
+
+				err := copyOverCat(downloadUtil, []string{"ssh", "my_app", "--command"}, "/tmp/dump.hprof", dest, utils.CopyOptions{}, os.Stdout)
+				Expect(err).NotTo(BeNil())
+				Expect(dest).To(BeARegularFile())
+
+				_, _, cliOutput := captureOutput(func() (string, error) {
+					cleanup.run(downloadUtil, os.Stdout)
+					return "", nil
+				})
+
+				Expect(dest).NotTo(BeAnExistingFile())
+				Expect(cliOutput).To(ContainSubstring("Removed the incomplete local file " + dest))
+			})
+
+			It("keeps an existing local file", func() {
+
+				Expect(os.WriteFile(dest, []byte("JAVA PROFILE 1.0.2"), 0644)).To(Succeed())
+
+				err := copyOverCat(downloadUtil, []string{"ssh", "my_app", "--command"}, "/tmp/dump.hprof", dest, utils.CopyOptions{}, os.Stdout)
+				Expect(err.Error()).To(ContainSubstring("already exists"))
+				cleanup.run(downloadUtil, os.Stdout)
+
+				Expect(os.ReadFile(dest)).To(Equal([]byte("JAVA PROFILE 1.0.2")))
+			})
+
+			It("removes an existing local file overwritten with the flag force", func() {
+
+				Expect(os.WriteFile(dest, []byte("JAVA PROFILE 1.0.2"), 0644)).To(Succeed())
+
+				err := copyOverCat(downloadUtil, []string{"ssh", "my_app", "--command"}, "/tmp/dump.hprof", dest, utils.CopyOptions{Force: true}, os.Stdout)
+				Expect(err).NotTo(BeNil())
+				_, _, _ = captureOutput(func() (string, error) {
+					cleanup.run(downloadUtil, os.Stdout)
+					return "", nil
+				})
+
+				Expect(dest).NotTo(BeAnExistingFile())
+			})
+
+		})
+
+		It("does not stop the remote script of a successful command", func() {
+
+			cliConnection.CliCommandReturns([]string{"done"}, nil)
+
+			cleanup.reset()
+			cleanup.addRemotePath([]string{"ssh", "my_app", "--command"}, "/tmp/dump.hprof")
+			_, err := commandExecutorImpl{cliConnection: cliConnection}.Execute([]string{"ssh", "my_app", "--command", "jmap"})
+			Expect(err).To(BeNil())
+			cleanup.run(util, os.Stdout)
+
+			Expect(calls).To(Equal([]string{"delete /tmp/dump.hprof"}))
+		})
+
+	})
+
+	Describe("serve", func() {
+
+		var (
+			client   net.Conn
+			lines    *bufio.Scanner
+			executor *FakeCommandExecutor
+			util     FakeCfJavaPluginUtil
+		)
+
+		BeforeEach(func() {
+			executor = new(FakeCommandExecutor)
+			uuidGenerator := new(FakeUUIDGenerator)
+			uuidGenerator.GenerateReturns("cdc8cea3-92e6-4f92-8dc7-c4952dd67be5")
+			util = FakeCfJavaPluginUtil{SshEnabled: true, Jmap_jvmmon_present: true, Container_path_valid: true, Fspath: "/tmp", LocalPathValid: true, UUID: uuidGenerator.Generate(), OutputFileName: "java_pid0_0.hprof",
+				Apps: []utils.AppSummary{{Name: "my_app", GUID: "my-app-guid", State: "STARTED"}}}
+			now = func() time.Time { return time.Date(2024, time.June, 1, 12, 30, 5, 0, time.UTC) }
+
+			var server net.Conn
+			client, server = net.Pipe()
+			lines = bufio.NewScanner(client)
+			// The server of a spec may start once the next one has set up its fakes
+			go func(executor *FakeCommandExecutor, util FakeCfJavaPluginUtil) {
+				defer server.Close()
+				new(JavaPlugin).serveConnection(server, executor, uuidGenerator, util)
+			}(executor, util)
+		})
+
+		AfterEach(func() {
+			client.Close()
+			now = time.Now
+		})
+
+		// call sends the request and returns the lines received up to the response
+		call := func(request string) []string {
+			go client.Write([]byte(request + "\n"))
+			var received []string
+			for lines.Scan() {
+				received = append(received, lines.Text())
+				if strings.Contains(lines.Text(), `"id":`) {
+					break
+				}
+			}
+			return received
+		}
+
+		It("returns the commands and the apps", func() {
+
+			received := call(`{"jsonrpc": "2.0", "id": 1, "method": "commands"}`)
+			Expect(received).To(HaveLen(1))
+			Expect(received[0]).To(HavePrefix(`{"jsonrpc":"2.0","id":1,"result":[{"name":"heap-dump",`))
+
+			Expect(call(`{"jsonrpc": "2.0", "id": "apps", "method": "apps"}`)).To(Equal([]string{
+				`{"jsonrpc":"2.0","id":"apps","result":[{"name":"my_app","guid":"my-app-guid","state":"STARTED"}]}`,
+			}))
+		})
+
+		It("runs a command, sending its messages and progress as notifications", func() {
+
+			received := call(`{"jsonrpc": "2.0", "id": 2, "method": "run", "params": {"args": ["heap-dump", "my_app", "-ld", "/valid/path", "-progress", "json"]}}`)
+			Expect(received).To(ContainElement(`{"jsonrpc":"2.0","method":"progress","params":{"time":"2024-06-01T12:30:05Z","event":"step-started","step":"heap-dump"}}`))
+			Expect(received).To(ContainElement(`{"jsonrpc":"2.0","method":"message","params":{"text":"Successfully created heap dump in application container at: /tmp/java_pid0_0.hprof"}}`))
+			Expect(received[len(received)-1]).To(Equal(`{"jsonrpc":"2.0","id":2,"result":{"output":""}}`))
+		})
+
+		It("keeps what the rest of the process prints while a command runs out of the notifications", func() {
+
+			var stdout, stdoutWhileRunning *os.File
+			executor.ExecuteStub = func(args []string) ([]string, error) {
+				stdoutWhileRunning = os.Stdout
+				fmt.Println("printed by the tool embedding the commands")
+				return []string{"1234:", "5.123 s"}, nil
+			}
+
+			var received []string
+			_, _, printed := captureOutput(func() (string, error) {
+				stdout = os.Stdout
+				received = call(`{"jsonrpc": "2.0", "id": 2, "method": "run", "params": {"args": ["thread-dump", "my_app"]}}`)
+				return "", nil
+			})
+
+			Expect(stdoutWhileRunning).To(Equal(stdout))
+			Expect(strings.Join(received, "\n")).NotTo(ContainSubstring("printed by the tool embedding the commands"))
+			Expect(received[len(received)-1]).To(HavePrefix(`{"jsonrpc":"2.0","id":2,"result":`))
+			Expect(printed).To(ContainSubstring("printed by the tool embedding the commands"))
+		})
+
+		It("creates the socket that only the user may connect to", func() {
+
+			socket := filepath.Join(GinkgoT().TempDir(), "cf-java-plugin.sock")
+
+			listener, err := listenPrivate(socket)
+			Expect(err).To(BeNil())
+			defer listener.Close()
+
+			info, err := os.Stat(socket)
+			Expect(err).To(BeNil())
+			Expect(info.Mode() & os.ModeSocket).NotTo(BeZero())
+			Expect(info.Mode().Perm() & 0077).To(BeZero())
+		})
+
+		It("answers the requests of all clients one at a time", func() {
+
+			started, release := make(chan struct{}), make(chan struct{})
+			executor.ExecuteStub = func(args []string) ([]string, error) {
+				close(started)
+				<-release
+				return []string{"1234:", "5.123 s"}, nil
+			}
+			go client.Write([]byte(`{"jsonrpc": "2.0", "id": 7, "method": "run", "params": {"args": ["exec", "my_app", "--", "${JCMD_COMMAND}", "${JAVA_PID}", "VM.uptime"]}}` + "\n"))
+			Eventually(started).Should(BeClosed())
+
+			otherClient, server := net.Pipe()
+			defer otherClient.Close()
+			go func() {
+				defer server.Close()
+				new(JavaPlugin).serveConnection(server, executor, new(FakeUUIDGenerator), util)
+			}()
+			go otherClient.Write([]byte(`{"jsonrpc": "2.0", "id": 8, "method": "commands"}` + "\n"))
+			answered := make(chan string, 1)
+			go func() {
+				otherLines := bufio.NewScanner(otherClient)
+				otherLines.Buffer(make([]byte, 64*1024), 1024*1024)
+				if otherLines.Scan() {
+					answered <- otherLines.Text()
+				}
+			}()
+
+			Consistently(answered, 0.2).ShouldNot(Receive())
+			close(release)
+			Eventually(answered).Should(Receive(HavePrefix(`{"jsonrpc":"2.0","id":8,"result":[`)))
+			for lines.Scan() {
+				if strings.Contains(lines.Text(), `"id":7`) {
+					break
+				}
+			}
+		})
+
+		It("reports the errors of the commands and of the requests", func() {
+
+			Expect(call(`{"jsonrpc": "2.0", "id": 3, "method": "run", "params": {"args": ["heap-dump"]}}`)).To(Equal([]string{
+				`{"jsonrpc":"2.0","id":3,"error":{"code":-32000,"message":"No application name provided"}}`,
+			}))
+			Expect(call(`{"jsonrpc": "2.0", "id": 4, "method": "run", "params": {"args": ["serve"]}}`)).To(Equal([]string{
+				`{"jsonrpc":"2.0","id":4,"error":{"code":-32602,"message":"serve cannot be run by serve"}}`,
+			}))
+			Expect(call(`{"jsonrpc": "2.0", "id": 5, "method": "stop-jfr"}`)).To(Equal([]string{
+				`{"jsonrpc":"2.0","id":5,"error":{"code":-32601,"message":"unknown method \"stop-jfr\", expected commands, apps or run"}}`,
+			}))
+			Expect(call(`{"jsonrpc": "2.0", "id": 6,`)[0]).To(HavePrefix(`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,`))
+		})
+
+	})
+
+})
@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"utils"
+)
+
+// cfHomeFlag selects the configuration directory of the cf CLI, e.g., to target another foundation. The plugin runs
+// with the session of the cf CLI invoking it, which cannot be switched, so the flag is handled before any command runs,
+// by running the plugin again with a cf CLI reading its configuration from the directory, see runWithCfHome.
+const cfHomeFlag = "cf-home"
+
+// splitCfHome splits the flag cfHomeFlag, given as -cf-home, --cf-home or -ch, with its value as the next argument or
+// after =, off the arguments of the plugin. The arguments after "--" belong to the command run by exec and are kept
+// as they are. The directory is empty if the flag is not given.
+func splitCfHome(args []string) (string, []string, error) {
+	dir := ""
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+
+		name, value, hasValue := strings.TrimLeft(arg, "-"), "", false
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value, hasValue = name[:j], name[j+1:], true
+		}
+		if !strings.HasPrefix(arg, "-") || (name != cfHomeFlag && name != "ch") {
+			rest = append(rest, arg)
+			continue
+		}
+
+		if !hasValue {
+			if i+1 == len(args) || args[i+1] == "--" {
+				return "", nil, errors.New("The flag " + cfHomeFlag + " requires the configuration directory of the cf CLI, e.g., -cf-home ~/.cf-eu10")
+			}
+			i++
+			value = args[i]
+		}
+		if value == "" {
+			return "", nil, errors.New("The configuration directory of the cf CLI given with the flag " + cfHomeFlag + " must not be empty")
+		}
+		dir = value
+	}
+
+	return dir, rest, nil
+}
+
+// cfHomeCommand returns the cf process running the plugin again with the given arguments and the cf CLI reading its
+// configuration from dir. The plugins stay those of the invoking cf CLI, as they are usually not installed below dir.
+func cfHomeCommand(dir string, args []string) (*exec.Cmd, error) {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, errors.New("The configuration directory of the cf CLI " + dir + " does not exist")
+	}
+	plugins, err := pluginsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := utils.CfCommand(args...)
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env, "CF_HOME="+dir, "CF_PLUGIN_HOME="+filepath.Dir(filepath.Dir(plugins)))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd, nil
+}
+
+// runWithCfHome runs the plugin again with the cf CLI reading its configuration from dir and returns its exit code.
+// The interrupts reach the plugin run again as well, so they are ignored here until it has cleaned up and exited.
+func runWithCfHome(dir string, args []string) (int, error) {
+	cmd, err := cfHomeCommand(dir, args)
+	if err != nil {
+		return 1, err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode(), nil
+		}
+		return 1, errors.New("Error running the cf CLI with the configuration directory " + dir + ": " + err.Error())
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"utils"
+)
+
+// cleanupTasks holds what the running command leaves behind until it completes: the local files it is writing and the
+// files and directories it creates in the container. Should the command fail or be interrupted, they are removed, as
+// a heap dump written halfway is of no use and may take gigabytes. When interrupted while the remote command runs, it
+// is stopped beforehand, as closing the cf ssh session leaves it running in the container.
+type cleanupTasks struct {
+	mutex          sync.Mutex
+	cfSSHArguments []string
+	localFiles     []string
+	remotePaths    []string
+	remoteScript   string
+}
+
+// cleanup holds the cleanup tasks of the running command
+var cleanup = &cleanupTasks{}
+
+// reset forgets the tasks of the previous command
+func (tasks *cleanupTasks) reset() {
+	tasks.mutex.Lock()
+	defer tasks.mutex.Unlock()
+
+	tasks.cfSSHArguments, tasks.localFiles, tasks.remotePaths, tasks.remoteScript = nil, nil, nil, ""
+}
+
+// addRemoteScript stops the remote script with the given id, see remoteScript, should the command be interrupted before
+// the script is settled
+func (tasks *cleanupTasks) addRemoteScript(cfSSHArguments []string, id string) {
+	tasks.mutex.Lock()
+	defer tasks.mutex.Unlock()
+
+	tasks.cfSSHArguments = cfSSHArguments
+	tasks.remoteScript = id
+}
+
+// settleRemoteScript forgets the remote script once it is done
+func (tasks *cleanupTasks) settleRemoteScript() {
+	tasks.mutex.Lock()
+	defer tasks.mutex.Unlock()
+
+	tasks.remoteScript = ""
+}
+
+// addLocalFile removes the local file should the command fail before it is settled
+func (tasks *cleanupTasks) addLocalFile(path string) {
+	tasks.mutex.Lock()
+	defer tasks.mutex.Unlock()
+
+	tasks.localFiles = append(tasks.localFiles, path)
+}
+
+// addRemotePath removes the file or directory in the container should the command fail before it is settled
+func (tasks *cleanupTasks) addRemotePath(cfSSHArguments []string, path string) {
+	tasks.mutex.Lock()
+	defer tasks.mutex.Unlock()
+
+	tasks.cfSSHArguments = cfSSHArguments
+	tasks.remotePaths = append(tasks.remotePaths, path)
+}
+
+// settle keeps the given local files and paths in the container, e.g., once they are complete
+func (tasks *cleanupTasks) settle(paths ...string) {
+	tasks.mutex.Lock()
+	defer tasks.mutex.Unlock()
+
+	tasks.localFiles = without(tasks.localFiles, paths)
+	tasks.remotePaths = without(tasks.remotePaths, paths)
+}
+
+// run removes the local files and the paths in the container not settled, and forgets them
+func (tasks *cleanupTasks) run(util utils.CfJavaPluginUtil, messages io.Writer) {
+	tasks.mutex.Lock()
+	defer tasks.mutex.Unlock()
+
+	if tasks.remoteScript != "" {
+		if err := util.StopRemoteProcesses(tasks.cfSSHArguments, remoteScriptPattern(tasks.remoteScript)); err != nil {
+			fmt.Fprintln(messages, err.Error())
+		} else {
+			fmt.Fprintln(messages, "Stopped the remote command in the app container")
+		}
+	}
+	for _, file := range tasks.localFiles {
+		if err := os.Remove(file); err == nil {
+			fmt.Fprintln(messages, "Removed the incomplete local file "+file)
+		}
+	}
+	if len(tasks.remotePaths) > 0 {
+		if err := util.DeleteRemotePaths(tasks.cfSSHArguments, tasks.remotePaths); err != nil {
+			fmt.Fprintln(messages, err.Error()+", run 'cf java remote-clean' to remove the files left behind by this plugin")
+		} else {
+			fmt.Fprintln(messages, "Removed "+strings.Join(tasks.remotePaths, ", ")+" from the app container")
+		}
+	}
+
+	tasks.cfSSHArguments, tasks.localFiles, tasks.remotePaths, tasks.remoteScript = nil, nil, nil, ""
+}
+
+// without returns the values not in removed
+func without(values []string, removed []string) []string {
+	var kept []string
+	for _, value := range values {
+		if !containsString(removed, value) {
+			kept = append(kept, value)
+		}
+	}
+
+	return kept
+}
+
+// handleInterrupts runs the cleanup tasks and exits once the plugin is interrupted, e.g., with Ctrl+C, or terminated.
+// The returned function stops handling them.
+func handleInterrupts(util utils.CfJavaPluginUtil) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-signals:
+			fmt.Println()
+			fmt.Println("Interrupted, cleaning up")
+			cleanup.run(util, os.Stdout)
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
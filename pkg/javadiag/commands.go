@@ -0,0 +1,748 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"utils"
+
+	"code.cloudfoundry.org/cli/plugin"
+	"github.com/simonleung8/flags"
+)
+
+// Command describes a command of the plugin. The table of commands is printed by `cf java commands --json`
+// for external tools, so changes to the exported fields are visible to them.
+type Command struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Arguments are the positional arguments following the command name, e.g., "APP_NAME"
+	Arguments []string `json:"arguments"`
+	// Flags are the flags supported by the command
+	Flags []string `json:"flags"`
+	// OutputFile describes the file created by the command, if any
+	OutputFile string `json:"outputFile,omitempty"`
+	// RequiresSapMachine is set for the commands that rely on tools shipped only with SapMachine
+	RequiresSapMachine bool `json:"requiresSapMachine"`
+	// Examples are complete invocations of the command, shown in its help
+	Examples []string `json:"examples"`
+	// Custom is set for the commands defined by the user, see customCommand
+	Custom bool `json:"custom,omitempty"`
+	// flagsDescription names the command in the errors about unsupported flags
+	flagsDescription string
+	// unavailability returns why the command cannot work in a container with the given runtime and tools,
+	// or an empty string if it can; nil means that the command works everywhere
+	unavailability func(runtime string, tools map[string]bool) string
+	// inspectsRuntime is set for the commands that run tools in the container, which needs the runtime of the app
+	// and the shell of the container to be detected first
+	inspectsRuntime bool
+	// keepalive is set for the commands that run long enough to need the KeepaliveCommand, so that the cf ssh session
+	// is not closed for inactivity
+	keepalive bool
+	// custom is the definition of a command defined by the user, nil for the commands of the plugin
+	custom *customCommand
+}
+
+// commandAvailability tells whether a command works in the container of an app, see `cf java commands APP_NAME`
+type commandAvailability struct {
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// containerTools are the tools looked up in the container to tell which commands are available
+var containerTools = []string{"jmap", "jvmmon", "jstack", "jcmd", "jattach", "jstat", "eu-stack", "gdb"}
+
+const (
+	commandsCommand       = "commands"
+	examplesCommand       = "examples"
+	threadAnalysisCommand = "thread-analysis"
+	lintCommandsCommand   = "lint-commands"
+	serveCommand          = "serve"
+)
+
+// commands are the commands of the plugin followed by those defined by the user, see loadCommands
+var commands = builtinCommands
+
+// builtinCommands are the commands of the plugin
+var builtinCommands = []Command{
+	{
+		Name:             heapDumpCommand,
+		Description:      "Create a heap dump of the app and download it if a local directory is given",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "guid", "route", "keep", "dry-run", "container-dir", "local-dir", "organize", "limit-rate", "no-create", "force", "no-uuid", "timestamp", "redact", "output", "progress", "no-cache", "record", "verbose"},
+		OutputFile:       "heap dump, in the HPROF format or, on OpenJ9, in the PHD format",
+		Examples:         []string{"cf java heap-dump my_app -local-dir ~/dumps", "cf java heap-dump my_app -i 1 -keep -container-dir /var/dumps", "cf java heap-dump my_app -no-uuid -local-dir /var/nightly -force", "cf java heap-dump my_app -timestamp iso -local-dir ~/dumps", "cf java heap-dump my_app -output - | gzip > dump.hprof.gz"},
+		flagsDescription: "heap-dumps",
+		inspectsRuntime:  true,
+		keepalive:        true,
+		unavailability: func(runtime string, tools map[string]bool) string {
+			switch {
+			case runtime == utils.RuntimeNativeImage:
+				return "heap dumps of GraalVM native images cannot be created with jmap"
+			case runtime == utils.RuntimeOpenJ9 && !tools["jcmd"]:
+				return "jcmd not found in the container"
+			case runtime == utils.RuntimeHotSpot && !tools["jmap"] && !tools["jvmmon"] && !tools["jcmd"] && !tools["jattach"]:
+				return "neither jmap, jvmmon, jcmd nor jattach found in the container"
+			}
+			return ""
+		},
+	},
+	{
+		Name:             threadDumpCommand,
+		Description:      "Print a thread dump of the app",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "all-instances", "guid", "route", "dry-run", "progress", "no-cache", "record", "verbose"},
+		Examples:         []string{"cf java thread-dump my_app > my_app-threads.txt", "cf java thread-dump -guid 4a5c7d47-0b6e-4bd6-a3ca-bc4de4fd2b7e"},
+		flagsDescription: "thread-dumps",
+		inspectsRuntime:  true,
+		unavailability: func(runtime string, tools map[string]bool) string {
+			switch {
+			case runtime == utils.RuntimeNativeImage && !tools["eu-stack"] && !tools["gdb"]:
+				return "neither eu-stack nor gdb found in the container"
+			}
+			return ""
+		},
+	},
+	{
+		Name:             signalDumpCommand,
+		Description:      "Send SIGQUIT to the JVM of the app and print the thread dump it writes into the app logs, for containers that block the tools attaching to the JVM",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "all-instances", "guid", "route", "dry-run", "no-cache", "record", "verbose"},
+		Examples:         []string{"cf java signal-dump my_app > my_app-threads.txt", "cf java signal-dump my_app -i 1"},
+		flagsDescription: signalDumpCommand,
+		inspectsRuntime:  true,
+		unavailability: func(runtime string, tools map[string]bool) string {
+			if runtime == utils.RuntimeOpenJ9 {
+				return "OpenJ9 writes the thread dump upon SIGQUIT into a javacore file instead of the app logs"
+			}
+			return ""
+		},
+	},
+	{
+		Name:             vmLogCommand,
+		Description:      "Enable or disable the unified logging of the JVM into a file in the container, or list its configuration",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "guid", "route", "keep", "dry-run", "what", "output", "disable", "local-dir", "organize", "limit-rate", "no-create", "force", "progress", "no-cache", "record", "verbose"},
+		OutputFile:       "log of the JVM, fetched with -disable and -local-dir",
+		Examples:         []string{"cf java vm-log my_app -what gc=debug -output /tmp/gc.log", "cf java vm-log my_app -disable -output /tmp/gc.log -local-dir ~/logs", "cf java vm-log my_app"},
+		flagsDescription: vmLogCommand,
+		inspectsRuntime:  true,
+		unavailability: func(runtime string, tools map[string]bool) string {
+			switch {
+			case runtime != utils.RuntimeHotSpot:
+				return "unified logging is only available on HotSpot-based JVMs"
+			case !tools["jcmd"]:
+				return "jcmd not found in the container"
+			}
+			return ""
+		},
+	},
+	{
+		Name:             gcLogsCommand,
+		Description:      "List the GC log files of the app, print them as the JVM writes them, or download them",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "guid", "route", "follow", "local-dir", "organize", "limit-rate", "no-create", "force", "archive", "progress", "record", "verbose"},
+		OutputFile:       "GC log files, downloaded with -local-dir",
+		Examples:         []string{"cf java gc-logs my_app -follow", "cf java gc-logs my_app -i 1 -local-dir ~/logs"},
+		flagsDescription: gcLogsCommand,
+		unavailability: func(runtime string, tools map[string]bool) string {
+			if runtime == utils.RuntimeNativeImage {
+				return "GraalVM native images write no GC log files"
+			}
+			return ""
+		},
+	},
+	{
+		Name:             crashReportCommand,
+		Description:      "List the hs_err and replay files of crashed JVMs in the container of the app, or download the newest ones",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "guid", "route", "container-dir", "local-dir", "organize", "limit-rate", "no-create", "force", "delete", "archive", "progress", "record", "verbose"},
+		OutputFile:       "hs_err file and replay file of the most recent crash, downloaded with -local-dir",
+		Examples:         []string{"cf java crash-report my_app", "cf java crash-report my_app -container-dir /var/crashes -local-dir ~/crashes -archive"},
+		flagsDescription: crashReportCommand,
+	},
+	{
+		Name:             attachAgentCommand,
+		Description:      "Upload a Java agent into the container of the app and load it into the running JVM",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "guid", "route", "dry-run", "container-dir", "jar", "options", "no-cache", "record", "verbose"},
+		Examples:         []string{"cf java attach-agent my_app -jar ./my-agent.jar -options key=value"},
+		flagsDescription: attachAgentCommand,
+		inspectsRuntime:  true,
+		unavailability: func(runtime string, tools map[string]bool) string {
+			switch {
+			case runtime != utils.RuntimeHotSpot:
+				return "Java agents can only be loaded at runtime into HotSpot-based JVMs"
+			case !tools["jcmd"]:
+				return "jcmd not found in the container"
+			}
+			return ""
+		},
+	},
+	{
+		Name:             jolokiaCommand,
+		Description:      "Load the Jolokia agent into the running JVM of the app and forward its port locally, for JMX access over HTTP",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "guid", "route", "dry-run", "container-dir", "jar", "options", "local-port", "no-cache", "record", "verbose"},
+		Examples:         []string{"cf java jolokia my_app", "cf java jolokia my_app -i 1 -local-port 9778 -jar ./jolokia-agent-jvm-javaagent.jar"},
+		flagsDescription: jolokiaCommand,
+		inspectsRuntime:  true,
+		unavailability: func(runtime string, tools map[string]bool) string {
+			switch {
+			case runtime != utils.RuntimeHotSpot:
+				return "Java agents can only be loaded at runtime into HotSpot-based JVMs"
+			case !tools["jcmd"]:
+				return "jcmd not found in the container"
+			}
+			return ""
+		},
+	},
+	{
+		Name:             histoDiffCommand,
+		Description:      "Compare two class histograms of the app and print the classes with the biggest growth",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "guid", "route", "interval", "baseline", "save", "record", "verbose"},
+		Examples:         []string{"cf java histo-diff my_app -interval 5m", "cf java histo-diff my_app -save histo-monday.txt", "cf java histo-diff my_app -baseline histo-monday.txt"},
+		flagsDescription: histoDiffCommand,
+		unavailability: func(runtime string, tools map[string]bool) string {
+			switch {
+			case runtime == utils.RuntimeNativeImage:
+				return "GraalVM native images cannot create class histograms"
+			case !tools["jcmd"] && !tools["jmap"]:
+				return "neither jcmd nor jmap found in the container"
+			}
+			return ""
+		},
+	},
+	{
+		Name:             monitorCommand,
+		Description:      "Sample the heap, GC, threads and CPU usage of the app for some time and write them as CSV",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "guid", "route", "dry-run", "duration", "interval", "out", "alert", "progress", "no-cache", "record", "verbose"},
+		OutputFile:       "CSV file with one row per sample, with -out",
+		Examples:         []string{"cf java monitor my_app -duration 30m -out metrics.csv", "cf java monitor my_app -duration 2m -interval 5s", "cf java monitor my_app -duration 1h -alert 'heap>90%,threads>500'"},
+		flagsDescription: monitorCommand,
+		inspectsRuntime:  true,
+		keepalive:        true,
+		unavailability: func(runtime string, tools map[string]bool) string {
+			switch {
+			case runtime != utils.RuntimeHotSpot:
+				return "jstat can only sample HotSpot-based JVMs"
+			case !tools["jstat"]:
+				return "jstat not found in the container"
+			}
+			return ""
+		},
+	},
+	{
+		Name:             watchOOMCommand,
+		Description:      "Wait for the JVM of the app to write a heap dump or hs_err file upon an OutOfMemoryError or a crash, and download it together with a thread dump",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "guid", "route", "dry-run", "container-dir", "local-dir", "organize", "limit-rate", "no-create", "force", "delete", "progress", "no-cache", "record", "verbose"},
+		OutputFile:       "heap dump, hs_err file and thread dump written upon an OutOfMemoryError or a crash, in the local directory",
+		Examples:         []string{"cf java watch-oom my_app -local-dir ~/dumps", "cf java watch-oom my_app -i 2 -container-dir /var/dumps -delete"},
+		flagsDescription: watchOOMCommand,
+		inspectsRuntime:  true,
+		keepalive:        true,
+		unavailability: func(runtime string, tools map[string]bool) string {
+			if runtime == utils.RuntimeNativeImage {
+				return "GraalVM native images write no heap dump upon an OutOfMemoryError"
+			}
+			return ""
+		},
+	},
+	{
+		Name:               checkpointCommand,
+		Description:        "Checkpoint the JVM of the app with CRaC, which stops it, for restoring it later with a faster startup",
+		Arguments:          []string{"APP_NAME"},
+		Flags:              []string{"app-instance-index", "guid", "route", "dry-run", "force", "no-cache", "record", "verbose"},
+		OutputFile:         "CRaC image in the directory given to the JVM with -XX:CRaCCheckpointTo, in the container",
+		RequiresSapMachine: true,
+		Examples:           []string{"cf java checkpoint my_app -i 1", "cf java checkpoint my_app -force"},
+		flagsDescription:   checkpointCommand,
+		inspectsRuntime:    true,
+		keepalive:          true,
+		unavailability:     cracUnavailability,
+	},
+	{
+		Name:               cracStatusCommand,
+		Description:        "Print the CRaC options of the JVM of the app and the files in its checkpoint directory",
+		Arguments:          []string{"APP_NAME"},
+		Flags:              []string{"app-instance-index", "all-instances", "guid", "route", "dry-run", "no-cache", "record", "verbose"},
+		RequiresSapMachine: true,
+		Examples:           []string{"cf java crac-status my_app"},
+		flagsDescription:   cracStatusCommand,
+		inspectsRuntime:    true,
+		unavailability:     cracUnavailability,
+	},
+	{
+		Name:             cdsCommand,
+		Description:      "Print the CDS archives and AOT caches the JVM of the app uses, dump the loaded classes into a CDS archive with jcmd VM.cds and download it if a local directory is given",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "guid", "route", "keep", "dry-run", "dynamic", "container-dir", "local-dir", "organize", "limit-rate", "no-create", "force", "progress", "no-cache", "record", "verbose"},
+		OutputFile:       "CDS archive of the classes loaded by the JVM, for -XX:SharedArchiveFile",
+		Examples:         []string{"cf java cds my_app -local-dir ~/cds", "cf java cds my_app -dynamic -local-dir ~/cds"},
+		flagsDescription: cdsCommand,
+		inspectsRuntime:  true,
+		unavailability: func(runtime string, tools map[string]bool) string {
+			switch {
+			case runtime != utils.RuntimeHotSpot:
+				return "CDS archives can only be dumped at runtime by HotSpot-based JVMs"
+			case !tools["jcmd"]:
+				return "jcmd not found in the container"
+			}
+			return ""
+		},
+	},
+	{
+		Name:             remoteListCommand,
+		Description:      "List the files left behind by the plugin in the container of the app",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "guid", "route", "dry-run", "container-dir", "older-than", "record", "verbose"},
+		Examples:         []string{"cf java remote-list my_app -older-than 7d"},
+		flagsDescription: remoteListCommand,
+	},
+	{
+		Name:             remoteCleanCommand,
+		Description:      "Remove the files left behind by the plugin in the container of the app",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "guid", "route", "dry-run", "container-dir", "older-than", "record", "verbose"},
+		Examples:         []string{"cf java remote-clean my_app -i 2 -older-than 1d"},
+		flagsDescription: remoteCleanCommand,
+	},
+	{
+		Name:             downloadCommand,
+		Description:      "Download the most recent file matching a path or pattern from the container of the app",
+		Arguments:        []string{"APP_NAME", "REMOTE_PATH_OR_PATTERN"},
+		Flags:            []string{"app-instance-index", "guid", "route", "local-dir", "organize", "limit-rate", "no-create", "force", "resume", "delete", "progress", "record", "verbose"},
+		OutputFile:       "the file downloaded from the container",
+		Examples:         []string{"cf java download my_app '/tmp/my_app-heapdump-*.hprof' -local-dir ~/dumps -delete"},
+		flagsDescription: downloadCommand,
+	},
+	{
+		Name:             cpCommand,
+		Description:      "Copy a file from the container of the app to a local file or directory, like download",
+		Arguments:        []string{"APP_NAME", "REMOTE_PATH", "[LOCAL_PATH]"},
+		Flags:            []string{"app-instance-index", "guid", "route", "limit-rate", "no-create", "force", "resume", "delete", "progress", "record", "verbose"},
+		OutputFile:       "the file copied from the container, into the working directory unless LOCAL_PATH is given",
+		Examples:         []string{"cf java cp my_app /home/vcap/app/logs/app.log", "cf java cp my_app /tmp/config.yml ./my_app-config.yml -i 1", "cf java cp my_app '/tmp/*.jfr' ~/recordings/"},
+		flagsDescription: cpCommand,
+	},
+	{
+		Name:             pushFileCommand,
+		Description:      "Upload a local file, e.g., JFR settings, an agent jar or a script, into a writable directory of the container of the app",
+		Arguments:        []string{"APP_NAME", "LOCAL_FILE", "REMOTE_DIR"},
+		Flags:            []string{"app-instance-index", "guid", "route", "max-size", "progress", "record", "verbose"},
+		Examples:         []string{"cf java push-file my_app ./profile.jfc /tmp", "cf java push-file my_app ./my-agent.jar auto:largest -max-size 500M"},
+		flagsDescription: pushFileCommand,
+	},
+	{
+		Name:             execCommand,
+		Description:      "Run a command in the container of the app, with the PID of the JVM and the paths of the Java tools exported as environment variables",
+		Arguments:        []string{"APP_NAME", "-- COMMAND..."},
+		Flags:            []string{"app-instance-index", "all-instances", "guid", "route", "dry-run", "no-cache", "record", "verbose"},
+		Examples:         []string{"cf java exec my_app -- '${JCMD_COMMAND} ${JAVA_PID} VM.uptime'", "cf java exec my_app -i 1 -- '${JSTAT_COMMAND} -gcutil ${JAVA_PID} 1000 10'"},
+		flagsDescription: execCommand,
+		inspectsRuntime:  true,
+		keepalive:        true,
+	},
+	{
+		Name:             sshCommand,
+		Description:      "Open an interactive shell in the container of the app, with the JDK tools and asprof on the PATH and the PID of the JVM in JAVA_PID",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "guid", "route", "dry-run", "no-cache", "verbose"},
+		Examples:         []string{"cf java ssh my_app", "cf java ssh my_app -i 1"},
+		flagsDescription: sshCommand,
+		inspectsRuntime:  true,
+	},
+	{
+		Name:             whereIsCommand,
+		Description:      "Print the absolute paths of the java binary of the JVM and of the Java tools the plugin uses in the container of the app",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "all-instances", "guid", "route", "dry-run", "no-cache", "record", "verbose"},
+		Examples:         []string{"cf java where-is my_app", "cf java where-is my_app -i 1", "cf java where-is my_app -all-instances"},
+		flagsDescription: whereIsCommand,
+		inspectsRuntime:  true,
+	},
+	{
+		Name:             runtimeInfoCommand,
+		Description:      "Print the buildpacks and stack of the app, the version and memory settings of its JVM, the settings of the memory calculator and the JBP_CONFIG_* environment variables",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "all-instances", "guid", "route", "dry-run", "no-cache", "record", "verbose"},
+		Examples:         []string{"cf java runtime-info my_app", "cf java runtime-info my_app -i 1"},
+		flagsDescription: runtimeInfoCommand,
+		inspectsRuntime:  true,
+	},
+	{
+		Name:             memoryAdviseCommand,
+		Description:      "Compare the memory limit of the app with the memory settings and usage of its JVM, and suggest adjustments of the heap, metaspace and thread stacks",
+		Arguments:        []string{"APP_NAME"},
+		Flags:            []string{"app-instance-index", "all-instances", "guid", "route", "dry-run", "no-cache", "record", "verbose"},
+		Examples:         []string{"cf java memory-advise my_app", "cf java memory-advise my_app -i 1"},
+		flagsDescription: memoryAdviseCommand,
+		inspectsRuntime:  true,
+		unavailability: func(runtime string, tools map[string]bool) string {
+			switch {
+			case runtime != utils.RuntimeHotSpot:
+				return "the memory settings can only be read from HotSpot-based JVMs"
+			case !tools["jcmd"]:
+				return "jcmd not found in the container"
+			}
+			return ""
+		},
+	},
+	{
+		Name:               vitalsHistoryCommand,
+		Description:        "Chart the history of the SapMachine Vitals of the app, e.g., its heap and RSS over the last hours, or save it as CSV, and download the vitals files of the JVM if a local directory is given",
+		Arguments:          []string{"APP_NAME"},
+		Flags:              []string{"app-instance-index", "guid", "route", "dry-run", "out", "local-dir", "organize", "limit-rate", "no-create", "force", "progress", "no-cache", "record", "verbose"},
+		OutputFile:         "CSV of the SapMachine Vitals with -out, and the files written by the JVM with -XX:VitalsFile",
+		RequiresSapMachine: true,
+		Examples:           []string{"cf java vitals-history my_app", "cf java vitals-history my_app -out vitals.csv", "cf java vitals-history my_app -local-dir ~/vitals"},
+		flagsDescription:   vitalsHistoryCommand,
+		inspectsRuntime:    true,
+		unavailability: func(runtime string, tools map[string]bool) string {
+			switch {
+			case runtime != utils.RuntimeHotSpot:
+				return "the SapMachine Vitals are only available in SapMachine"
+			case !tools["jcmd"]:
+				return "jcmd not found in the container"
+			}
+			return ""
+		},
+	},
+	{
+		Name:             verifyInstallCommand,
+		Description:      "Check the installed plugin binary against the published release",
+		Arguments:        []string{},
+		Flags:            []string{"verbose"},
+		Examples:         []string{"cf java verify-install"},
+		flagsDescription: verifyInstallCommand,
+	},
+	{
+		Name:             threadAnalysisCommand,
+		Description:      "Compare thread dumps taken one after the other and report hot threads, contended locks and saturated thread pools",
+		Arguments:        []string{"THREAD_DUMP_FILE..."},
+		Flags:            []string{},
+		Examples:         []string{"cf java thread-analysis threads-1.txt threads-2.txt threads-3.txt"},
+		flagsDescription: threadAnalysisCommand,
+	},
+	{
+		Name:             commandsCommand,
+		Description:      "List the commands of the plugin, or check which of them work for the given app",
+		Arguments:        []string{"[APP_NAME]"},
+		Flags:            []string{"app-instance-index", "json"},
+		Examples:         []string{"cf java commands -json", "cf java commands my_app -i 1"},
+		flagsDescription: commandsCommand,
+	},
+	{
+		Name:             examplesCommand,
+		Description:      "Print examples of invocations of all commands, or of the given one",
+		Arguments:        []string{"[COMMAND]"},
+		Flags:            []string{},
+		Examples:         []string{"cf java examples", "cf java examples heap-dump"},
+		flagsDescription: examplesCommand,
+	},
+	{
+		Name:             lintCommandsCommand,
+		Description:      "Check the definitions of the custom commands, in the given file or in cf-java-plugin.yml next to the plugins of the cf CLI",
+		Arguments:        []string{"[FILE]"},
+		Flags:            []string{},
+		Examples:         []string{"cf java lint-commands", "cf java lint-commands ./team-commands.yml"},
+		flagsDescription: lintCommandsCommand,
+	},
+	{
+		Name:             serveCommand,
+		Description:      "Serve the commands over JSON-RPC on a local socket, e.g., for IDEs, until interrupted",
+		Arguments:        []string{},
+		Flags:            []string{"socket"},
+		Examples:         []string{"cf java serve", "cf java serve -socket /tmp/cf-java.sock"},
+		flagsDescription: serveCommand,
+	},
+}
+
+// findCommand returns the command with the given name
+func findCommand(name string) (Command, bool) {
+	for _, command := range commands {
+		if command.Name == name {
+			return command, true
+		}
+	}
+
+	return Command{}, false
+}
+
+// findBuiltinCommand returns the command of the plugin with the given name
+func findBuiltinCommand(name string) (Command, bool) {
+	for _, command := range builtinCommands {
+		if command.Name == name {
+			return command, true
+		}
+	}
+
+	return Command{}, false
+}
+
+// commandNames returns the names of all commands, quoted and in prose, e.g., "'a', 'b' and 'c'"
+func commandNames() string {
+	names := make([]string, len(commands))
+	for i, command := range commands {
+		names[i] = "'" + command.Name + "'"
+	}
+
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// commandsUsage returns the usage lines of the commands, grouping the commands taking the same arguments
+func commandsUsage() string {
+	var arguments []string
+	names := map[string][]string{}
+	for _, command := range commands {
+		key := strings.Join(command.Arguments, " ")
+		if _, ok := names[key]; !ok {
+			arguments = append(arguments, key)
+		}
+		names[key] = append(names[key], command.Name)
+	}
+
+	lines := make([]string, len(arguments))
+	for i, key := range arguments {
+		line := "cf java " + names[key][0]
+		if len(names[key]) > 1 {
+			line = "cf java [" + strings.Join(names[key], "|") + "]"
+		}
+		if key != "" {
+			line += " " + key
+		}
+		lines[i] = line
+	}
+
+	return strings.Join(lines, "\n   ")
+}
+
+// pluginCommandPrefix prefixes the names under which the commands are registered with the cf CLI on their own
+const pluginCommandPrefix = "java-"
+
+// pluginCommand returns the command as registered with the cf CLI on its own, e.g., cf java-heap-dump, with the given
+// options of the plugin that it supports
+func (command Command) pluginCommand(options map[string]string) plugin.Command {
+	supported := map[string]string{}
+	for _, flag := range command.Flags {
+		supported[flag] = options[flag]
+	}
+	// Every command can run with another configuration of the cf CLI, see cfHomeFlag
+	supported[cfHomeFlag] = options[cfHomeFlag]
+
+	return plugin.Command{
+		Name:     pluginCommandPrefix + command.Name,
+		HelpText: command.Description,
+		UsageDetails: plugin.Usage{
+			Usage:   strings.TrimSpace("cf " + pluginCommandPrefix + command.Name + " " + strings.Join(command.Arguments, " ")),
+			Options: supported,
+		},
+	}
+}
+
+// usage returns the usage line of the command
+func (command Command) usage() string {
+	return strings.TrimSpace("cf java " + command.Name + " " + strings.Join(command.Arguments, " "))
+}
+
+// help returns the help of the command, describing the given options of the plugin that the command supports
+func (command Command) help(options map[string]string) string {
+	lines := []string{command.Name + " - " + command.Description, "", "USAGE:", "   " + command.usage()}
+
+	// Every command can run with another configuration of the cf CLI, see cfHomeFlag
+	lines = append(lines, "", "OPTIONS:")
+	for _, flag := range append(command.Flags[:len(command.Flags):len(command.Flags)], cfHomeFlag) {
+		lines = append(lines, fmt.Sprintf("   %-26s%s", "-"+flag, options[flag]))
+	}
+
+	if len(command.Examples) > 0 {
+		lines = append(lines, "", "EXAMPLES:")
+		for _, example := range command.Examples {
+			lines = append(lines, "   "+example)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// appCommand tells whether the command works on an app, which it then takes as first argument
+func (command Command) appCommand() bool {
+	return len(command.Arguments) > 0 && command.Arguments[0] == "APP_NAME"
+}
+
+// optionalArguments returns the number of trailing arguments of the command that may be omitted, e.g., "[LOCAL_PATH]"
+func (command Command) optionalArguments() int {
+	count := 0
+	for i := len(command.Arguments) - 1; i >= 0 && strings.HasPrefix(command.Arguments[i], "["); i-- {
+		count++
+	}
+
+	return count
+}
+
+// passthrough tells whether the command takes a command to run in the container after "--", e.g., "-- COMMAND..."
+func (command Command) passthrough() bool {
+	return len(command.Arguments) > 0 && strings.HasPrefix(command.Arguments[len(command.Arguments)-1], "-- ")
+}
+
+// variadic tells whether the last argument of the command can be repeated, e.g., "FILE..."
+func (command Command) variadic() bool {
+	return len(command.Arguments) > 0 && strings.HasSuffix(command.Arguments[len(command.Arguments)-1], "...")
+}
+
+// supportsFlag tells whether the command supports the given flag
+func (command Command) supportsFlag(flag string) bool {
+	for _, supported := range command.Flags {
+		if supported == flag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkSupportedFlags returns an InvalidUsageError if any of the given flags is set but not supported by the command
+func checkSupportedFlags(commandFlags flags.FlagContext, command Command, allFlags []string) error {
+	for _, flag := range allFlags {
+		// The instance index has a default value, which makes it always set
+		if flag == "app-instance-index" && commandFlags.Int(flag) < 0 {
+			continue
+		}
+		if !command.supportsFlag(flag) {
+			if err := checkUnsupportedFlags(commandFlags, command.flagsDescription, flag); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// cracUnavailability tells why CRaC cannot be used in a container with the given runtime and tools
+func cracUnavailability(runtime string, tools map[string]bool) string {
+	switch {
+	case runtime != utils.RuntimeHotSpot:
+		return "CRaC is only available on HotSpot-based JVMs like SapMachine"
+	case !tools["jcmd"]:
+		return "jcmd not found in the container"
+	}
+	return ""
+}
+
+// listCommands prints the table of commands, as JSON for external tools or as text for humans
+func listCommands(asJSON bool) (string, error) {
+	if asJSON {
+		catalog, err := json.MarshalIndent(commands, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(catalog), nil
+	}
+
+	lines := make([]string, len(commands))
+	for i, command := range commands {
+		lines[i] = fmt.Sprintf("%-16s%s", command.Name, command.Description)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// listExamples prints the examples of all commands, or of the command with the given name
+func listExamples(name string) (string, error) {
+	selected := commands
+	if name != "" {
+		command, found := findCommand(name)
+		if !found {
+			return "", &InvalidUsageError{message: fmt.Sprintf("Unrecognized command %q: supported commands are %s (see cf help)", name, commandNames())}
+		}
+		selected = []Command{command}
+	}
+
+	var lines []string
+	for _, command := range selected {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "# "+command.Description)
+		lines = append(lines, command.Examples...)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// checkCommands probes the container of the app and reports which commands work there
+func checkCommands(util utils.CfJavaPluginUtil, app string, instance int, asJSON bool) (string, error) {
+	if instance < 0 {
+		instance = 0
+	}
+	if err := util.CheckAppInstance(app, instance); err != nil {
+		return "", err
+	}
+
+	cfSSHArguments := []string{"ssh", app}
+	if instance > 0 {
+		cfSSHArguments = append(cfSSHArguments, "--app-instance-index", strconv.Itoa(instance))
+	}
+	cfSSHArguments = append(cfSSHArguments, "--command")
+
+	runtime, err := util.DetectRuntime(cfSSHArguments)
+	if err != nil {
+		return "", err
+	}
+	tools, err := util.FindTools(cfSSHArguments, containerTools)
+	if err != nil {
+		return "", err
+	}
+
+	availabilities := make([]commandAvailability, 0, len(commands))
+	for _, command := range commands {
+		if !command.appCommand() {
+			continue
+		}
+		availability := commandAvailability{Name: command.Name, Available: true}
+		if command.unavailability != nil {
+			availability.Reason = command.unavailability(runtime, tools)
+			availability.Available = availability.Reason == ""
+		}
+		availabilities = append(availabilities, availability)
+	}
+
+	if asJSON {
+		report, err := json.MarshalIndent(availabilities, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(report), nil
+	}
+
+	lines := []string{"Runtime: " + runtime}
+	for _, availability := range availabilities {
+		status := "available"
+		if !availability.Available {
+			status = "unavailable: " + availability.Reason
+		}
+		lines = append(lines, fmt.Sprintf("%-16s%s", availability.Name, status))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// sortedKeys returns the keys of the map in lexical order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
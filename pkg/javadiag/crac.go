@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import "utils"
+
+// CRaC, i.e., Coordinated Restore at Checkpoint, writes the state of the JVM into the directory given with
+// -XX:CRaCCheckpointTo, from which a new JVM is restored with -XX:CRaCRestoreFrom. The JVM stops once the checkpoint
+// is written, so Cloud Foundry restarts the app instance in a new container afterwards.
+
+// cracCheckpointDir is the command setting CRAC_DIR to the checkpoint directory the JVM was started with, or to an
+// empty string if it was not started with CRaC; it needs JCMD_COMMAND
+func cracCheckpointDir(shell shellDialect) string {
+	return "CRAC_DIR=`${JCMD_COMMAND} " + shell.javaPID + " VM.command_line | grep -o -- '-XX:CRaCCheckpointTo=[^ ]*' | head -1 | cut -d = -f 2`"
+}
+
+// cracStatusCommands returns the remote commands printing the CRaC options of the JVM and the files in its checkpoint
+// directory
+func cracStatusCommands(shell shellDialect) []string {
+	return []string{
+		"JCMD_COMMAND=`" + shell.findExecutable("jcmd") + " | head -1 | tr -d [:space:]`",
+		"if [ -z \"${JCMD_COMMAND}\" ]; then echo >&2 'jcmd is required for CRaC, please make sure that the app runs on a full JDK'; exit 1; fi",
+		cracCheckpointDir(shell),
+		"if [ -z \"${CRAC_DIR}\" ]; then echo 'CRaC is not enabled: the JVM was not started with -XX:CRaCCheckpointTo'; exit 0; fi",
+		"${JCMD_COMMAND} " + shell.javaPID + " VM.command_line | grep -o -- '-XX:[+-]*CRaC[^ ]*'",
+		"echo \"Checkpoint directory ${CRAC_DIR}:\"; ls -l \"${CRAC_DIR}\" 2>/dev/null || echo '(empty)'",
+	}
+}
+
+// checkpointCommands returns the remote commands checkpointing the JVM with jcmd JDK.checkpoint, after checking that
+// it was started with CRaC
+func checkpointCommands(shell shellDialect) []string {
+	return []string{
+		"JCMD_COMMAND=`" + shell.findExecutable("jcmd") + " | head -1 | tr -d [:space:]`",
+		"if [ -z \"${JCMD_COMMAND}\" ]; then echo >&2 'jcmd is required for CRaC, please make sure that the app runs on a full JDK'; exit 1; fi",
+		cracCheckpointDir(shell),
+		"if [ -z \"${CRAC_DIR}\" ]; then echo >&2 'The JVM was not started with -XX:CRaCCheckpointTo, add it to JAVA_OPTS on a JDK with CRaC, like SapMachine, and restart the app'; exit 1; fi",
+		"echo \"Checkpointing the JVM into ${CRAC_DIR}\"",
+		"${JCMD_COMMAND} " + shell.javaPID + " JDK.checkpoint",
+	}
+}
+
+// checkpointNotice tells what happens to the app instance and the checkpoint once the JVM stopped
+func checkpointNotice(applicationName string) string {
+	return "The JVM stops once the checkpoint is written, and Cloud Foundry restarts the app instance in a new container: " +
+		"the checkpoint is lost with the old container unless its directory is on a volume service. " +
+		"Start the JVM with -XX:CRaCRestoreFrom=<directory> to restore from it, and check `cf logs " + utils.ShellWord(applicationName) + " --recent` for the result of the checkpoint."
+}
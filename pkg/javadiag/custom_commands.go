@@ -0,0 +1,287 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"utils"
+)
+
+// The placeholders in the command of a customCommand
+const (
+	fileNamePlaceholder = "@FILE_NAME"
+	argsPlaceholder     = "@ARGS"
+)
+
+var (
+	// placeholderPattern matches the placeholders in the command of a customCommand, e.g., @FILE_NAME
+	placeholderPattern = regexp.MustCompile(`@[A-Z][A-Z_]*`)
+	// toolVariablePattern matches the environment variables with the paths of the tools, e.g., ${JCMD_COMMAND}
+	toolVariablePattern = regexp.MustCompile(`\$\{?([A-Z_]+)_COMMAND\b`)
+)
+
+// customCommandsFile returns the YAML file defining the custom commands. Visible for tests
+var customCommandsFile = defaultCustomCommandsFile
+
+// defaultCustomCommandsFile returns the file next to the plugins of the cf CLI
+func defaultCustomCommandsFile() (string, error) {
+	dir, err := pluginsDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "cf-java-plugin.yml"), nil
+}
+
+// customCommand is a command defined by the user in the customCommandsFile, e.g.:
+//
+//	commands:
+//	- name: class-histogram-all
+//	  description: Print the class histogram of the JVM, including the unreachable objects
+//	  command: ${JCMD_COMMAND} ${JAVA_PID} GC.class_histogram -all @ARGS
+//	- name: jfr
+//	  description: Record the JVM with Java Flight Recorder for a minute and download the recording
+//	  command: ${JCMD_COMMAND} ${JAVA_PID} JFR.start duration=60s filename=@FILE_NAME && sleep 65
+//	  generateFiles: true
+//	  fileExtension: .jfr
+//
+// The command runs in the container like the one of exec, with the same environment variables, and with @ARGS
+// replaced by the value of the flag "args", see remoteCommands. If it generates a file, @FILE_NAME is replaced by the
+// file in the container to write, which is then downloaded and removed like a heap dump.
+type customCommand struct {
+	Name          string `yaml:"name"`
+	Description   string `yaml:"description"`
+	Command       string `yaml:"command"`
+	GenerateFiles bool   `yaml:"generateFiles"`
+	FileExtension string `yaml:"fileExtension"`
+}
+
+// customCommands is the content of the customCommandsFile
+type customCommands struct {
+	Commands []customCommand `yaml:"commands"`
+}
+
+// readCustomCommands returns the commands defined in the given file, none if there is no such file
+func readCustomCommands(file string) ([]customCommand, error) {
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config customCommands
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{}
+	for _, command := range config.Commands {
+		switch {
+		case command.Name == "" || strings.ContainsAny(command.Name, " \t\n") || strings.HasPrefix(command.Name, "-"):
+			return nil, fmt.Errorf("invalid command name %q", command.Name)
+		case names[command.Name]:
+			return nil, fmt.Errorf("the command %q is defined more than once", command.Name)
+		case strings.TrimSpace(command.Command) == "":
+			return nil, fmt.Errorf("the command %q has no command to run in the container", command.Name)
+		}
+		if _, builtin := findBuiltinCommand(command.Name); builtin {
+			return nil, fmt.Errorf("the command %q would replace the command of the plugin with the same name", command.Name)
+		}
+		names[command.Name] = true
+	}
+
+	return config.Commands, nil
+}
+
+// loadCommands sets the commands to the builtinCommands followed by the custom ones. Should the customCommandsFile not
+// be readable, the commands are just the builtinCommands and the error tells why.
+func loadCommands() error {
+	commands = builtinCommands
+
+	file, err := customCommandsFile()
+	if err != nil {
+		return nil
+	}
+	custom, err := readCustomCommands(file)
+	if err != nil {
+		return errors.New("Ignoring the custom commands in " + file + ": " + err.Error())
+	}
+
+	commands = append(append([]Command{}, builtinCommands...), make([]Command, len(custom))...)
+	for i, command := range custom {
+		commands[len(builtinCommands)+i] = command.tableEntry()
+	}
+
+	return nil
+}
+
+// tableEntry returns the command for the table of commands
+func (command customCommand) tableEntry() Command {
+	flags := []string{"app-instance-index", "guid", "route", "args", "dry-run"}
+	examples := []string{"cf java " + command.Name + " my_app"}
+	if command.GenerateFiles {
+		flags = append(flags, "keep", "container-dir", "local-dir", "organize", "limit-rate", "no-create", "force", "progress")
+		examples = append(examples, "cf java "+command.Name+" my_app -local-dir ~/"+command.Name)
+	}
+
+	description := command.Description
+	if description == "" {
+		description = "Run the custom command " + command.Name
+	}
+
+	custom := command
+	return Command{
+		Name:             command.Name,
+		Description:      description,
+		Arguments:        []string{"APP_NAME"},
+		Flags:            append(flags, "no-cache", "record", "verbose"),
+		Examples:         examples,
+		Custom:           true,
+		flagsDescription: command.Name,
+		inspectsRuntime:  true,
+		keepalive:        true,
+		custom:           &custom,
+	}
+}
+
+// argsVariable is the environment variable holding the value of the flag "args" in the container
+const argsVariable = "CF_JAVA_ARGS"
+
+// remoteCommands returns the commands to run in the container, with the placeholders replaced by the file to generate
+// and the arguments. The arguments of the flag "args" are not inserted as they are, as their quotes, semicolons or
+// $(...) would be run by the shell, but passed in the argsVariable: the shell splits its value into words where @ARGS
+// is not quoted, and keeps it as it is where @ARGS is in double quotes. The toolArguments given after "--" are
+// inserted quoted instead, each as one word exactly as typed.
+func (command customCommand) remoteCommands(fileName string, args string, toolArguments []string) []string {
+	if toolArguments != nil {
+		quoted := make([]string, len(toolArguments))
+		for i, argument := range toolArguments {
+			quoted[i] = utils.ShellQuote(argument)
+		}
+		return []string{strings.NewReplacer(fileNamePlaceholder, fileName, argsPlaceholder, strings.Join(quoted, " ")).Replace(command.Command)}
+	}
+
+	remoteCommand := strings.NewReplacer(fileNamePlaceholder, fileName, argsPlaceholder, "${"+argsVariable+"}").Replace(command.Command)
+	if !strings.Contains(command.Command, argsPlaceholder) {
+		return []string{remoteCommand}
+	}
+
+	return []string{"export " + argsVariable + "=" + utils.ShellQuote(args), remoteCommand}
+}
+
+// lint returns the problems of the definition of the command that would make it fail in the container, or do other
+// than intended
+func (command customCommand) lint() []string {
+	var problems []string
+	for _, placeholder := range placeholderPattern.FindAllString(command.Command, -1) {
+		if placeholder != fileNamePlaceholder && placeholder != argsPlaceholder {
+			problems = append(problems, "unknown placeholder "+placeholder+", supported are "+fileNamePlaceholder+" and "+argsPlaceholder)
+		}
+	}
+	for _, match := range toolVariablePattern.FindAllStringSubmatch(command.Command, -1) {
+		if !containsString(execTools, strings.ToLower(match[1])) {
+			problems = append(problems, "unknown variable "+match[1]+"_COMMAND, the paths of "+strings.Join(execTools, ", ")+" are exported")
+		}
+	}
+
+	usesFile := strings.Contains(command.Command, fileNamePlaceholder)
+	if command.GenerateFiles {
+		if command.FileExtension == "" {
+			problems = append(problems, "generateFiles without fileExtension, the file would have none")
+		}
+		if !usesFile {
+			problems = append(problems, "generateFiles without "+fileNamePlaceholder+" in the command, which names the file to write")
+		}
+	} else {
+		if usesFile {
+			problems = append(problems, fileNamePlaceholder+" without generateFiles, it would be replaced by nothing")
+		}
+		if command.FileExtension != "" {
+			problems = append(problems, "fileExtension without generateFiles, it would not be used")
+		}
+	}
+	if command.FileExtension != "" && (!strings.HasPrefix(command.FileExtension, ".") || strings.ContainsAny(command.FileExtension, " /'\"$`")) {
+		problems = append(problems, "invalid fileExtension "+command.FileExtension+", expected a dot followed by letters, e.g., .jfr")
+	}
+
+	if quote := unbalancedQuote(command.Command); quote != "" {
+		problems = append(problems, "unbalanced "+quote+" in the command")
+	}
+
+	return problems
+}
+
+// unbalancedQuote returns the kind of quote left open in the shell command, or an empty string if none is
+func unbalancedQuote(command string) string {
+	var open rune
+	escaped := false
+	for _, char := range command {
+		switch {
+		case escaped:
+			escaped = false
+		case char == '\\' && open != '\'':
+			escaped = true
+		case open == 0 && (char == '\'' || char == '"' || char == '`'):
+			open = char
+		case char == open:
+			open = 0
+		}
+	}
+
+	switch open {
+	case '\'':
+		return "single quote"
+	case '"':
+		return "double quote"
+	case '`':
+		return "backtick"
+	}
+	return ""
+}
+
+// lintCommands checks the definitions of the custom commands in the given file, or the customCommandsFile if none is
+// given, and fails if any of them has problems
+func lintCommands(file string) (string, error) {
+	if file == "" {
+		var err error
+		if file, err = customCommandsFile(); err != nil {
+			return "", err
+		}
+	}
+	if _, err := os.Stat(file); err != nil {
+		return "", errors.New("Cannot read the custom commands in " + file + ": " + err.Error())
+	}
+
+	custom, err := readCustomCommands(file)
+	if err != nil {
+		return "", errors.New("Invalid custom commands in " + file + ": " + err.Error())
+	}
+
+	var lines []string
+	for _, command := range custom {
+		for _, problem := range command.lint() {
+			lines = append(lines, command.Name+": "+problem)
+		}
+	}
+	if len(lines) == 1 {
+		return "", errors.New("1 problem found in the custom commands in " + file + ":\n" + lines[0])
+	} else if len(lines) > 1 {
+		return "", fmt.Errorf("%d problems found in the custom commands in %s:\n%s", len(lines), file, strings.Join(lines, "\n"))
+	}
+
+	return fmt.Sprintf("%d custom commands defined in %s, no problems found", len(custom), file), nil
+}
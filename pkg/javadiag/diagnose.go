@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"utils"
+)
+
+// brokenSession tells whether the ssh session of a remote command broke off before the command completed, which cf
+// ssh reports as "unexpected EOF"
+func brokenSession(output []string, err error) bool {
+	if err == nil {
+		return false
+	}
+	if strings.Contains(err.Error(), "EOF") {
+		return true
+	}
+	for _, line := range output {
+		if strings.Contains(line, "unexpected EOF") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// diagnoseBrokenSession returns the error explaining the most likely cause of a broken ssh session, told apart by the
+// state of the app instance afterwards, and how to run the command again
+func diagnoseBrokenSession(util utils.CfJavaPluginUtil, applicationName string, applicationInstance int, started time.Time, rerun string) error {
+	if applicationInstance < 0 {
+		applicationInstance = 0
+	}
+
+	message := "The connection to the container broke off with \"unexpected EOF\"."
+	state, uptime, err := util.GetInstanceState(applicationName, applicationInstance)
+	switch {
+	case err != nil:
+		message += " The state of the app instance could not be checked: " + err.Error()
+	case state != "RUNNING":
+		message += " The app instance is " + state + " now: it most likely crashed, e.g., it was killed for exceeding its memory limit, which jmap and the other tools attaching to the JVM need memory on top of the heap for."
+	case uptime < now().Sub(started):
+		message += " The app instance was restarted " + uptime.String() + " ago, while the command ran: it most likely crashed, e.g., it was killed for exceeding its memory limit, which jmap and the other tools attaching to the JVM need memory on top of the heap for."
+	default:
+		message += " The app instance is still running, so the session was most likely cut by the idle timeout of a load balancer or by the network."
+	}
+
+	return errors.New(message + "\nTo try again, run: " + rerun)
+}
+
+// copyOverCat downloads src into dest and, should the download fail midway, resumes it once, keeping the chunks
+// downloaded already. Should the download fail otherwise, the new local file is removed, see cleanupTasks.
+func copyOverCat(util utils.CfJavaPluginUtil, cfSSHArguments []string, src string, dest string, copyOptions utils.CopyOptions, messages io.Writer) error {
+	// An existing local file is never removed, unless it is overwritten anyway
+	if _, err := os.Stat(dest); !copyOptions.Resume && (os.IsNotExist(err) || copyOptions.Force) {
+		cleanup.addLocalFile(dest)
+	}
+
+	err := util.CopyOverCat(cfSSHArguments, src, dest, copyOptions)
+	_, transferFailed := err.(*utils.TransferError)
+	if transferFailed && !copyOptions.Resume {
+		fmt.Fprintln(messages, "The download of "+src+" failed midway, resuming it: "+err.Error())
+		progress.warning("The download of " + src + " failed midway, resuming it")
+		copyOptions.Resume = true
+		err = util.CopyOverCat(cfSSHArguments, src, dest, copyOptions)
+		_, transferFailed = err.(*utils.TransferError)
+	}
+	// The chunks downloaded already are kept to resume the download later
+	if err == nil || transferFailed {
+		cleanup.settle(dest)
+	}
+
+	return err
+}
+
+// resumeInstructions returns the command resuming the download of remoteFile into localDir, which keeps the chunks
+// downloaded already
+func resumeInstructions(applicationName string, applicationInstance int, remoteFile string, localDir string) string {
+	return "cf java download " + utils.ShellWord(applicationName) + instanceFlag(applicationInstance) + " " + utils.ShellWord(remoteFile) + " -local-dir " + utils.ShellWord(localDir) + " -resume"
+}
+
+// commandLine returns the command line of the plugin invocation with the given arguments, quoting those the shell
+// would otherwise split or expand
+func commandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = utils.ShellWord(arg)
+	}
+
+	return "cf " + strings.Join(quoted, " ")
+}
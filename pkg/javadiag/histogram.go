@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// histogramTopClasses is the number of classes printed by histo-diff
+const histogramTopClasses = 20
+
+// sleep waits between the two class histograms of histo-diff. Visible for tests
+var sleep = time.Sleep
+
+// histogramLine matches the lines of the class histograms of jmap -histo and jcmd GC.class_histogram, e.g.,
+// "   1:         12345        1234567  [B (java.base@17.0.2)"
+var histogramLine = regexp.MustCompile(`^\s*\d+:\s+(\d+)\s+(\d+)\s+(\S+)`)
+
+// histogramEntry is the number of instances of a class and the bytes they take
+type histogramEntry struct {
+	Instances int64
+	Bytes     int64
+}
+
+// classGrowth is the growth of a class between two class histograms
+type classGrowth struct {
+	Name      string
+	Instances int64
+	Bytes     int64
+}
+
+// parseClassHistogram reads the entries of a class histogram by class name, ignoring the header and the total
+func parseClassHistogram(histogram string) map[string]histogramEntry {
+	entries := map[string]histogramEntry{}
+	for _, line := range strings.Split(histogram, "\n") {
+		match := histogramLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		instances, _ := strconv.ParseInt(match[1], 10, 64)
+		bytes, _ := strconv.ParseInt(match[2], 10, 64)
+
+		entry := entries[match[3]]
+		entry.Instances += instances
+		entry.Bytes += bytes
+		entries[match[3]] = entry
+	}
+
+	return entries
+}
+
+// histogramGrowth returns the classes that take more bytes or have more instances after than before, the biggest
+// growth in bytes first
+func histogramGrowth(before map[string]histogramEntry, after map[string]histogramEntry) []classGrowth {
+	var growth []classGrowth
+	for name, entry := range after {
+		instances := entry.Instances - before[name].Instances
+		bytes := entry.Bytes - before[name].Bytes
+		if instances > 0 || bytes > 0 {
+			growth = append(growth, classGrowth{Name: name, Instances: instances, Bytes: bytes})
+		}
+	}
+
+	sort.Slice(growth, func(i, j int) bool {
+		if growth[i].Bytes != growth[j].Bytes {
+			return growth[i].Bytes > growth[j].Bytes
+		}
+		if growth[i].Instances != growth[j].Instances {
+			return growth[i].Instances > growth[j].Instances
+		}
+		return growth[i].Name < growth[j].Name
+	})
+
+	return growth
+}
+
+// formatHistogramGrowth prints the classes with the biggest growth as a table
+func formatHistogramGrowth(growth []classGrowth) string {
+	if len(growth) == 0 {
+		return "No class grew between the class histograms"
+	}
+	if len(growth) > histogramTopClasses {
+		growth = growth[:histogramTopClasses]
+	}
+
+	lines := []string{fmt.Sprintf("%12s %14s  %s", "#instances", "#bytes", "class name")}
+	for _, class := range growth {
+		lines = append(lines, fmt.Sprintf("%+12d %+14d  %s", class.Instances, class.Bytes, class.Name))
+	}
+	return strings.Join(lines, "\n")
+}
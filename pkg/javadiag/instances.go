@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"github.com/SAP/cf-cli-java-plugin/cmd"
+	"github.com/SAP/cf-cli-java-plugin/uuid"
+
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/bytefmt"
+
+	"utils"
+)
+
+// instanceInvocation returns the invocation of the plugin for a single instance of the app: the given one without the
+// flag "all-instances", and with the index of the instance, before the arguments after "--", if any
+func instanceInvocation(invocation []string, applicationInstance int) []string {
+	var args, rest []string
+	for i := 0; i < len(invocation); i++ {
+		arg := invocation[i]
+		if arg == "--" {
+			rest = invocation[i:]
+			break
+		}
+		nameAndValue := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)
+		if strings.HasPrefix(arg, "-") && (nameAndValue[0] == "all-instances" || nameAndValue[0] == "ai") {
+			// along with its value, if given as a separate argument, see parseCommandFlags
+			if len(nameAndValue) == 1 && i+1 < len(invocation) {
+				if _, err := strconv.ParseBool(invocation[i+1]); err == nil {
+					i++
+				}
+			}
+			continue
+		}
+		args = append(args, arg)
+	}
+
+	return append(append(args, "-app-instance-index", strconv.Itoa(applicationInstance)), rest...)
+}
+
+// executeOnAllInstances runs the invocation on each running instance of the app one after the other and returns their
+// output, each line prefixed with the instance like in cf logs, followed by a summary. The failures of single instances
+// are reported in their place, and fail the whole run once all instances are done.
+func (c *JavaPlugin) executeOnAllInstances(commandExecutor cmd.CommandExecutor, uuidGenerator uuid.UUIDGenerator, util utils.CfJavaPluginUtil, invocation []string, command string, applicationName string) (string, error) {
+	instances, err := util.GetRunningInstances(applicationName)
+	if err != nil {
+		return "", err
+	}
+	if len(instances) == 0 {
+		return "", errors.New("The app " + applicationName + " has no running instance")
+	}
+
+	// The output of each instance is prefixed before being shown
+	commandExecutor = bufferedExecutor{commandExecutor}
+
+	var lines []string
+	var failed []string
+	for _, instance := range instances {
+		prefix := fmt.Sprintf("[inst %d] ", instance)
+		output, err := c.execute(commandExecutor, uuidGenerator, util, instanceInvocation(invocation, instance))
+		if err != nil {
+			// The files the failed run left behind in the container are removed like for a single instance
+			cleanup.run(util, c.messageOutput())
+			failed = append(failed, strconv.Itoa(instance))
+			lines = append(lines, prefix+"failed: "+err.Error())
+			continue
+		}
+		for _, line := range strings.Split(output, "\n") {
+			lines = append(lines, prefix+line)
+		}
+	}
+
+	summary := fmt.Sprintf("%s ran on %d instances of %s: %d succeeded", command, len(instances), applicationName, len(instances)-len(failed))
+	if len(failed) > 0 {
+		fmt.Fprintln(c.messageOutput(), strings.Join(lines, "\n"))
+		return "", errors.New(summary + ", failed on instance " + strings.Join(failed, ", "))
+	}
+
+	return strings.Join(append(lines, "", summary), "\n"), nil
+}
+
+// reportInstances prints the state of each instance of the app in verbose mode, to help choosing the one to run on
+func reportInstances(util utils.CfJavaPluginUtil, applicationName string, messages io.Writer) error {
+	instances, err := util.GetInstances(applicationName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(messages, "Instances of "+applicationName+":")
+	for _, instance := range instances {
+		line := fmt.Sprintf("  #%d %s", instance.Index, instance.State)
+		if instance.State == "RUNNING" {
+			line += ", up " + instance.Uptime.String()
+		}
+		if instance.MemoryQuota > 0 {
+			line += fmt.Sprintf(", memory %s of %s", bytefmt.ByteSize(uint64(instance.MemoryUsage)), bytefmt.ByteSize(uint64(instance.MemoryQuota)))
+		}
+		fmt.Fprintln(messages, line)
+	}
+
+	return nil
+}
+
+// onlyRunningInstance returns the index of the running instance of the app, if it has several but only one of them is
+// running, e.g., while the others crashed or are starting, and false otherwise
+func onlyRunningInstance(util utils.CfJavaPluginUtil, applicationName string) (int, bool, error) {
+	instances, err := util.GetInstances(applicationName)
+	if err != nil || len(instances) < 2 {
+		return 0, false, err
+	}
+
+	running := -1
+	for _, instance := range instances {
+		if instance.State != "RUNNING" {
+			continue
+		}
+		if running >= 0 {
+			return 0, false, nil
+		}
+		running = instance.Index
+	}
+
+	return running, running >= 0, nil
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+// Package javadiag runs the commands of the cf java plugin, e.g., heap-dump or thread-dump, against the Java apps on
+// Cloud Foundry. The plugin itself is a thin wrapper around it, and other tools, like ops dashboards or chatbots, can
+// embed its commands with Execute instead of shelling out to cf java.
+package javadiag
+
+import (
+	"code.cloudfoundry.org/cli/plugin/models"
+
+	"utils"
+)
+
+// CliConnection is the part of plugin.CliConnection that the commands run cf commands with, using the session of the
+// cf CLI. Tools embedding the commands can implement it, e.g., by running the cf binary.
+type CliConnection interface {
+	utils.CliConnection
+	// CliCommand runs the cf command, showing its output in the terminal, and returns the output
+	CliCommand(args ...string) ([]string, error)
+}
+
+// Execute runs a command of the plugin, e.g., Execute(cliConnection, "thread-dump", "my_app", "-i", "1"), like
+// cf java does, and returns its output. The messages of the command, like the progress of a download, are printed to
+// stdout and stderr like in the terminal. Execute is safe to call from many goroutines, but runs one command at a
+// time, as the commands keep their state in the package while they run; it must not be called from within a command,
+// e.g., by the CliConnection, which would wait for itself.
+func Execute(cliConnection CliConnection, args ...string) (string, error) {
+	util := utils.CfJavaPluginUtilImpl{CliConnection: cliConnection, AppGUIDs: &utils.AppGUIDs{}, SpaceGUID: spaceGUID(cliConnection)}
+
+	return new(JavaPlugin).DoRun(commandExecutorImpl{cliConnection: cliConnection}, uuidGeneratorImpl{}, util, append([]string{"java"}, args...))
+}
+
+// spaceReader is the part of plugin.CliConnection reading the targeted space, which the connections of the tools
+// embedding the commands may implement, too
+type spaceReader interface {
+	GetCurrentSpace() (plugin_models.Space, error)
+}
+
+// spaceGUID returns the lookup of the GUID of the targeted space through the connection, or nil if it cannot read it
+func spaceGUID(cliConnection interface{}) func() (string, error) {
+	reader, ok := cliConnection.(spaceReader)
+	if !ok {
+		return nil
+	}
+
+	return func() (string, error) {
+		space, err := reader.GetCurrentSpace()
+		return space.Guid, err
+	}
+}
+
+// Commands returns the catalog of the commands of the plugin, including the custom commands of the user. Should their
+// definition be broken, the catalog holds only the built-in commands and the error tells why.
+func Commands() ([]Command, error) {
+	runMutex.Lock()
+	defer runMutex.Unlock()
+
+	return commandCatalog()
+}
+
+// commandCatalog returns the catalog of the commands like Commands, from within a running command, e.g., serve
+func commandCatalog() ([]Command, error) {
+	err := loadCommands()
+
+	return append([]Command{}, commands...), err
+}
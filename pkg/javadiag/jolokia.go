@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// jolokiaPort is the port the Jolokia agent listens on in the container, on the loopback interface only
+const jolokiaPort = "8778"
+
+// jolokiaAgentURL is the Jolokia JVM agent downloaded when no agent jar is given. Visible for tests
+var jolokiaAgentURL = "https://repo1.maven.org/maven2/org/jolokia/jolokia-agent-jvm/2.1.1/jolokia-agent-jvm-2.1.1-javaagent.jar"
+
+// jolokiaAgentJar returns the local file the Jolokia JVM agent is cached in
+func jolokiaAgentJar() string {
+	return filepath.Join(os.TempDir(), path.Base(jolokiaAgentURL))
+}
+
+// fetchJolokiaAgent downloads the Jolokia JVM agent into jolokiaAgentJar, unless it has been downloaded before
+func fetchJolokiaAgent(messages io.Writer) (string, error) {
+	agentJar := jolokiaAgentJar()
+	if _, err := os.Stat(agentJar); err == nil {
+		return agentJar, nil
+	}
+
+	fmt.Fprintln(messages, "Downloading the Jolokia JVM agent from "+jolokiaAgentURL)
+	response, err := http.Get(jolokiaAgentURL)
+	if err != nil {
+		return "", errors.New("Error downloading the Jolokia JVM agent: " + err.Error() + ", please download it yourself and specify it with the flag \"jar\"")
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", errors.New("Error downloading the Jolokia JVM agent: unexpected status " + response.Status + ", please download it yourself and specify it with the flag \"jar\"")
+	}
+
+	// Write into a temporary file first, so that an interrupted download is not mistaken for the agent later on
+	f, err := os.CreateTemp(filepath.Dir(agentJar), path.Base(agentJar)+".*")
+	if err != nil {
+		return "", errors.New("Error caching the Jolokia JVM agent: " + err.Error())
+	}
+	_, err = io.Copy(f, response.Body)
+	f.Close()
+	if err == nil {
+		err = os.Rename(f.Name(), agentJar)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", errors.New("Error caching the Jolokia JVM agent: " + err.Error())
+	}
+
+	return agentJar, nil
+}
+
+// jolokiaLocalPort returns the local port to forward to the Jolokia agent, 8778 unless another one is given
+func jolokiaLocalPort(value string) (string, error) {
+	if value == "" {
+		return jolokiaPort, nil
+	}
+
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return "", &InvalidUsageError{message: fmt.Sprintf("Invalid value %q for the flag %q: expected a port number", value, "local-port")}
+	}
+
+	return value, nil
+}
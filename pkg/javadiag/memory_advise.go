@@ -0,0 +1,245 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/bytefmt"
+
+	"utils"
+)
+
+const (
+	// memoryCalculatorStackThreads is the number of threads the memory calculator of the Java buildpack reserves stack
+	// memory for, unless configured otherwise
+	memoryCalculatorStackThreads = 250
+	// jvmOverheadBytes is a rough estimate of the memory the JVM uses beyond its heap, metaspace, code cache, thread
+	// stacks and direct buffers, e.g., for the garbage collector and the symbol tables
+	jvmOverheadBytes = 64 * bytefmt.MEGABYTE
+)
+
+// memoryAdviseCommands returns the remote commands printing the memory limit of the container, the flags of the JVM,
+// its number of threads and the performance counters with the usage of the heap and the metaspace, see
+// parseMemoryState
+func memoryAdviseCommands(shell shellDialect) []string {
+	return []string{
+		"JCMD_COMMAND=`" + shell.findExecutable("jcmd") + " | head -1 | tr -d [:space:]`",
+		"if [ -z \"${JCMD_COMMAND}\" ]; then echo >&2 'jcmd is required for reading the memory settings of the JVM, please make sure that the app runs on a full JDK'; exit 1; fi",
+		"echo \"LIMIT ${MEMORY_LIMIT}\"",
+		"echo \"CGROUP $(cat /sys/fs/cgroup/memory.max 2>/dev/null || cat /sys/fs/cgroup/memory/memory.limit_in_bytes 2>/dev/null)\"",
+		"echo \"FLAGS $(${JCMD_COMMAND} " + shell.javaPID + " VM.flags | tr ' ' '\\n' | grep '^-XX:' | tr '\\n' ' ')\"",
+		"echo \"THREADS $(grep '^Threads:' /proc/" + shell.javaPID + "/status | cut -f 2)\"",
+		"${JCMD_COMMAND} " + shell.javaPID + " PerfCounter.print | grep -E '^sun\\.gc\\.(generation\\.[0-9]+\\.space\\.[0-9]+\\.used|metaspace\\.used)='",
+	}
+}
+
+// memoryState holds the memory settings and usage of a JVM, in bytes. The sizes are 0 if unknown or unlimited.
+type memoryState struct {
+	LimitBytes         int64
+	MaxHeapBytes       int64
+	MaxMetaspaceBytes  int64
+	CodeCacheBytes     int64
+	MaxDirectBytes     int64
+	ThreadStackBytes   int64
+	Threads            int64
+	HeapUsedBytes      int64
+	MetaspaceUsedBytes int64
+}
+
+// parseMemoryState reads the output of the memoryAdviseCommands
+func parseMemoryState(output []string) (memoryState, error) {
+	var state memoryState
+	cgroupLimit := int64(0)
+	for _, line := range output {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "LIMIT" && len(fields) == 2:
+			if limit, err := bytefmt.ToBytes(fields[1]); err == nil {
+				state.LimitBytes = int64(limit)
+			}
+		case fields[0] == "CGROUP" && len(fields) == 2:
+			// cgroup v2 reports "max" for no limit, v1 a huge number
+			cgroupLimit, _ = strconv.ParseInt(fields[1], 10, 64)
+		case fields[0] == "THREADS" && len(fields) == 2:
+			state.Threads, _ = strconv.ParseInt(fields[1], 10, 64)
+		case fields[0] == "FLAGS":
+			for _, flag := range fields[1:] {
+				parts := strings.SplitN(strings.TrimPrefix(flag, "-XX:"), "=", 2)
+				if len(parts) != 2 {
+					continue
+				}
+				value, err := strconv.ParseUint(parts[1], 10, 64)
+				if err != nil {
+					continue
+				}
+				switch parts[0] {
+				case "MaxHeapSize":
+					state.MaxHeapBytes = boundedSize(value)
+				case "MaxMetaspaceSize":
+					state.MaxMetaspaceBytes = boundedSize(value)
+				case "ReservedCodeCacheSize":
+					state.CodeCacheBytes = boundedSize(value)
+				case "MaxDirectMemorySize":
+					state.MaxDirectBytes = boundedSize(value)
+				case "ThreadStackSize":
+					// In kilobytes, unlike the other sizes
+					state.ThreadStackBytes = boundedSize(value * bytefmt.KILOBYTE)
+				}
+			}
+		case strings.HasPrefix(fields[0], "sun.gc."):
+			parts := strings.SplitN(fields[0], "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			value, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			if parts[0] == "sun.gc.metaspace.used" {
+				state.MetaspaceUsedBytes = value
+			} else {
+				state.HeapUsedBytes += value
+			}
+		}
+	}
+
+	if state.LimitBytes == 0 && cgroupLimit > 0 && cgroupLimit < 1<<60 {
+		state.LimitBytes = cgroupLimit
+	}
+	if state.MaxHeapBytes == 0 {
+		return state, errors.New("The maximum heap size could not be read from the flags of the JVM")
+	}
+
+	return state, nil
+}
+
+// boundedSize returns the size, or 0 for the values the JVM uses for unlimited
+func boundedSize(value uint64) int64 {
+	if value >= 1<<60 {
+		return 0
+	}
+	return int64(value)
+}
+
+// roundUpMegabytes returns the size rounded up to whole megabytes, formatted for the options of the JVM, e.g., 256M
+func roundUpMegabytes(bytes int64) string {
+	return strconv.FormatInt((bytes+bytefmt.MEGABYTE-1)/bytefmt.MEGABYTE, 10) + "M"
+}
+
+// percent returns the share of part in whole as a rounded percentage
+func percent(part int64, whole int64) int64 {
+	return (part*100 + whole/2) / whole
+}
+
+// footprint returns an estimate of the memory the JVM may use at most: the maximum heap, the metaspace, the code
+// cache, the stacks of its threads and the direct buffers, plus jvmOverheadBytes. Without MaxDirectMemorySize, the
+// direct buffers may grow as large as the heap, which few apps do, so they are not counted then.
+func (state memoryState) footprint() int64 {
+	metaspace := state.MaxMetaspaceBytes
+	if metaspace == 0 {
+		metaspace = state.MetaspaceUsedBytes
+	}
+	return state.MaxHeapBytes + metaspace + state.CodeCacheBytes + state.Threads*state.ThreadStackBytes + state.MaxDirectBytes + jvmOverheadBytes
+}
+
+// advice returns the suggested adjustments of the memory settings of the JVM, to be set in JAVA_TOOL_OPTIONS or, for
+// apps staged by the Java buildpack, in JBP_CONFIG_OPEN_JDK_JRE
+func (state memoryState) advice(applicationName string) []string {
+	var suggestions []string
+
+	if excess := state.footprint() - state.LimitBytes; state.LimitBytes > 0 && excess > 0 {
+		lowerHeap := ""
+		if state.MaxHeapBytes-excess > state.MaxHeapBytes/2 {
+			lowerHeap = "lower the maximum heap with -Xmx" + roundUpMegabytes(state.MaxHeapBytes-excess) + " in JAVA_TOOL_OPTIONS, or "
+		}
+		suggestions = append(suggestions, fmt.Sprintf("The JVM may use up to %s, more than the memory limit of %s, and be killed by the container: %sraise the memory with `cf scale %s -m %s`",
+			bytefmt.ByteSize(uint64(state.footprint())), bytefmt.ByteSize(uint64(state.LimitBytes)), lowerHeap, utils.ShellWord(applicationName), roundUpMegabytes(state.footprint())))
+	}
+
+	// Without a limit, the memory of the app cannot be raised or lowered
+	heapUsage := percent(state.HeapUsedBytes, state.MaxHeapBytes)
+	switch {
+	case state.LimitBytes == 0:
+	case percent(state.MaxHeapBytes, state.LimitBytes) <= 30:
+		// Without the memory calculator of the Java buildpack, the JVM takes a quarter of the memory for the heap
+		suggestions = append(suggestions, fmt.Sprintf("The heap may take only %d%% of the memory limit, and the rest goes unused by most apps: give it more with -XX:MaxRAMPercentage=70 in JAVA_TOOL_OPTIONS",
+			percent(state.MaxHeapBytes, state.LimitBytes)))
+	case heapUsage >= 85:
+		suggestions = append(suggestions, fmt.Sprintf("The heap is %d%% full, including garbage not collected yet: if it stays that full after a full GC, raise the memory with `cf scale %s -m %s`, which gives the heap the extra memory",
+			heapUsage, utils.ShellWord(applicationName), roundUpMegabytes(state.LimitBytes+state.MaxHeapBytes/2)))
+	case heapUsage <= 25 && state.MaxHeapBytes > 512*bytefmt.MEGABYTE:
+		suggestions = append(suggestions, fmt.Sprintf("Only %d%% of the heap are used: if that holds under load, the memory of the app can be lowered, e.g., with `cf scale %s -m %s`",
+			heapUsage, utils.ShellWord(applicationName), roundUpMegabytes(state.LimitBytes-state.MaxHeapBytes/2)))
+	}
+
+	if state.MaxMetaspaceBytes == 0 && state.MetaspaceUsedBytes > 0 {
+		suggestions = append(suggestions, fmt.Sprintf("The metaspace is unbounded, so a class loader leak takes all memory of the container: bound it with -XX:MaxMetaspaceSize=%s in JAVA_TOOL_OPTIONS",
+			roundUpMegabytes(state.MetaspaceUsedBytes*3/2)))
+	} else if state.MaxMetaspaceBytes > 0 && percent(state.MetaspaceUsedBytes, state.MaxMetaspaceBytes) >= 80 {
+		suggestions = append(suggestions, fmt.Sprintf("The metaspace is %d%% full and an OutOfMemoryError: Metaspace is near: raise it with -XX:MaxMetaspaceSize=%s in JAVA_TOOL_OPTIONS",
+			percent(state.MetaspaceUsedBytes, state.MaxMetaspaceBytes), roundUpMegabytes(state.MetaspaceUsedBytes*3/2)))
+	}
+
+	if state.Threads > memoryCalculatorStackThreads {
+		suggestions = append(suggestions, fmt.Sprintf("The JVM runs %d threads, more than the %d the memory calculator of the Java buildpack reserves stack memory for by default: set JBP_CONFIG_OPEN_JDK_JRE to '{ memory_calculator: { stack_threads: %d } }'",
+			state.Threads, memoryCalculatorStackThreads, (state.Threads*5/4+49)/50*50))
+	}
+	if state.Threads > 200 && state.ThreadStackBytes >= bytefmt.MEGABYTE {
+		suggestions = append(suggestions, fmt.Sprintf("The stacks of the %d threads may take %s: unless the app recurses deeply, smaller stacks, e.g., -Xss512k in JAVA_TOOL_OPTIONS, leave more memory for the heap",
+			state.Threads, bytefmt.ByteSize(uint64(state.Threads*state.ThreadStackBytes))))
+	}
+
+	return suggestions
+}
+
+// memoryAdvice returns the memory settings and usage of the JVM read from the output of the memoryAdviseCommands,
+// followed by the suggested adjustments
+func memoryAdvice(applicationName string, output []string) (string, error) {
+	state, err := parseMemoryState(output)
+	if err != nil {
+		return "", err
+	}
+
+	size := func(bytes int64) string {
+		if bytes == 0 {
+			return "unlimited"
+		}
+		return bytefmt.ByteSize(uint64(bytes))
+	}
+	directMemory := "up to the maximum heap, MaxDirectMemorySize is not set"
+	if state.MaxDirectBytes > 0 {
+		directMemory = size(state.MaxDirectBytes)
+	}
+	lines := []string{
+		"Memory limit:     " + size(state.LimitBytes),
+		fmt.Sprintf("Heap:             %s used of at most %s", bytefmt.ByteSize(uint64(state.HeapUsedBytes)), size(state.MaxHeapBytes)),
+		fmt.Sprintf("Metaspace:        %s used of at most %s", bytefmt.ByteSize(uint64(state.MetaspaceUsedBytes)), size(state.MaxMetaspaceBytes)),
+		"Code cache:       " + size(state.CodeCacheBytes),
+		fmt.Sprintf("Thread stacks:    %d threads of %s", state.Threads, size(state.ThreadStackBytes)),
+		"Direct memory:    " + directMemory,
+		"Footprint:        up to " + bytefmt.ByteSize(uint64(state.footprint())) + ", estimated",
+	}
+
+	suggestions := state.advice(applicationName)
+	if len(suggestions) == 0 {
+		return strings.Join(append(lines, "", "The memory settings fit the usage of the JVM, no adjustments suggested"), "\n"), nil
+	}
+	lines = append(lines, "", "Suggestions:")
+	for _, suggestion := range suggestions {
+		lines = append(lines, "- "+suggestion)
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,291 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+const (
+	// monitorDuration and monitorInterval are the defaults of the flags "duration" and "interval" of monitor
+	monitorDuration = 5 * time.Minute
+	monitorInterval = 10 * time.Second
+)
+
+// monitorColumns are the columns of the time series written by monitor
+var monitorColumns = []string{"timestamp", "heap_used_bytes", "heap_committed_bytes", "gc_count", "gc_time_seconds", "threads", "cpu_percent"}
+
+// monitorSample holds the metrics of the JVM sampled at one point in time
+type monitorSample struct {
+	Time               time.Time
+	HeapUsedBytes      int64
+	HeapCommittedBytes int64
+	GCCount            int64
+	GCTimeSeconds      float64
+	Threads            int64
+	// CPUTicks is the CPU time used by the JVM so far, in clock ticks
+	CPUTicks int64
+}
+
+// monitorSeries holds the samples of a monitor session
+type monitorSeries struct {
+	Samples []monitorSample
+	// Ticks is the number of clock ticks per second, the unit of the CPU time of the samples
+	Ticks int64
+	// MaxHeapBytes is the maximum size of the heap, or 0 if it could not be determined
+	MaxHeapBytes int64
+}
+
+// cpuPercent returns the share of one CPU used by the JVM between the sample with the given index and the previous
+// one, which may exceed 100 on machines with many CPUs, or false for the first sample
+func (series monitorSeries) cpuPercent(index int) (float64, bool) {
+	if index == 0 {
+		return 0, false
+	}
+
+	sample, previous := series.Samples[index], series.Samples[index-1]
+	elapsed := sample.Time.Sub(previous.Time).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+
+	used := float64(sample.CPUTicks-previous.CPUTicks) / float64(series.Ticks)
+	return used / elapsed * 100, true
+}
+
+// monitorDurations parses the flags "duration" and "interval" of monitor, which sleeps in whole seconds in the container
+func monitorDurations(durationFlag string, intervalFlag string) (time.Duration, time.Duration, error) {
+	duration, interval := monitorDuration, monitorInterval
+	for _, flag := range []struct {
+		name   string
+		value  string
+		target *time.Duration
+	}{{"duration", durationFlag, &duration}, {"interval", intervalFlag, &interval}} {
+		if flag.value == "" {
+			continue
+		}
+		parsed, err := parseAge(flag.value)
+		if err == nil && parsed < time.Second {
+			err = errors.New("expected at least one second")
+		}
+		if err != nil {
+			return 0, 0, &InvalidUsageError{message: fmt.Sprintf("Invalid value %q for the flag %q: %v", flag.value, flag.name, err)}
+		}
+		*flag.target = parsed.Round(time.Second)
+	}
+
+	return duration, interval, nil
+}
+
+// monitorCommands returns the remote commands sampling the JVM for the given duration, all in one ssh session. They
+// print the clock ticks per second, the maximum heap size as reported by jcmd, if there is one, the header of jstat
+// -gc and then one line per sample with the time, the user and system CPU ticks, the number of threads and the values
+// of jstat -gc.
+func monitorCommands(shell shellDialect, duration time.Duration, interval time.Duration) []string {
+	return []string{
+		"JSTAT_COMMAND=`" + shell.findExecutable("jstat") + " | head -1 | tr -d [:space:]`",
+		"if [ -z \"${JSTAT_COMMAND}\" ]; then echo >&2 'jstat not found in the container, monitor requires a full JDK'; exit 1; fi",
+		"PID=" + shell.javaPID,
+		"echo \"TICKS $(getconf CLK_TCK 2>/dev/null || echo 100)\"",
+		"JCMD_COMMAND=`" + shell.findExecutable("jcmd") + " | head -1 | tr -d [:space:]`",
+		"if [ -n \"${JCMD_COMMAND}\" ]; then echo \"MAXHEAP $(${JCMD_COMMAND} ${PID} VM.flags | tr ' ' '\\n' | grep '^-XX:MaxHeapSize=' | cut -d = -f 2)\"; fi",
+		"echo \"HEADER $(${JSTAT_COMMAND} -gc ${PID} | head -1)\"",
+		fmt.Sprintf("END=$(( $(date +%%s) + %d ))", int64(duration.Seconds())),
+		fmt.Sprintf("while [ $(date +%%s) -lt ${END} ]; do echo \"SAMPLE $(date +%%s) $(cut -d ' ' -f 14,15 /proc/${PID}/stat) $(grep '^Threads:' /proc/${PID}/status | cut -f 2) $(${JSTAT_COMMAND} -gc ${PID} | tail -1)\"; sleep %d; done", int64(interval.Seconds())),
+	}
+}
+
+// parseMonitorOutput reads the samples printed by the commands of monitorCommands
+func parseMonitorOutput(output []string) (monitorSeries, error) {
+	series := monitorSeries{Ticks: 100}
+	var header []string
+	for _, line := range output {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "TICKS":
+			if len(fields) == 2 {
+				if value, err := strconv.ParseInt(fields[1], 10, 64); err == nil && value > 0 {
+					series.Ticks = value
+				}
+			}
+		case "MAXHEAP":
+			if len(fields) == 2 {
+				series.MaxHeapBytes, _ = strconv.ParseInt(fields[1], 10, 64)
+			}
+		case "HEADER":
+			header = fields[1:]
+		case "SAMPLE":
+			if len(header) == 0 || len(fields) != 5+len(header) {
+				return series, errors.New("Unexpected sample from the container: " + line)
+			}
+			sample, err := parseMonitorSample(fields[1:5], header, fields[5:])
+			if err != nil {
+				return series, errors.New("Unexpected sample from the container: " + line)
+			}
+			series.Samples = append(series.Samples, sample)
+		}
+	}
+
+	if len(series.Samples) == 0 {
+		return series, errors.New("No samples received from the container")
+	}
+
+	return series, nil
+}
+
+// parseMonitorSample reads the time, the CPU ticks and the number of threads from procFields, and the heap and GC
+// metrics from the values of jstat -gc, in kilobytes, named by the columns of its header
+func parseMonitorSample(procFields []string, header []string, values []string) (monitorSample, error) {
+	var numbers [4]int64
+	for i, field := range procFields {
+		number, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return monitorSample{}, err
+		}
+		numbers[i] = number
+	}
+
+	gc := map[string]float64{}
+	for i, column := range header {
+		// Columns that do not apply to the garbage collector in use are printed as "-"
+		if values[i] == "-" {
+			continue
+		}
+		value, err := strconv.ParseFloat(values[i], 64)
+		if err != nil {
+			return monitorSample{}, err
+		}
+		gc[column] = value
+	}
+
+	return monitorSample{
+		Time:               time.Unix(numbers[0], 0).UTC(),
+		CPUTicks:           numbers[1] + numbers[2],
+		Threads:            numbers[3],
+		HeapUsedBytes:      int64((gc["S0U"] + gc["S1U"] + gc["EU"] + gc["OU"]) * 1024),
+		HeapCommittedBytes: int64((gc["S0C"] + gc["S1C"] + gc["EC"] + gc["OC"]) * 1024),
+		GCCount:            int64(gc["YGC"] + gc["FGC"] + gc["CGC"]),
+		GCTimeSeconds:      gc["GCT"],
+	}, nil
+}
+
+// formatMonitorCSV writes the samples as CSV with one row per sample. The CPU usage is empty for the first sample.
+func formatMonitorCSV(series monitorSeries) string {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	writer.Write(monitorColumns)
+	for i, sample := range series.Samples {
+		cpu := ""
+		if percent, ok := series.cpuPercent(i); ok {
+			cpu = strconv.FormatFloat(percent, 'f', 1, 64)
+		}
+		writer.Write([]string{
+			sample.Time.Format(time.RFC3339),
+			strconv.FormatInt(sample.HeapUsedBytes, 10),
+			strconv.FormatInt(sample.HeapCommittedBytes, 10),
+			strconv.FormatInt(sample.GCCount, 10),
+			strconv.FormatFloat(sample.GCTimeSeconds, 'f', 3, 64),
+			strconv.FormatInt(sample.Threads, 10),
+			cpu,
+		})
+	}
+	writer.Flush()
+
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
+
+// alertRule is a threshold on a metric of monitor, e.g., heap>90%
+type alertRule struct {
+	Text   string
+	Metric string
+	// Threshold is a percentage for the CPU usage and heap thresholds ending with %, bytes for the other heap
+	// thresholds and a count for the threads
+	Threshold float64
+	Percent   bool
+}
+
+// parseAlertRules parses the value of the flag "alert", a comma-separated list of rules like heap>90%, heap>2G,
+// threads>500 or cpu>80%
+func parseAlertRules(value string) ([]alertRule, error) {
+	var rules []alertRule
+	for _, text := range strings.Split(value, ",") {
+		text = strings.TrimSpace(text)
+		parts := strings.SplitN(text, ">", 2)
+		if len(parts) != 2 {
+			return nil, &InvalidUsageError{message: fmt.Sprintf("Invalid alert rule %q: expected METRIC>THRESHOLD, e.g., heap>90%%", text)}
+		}
+
+		rule := alertRule{Text: text, Metric: parts[0], Percent: strings.HasSuffix(parts[1], "%")}
+		threshold := strings.TrimSuffix(parts[1], "%")
+		var err error
+		switch {
+		case rule.Metric == "heap" && !rule.Percent:
+			var bytes uint64
+			bytes, err = bytefmt.ToBytes(threshold)
+			rule.Threshold = float64(bytes)
+		case rule.Metric == "heap", rule.Metric == "cpu", rule.Metric == "threads" && !rule.Percent:
+			rule.Threshold, err = strconv.ParseFloat(threshold, 64)
+		default:
+			return nil, &InvalidUsageError{message: fmt.Sprintf("Invalid alert rule %q: supported are heap>PERCENT%%, heap>SIZE, threads>COUNT and cpu>PERCENT%%", text)}
+		}
+		if err != nil || rule.Threshold < 0 {
+			return nil, &InvalidUsageError{message: fmt.Sprintf("Invalid alert rule %q: the threshold %q is not a positive number", text, parts[1])}
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// value returns the value of the metric of the rule for the sample with the given index, formatted for the user, or
+// false if the sample has none
+func (rule alertRule) value(series monitorSeries, index int) (float64, string, bool) {
+	sample := series.Samples[index]
+	switch {
+	case rule.Metric == "threads":
+		return float64(sample.Threads), strconv.FormatInt(sample.Threads, 10) + " threads", true
+	case rule.Metric == "cpu":
+		percent, ok := series.cpuPercent(index)
+		return percent, strconv.FormatFloat(percent, 'f', 1, 64) + "% CPU", ok
+	case rule.Percent:
+		percent := float64(sample.HeapUsedBytes) / float64(series.MaxHeapBytes) * 100
+		return percent, strconv.FormatFloat(percent, 'f', 1, 64) + "% of the maximum heap", series.MaxHeapBytes > 0
+	default:
+		return float64(sample.HeapUsedBytes), bytefmt.ByteSize(uint64(sample.HeapUsedBytes)) + " of heap used", true
+	}
+}
+
+// checkAlertRules returns a warning for each rule breached by any of the samples, naming the first sample that did
+func checkAlertRules(rules []alertRule, series monitorSeries) ([]string, error) {
+	var warnings []string
+	for _, rule := range rules {
+		if rule.Metric == "heap" && rule.Percent && series.MaxHeapBytes == 0 {
+			return nil, errors.New("The maximum heap size of the JVM could not be determined for the alert rule " + rule.Text + ", it requires jcmd in the container")
+		}
+
+		for i, sample := range series.Samples {
+			if value, description, ok := rule.value(series, i); ok && value > rule.Threshold {
+				warnings = append(warnings, "Alert "+rule.Text+" breached at "+sample.Time.Format(time.RFC3339)+": "+description)
+				break
+			}
+		}
+	}
+
+	return warnings, nil
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// latestLink is the symbolic link to the newest file downloaded with the flag "organize", or empty without the flag
+var latestLink string
+
+// organizedDir returns the directory <localDir>/<app>/<instance>/<date> the flag "organize" downloads files into, so
+// that the files of many incidents do not pile up in one directory
+func organizedDir(localDir string, applicationName string, applicationInstance int, date time.Time) string {
+	if applicationInstance < 0 {
+		applicationInstance = 0
+	}
+
+	return filepath.Join(localDir, fileSafeName(applicationName), strconv.Itoa(applicationInstance), date.Format("2006-01-02"))
+}
+
+// linkLatest points the latestLink, if any, to the downloaded file. The link is relative, so that it survives moving
+// the directory, and failing to create it, e.g., without the privilege on Windows, does not fail the download.
+func linkLatest(file string, messages io.Writer) {
+	if latestLink == "" {
+		return
+	}
+
+	target, err := filepath.Rel(filepath.Dir(latestLink), file)
+	if err == nil {
+		os.Remove(latestLink)
+		err = os.Symlink(target, latestLink)
+	}
+	if err != nil {
+		fmt.Fprintln(messages, "Cannot link "+latestLink+" to "+file+": "+err.Error())
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// progress emits the progress events of the running command, if enabled with --progress json
+var progress progressEvents
+
+// progressEvent is a single line of the JSON-lines progress events
+type progressEvent struct {
+	Time    string `json:"time"`
+	Event   string `json:"event"`
+	Step    string `json:"step,omitempty"`
+	File    string `json:"file,omitempty"`
+	Bytes   int64  `json:"bytes,omitempty"`
+	Total   int64  `json:"total,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// progressEvents emits newline-delimited JSON events about the steps of a command, so that CI systems can render
+// the progress and tell in which step a command failed. All methods do nothing unless enabled.
+type progressEvents struct {
+	enabled bool
+	output  io.Writer
+}
+
+// newProgressEvents returns the progress events for the value of the flag "progress", which is either empty or "json",
+// written to output
+func newProgressEvents(format string, output io.Writer) (progressEvents, error) {
+	switch format {
+	case "":
+		return progressEvents{}, nil
+	case "json":
+		return progressEvents{enabled: true, output: output}, nil
+	}
+
+	return progressEvents{}, &InvalidUsageError{message: fmt.Sprintf("Invalid value %q for the flag %q: expected json", format, "progress")}
+}
+
+func (p progressEvents) emit(event progressEvent) {
+	if !p.enabled {
+		return
+	}
+
+	event.Time = now().UTC().Format(time.RFC3339)
+	line, _ := json.Marshal(event)
+	fmt.Fprintln(p.output, string(line))
+}
+
+// started reports that the step, optionally dealing with the given file, started
+func (p progressEvents) started(step string, file string) {
+	p.emit(progressEvent{Event: "step-started", Step: step, File: file})
+}
+
+// finished reports that the step completed, or failed if err is not nil
+func (p progressEvents) finished(step string, file string, err error) {
+	if err != nil {
+		p.emit(progressEvent{Event: "step-failed", Step: step, File: file, Message: err.Error()})
+		return
+	}
+	p.emit(progressEvent{Event: "step-completed", Step: step, File: file})
+}
+
+// transferred returns the callback reporting the bytes of the file transferred so far
+func (p progressEvents) transferred(step string, file string) func(int64, int64) {
+	if !p.enabled {
+		return nil
+	}
+
+	return func(bytes int64, total int64) {
+		p.emit(progressEvent{Event: "bytes-transferred", Step: step, File: file, Bytes: bytes, Total: total})
+	}
+}
+
+// warning reports a condition the user should know about, which does not make the command fail
+func (p progressEvents) warning(message string) {
+	p.emit(progressEvent{Event: "warning", Message: message})
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"github.com/SAP/cf-cli-java-plugin/cmd"
+	"github.com/SAP/cf-cli-java-plugin/uuid"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"utils"
+)
+
+// recordingFileName is the name of the file the flag "record" writes into the given directory
+const recordingFileName = "recording.json"
+
+// secretPatterns match the secrets in the remote commands and their output, e.g., from the environment of the app,
+// which are masked in recordings, as they are meant to be attached to bug reports
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)((?:password|passwd|secret|token|credentials?|api[_-]?key|access[_-]?key)["']?\s*[=:]\s*["']?)[^\s"',;&]+`),
+	regexp.MustCompile(`(?i)(bearer\s+)[^\s"',;&]+`),
+}
+
+// recording holds the remote commands run by an invocation of the plugin and their output, along with the result of
+// the invocation, to reproduce it without the app, see replayExecutor
+type recording struct {
+	Invocation   []string      `json:"invocation"`
+	Interactions []interaction `json:"interactions"`
+	Output       string        `json:"output"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// interaction is a command run with the cf CLI, usually cf ssh, and its output
+type interaction struct {
+	Args   []string `json:"args"`
+	Output []string `json:"output"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// sanitize masks the secrets in value
+func sanitize(value string) string {
+	for _, pattern := range secretPatterns {
+		value = pattern.ReplaceAllString(value, "${1}***")
+	}
+
+	return value
+}
+
+// sanitizeAll masks the secrets in values
+func sanitizeAll(values []string) []string {
+	sanitized := make([]string, len(values))
+	for i, value := range values {
+		sanitized[i] = sanitize(value)
+	}
+
+	return sanitized
+}
+
+// withoutRecordFlag returns the invocation without the flag "record" and its value, to replay it without recording
+func withoutRecordFlag(invocation []string) []string {
+	var args []string
+	for i := 0; i < len(invocation); i++ {
+		arg := invocation[i]
+		if arg == "--" {
+			return append(args, invocation[i:]...)
+		}
+		name := strings.TrimLeft(arg, "-")
+		if strings.HasPrefix(arg, "-") && (name == "record" || name == "rc") {
+			i++
+			continue
+		}
+		if strings.HasPrefix(arg, "-") && (strings.HasPrefix(name, "record=") || strings.HasPrefix(name, "rc=")) {
+			continue
+		}
+		args = append(args, arg)
+	}
+
+	return args
+}
+
+// recordingExecutor runs the commands with the wrapped executor and records them along with their output
+type recordingExecutor struct {
+	cmd.CommandExecutor
+	recording recording
+}
+
+// recorder records the running invocation of the plugin, nil unless the flag "record" is set
+var recorder *recordingExecutor
+
+func (r *recordingExecutor) Execute(args []string) ([]string, error) {
+	output, err := r.CommandExecutor.Execute(args)
+	r.record(args, output, err)
+
+	return output, err
+}
+
+// streamingRecordingExecutor is the recordingExecutor of a streamingCommandExecutor, which keeps streaming the output
+type streamingRecordingExecutor struct {
+	*recordingExecutor
+	streamer streamingCommandExecutor
+}
+
+func (r streamingRecordingExecutor) ExecuteStreaming(args []string) ([]string, error) {
+	output, err := r.streamer.ExecuteStreaming(args)
+	r.record(args, output, err)
+
+	return output, err
+}
+
+func (r *recordingExecutor) record(args []string, output []string, err error) {
+	recorded := interaction{Args: sanitizeAll(args), Output: sanitizeAll(output)}
+	if err != nil {
+		recorded.Error = sanitize(err.Error())
+	}
+	r.recording.Interactions = append(r.recording.Interactions, recorded)
+}
+
+// save writes the recording with the result of the invocation into dir
+func (r *recordingExecutor) save(dir string, output string, err error, messages io.Writer) error {
+	r.recording.Output = sanitize(output)
+	if err != nil {
+		r.recording.Error = sanitize(err.Error())
+	}
+
+	// The remote commands stay readable, with their redirections not escaped for HTML
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(r.recording); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.New("Error creating the directory " + dir + " for the recording: " + err.Error())
+	}
+	file := filepath.Join(dir, recordingFileName)
+	if err := os.WriteFile(file, data.Bytes(), 0644); err != nil {
+		return errors.New("Error writing the recording into " + file + ": " + err.Error())
+	}
+	fmt.Fprintf(messages, "Recorded %d remote commands into %s, secrets masked\n", len(r.recording.Interactions), file)
+
+	return nil
+}
+
+// executeRecording runs the invocation with its remote commands recorded into dir
+func (c *JavaPlugin) executeRecording(commandExecutor cmd.CommandExecutor, uuidGenerator uuid.UUIDGenerator, util utils.CfJavaPluginUtil, invocation []string, dir string) (string, error) {
+	recorder = &recordingExecutor{CommandExecutor: commandExecutor, recording: recording{Invocation: sanitizeAll(withoutRecordFlag(invocation))}}
+	defer func() {
+		recorder = nil
+	}()
+
+	var recordingCommandExecutor cmd.CommandExecutor = recorder
+	if streamer, streaming := commandExecutor.(streamingCommandExecutor); streaming {
+		recordingCommandExecutor = streamingRecordingExecutor{recordingExecutor: recorder, streamer: streamer}
+	}
+
+	output, err := c.execute(recordingCommandExecutor, uuidGenerator, util, invocation)
+	messages := c.messageOutput()
+	if saveErr := recorder.save(dir, output, err, messages); saveErr != nil {
+		fmt.Fprintln(messages, saveErr.Error())
+	}
+
+	return output, err
+}
+
+// loadRecording reads the recording in dir
+func loadRecording(dir string) (recording, error) {
+	var loaded recording
+	data, err := os.ReadFile(filepath.Join(dir, recordingFileName))
+	if err != nil {
+		return loaded, err
+	}
+	err = json.Unmarshal(data, &loaded)
+
+	return loaded, err
+}
+
+// replayExecutor plays back the output of the commands of a recording, in order, failing as soon as a command differs
+// from the recorded one, e.g., to reproduce a failure in the container of an app in the tests
+type replayExecutor struct {
+	recording recording
+	next      int
+}
+
+func (r *replayExecutor) Execute(args []string) ([]string, error) {
+	if r.next >= len(r.recording.Interactions) {
+		return nil, errors.New("The recording has no further command for: cf " + strings.Join(args, " "))
+	}
+	recorded := r.recording.Interactions[r.next]
+	if !reflect.DeepEqual(sanitizeAll(args), recorded.Args) {
+		return nil, fmt.Errorf("The command %d differs from the recording: cf %s", r.next+1, strings.Join(args, " "))
+	}
+	r.next++
+
+	if recorded.Error != "" {
+		return recorded.Output, errors.New(recorded.Error)
+	}
+	return recorded.Output, nil
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"utils"
+)
+
+// jvmMemoryOptionsPattern matches the options of the JVM that size its memory, which the memory calculator of the
+// Java buildpack sets, for grep -E in the container
+const jvmMemoryOptionsPattern = "^-(Xm[sx]|Xss|XX:(MaxMetaspaceSize|ReservedCodeCacheSize|MaxDirectMemorySize|CompressedClassSpaceSize|MaxRAM|InitialRAMPercentage|MinRAMPercentage|MaxRAMPercentage|ActiveProcessorCount)=)"
+
+var (
+	// memoryCalculatorPattern matches the invocation of the memory calculator in the start command of a droplet staged
+	// by the Java buildpack, e.g., "$PWD/.java-buildpack/open_jdk_jre/bin/java-buildpack-memory-calculator-3.13.0_RELEASE
+	// -totMemory=$MEMORY_LIMIT -stackThreads=250", with the binary and its arguments
+	memoryCalculatorPattern = regexp.MustCompile(`(java-buildpack-memory-calculator[^\s/]*)((?:\s+-\w+=(?:"[^"]*"|[^\s")]+))*)`)
+	// memoryCalculatorArgumentPattern matches one of the arguments of the memory calculator
+	memoryCalculatorArgumentPattern = regexp.MustCompile(`-\w+=(?:"[^"]*"|[^\s")]+)`)
+)
+
+// runtimeInfoCommands returns the remote commands printing the binary, the version and the memory options of the JVM,
+// and the memory limit of the container
+func runtimeInfoCommands(shell shellDialect) []string {
+	return []string{
+		"JAVA_BINARY=$(readlink -f /proc/" + shell.javaPID + "/exe)",
+		"echo \"JVM: ${JAVA_BINARY}\"",
+		// The version is printed by a JVM of its own, which must not pick up the options meant for the app
+		"env -u JAVA_TOOL_OPTIONS -u JDK_JAVA_OPTIONS ${JAVA_BINARY} -version 2>&1 | sed 's/^/   /'",
+		"echo \"Memory limit: ${MEMORY_LIMIT:-not set}\"",
+		"echo \"JVM memory options: $(tr '\\0' '\\n' < /proc/" + shell.javaPID + "/cmdline | grep -E -- '" + jvmMemoryOptionsPattern + "' | tr '\\n' ' ')\"",
+	}
+}
+
+// memoryCalculator returns the memory calculator invoked by the start command and its arguments, or an empty string
+// if the start command does not run the memory calculator of the Java buildpack
+func memoryCalculator(startCommand string) string {
+	match := memoryCalculatorPattern.FindStringSubmatch(startCommand)
+	if match == nil {
+		return ""
+	}
+
+	return strings.Join(append([]string{match[1]}, memoryCalculatorArgumentPattern.FindAllString(match[2], -1)...), " ")
+}
+
+// buildpackLabel returns the name and version of the buildpack, followed by its name in Cloud Foundry if it reported
+// another one for itself
+func buildpackLabel(buildpack utils.Buildpack) string {
+	name := buildpack.BuildpackName
+	if name == "" {
+		name = buildpack.Name
+	}
+	if buildpack.Version != "" {
+		name += " " + buildpack.Version
+	}
+	if buildpack.BuildpackName != "" && buildpack.BuildpackName != buildpack.Name {
+		name += " (" + buildpack.Name + ")"
+	}
+
+	return name
+}
+
+// runtimeInfoReport returns the buildpacks and stack of the droplet of the app, the output of the runtimeInfoCommands,
+// the settings of the memory calculator and the environment variables configuring the Java buildpack
+func runtimeInfoReport(util utils.CfJavaPluginUtil, applicationName string, output []string) (string, error) {
+	droplet, err := util.GetDropletInfo(applicationName)
+	if err != nil {
+		return "", err
+	}
+	env, err := util.GetAppEnvironment(applicationName)
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	if droplet.Stack != "" {
+		lines = append(lines, "Stack: "+droplet.Stack)
+	}
+	if len(droplet.Buildpacks) == 0 {
+		lines = append(lines, "Buildpack: none, the app runs a Docker image")
+	}
+	for _, buildpack := range droplet.Buildpacks {
+		lines = append(lines, "Buildpack: "+buildpackLabel(buildpack))
+	}
+
+	lines = append(lines, output...)
+
+	if calculator := memoryCalculator(droplet.ProcessTypes["web"]); calculator != "" {
+		lines = append(lines, "Memory calculator: "+calculator)
+	} else {
+		lines = append(lines, "Memory calculator: not run by the start command")
+	}
+
+	var names []string
+	for name := range env {
+		if strings.HasPrefix(name, "JBP_CONFIG_") || name == "JAVA_OPTS" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		lines = append(lines, "JBP_CONFIG_* and JAVA_OPTS: none set")
+	}
+	for _, name := range names {
+		lines = append(lines, name+": "+env[name])
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"github.com/SAP/cf-cli-java-plugin/cmd"
+	"github.com/SAP/cf-cli-java-plugin/uuid"
+
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"utils"
+)
+
+// The JSON-RPC 2.0 error codes of serve
+const (
+	rpcParseError     = -32700
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcCommandFailed  = -32000
+)
+
+// serveMutex answers the requests to serve one at a time, as the commands share the state of the package, like the
+// cleanup tasks, and "commands" loads the custom commands into it
+var serveMutex sync.Mutex
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// rpcRunParams are the parameters of the method "run", the arguments following "cf java", e.g., ["thread-dump", "my_app"]
+type rpcRunParams struct {
+	Args []string `json:"args"`
+}
+
+// rpcRunResult is the result of the method "run"
+type rpcRunResult struct {
+	Output string `json:"output"`
+}
+
+// rpcConnection writes the responses and notifications to a client of serve, one JSON object per line
+type rpcConnection struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func (conn *rpcConnection) send(message interface{}) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.encoder.Encode(message)
+}
+
+func (conn *rpcConnection) notify(method string, params interface{}) {
+	conn.send(rpcNotification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// progressNotifier turns the progress events of a command, one JSON object per line, into "progress" notifications
+type progressNotifier struct {
+	conn *rpcConnection
+}
+
+func (n progressNotifier) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSpace(string(p)), "\n") {
+		var event json.RawMessage
+		if json.Unmarshal([]byte(line), &event) == nil {
+			n.conn.notify("progress", event)
+		}
+	}
+	return len(p), nil
+}
+
+// defaultServeSocket returns the socket next to the plugins of the cf CLI
+func defaultServeSocket() (string, error) {
+	dir, err := pluginsDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "cf-java-plugin.sock"), nil
+}
+
+// serve runs the commands of the plugin for the clients of a local socket, like IDEs, until interrupted. The clients
+// speak JSON-RPC 2.0, one message per line, with the methods "commands", "apps" and "run"; while a command runs, its
+// messages and progress events are sent as "message" and "progress" notifications.
+func (c *JavaPlugin) serve(commandExecutor cmd.CommandExecutor, uuidGenerator uuid.UUIDGenerator, util utils.CfJavaPluginUtil, socket string) error {
+	if socket == "" {
+		var err error
+		if socket, err = defaultServeSocket(); err != nil {
+			return err
+		}
+	}
+
+	// The socket of a serve that was killed is left behind
+	os.Remove(socket)
+	listener, err := listenPrivate(socket)
+	if err != nil {
+		return fmt.Errorf("cannot listen on the socket %s: %v", socket, err)
+	}
+	defer os.Remove(socket)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+
+	fmt.Fprintln(c.messageOutput(), "Serving the commands over JSON-RPC on "+socket+", stop with Ctrl+C")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// Closed once interrupted
+			return nil
+		}
+		go func() {
+			defer conn.Close()
+			c.serveConnection(conn, commandExecutor, uuidGenerator, util)
+		}()
+	}
+}
+
+// serveConnection answers the requests of a client of serve until it disconnects
+func (c *JavaPlugin) serveConnection(conn io.ReadWriter, commandExecutor cmd.CommandExecutor, uuidGenerator uuid.UUIDGenerator, util utils.CfJavaPluginUtil) {
+	rpc := &rpcConnection{encoder: json.NewEncoder(conn)}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var request rpcRequest
+		if err := json.Unmarshal([]byte(line), &request); err != nil {
+			rpc.send(rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: err.Error()}})
+			continue
+		}
+		result, rpcErr := c.serveRequest(rpc, request, commandExecutor, uuidGenerator, util)
+		// Requests without an ID are notifications, which get no response
+		if request.ID == nil {
+			continue
+		}
+		response := rpcResponse{JSONRPC: "2.0", ID: request.ID, Error: rpcErr}
+		if rpcErr == nil {
+			response.Result = result
+		}
+		rpc.send(response)
+	}
+}
+
+func (c *JavaPlugin) serveRequest(rpc *rpcConnection, request rpcRequest, commandExecutor cmd.CommandExecutor, uuidGenerator uuid.UUIDGenerator, util utils.CfJavaPluginUtil) (interface{}, *rpcError) {
+	serveMutex.Lock()
+	defer serveMutex.Unlock()
+
+	switch request.Method {
+	case "commands":
+		catalog, err := commandCatalog()
+		if err != nil {
+			rpc.notify("message", map[string]string{"text": err.Error()})
+		}
+		return catalog, nil
+	case "apps":
+		apps, err := util.GetApps()
+		if err != nil {
+			return nil, &rpcError{Code: rpcCommandFailed, Message: err.Error()}
+		}
+		return apps, nil
+	case "run":
+		var params rpcRunParams
+		if err := json.Unmarshal(request.Params, &params); err != nil || len(params.Args) == 0 {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "expected the arguments of the command, e.g., {\"args\": [\"thread-dump\", \"my_app\"]}"}
+		}
+		if params.Args[0] == serveCommand {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "serve cannot be run by serve"}
+		}
+		output, err := c.serveRun(rpc, params.Args, commandExecutor, uuidGenerator, util)
+		if err != nil {
+			return nil, &rpcError{Code: rpcCommandFailed, Message: err.Error()}
+		}
+		return rpcRunResult{Output: output}, nil
+	}
+
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("unknown method %q, expected commands, apps or run", request.Method)}
+}
+
+// serveRun runs a command for a client of serve, sending its messages as "message" notifications and its progress
+// events, if enabled with "-progress json", as "progress" notifications. What the rest of the process prints, e.g.,
+// serve itself or the tools embedding the commands, stays out of them.
+func (c *JavaPlugin) serveRun(rpc *rpcConnection, args []string, commandExecutor cmd.CommandExecutor, uuidGenerator uuid.UUIDGenerator, util utils.CfJavaPluginUtil) (string, error) {
+	reader, writer := io.Pipe()
+	messages := make(chan struct{})
+	go func() {
+		defer close(messages)
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			rpc.notify("message", map[string]string{"text": scanner.Text()})
+		}
+	}()
+
+	run := &JavaPlugin{stdout: writer, stderr: progressNotifier{rpc}}
+	output, err := run.execute(bufferedExecutor{commandExecutor}, uuidGenerator, util, append([]string{"java"}, args...))
+	if err != nil {
+		cleanup.run(util, writer)
+	}
+
+	writer.Close()
+	<-messages
+	reader.Close()
+
+	return output, err
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivate listens on the unix socket, which only the user may connect to, as the commands run with the session
+// of the cf CLI. The socket is created under the umask 0077, so that there is no moment in which others may connect.
+func listenPrivate(socket string) (net.Listener, error) {
+	umask := syscall.Umask(0077)
+	defer syscall.Umask(umask)
+
+	return net.Listen("unix", socket)
+}
@@ -0,0 +1,15 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import "net"
+
+// listenPrivate listens on the unix socket, which, like the other files of the user, inherits the access control list
+// of the directory, e.g., the profile of the user next to the plugins of the cf CLI
+func listenPrivate(socket string) (net.Listener, error) {
+	return net.Listen("unix", socket)
+}
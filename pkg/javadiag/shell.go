@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"strings"
+	"unicode"
+
+	"utils"
+)
+
+// nativeImageDetection is the prologue command that stores the PID of the GraalVM native image in the container in
+// NATIVE_PID, or fails if there is none. Native images are told apart by the SubstrateVM classes compiled into them.
+const nativeImageDetection = "NATIVE_PID=; for P in /proc/[0-9]*; do if grep -q -a com.oracle.svm ${P}/exe 2>/dev/null; then NATIVE_PID=${P##*/}; break; fi; done; if [ -z \"${NATIVE_PID}\" ]; then echo \"No GraalVM native image process found running.\" >&2; exit 1; fi"
+
+// shellDialect holds the parts of the remote commands that depend on the utilities available in the container
+type shellDialect struct {
+	// javaDetection is the prologue command that fails if there is no java process in the container
+	javaDetection string
+	// javaPID expands to the PID of the java process
+	javaPID string
+	// findExecutable returns the command listing the executables with the given name in the utils.ToolLocations and,
+	// unless found there, below the working directory
+	findExecutable func(name string) string
+	// newestFile returns the command printing the most recently modified file in dir matching the given name pattern
+	newestFile func(dir string, pattern string) string
+	// fileSize returns the command printing the size in bytes of the given file
+	fileSize func(file string) string
+}
+
+// fullShell is the dialect for containers with the GNU utilities and procps, like the cflinuxfs stacks
+var fullShell = shellDialect{
+	javaDetection: JavaDetectionCommand,
+	javaPID:       "$(pidof java)",
+	findExecutable: func(name string) string {
+		return "(" + utils.ProbeToolLocations(name) + "; find -executable -name " + name + ")"
+	},
+	newestFile: func(dir string, pattern string) string {
+		return "find " + dir + " -name '" + pattern + "' -printf '%T@ %p\\0' | sort -zk 1nr | sed -z 's/^[^ ]* //' | tr '\\0' '\\n' | head -n 1"
+	},
+	fileSize: func(file string) string {
+		return "stat -c '%s' " + file
+	},
+}
+
+// portableShell is the dialect for minimal containers, e.g., based on busybox, which lack pgrep, pidof or the GNU
+// extensions of find, and may not have bash. It sticks to POSIX sh and reads the processes from /proc.
+var portableShell = shellDialect{
+	javaDetection: "JAVA_PID=$(grep -l '^java$' /proc/[0-9]*/comm 2>/dev/null | head -n 1 | cut -d / -f 3); if [ -z \"${JAVA_PID}\" ]; then echo \"No 'java' process found running. Are you sure this is a Java app?\" >&2; exit 1; fi",
+	javaPID:       "${JAVA_PID}",
+	findExecutable: func(name string) string {
+		return "(" + utils.ProbeToolLocations(name) + "; find . -name " + name + " -perm -100)"
+	},
+	newestFile: func(dir string, pattern string) string {
+		return "ls -t " + dir + "/" + pattern + " 2>/dev/null | head -n 1"
+	},
+	fileSize: func(file string) string {
+		return "wc -c < " + file
+	},
+}
+
+// uploadScript writes the script of remoteScript into the container. Visible for tests
+var uploadScript = utils.UploadScript
+
+// remoteScriptPath returns the path in the container of the script with the given id, expanded by the remote shell
+func remoteScriptPath(id string) string {
+	return "${TMPDIR:-/tmp}/cf-java-" + id + ".sh"
+}
+
+// remoteScript returns the remote command that runs the script with the given id, written with uploadScript, with bash,
+// or sh if there is none, and removes it again. Its length does not depend on the commands of the script, as the
+// command line of cf ssh is limited in length, and none of their quotes, backticks or dollar signs can be mangled on
+// the way through cf ssh.
+func remoteScript(id string) string {
+	return "SCRIPT=" + remoteScriptPath(id) + "; $(command -v bash || command -v sh) ${SCRIPT}; STATUS=$?; rm -f ${SCRIPT}; exit ${STATUS}"
+}
+
+// remoteScriptPattern returns the pattern matching the command line of the shell running the script of remoteScript,
+// for pgrep -f. The bracket keeps the pattern from matching the command line of the shell looking for it.
+func remoteScriptPattern(id string) string {
+	return "cf-java-" + id + "[.]sh"
+}
+
+// fileSafeName returns the app name for the names of files and directories, both in the container, where they end up
+// in remote commands unquoted, and locally, with anything but ASCII letters, digits, dots, dashes and underscores
+// replaced by underscores
+func fileSafeName(applicationName string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 128 && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_') {
+			return r
+		}
+		return '_'
+	}, applicationName)
+}
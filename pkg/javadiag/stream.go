@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"github.com/SAP/cf-cli-java-plugin/cmd"
+
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+)
+
+// streamingCommandExecutor is a cmd.CommandExecutor that can also show the output of a command in the terminal while it
+// runs, instead of only returning it once the command is done
+type streamingCommandExecutor interface {
+	cmd.CommandExecutor
+	// ExecuteStreaming runs the command like Execute, writing its output to the terminal as it is produced
+	ExecuteStreaming(args []string) ([]string, error)
+}
+
+// streamBuffer collects the output of both stdout and stderr of a command, in the order it is written
+type streamBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+// lines returns the collected output split into lines, like plugin.CliConnection.CliCommand does
+func (b *streamBuffer) lines() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	output := strings.TrimSuffix(b.buffer.String(), "\n")
+	if output == "" {
+		return nil
+	}
+	return strings.Split(output, "\n")
+}
+
+// withoutKeepalive returns the lines of output without the NUL bytes written by KeepaliveCommand, which are of no
+// interest to the user, see streamWriter
+func withoutKeepalive(output []string) []string {
+	var lines []string
+	for _, line := range output {
+		stripped := strings.ReplaceAll(line, "\x00", "")
+		if stripped == "" && line != "" {
+			continue
+		}
+		lines = append(lines, stripped)
+	}
+
+	return lines
+}
+
+// streamWriter writes the output of a command to the terminal as it is produced, and collects it into a streamBuffer,
+// both without the NUL bytes written by KeepaliveCommand
+type streamWriter struct {
+	terminal io.Writer
+	buffer   *streamBuffer
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	data := bytes.ReplaceAll(p, []byte{0}, nil)
+
+	w.buffer.mutex.Lock()
+	w.buffer.buffer.Write(data)
+	w.buffer.mutex.Unlock()
+
+	if _, err := w.terminal.Write(data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// bufferedExecutor hides the streaming of a streamingCommandExecutor, for the output of commands that is
+// reworked before being shown, like the one prefixed by instance with the flag "all-instances"
+type bufferedExecutor struct {
+	cmd.CommandExecutor
+}
@@ -0,0 +1,287 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// hotThreadFrames is the number of top frames that must stay the same for a thread to be reported as hot
+const hotThreadFrames = 5
+
+var (
+	// threadHeader matches the first line of a thread in a thread dump of jstack or jcmd Thread.print
+	threadHeader = regexp.MustCompile(`^"(.*?)"(\s|$)`)
+	// lockLine matches the locks held or waited for by a thread, e.g., "- waiting to lock <0x00000000c0a1b2c3> (a java.lang.Object)"
+	lockLine = regexp.MustCompile(`^- (locked|waiting to lock) (<[^>]+> \(a [^)]+\))`)
+	// poolSuffix matches the number by which the threads of a pool are told apart, e.g., "-7" in "http-nio-8080-exec-7"
+	poolSuffix = regexp.MustCompile(`[-#_ ]?\d+$`)
+)
+
+// threadInfo is a thread of a thread dump
+type threadInfo struct {
+	Name          string
+	State         string
+	Frames        []string
+	Locked        []string
+	WaitingToLock string
+}
+
+// parseThreadDump reads the threads of a thread dump as printed by jstack or jcmd Thread.print
+func parseThreadDump(dump string) []threadInfo {
+	var threads []threadInfo
+	for _, line := range strings.Split(dump, "\n") {
+		if match := threadHeader.FindStringSubmatch(line); match != nil {
+			threads = append(threads, threadInfo{Name: match[1]})
+			continue
+		}
+		if len(threads) == 0 {
+			continue
+		}
+
+		thread := &threads[len(threads)-1]
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "java.lang.Thread.State: "):
+			thread.State = strings.Fields(strings.TrimPrefix(line, "java.lang.Thread.State: "))[0]
+		case strings.HasPrefix(line, "at "):
+			thread.Frames = append(thread.Frames, strings.TrimPrefix(line, "at "))
+		default:
+			if match := lockLine.FindStringSubmatch(line); match != nil {
+				if match[1] == "locked" {
+					thread.Locked = append(thread.Locked, match[2])
+				} else {
+					thread.WaitingToLock = match[2]
+				}
+			}
+		}
+	}
+
+	return threads
+}
+
+// topFrames returns the first frames of the thread, up to the given number
+func (thread threadInfo) topFrames(count int) string {
+	if len(thread.Frames) < count {
+		count = len(thread.Frames)
+	}
+
+	return strings.Join(thread.Frames[:count], "\n")
+}
+
+// idle tells whether the thread waits for work in a pool
+func (thread threadInfo) idle() bool {
+	for _, frame := range thread.Frames {
+		if strings.Contains(frame, "ThreadPoolExecutor.getTask") || strings.Contains(frame, "ForkJoinPool.awaitWork") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hotThreads returns the threads that are RUNNABLE with the same top frames in all thread dumps. Threads in native
+// methods, which are mostly waiting for I/O, are left out.
+func hotThreads(dumps [][]threadInfo) []threadInfo {
+	var hot []threadInfo
+	for _, thread := range dumps[0] {
+		if thread.State != "RUNNABLE" || len(thread.Frames) == 0 || strings.HasSuffix(thread.Frames[0], "(Native Method)") {
+			continue
+		}
+
+		same := true
+		for _, dump := range dumps[1:] {
+			found := false
+			for _, other := range dump {
+				if other.Name == thread.Name && other.State == "RUNNABLE" && other.topFrames(hotThreadFrames) == thread.topFrames(hotThreadFrames) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				same = false
+				break
+			}
+		}
+		if same {
+			hot = append(hot, thread)
+		}
+	}
+
+	return hot
+}
+
+// lockContention is how much threads waited for a lock over the thread dumps
+type lockContention struct {
+	Lock       string
+	MaxWaiting int
+	Dumps      int
+	Owners     []string
+}
+
+// contendedLocks returns the locks that threads waited for, the most contended first
+func contendedLocks(dumps [][]threadInfo) []lockContention {
+	contentions := map[string]*lockContention{}
+	for _, dump := range dumps {
+		waiting := map[string]int{}
+		owners := map[string]string{}
+		for _, thread := range dump {
+			if thread.WaitingToLock != "" {
+				waiting[thread.WaitingToLock]++
+			}
+			for _, lock := range thread.Locked {
+				owners[lock] = thread.Name
+			}
+		}
+
+		for lock, count := range waiting {
+			contention, ok := contentions[lock]
+			if !ok {
+				contention = &lockContention{Lock: lock}
+				contentions[lock] = contention
+			}
+			contention.Dumps++
+			if count > contention.MaxWaiting {
+				contention.MaxWaiting = count
+			}
+			if owner, ok := owners[lock]; ok && !containsString(contention.Owners, owner) {
+				contention.Owners = append(contention.Owners, owner)
+			}
+		}
+	}
+
+	result := make([]lockContention, 0, len(contentions))
+	for _, contention := range contentions {
+		result = append(result, *contention)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Dumps != result[j].Dumps {
+			return result[i].Dumps > result[j].Dumps
+		}
+		if result[i].MaxWaiting != result[j].MaxWaiting {
+			return result[i].MaxWaiting > result[j].MaxWaiting
+		}
+		return result[i].Lock < result[j].Lock
+	})
+
+	return result
+}
+
+// saturatedPools returns the names of the thread pools, with their number of threads in the last thread dump, none
+// of whose threads waited for work in any thread dump. Threads belong to the same pool if their names differ only in
+// a trailing number.
+func saturatedPools(dumps [][]threadInfo) map[string]int {
+	saturated := map[string]int{}
+	for i, dump := range dumps {
+		sizes := map[string]int{}
+		idle := map[string]bool{}
+		for _, thread := range dump {
+			if !poolSuffix.MatchString(thread.Name) {
+				continue
+			}
+			pool := poolSuffix.ReplaceAllString(thread.Name, "")
+			sizes[pool]++
+			idle[pool] = idle[pool] || thread.idle()
+		}
+
+		for pool, size := range sizes {
+			_, before := saturated[pool]
+			if size > 1 && !idle[pool] && (i == 0 || before) {
+				saturated[pool] = size
+			} else {
+				delete(saturated, pool)
+			}
+		}
+		for pool := range saturated {
+			if _, ok := sizes[pool]; !ok {
+				delete(saturated, pool)
+			}
+		}
+	}
+
+	return saturated
+}
+
+// containsString tells whether the slice contains the value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// analyzeThreadDumps reads the thread dumps in the given local files, taken one after the other from the same JVM,
+// and reports the threads that stayed busy in the same frames, the contended locks and the saturated thread pools
+func analyzeThreadDumps(files []string) (string, error) {
+	if len(files) < 2 {
+		return "", &InvalidUsageError{message: "At least two thread dump files are required for the analysis"}
+	}
+
+	dumps := make([][]threadInfo, len(files))
+	for i, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", errors.New("Error reading the thread dump " + file + ": " + err.Error())
+		}
+		dumps[i] = parseThreadDump(string(content))
+		if len(dumps[i]) == 0 {
+			return "", errors.New("No threads found in " + file + ", is it a thread dump of jstack or jcmd?")
+		}
+	}
+
+	lines := []string{fmt.Sprintf("Threads RUNNABLE in the same frames in all %d thread dumps:", len(dumps))}
+	hot := hotThreads(dumps)
+	for _, thread := range hot {
+		lines = append(lines, fmt.Sprintf("   %q at %s", thread.Name, thread.Frames[0]))
+	}
+	if len(hot) == 0 {
+		lines = append(lines, "   none")
+	}
+
+	lines = append(lines, "", "Contended locks:")
+	locks := contendedLocks(dumps)
+	for _, lock := range locks {
+		line := fmt.Sprintf("   %s: up to %d threads waiting, in %d of %d thread dumps", lock.Lock, lock.MaxWaiting, lock.Dumps, len(dumps))
+		if len(lock.Owners) > 0 {
+			line += ", held by \"" + strings.Join(lock.Owners, "\", \"") + "\""
+		}
+		lines = append(lines, line)
+	}
+	if len(locks) == 0 {
+		lines = append(lines, "   none")
+	}
+
+	lines = append(lines, "", "Saturated thread pools:")
+	pools := saturatedPools(dumps)
+	for _, pool := range sortedPools(pools) {
+		lines = append(lines, fmt.Sprintf("   %s: all %d threads busy in all %d thread dumps", pool, pools[pool], len(dumps)))
+	}
+	if len(pools) == 0 {
+		lines = append(lines, "   none")
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// sortedPools returns the names of the pools in lexical order
+func sortedPools(pools map[string]int) []string {
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"utils"
+)
+
+// toolCacheFile returns the file caching the paths of the tools in the containers. Visible for tests
+var toolCacheFile = defaultToolCacheFile
+
+// pluginsDir returns the directory of the plugins of the cf CLI, honoring CF_PLUGIN_HOME and CF_HOME the same way it
+// does
+func pluginsDir() (string, error) {
+	home := os.Getenv("CF_PLUGIN_HOME")
+	if home == "" {
+		home = os.Getenv("CF_HOME")
+	}
+	if home == "" {
+		var err error
+		if home, err = os.UserHomeDir(); err != nil {
+			return "", err
+		}
+	}
+
+	return filepath.Join(home, ".cf", "plugins"), nil
+}
+
+// defaultToolCacheFile returns the file next to the plugins of the cf CLI
+func defaultToolCacheFile() (string, error) {
+	dir, err := pluginsDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "cf-java-plugin-tools.json"), nil
+}
+
+// toolCache maps the key of an app instance, see toolCacheKey, to the paths of the execTools in its container, with
+// an empty path for the tools that are not there
+type toolCache map[string]map[string]string
+
+// toolCacheKey identifies the container of an app instance: a new droplet may come with other tools, while the
+// instances of a droplet all have the same
+func toolCacheKey(appGUID string, dropletGUID string, applicationInstance int) string {
+	if applicationInstance < 0 {
+		applicationInstance = 0
+	}
+
+	return appGUID + "/" + dropletGUID + "/" + strconv.Itoa(applicationInstance)
+}
+
+// readToolCache returns the cached tool paths, or an empty cache if there is none or it cannot be read
+func readToolCache(file string) toolCache {
+	cache := toolCache{}
+	if content, err := os.ReadFile(file); err == nil {
+		json.Unmarshal(content, &cache)
+	}
+
+	return cache
+}
+
+// writeToolCache stores the cache, dropping the entries of other droplets of the app as they are not used anymore
+func writeToolCache(file string, cache toolCache, appGUID string, dropletGUID string) error {
+	for key := range cache {
+		if strings.HasPrefix(key, appGUID+"/") && !strings.HasPrefix(key, appGUID+"/"+dropletGUID+"/") {
+			delete(cache, key)
+		}
+	}
+
+	content, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, content, 0644)
+}
+
+// withCachedTools returns the shell dialect that uses the cached paths of the execTools instead of looking for them
+// with find across the droplet, which takes seconds for large apps. The paths are resolved and cached on first use,
+// and again if refresh is set, i.e., with the flag "no-cache". Apps without droplet are not cached.
+func withCachedTools(util utils.CfJavaPluginUtil, sshArguments []string, applicationName string, applicationInstance int, shell shellDialect, refresh bool, verbose bool, messages io.Writer) (shellDialect, error) {
+	appGUID, dropletGUID, err := util.GetAppDroplet(applicationName)
+	if err != nil {
+		return shell, err
+	}
+	file, err := toolCacheFile()
+	if err != nil || dropletGUID == "" {
+		return shell, nil
+	}
+
+	key := toolCacheKey(appGUID, dropletGUID, applicationInstance)
+	cache := readToolCache(file)
+	paths, cached := cache[key]
+	if !cached || refresh {
+		paths, err = util.ResolveTools(sshArguments, execTools)
+		if err != nil {
+			return shell, err
+		}
+		cache[key] = paths
+		// The cache only saves time, the command works without it
+		if err := writeToolCache(file, cache, appGUID, dropletGUID); err != nil && verbose {
+			fmt.Fprintln(messages, "Cannot cache the paths of the tools in "+file+": "+err.Error())
+		}
+	} else if verbose {
+		fmt.Fprintln(messages, "Using the paths of the tools cached in "+file+", run with -no-cache to look for them again")
+	}
+
+	findExecutable := shell.findExecutable
+	shell.findExecutable = func(name string) string {
+		path, ok := paths[name]
+		switch {
+		case !ok:
+			return findExecutable(name)
+		case path == "":
+			return "true"
+		}
+		return "echo '" + path + "'"
+	}
+
+	return shell, nil
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// commit is the git commit the plugin was built from, set with -ldflags "-X cf.plugin.ref/requires/pkg/javadiag.commit=...", see the Makefile
+var commit = "unknown"
+
+// pluginRepositoryURL lists the plugins published in the CF Community plugin repository, including the checksums
+// of their binaries. Visible for tests
+var pluginRepositoryURL = "https://plugins.cloudfoundry.org/list"
+
+type pluginRepositoryListing struct {
+	Plugins []struct {
+		Name     string `json:"name"`
+		Version  string `json:"version"`
+		Binaries []struct {
+			Platform string `json:"platform"`
+			URL      string `json:"url"`
+			Checksum string `json:"checksum"`
+		} `json:"binaries"`
+	} `json:"plugins"`
+}
+
+// releasePlatform returns the name of the platform of the running binary as used in the plugin repository
+// and in the names of the release binaries
+func releasePlatform() string {
+	switch runtime.GOOS + "/" + runtime.GOARCH {
+	case "darwin/amd64":
+		return "osx"
+	case "linux/386":
+		return "linux32"
+	case "linux/amd64":
+		return "linux64"
+	case "windows/386":
+		return "win32"
+	case "windows/amd64":
+		return "win64"
+	}
+
+	return runtime.GOOS + "-" + runtime.GOARCH
+}
+
+// fileChecksum returns the hex-encoded SHA-1 checksum of the file, the algorithm used by the plugin repository
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha1.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// publishedChecksum looks up the checksum of the binary published for the given version and platform,
+// returning an empty string if there is none
+func publishedChecksum(version string, platform string) (string, error) {
+	response, err := http.Get(pluginRepositoryURL)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", errors.New("unexpected status " + response.Status)
+	}
+
+	var listing pluginRepositoryListing
+	if err := json.NewDecoder(response.Body).Decode(&listing); err != nil {
+		return "", err
+	}
+
+	for _, plugin := range listing.Plugins {
+		if plugin.Name != "java" || strings.TrimPrefix(plugin.Version, "v") != version {
+			continue
+		}
+		for _, binary := range plugin.Binaries {
+			if binary.Platform == platform {
+				return binary.Checksum, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// verifyInstall reports version, build commit and platform of the running binary and checks it against the
+// checksum published for that release
+func verifyInstall(version string, messages io.Writer) error {
+	platform := releasePlatform()
+
+	fmt.Fprintln(messages, "Version: "+version)
+	fmt.Fprintln(messages, "Commit: "+commit)
+	fmt.Fprintln(messages, "Platform: "+platform)
+
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.New("Error locating the plugin binary: " + err.Error())
+	}
+	checksum, err := fileChecksum(executable)
+	if err != nil {
+		return errors.New("Error computing the checksum of the plugin binary " + executable + ": " + err.Error())
+	}
+
+	fmt.Fprintln(messages, "Binary: "+executable)
+	fmt.Fprintln(messages, "Checksum (SHA-1): "+checksum)
+
+	expected, err := publishedChecksum(version, platform)
+	if err != nil {
+		return errors.New("Error reading the release metadata from " + pluginRepositoryURL + ": " + err.Error())
+	}
+
+	if expected == "" {
+		fmt.Fprintln(messages, "No binary published for version "+version+" on platform "+platform+", the integrity of the binary cannot be verified")
+		return nil
+	}
+	if !strings.EqualFold(expected, checksum) {
+		return errors.New("The plugin binary does not match the published release " + version + " for platform " + platform + " (expected checksum " + expected + "), please reinstall the plugin")
+	}
+
+	fmt.Fprintln(messages, "The plugin binary matches the published release")
+	return nil
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/bytefmt"
+
+	"utils"
+)
+
+// SapMachine Vitals sample the memory and threads of the JVM, its process and the system every ten seconds for the
+// last hour, and every hour for the last days, see https://github.com/SAP/SapMachine/wiki/SapMachine-Vitals.
+
+// vitalsChartWidth is the maximum number of samples shown in a line of the chart of vitals-history
+const vitalsChartWidth = 60
+
+// vitalsChartColumns are the columns of the SapMachine Vitals charted by vitals-history, with whether their values
+// are sizes
+var vitalsChartColumns = []struct {
+	name  string
+	bytes bool
+}{
+	{"proc-rss-all", true},
+	{"jvm-heap-comm", true},
+	{"jvm-heap-used", true},
+	{"jvm-meta-comm", true},
+	{"jvm-meta-used", true},
+	{"jvm-code", true},
+	{"jvm-jthr-num", false},
+	{"jvm-cls-num", false},
+}
+
+// sparklineBlocks are the characters of the chart of vitals-history, from the lowest value to the highest
+var sparklineBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// vitalsHistoryCommands returns the remote commands printing the whole history of the SapMachine Vitals as CSV, with
+// a sample taken now, followed by the vitals files the JVM was told to write with -XX:VitalsFile, see foundFiles
+func vitalsHistoryCommands(shell shellDialect) []string {
+	return []string{
+		"JCMD_COMMAND=`" + shell.findExecutable("jcmd") + " | head -1 | tr -d [:space:]`",
+		"if [ -z \"${JCMD_COMMAND}\" ]; then echo >&2 'jcmd is required for reading the SapMachine Vitals, please make sure that the app runs on a full JDK'; exit 1; fi",
+		"if ! ${JCMD_COMMAND} " + shell.javaPID + " help | grep -q VM.vitals; then echo >&2 'The JVM has no jcmd VM.vitals, the SapMachine Vitals are only available in SapMachine'; exit 1; fi",
+		"${JCMD_COMMAND} " + shell.javaPID + " VM.vitals csv now",
+		// The JVM writes <file>.txt and <file>.csv with -XX:+DumpVitalsAtExit, e.g., before a restart in the container
+		"VITALS_FILE=`${JCMD_COMMAND} " + shell.javaPID + " VM.command_line | grep -o -- '-XX:VitalsFile=[^ ]*' | head -1 | cut -d = -f 2`",
+		"if [ -n \"${VITALS_FILE}\" ]; then for F in \"${VITALS_FILE}\" \"${VITALS_FILE}.txt\" \"${VITALS_FILE}.csv\"; do if [ -s \"${F}\" ]; then echo \"FOUND ${F}\"; fi; done; fi",
+	}
+}
+
+// vitalsHistory holds the samples of the SapMachine Vitals, oldest first, by the name of their columns
+type vitalsHistory struct {
+	Columns []string
+	Samples [][]string
+}
+
+// parseVitalsHistory parses the CSV printed by vitalsHistoryCommands. The short-term and long-term samples come in
+// sections of their own, each with its header, and are sorted by their time, the first column.
+func parseVitalsHistory(output []string) (vitalsHistory, error) {
+	var history vitalsHistory
+	seen := map[string]bool{}
+	for _, line := range output {
+		// The line "<pid>:" of jcmd, the titles of the sections and the files found carry no values
+		if !strings.Contains(line, ",") || strings.HasPrefix(line, "FOUND ") {
+			continue
+		}
+		reader := csv.NewReader(strings.NewReader(line))
+		reader.LazyQuotes = true
+		record, err := reader.Read()
+		if err != nil || len(record) < 2 {
+			continue
+		}
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+
+		if history.Columns == nil {
+			history.Columns = record
+			continue
+		}
+		if record[0] == history.Columns[0] || seen[record[0]] {
+			continue
+		}
+		seen[record[0]] = true
+		history.Samples = append(history.Samples, record)
+	}
+
+	if len(history.Samples) == 0 {
+		return vitalsHistory{}, errors.New("No SapMachine Vitals found in the output of jcmd VM.vitals, please check that the JVM does not run with -XX:-EnableVitals")
+	}
+	sort.SliceStable(history.Samples, func(i, j int) bool {
+		return history.Samples[i][0] < history.Samples[j][0]
+	})
+
+	return history, nil
+}
+
+// csv returns the samples with their header, as CSV
+func (history vitalsHistory) csv() string {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	writer.Write(history.Columns)
+	writer.WriteAll(history.Samples)
+
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
+
+// values returns the values of the column that are numbers or sizes, e.g., 512m, in the order of the samples
+func (history vitalsHistory) values(column string) []float64 {
+	index := -1
+	for i, name := range history.Columns {
+		if name == column {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil
+	}
+
+	var values []float64
+	for _, sample := range history.Samples {
+		if index >= len(sample) || sample[index] == "" {
+			continue
+		}
+		if value, err := strconv.ParseFloat(sample[index], 64); err == nil {
+			values = append(values, value)
+		} else if size, err := bytefmt.ToBytes(sample[index]); err == nil {
+			values = append(values, float64(size))
+		}
+	}
+
+	return values
+}
+
+// sparkline returns a line of blocks as high as the values, taking evenly spaced ones if there are more than width
+func sparkline(values []float64, width int) string {
+	if len(values) > width {
+		sampled := make([]float64, width)
+		for i := range sampled {
+			sampled[i] = values[i*(len(values)-1)/(width-1)]
+		}
+		values = sampled
+	}
+
+	low, high := values[0], values[0]
+	for _, value := range values {
+		if value < low {
+			low = value
+		}
+		if value > high {
+			high = value
+		}
+	}
+
+	var line []rune
+	for _, value := range values {
+		level := 0
+		if high > low {
+			level = int((value - low) / (high - low) * float64(len(sparklineBlocks)-1))
+		}
+		line = append(line, sparklineBlocks[level])
+	}
+
+	return string(line)
+}
+
+// vitalsChart returns a line per charted column of the history, with its lowest, highest and latest value
+func vitalsChart(applicationName string, history vitalsHistory) string {
+	first, last := history.Samples[0][0], history.Samples[len(history.Samples)-1][0]
+	lines := []string{fmt.Sprintf("SapMachine Vitals of %s: %d samples from %s to %s", applicationName, len(history.Samples), first, last)}
+	for _, column := range vitalsChartColumns {
+		values := history.values(column.name)
+		if len(values) == 0 {
+			continue
+		}
+
+		format := func(value float64) string {
+			if column.bytes {
+				return bytefmt.ByteSize(uint64(value))
+			}
+			return strconv.FormatFloat(value, 'f', -1, 64)
+		}
+		low, high := values[0], values[0]
+		for _, value := range values {
+			if value < low {
+				low = value
+			}
+			if value > high {
+				high = value
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%-14s %s  min %s, max %s, last %s", column.name, sparkline(values, vitalsChartWidth), format(low), format(high), format(values[len(values)-1])))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// reportVitalsHistory prints the chart of the SapMachine Vitals or saves them into the given CSV file, and downloads the
+// vitals files found in the container into the local directory, if given, or tells how to
+func reportVitalsHistory(util utils.CfJavaPluginUtil, cfSSHArguments []string, applicationName string, applicationInstance int, output []string, out string, localDir string, copyOptions utils.CopyOptions, messages io.Writer) (string, error) {
+	history, err := parseVitalsHistory(output)
+	if err != nil {
+		return "", err
+	}
+
+	for _, file := range foundFiles(output) {
+		if localDir == "" {
+			fmt.Fprintln(messages, "The JVM wrote the vitals file "+file+", to download it, run: "+downloadInstructions(applicationName, applicationInstance, file))
+			continue
+		}
+		if _, err := download(util, cfSSHArguments, file, localDir, copyOptions, false, messages); err != nil {
+			return "", err
+		}
+	}
+
+	if out != "" {
+		if err := os.WriteFile(out, []byte(history.csv()+"\n"), 0644); err != nil {
+			return "", errors.New("Error writing the SapMachine Vitals to " + out + ": " + err.Error())
+		}
+		fmt.Fprintf(messages, "%d samples saved to: %s\n", len(history.Samples), out)
+		return "", nil
+	}
+
+	return vitalsChart(applicationName, history), nil
+}
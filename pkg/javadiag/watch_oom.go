@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2024 SAP SE or an SAP affiliate company. All rights reserved.
+ * This file is licensed under the Apache Software License, v. 2 except as noted
+ * otherwise in the LICENSE file at the root of the repository.
+ */
+
+package javadiag
+
+import (
+	"strconv"
+	"strings"
+)
+
+// watchOOMPollSeconds is how often watch-oom looks for new files in the container
+const watchOOMPollSeconds = 5
+
+// watchOOMFiles are the files the JVM writes upon an OutOfMemoryError or a crash: heap dumps of
+// -XX:+HeapDumpOnOutOfMemoryError, hs_err files and, for OpenJ9, heap dumps and javacores
+var watchOOMFiles = []string{"java_pid*.hprof", "hs_err_pid*.log", "heapdump.*.phd", "javacore.*.txt"}
+
+// watchOOMCommands returns the remote commands waiting, in one ssh session, for the JVM to write any of the
+// watchOOMFiles into dirs. Once one shows up, they write a thread dump into threadDumpFile while the JVM is still alive,
+// wait for the files to be complete and print them, one per line, prefixed with FOUND.
+func watchOOMCommands(shell shellDialect, dirs []string, marker string, threadDumpFile string) []string {
+	names := make([]string, len(watchOOMFiles))
+	for i, name := range watchOOMFiles {
+		names[i] = "-name '" + name + "'"
+	}
+
+	return []string{
+		"PID=" + shell.javaPID,
+		"touch " + marker,
+		"echo 'Watching the JVM for an OutOfMemoryError or a crash, until interrupted with Ctrl+C'",
+		"while true; do FILES=`find " + strings.Join(dirs, " ") + " -maxdepth 1 -type f -newer " + marker + " \\( " + strings.Join(names, " -o ") + " \\) 2>/dev/null`; " +
+			"if [ -n \"${FILES}\" ]; then break; fi; " +
+			"if ! kill -0 ${PID} 2>/dev/null; then rm -f " + marker + "; echo >&2 'The JVM exited without writing a heap dump or hs_err file'; exit 1; fi; " +
+			"sleep " + strconv.Itoa(watchOOMPollSeconds) + "; done",
+		"rm -f " + marker,
+		"JSTACK_COMMAND=`" + shell.findExecutable("jstack") + " | head -1 | tr -d [:space:]`",
+		"if [ -n \"${JSTACK_COMMAND}\" ] && kill -0 ${PID} 2>/dev/null && ${JSTACK_COMMAND} ${PID} > " + threadDumpFile + " 2>/dev/null; then FILES=\"${FILES} " + threadDumpFile + "\"; fi",
+		// The heap dump is complete once its size stops changing
+		"for F in ${FILES}; do SIZE=-1; while [ \"${SIZE}\" != \"$(" + shell.fileSize("${F}") + ")\" ]; do SIZE=$(" + shell.fileSize("${F}") + "); sleep 3; done; echo \"FOUND ${F}\"; done",
+	}
+}
+
+// foundFiles returns the files printed by the commands of watchOOMCommands
+func foundFiles(output []string) []string {
+	var files []string
+	for _, line := range output {
+		if strings.HasPrefix(line, "FOUND ") {
+			files = append(files, strings.TrimSpace(strings.TrimPrefix(line, "FOUND ")))
+		}
+	}
+
+	return files
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AppGUIDTTL is how long the GUID of an app is taken from the file of AppGUIDs, across runs of the plugin
+const AppGUIDTTL = 2 * time.Minute
+
+// AppGUIDs caches the GUIDs of apps by name for CfJavaPluginUtilImpl, which otherwise looks them up with cf app --guid
+// before each query of the v3 API. The GUIDs are kept for the run and, if File is set, in that file for AppGUIDTTL,
+// keyed by the Target, e.g., the API endpoint and the targeted space, so that repeated runs skip the lookup too.
+type AppGUIDs struct {
+	Target string
+	File   string
+	mutex  sync.Mutex
+	guids  map[string]string
+}
+
+type cachedAppGUID struct {
+	GUID    string    `json:"guid"`
+	Created time.Time `json:"created"`
+}
+
+func (c *AppGUIDs) get(app string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if guid, found := c.guids[app]; found {
+		return guid, true
+	}
+	if c.File == "" {
+		return "", false
+	}
+	cached, found := c.readFile()[c.Target+"/"+app]
+	if !found || time.Since(cached.Created) > AppGUIDTTL {
+		return "", false
+	}
+	if c.guids == nil {
+		c.guids = map[string]string{}
+	}
+	c.guids[app] = cached.GUID
+
+	return cached.GUID, true
+}
+
+func (c *AppGUIDs) put(app string, guid string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.guids == nil {
+		c.guids = map[string]string{}
+	}
+	c.guids[app] = guid
+	if c.File == "" {
+		return
+	}
+
+	// The expired entries of all targets are dropped, so that the file does not grow
+	cache := map[string]cachedAppGUID{}
+	for key, cached := range c.readFile() {
+		if time.Since(cached.Created) <= AppGUIDTTL {
+			cache[key] = cached
+		}
+	}
+	cache[c.Target+"/"+app] = cachedAppGUID{GUID: guid, Created: time.Now()}
+	if content, err := json.MarshalIndent(cache, "", "  "); err == nil && os.MkdirAll(filepath.Dir(c.File), 0755) == nil {
+		// Failing to cache the GUID only costs the lookup next time
+		os.WriteFile(c.File, content, 0644)
+	}
+}
+
+// readFile returns the GUIDs cached in the file, or none if there is none or it cannot be read
+func (c *AppGUIDs) readFile() map[string]cachedAppGUID {
+	cache := map[string]cachedAppGUID{}
+	if content, err := os.ReadFile(c.File); err == nil {
+		json.Unmarshal(content, &cache)
+	}
+
+	return cache
+}
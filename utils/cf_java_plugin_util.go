@@ -1,9 +1,99 @@
 package utils
 
+import (
+	"io"
+	"strings"
+	"time"
+)
+
 type CfJavaPluginUtil interface {
-	CheckRequiredTools(app string) (bool, error)
-	GetAvailablePath(data string, userpath string) (string, error)
-	CopyOverCat(args []string, src string, dest string) error
+	CheckRequiredTools(app string, args []string) (bool, error)
+	CheckAppInstance(app string, index int) error
+	GetInstanceState(app string, index int) (string, time.Duration, error)
+	GetRecentLogs(app string) ([]string, error)
+	GetRunningInstances(app string) ([]int, error)
+	GetInstances(app string) ([]InstanceInfo, error)
+	InspectContainer(args []string) (bool, string, error)
+	DetectRuntime(args []string) (string, error)
+	FindTools(args []string, tools []string) (map[string]bool, error)
+	ResolveTools(args []string, tools []string) (map[string]string, error)
+	FindGCLogs(args []string) ([]string, error)
+	GetClassHistogram(args []string) (string, error)
+	GetAppName(guid string) (string, error)
+	GetAppNameByRoute(route string) (string, error)
+	GetApps() ([]AppSummary, error)
+	GetAppDroplet(app string) (string, string, error)
+	GetAppVersion(app string) (string, error)
+	GetDropletInfo(app string) (DropletInfo, error)
+	GetAppEnvironment(app string) (map[string]string, error)
+	GetAvailablePath(data string, args []string, userpath string) (string, error)
+	CopyOverCat(args []string, src string, dest string, options CopyOptions) error
+	StreamFile(args []string, src string, out io.Writer, options CopyOptions) error
+	UploadFile(args []string, src string, dest string) error
 	DeleteRemoteFile(args []string, path string) error
+	DeleteRemotePaths(args []string, paths []string) error
+	StopRemoteProcesses(args []string, pattern string) error
 	FindDumpFile(args []string, fullpath string, fspath string) (string, error)
+	FindRemoteFile(args []string, pattern string) (string, error)
+	ValidateHeapDump(path string) (HeapDumpSummary, error)
+	RedactHeapDump(path string) (int, error)
+}
+
+// AppSummary describes an app of the targeted space
+type AppSummary struct {
+	Name  string `json:"name"`
+	GUID  string `json:"guid"`
+	State string `json:"state"`
+}
+
+// InstanceInfo describes an instance of an app, as reported by the v3 API
+type InstanceInfo struct {
+	Index  int
+	State  string
+	Uptime time.Duration
+	// MemoryQuota and MemoryUsage are in bytes, 0 unless the instance is running
+	MemoryQuota int64
+	MemoryUsage int64
+}
+
+// AutoLargestPath is the container path which asks GetAvailablePath for the directory with the most free space
+const AutoLargestPath = "auto:largest"
+
+// The runtimes told apart by DetectRuntime
+const (
+	RuntimeHotSpot     = "hotspot"
+	RuntimeOpenJ9      = "openj9"
+	RuntimeNativeImage = "native-image"
+)
+
+// ToolLocations are the directories into which the buildpacks install the JDK, relative to the working directory of
+// the container or absolute. Probing them spares most apps the search for the JDK tools across the whole droplet.
+var ToolLocations = []string{"${JAVA_HOME:+${JAVA_HOME}/bin}", "app/.java-buildpack/*/bin", "/layers/*/jre/bin", "/layers/*/jdk/bin"}
+
+// ProbeToolLocations returns the command printing the first executable with the given name in the ToolLocations and
+// exiting, if there is one; it must run in a subshell
+func ProbeToolLocations(name string) string {
+	paths := make([]string, len(ToolLocations))
+	for i, location := range ToolLocations {
+		paths[i] = location + "/" + name
+	}
+
+	return "for P in " + strings.Join(paths, " ") + "; do if [ -x \"${P}\" ]; then echo \"${P}\"; exit 0; fi; done"
+}
+
+// CopyOptions tweaks how CopyOverCat transfers a file from the container
+type CopyOptions struct {
+	// LimitRate is the maximum download speed in bytes per second, 0 means unlimited
+	LimitRate int64
+	// CreateLocalDir creates the directory of the local file, including its parents, if it does not exist
+	CreateLocalDir bool
+	// Force overwrites the local file if it already exists, otherwise the copy fails
+	Force bool
+	// Resume keeps the chunks of an existing local file that match their checksums, e.g., of a download that failed
+	// midway, and downloads only the others
+	Resume bool
+	// Manifest, if set, holds the size and chunk checksums of the remote file, which are then not queried again
+	Manifest *FileManifest
+	// Progress, if set, is called with the bytes copied so far and the size of the file after each verified chunk
+	Progress func(transferred int64, total int64)
 }
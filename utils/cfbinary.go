@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// cfBinary is the cf binary run by CfCommand
+var cfBinary = "cf"
+
+// cfBinaryName matches the names of the cf CLI, like cf, cf7 or cf8
+var cfBinaryName = regexp.MustCompile(`^cf\d*$`)
+
+// UseParentCf makes CfCommand run the cf binary that launched the plugin rather than the first one in the PATH, so
+// that the cf processes of the downloads and uploads use the same CLI, and with it the same session, as the
+// CliConnection, e.g., with cf8 installed next to an older cf. Should the parent process not be a cf CLI, e.g., as the
+// commands are embedded into another tool, the PATH is used.
+func UseParentCf() {
+	if path := parentExecutable(); isCfBinary(path) {
+		cfBinary = path
+	}
+}
+
+// isCfBinary tells whether the path is the one of a cf CLI
+func isCfBinary(path string) bool {
+	name := strings.TrimSuffix(strings.ToLower(filepath.Base(path)), ".exe")
+	return filepath.IsAbs(path) && cfBinaryName.MatchString(name)
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestIsCfBinary(t *testing.T) {
+	dir := os.TempDir()
+	for path, expected := range map[string]bool{
+		filepath.Join(dir, "cf"):             true,
+		filepath.Join(dir, "cf8"):            true,
+		filepath.Join(dir, "CF7.exe"):        true,
+		"cf":                                 false,
+		"":                                   false,
+		filepath.Join(dir, "go"):             false,
+		filepath.Join(dir, "cf-java-plugin"): false,
+		filepath.Join(dir, ".cf", "java"):    false,
+	} {
+		if isCfBinary(path) != expected {
+			t.Errorf("expected isCfBinary(%q) to be %v", path, expected)
+		}
+	}
+}
+
+func TestCfCommandRunsTheCfBinaryInUse(t *testing.T) {
+	defer func(binary string) { cfBinary = binary }(cfBinary)
+
+	if path := CfCommand("version").Args[0]; path != "cf" {
+		t.Errorf("expected the cf binary in the PATH by default, got %s", path)
+	}
+
+	cfBinary = "/opt/cf-cli/cf8"
+	if path := CfCommand("version").Path; path != "/opt/cf-cli/cf8" {
+		t.Errorf("expected the cf binary in use, got %s", path)
+	}
+}
+
+func TestUseParentCfKeepsThePathWithoutCfParent(t *testing.T) {
+	defer func(binary string) { cfBinary = binary }(cfBinary)
+
+	// The tests are launched by go test
+	UseParentCf()
+	if cfBinary != "cf" {
+		t.Errorf("expected the cf binary in the PATH, got %s", cfBinary)
+	}
+}
+
+// TestUseParentCf copies the test binary as cf, which launches the test binary again, like the cf CLI launches the
+// plugin, to check that the copy is found as the parent cf
+func TestUseParentCf(t *testing.T) {
+	switch os.Getenv("CF_JAVA_TEST_PARENT") {
+	case "cf":
+		child := exec.Command(os.Args[0], "-test.run=^TestUseParentCf$")
+		child.Env = append(os.Environ(), "CF_JAVA_TEST_PARENT=plugin")
+		child.Stdout = os.Stdout
+		if err := child.Run(); err != nil {
+			os.Exit(1)
+		}
+		return
+	case "plugin":
+		UseParentCf()
+		fmt.Println("CF_BINARY " + cfBinary)
+		return
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("the parent process is read from /proc")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := filepath.Join(t.TempDir(), "cf")
+	if err := copyExecutable(executable, cf); err != nil {
+		t.Fatal(err)
+	}
+
+	parent := exec.Command(cf, "-test.run=^TestUseParentCf$")
+	parent.Env = append(os.Environ(), "CF_JAVA_TEST_PARENT=cf")
+	output, err := parent.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(output), "CF_BINARY "+cf+"\n") {
+		t.Errorf("expected the parent cf %s to be used, got %s", cf, output)
+	}
+}
+
+func copyExecutable(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
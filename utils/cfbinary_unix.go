@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// parentExecutable returns the path of the executable of the parent process, or an empty string if it is unknown
+func parentExecutable() string {
+	if path, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", os.Getppid())); err == nil {
+		return path
+	}
+
+	// Without /proc, e.g., on macOS, ps shows the path the executable was started with
+	output, err := exec.Command("ps", "-o", "comm=", "-p", strconv.Itoa(os.Getppid())).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// processQueryLimitedInformation is the access right PROCESS_QUERY_LIMITED_INFORMATION
+const processQueryLimitedInformation = 0x1000
+
+var queryFullProcessImageName = syscall.NewLazyDLL("kernel32.dll").NewProc("QueryFullProcessImageNameW")
+
+// parentExecutable returns the path of the executable of the parent process, or an empty string if it is unknown
+func parentExecutable() string {
+	process, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(os.Getppid()))
+	if err != nil {
+		return ""
+	}
+	defer syscall.CloseHandle(process)
+
+	buffer := make([]uint16, syscall.MAX_PATH)
+	size := uint32(len(buffer))
+	if result, _, _ := queryFullProcessImageName.Call(uintptr(process), 0, uintptr(unsafe.Pointer(&buffer[0])), uintptr(unsafe.Pointer(&size))); result == 0 {
+		return ""
+	}
+
+	return syscall.UTF16ToString(buffer[:size])
+}
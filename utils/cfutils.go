@@ -4,12 +4,58 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// CliConnection is the part of the plugin.CliConnection, which the cf CLI hands to the plugin, used to run cf commands.
+// Going through it rather than executing the cf binary ensures the commands run with the very CLI and session that
+// invoked the plugin.
+type CliConnection interface {
+	CliCommandWithoutTerminalOutput(args ...string) ([]string, error)
+}
+
 type CfJavaPluginUtilImpl struct {
+	CliConnection CliConnection
+	// AppGUIDs caches the GUIDs of the apps, if set
+	AppGUIDs *AppGUIDs
+	// SpaceGUID returns the GUID of the targeted space, e.g., with GetCurrentSpace of the plugin.CliConnection, if set
+	SpaceGUID func() (string, error)
+}
+
+// cf runs a cf command through the CliConnection and returns its output
+func (checker CfJavaPluginUtilImpl) cf(args ...string) (string, error) {
+	output, err := checker.CliConnection.CliCommandWithoutTerminalOutput(args...)
+	return strings.Join(output, "\n"), err
+}
+
+// CfCommand returns the command running the cf binary in a process of its own, for the commands whose output is piped,
+// like the content of downloaded files. Should CF_TRACE be true, the trace of the process goes to stderr, or a file in
+// the temporary directory on Windows, so that it is not mixed into the output; trace into a file is kept as it is.
+// The binary is the cf CLI that launched the plugin, see UseParentCf, or the first one in the PATH.
+func CfCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(cfBinary, args...)
+	if strings.EqualFold(os.Getenv("CF_TRACE"), "true") {
+		cmd.Env = append(os.Environ(), "CF_TRACE="+traceFile())
+	}
+
+	return cmd
+}
+
+// traceFile returns where the cf processes of CfCommand write their trace to
+func traceFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.TempDir(), "cf-java-trace.log")
+	}
+	return "/dev/stderr"
 }
 
 type CFAppEnv struct {
@@ -17,6 +63,7 @@ type CFAppEnv struct {
 		JbpConfigSpringAutoReconfiguration string `json:"JBP_CONFIG_SPRING_AUTO_RECONFIGURATION"`
 		JbpConfigOpenJdkJre                string `json:"JBP_CONFIG_OPEN_JDK_JRE"`
 		JbpConfigComponents                string `json:"JBP_CONFIG_COMPONENTS"`
+		SourceVersion                      string `json:"SOURCE_VERSION"`
 	} `json:"environment_variables"`
 	StagingEnvJSON struct {
 	} `json:"staging_env_json"`
@@ -52,53 +99,457 @@ type CFAppEnv struct {
 			Limits struct {
 				Fds int `json:"fds"`
 			} `json:"limits"`
-			ApplicationName  string      `json:"application_name"`
-			ApplicationUris  []string    `json:"application_uris"`
-			Name             string      `json:"name"`
-			SpaceName        string      `json:"space_name"`
-			SpaceID          string      `json:"space_id"`
-			OrganizationID   string      `json:"organization_id"`
-			OrganizationName string      `json:"organization_name"`
-			Uris             []string    `json:"uris"`
-			Users            interface{} `json:"users"`
-			ApplicationID    string      `json:"application_id"`
+			ApplicationName    string      `json:"application_name"`
+			ApplicationUris    []string    `json:"application_uris"`
+			Name               string      `json:"name"`
+			SpaceName          string      `json:"space_name"`
+			SpaceID            string      `json:"space_id"`
+			OrganizationID     string      `json:"organization_id"`
+			OrganizationName   string      `json:"organization_name"`
+			Uris               []string    `json:"uris"`
+			Users              interface{} `json:"users"`
+			ApplicationID      string      `json:"application_id"`
+			ApplicationVersion string      `json:"application_version"`
 		} `json:"VCAP_APPLICATION"`
 	} `json:"application_env_json"`
 }
 
-func readAppEnv(app string) ([]byte, error) {
-	guid, err := exec.Command("cf", "app", app, "--guid").Output()
+func (checker CfJavaPluginUtilImpl) readAppEnv(app string) ([]byte, error) {
+	guid, err := checker.readAppGUID(app)
 	if err != nil {
 		return nil, err
 	}
 
-	env, err := exec.Command("cf", "curl", fmt.Sprintf("/v3/apps/%s/env", strings.Trim(string(guid[:]), "\n"))).Output()
+	env, err := checker.cf("curl", fmt.Sprintf("/v3/apps/%s/env", guid))
 	if err != nil {
 		return nil, err
 	}
-	return env, nil
+	return []byte(env), nil
+
+}
+
+type cfApp struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
+
+type cfProcessStats struct {
+	Resources []struct {
+		Index    int    `json:"index"`
+		State    string `json:"state"`
+		Uptime   int64  `json:"uptime"`
+		MemQuota int64  `json:"mem_quota"`
+		Usage    struct {
+			Mem int64 `json:"mem"`
+		} `json:"usage"`
+	} `json:"resources"`
+}
+
+func (checker CfJavaPluginUtilImpl) readAppGUID(app string) (string, error) {
+	if checker.AppGUIDs != nil {
+		if guid, found := checker.AppGUIDs.get(app); found {
+			return guid, nil
+		}
+	}
+
+	guid, err := checker.cf("app", app, "--guid")
+	if err != nil {
+		return "", errors.New("error occured while looking up the app: '" + app + "', please check that it exists in the targeted space")
+	}
+	guid = strings.TrimSpace(guid)
+	if checker.AppGUIDs != nil {
+		checker.AppGUIDs.put(app, guid)
+	}
+
+	return guid, nil
+}
+
+// GetAppName returns the name of the app with the given GUID, which must be in the targeted space
+// as cf ssh only reaches apps by name in the targeted space
+func (checker CfJavaPluginUtilImpl) GetAppName(guid string) (string, error) {
+	output, err := checker.cf("curl", "/v3/apps/"+guid)
+	if err != nil {
+		return "", errors.New("error occured while looking up the app with GUID: '" + guid + "'")
+	}
+	var appInfo cfApp
+	json.Unmarshal([]byte(output), &appInfo)
+
+	if appInfo.Name == "" {
+		return "", errors.New("no app found with GUID: '" + guid + "'")
+	}
+
+	targetedGUID, err := checker.readAppGUID(appInfo.Name)
+	if err != nil || targetedGUID != guid {
+		return "", errors.New("the app with GUID: '" + guid + "' is not in the targeted space, please target its org and space with 'cf target' and try again")
+	}
+
+	return appInfo.Name, nil
+}
+
+type cfDomains struct {
+	Resources []struct {
+		GUID string `json:"guid"`
+	} `json:"resources"`
+}
+
+type cfRoutes struct {
+	Resources []struct {
+		Destinations []struct {
+			App struct {
+				GUID string `json:"guid"`
+			} `json:"app"`
+		} `json:"destinations"`
+	} `json:"resources"`
+}
+
+// GetAppNameByRoute returns the name of the app bound to the route, e.g., api.example.com or
+// https://example.com/api, which must be in the targeted space like for GetAppName
+func (checker CfJavaPluginUtilImpl) GetAppNameByRoute(route string) (string, error) {
+	hostname := strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(route), "https://"), "http://")
+	routePath := ""
+	if slash := strings.Index(hostname, "/"); slash >= 0 {
+		hostname, routePath = hostname[:slash], strings.TrimSuffix(hostname[slash:], "/")
+	}
+	if colon := strings.Index(hostname, ":"); colon >= 0 {
+		hostname = hostname[:colon]
+	}
+
+	// The route either has a host on a domain, like api on example.com, or is the domain itself
+	candidates := [][2]string{{"", hostname}}
+	if dot := strings.Index(hostname, "."); dot >= 0 {
+		candidates = [][2]string{{hostname[:dot], hostname[dot+1:]}, {"", hostname}}
+	}
+
+	guids := map[string]bool{}
+	for _, candidate := range candidates {
+		output, err := checker.cf("curl", "/v3/domains?names="+url.QueryEscape(candidate[1]))
+		if err != nil {
+			return "", errors.New("error occured while looking up the domain of route: '" + route + "'")
+		}
+		var domains cfDomains
+		json.Unmarshal([]byte(output), &domains)
+		if len(domains.Resources) == 0 {
+			continue
+		}
+
+		output, err = checker.cf("curl", "/v3/routes?domain_guids="+domains.Resources[0].GUID+"&hosts="+url.QueryEscape(candidate[0])+"&paths="+url.QueryEscape(routePath))
+		if err != nil {
+			return "", errors.New("error occured while looking up the route: '" + route + "'")
+		}
+		var routes cfRoutes
+		json.Unmarshal([]byte(output), &routes)
+		for _, resource := range routes.Resources {
+			for _, destination := range resource.Destinations {
+				guids[destination.App.GUID] = true
+			}
+		}
+		if len(routes.Resources) > 0 {
+			break
+		}
+	}
+
+	switch len(guids) {
+	case 0:
+		return "", errors.New("no app found for route: '" + route + "', please check that it is mapped to an app in the targeted space")
+	case 1:
+		for guid := range guids {
+			return checker.GetAppName(guid)
+		}
+	}
 
+	var names []string
+	for guid := range guids {
+		name := guid
+		if output, err := checker.cf("curl", "/v3/apps/"+guid); err == nil {
+			var appInfo cfApp
+			json.Unmarshal([]byte(output), &appInfo)
+			if appInfo.Name != "" {
+				name = appInfo.Name
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return "", errors.New("the route: '" + route + "' is mapped to several apps: " + strings.Join(names, ", ") + ", please run the command with the name of one of them")
+}
+
+type cfApps struct {
+	Resources []struct {
+		Name  string `json:"name"`
+		GUID  string `json:"guid"`
+		State string `json:"state"`
+	} `json:"resources"`
 }
 
-func checkUserPathAvailability(app string, path string) (bool, error) {
-	output, err := exec.Command("cf", "ssh", app, "-c", "[[ -d \""+path+"\" && -r \""+path+"\" && -w \""+path+"\" ]] && echo \"exists and read-writeable\"").Output()
+// GetApps returns the apps of the targeted space, ordered by name
+func (checker CfJavaPluginUtilImpl) GetApps() ([]AppSummary, error) {
+	if checker.SpaceGUID == nil {
+		return nil, errors.New("the targeted space cannot be read through this connection")
+	}
+	guid, err := checker.SpaceGUID()
+	if err != nil {
+		return nil, errors.New("error occured while reading the targeted space, please target it with 'cf target' and try again")
+	}
+	if guid == "" {
+		return nil, errors.New("no space targeted, please target one with 'cf target -s' and try again")
+	}
+
+	output, err := checker.cf("curl", "/v3/apps?order_by=name&per_page=5000&space_guids="+guid)
+	if err != nil {
+		return nil, errors.New("error occured while reading the apps of the space with GUID: '" + guid + "'")
+	}
+	var apps cfApps
+	json.Unmarshal([]byte(output), &apps)
+
+	summaries := []AppSummary{}
+	for _, app := range apps.Resources {
+		summaries = append(summaries, AppSummary{Name: app.Name, GUID: app.GUID, State: app.State})
+	}
+
+	return summaries, nil
+}
+
+// GetAppDroplet returns the GUID of the app and the GUID of its current droplet, which is empty if it has none
+func (checker CfJavaPluginUtilImpl) GetAppDroplet(app string) (string, string, error) {
+	guid, err := checker.readAppGUID(app)
+	if err != nil {
+		return "", "", err
+	}
+
+	output, err := checker.cf("curl", "/v3/apps/"+guid+"/droplets/current")
+	if err != nil {
+		return "", "", errors.New("error occured while reading the droplet of app: '" + app + "'")
+	}
+	var droplet struct {
+		GUID string `json:"guid"`
+	}
+	json.Unmarshal([]byte(output), &droplet)
+
+	return guid, droplet.GUID, nil
+}
+
+// Buildpack is a buildpack that staged the droplet of an app
+type Buildpack struct {
+	// Name is the name of the buildpack in Cloud Foundry, or its URL
+	Name string `json:"name"`
+	// BuildpackName is the name the buildpack reported for itself, if any
+	BuildpackName string `json:"buildpack_name"`
+	Version       string `json:"version"`
+}
+
+// DropletInfo describes how the current droplet of an app was staged and is started
+type DropletInfo struct {
+	Stack      string      `json:"stack"`
+	Buildpacks []Buildpack `json:"buildpacks"`
+	// ProcessTypes are the start commands of the processes, by type, e.g., "web"
+	ProcessTypes map[string]string `json:"process_types"`
+}
+
+// GetDropletInfo returns the stack, the buildpacks and the start commands of the current droplet of the app
+func (checker CfJavaPluginUtilImpl) GetDropletInfo(app string) (DropletInfo, error) {
+	guid, err := checker.readAppGUID(app)
+	if err != nil {
+		return DropletInfo{}, err
+	}
+
+	output, err := checker.cf("curl", "/v3/apps/"+guid+"/droplets/current")
+	if err != nil {
+		return DropletInfo{}, errors.New("error occured while reading the droplet of app: '" + app + "'")
+	}
+	var droplet DropletInfo
+	json.Unmarshal([]byte(output), &droplet)
+
+	return droplet, nil
+}
+
+// GetAppEnvironment returns the environment variables set for the app with cf set-env or in its manifest
+func (checker CfJavaPluginUtilImpl) GetAppEnvironment(app string) (map[string]string, error) {
+	env, err := checker.readAppEnv(app)
+	if err != nil {
+		return nil, err
+	}
+
+	var appEnv struct {
+		EnvironmentVariables map[string]interface{} `json:"environment_variables"`
+	}
+	json.Unmarshal(env, &appEnv)
+
+	variables := map[string]string{}
+	for name, value := range appEnv.EnvironmentVariables {
+		variables[name] = fmt.Sprint(value)
+	}
+
+	return variables, nil
+}
+
+// isRunningState tells whether an instance in the given state runs a container that cf ssh can connect to, i.e.,
+// RUNNING, or STARTING, when the app may not pass its health check yet, e.g., as the JVM hangs
+func isRunningState(state string) bool {
+	return state == "RUNNING" || state == "STARTING"
+}
+
+// CheckAppInstance verifies via the v3 API that the app is started and that it has an instance with the given index
+// that is running or starting, as cf ssh only fails with a generic error otherwise
+func (checker CfJavaPluginUtilImpl) CheckAppInstance(app string, index int) error {
+	guid, err := checker.readAppGUID(app)
+	if err != nil {
+		return err
+	}
+
+	output, err := checker.cf("curl", "/v3/apps/"+guid)
+	if err != nil {
+		return errors.New("error occured while reading the state of app: '" + app + "'")
+	}
+	var appInfo cfApp
+	json.Unmarshal([]byte(output), &appInfo)
+
+	if appInfo.State == "STOPPED" {
+		return errors.New("app '" + app + "' is stopped; start it before collecting diagnostics")
+	}
+	if appInfo.State != "STARTED" {
+		return errors.New("app '" + app + "' is not started (state: " + appInfo.State + ")")
+	}
+
+	output, err = checker.cf("curl", "/v3/apps/"+guid+"/processes/web/stats")
+	if err != nil {
+		return errors.New("error occured while reading the instances of app: '" + app + "'")
+	}
+	var stats cfProcessStats
+	json.Unmarshal([]byte(output), &stats)
+
+	running := 0
+	for _, instance := range stats.Resources {
+		if isRunningState(instance.State) {
+			running++
+		}
+	}
+	if running == 0 {
+		return errors.New("app '" + app + "' has no running instance, e.g., as its instances crashed; check `cf app " + ShellWord(app) + "` and `cf logs " + ShellWord(app) + " --recent`, and start it before collecting diagnostics")
+	}
+
+	if index >= len(stats.Resources) {
+		return fmt.Errorf("instance %d requested but app '%s' has %d instances", index, app, len(stats.Resources))
+	}
+	for _, instance := range stats.Resources {
+		if instance.Index == index && !isRunningState(instance.State) {
+			return fmt.Errorf("instance %d of app '%s' is not running (state: %s)", index, app, instance.State)
+		}
+	}
+
+	return nil
+}
+
+// GetInstanceState returns the state of the app instance with the given index, e.g., RUNNING, CRASHED or STARTING, and
+// how long it has been running, or DOWN if there is no such instance
+func (checker CfJavaPluginUtilImpl) GetInstanceState(app string, index int) (string, time.Duration, error) {
+	guid, err := checker.readAppGUID(app)
+	if err != nil {
+		return "", 0, err
+	}
+
+	output, err := checker.cf("curl", "/v3/apps/"+guid+"/processes/web/stats")
+	if err != nil {
+		return "", 0, errors.New("error occured while reading the instances of app: '" + app + "'")
+	}
+	var stats cfProcessStats
+	json.Unmarshal([]byte(output), &stats)
+
+	for _, instance := range stats.Resources {
+		if instance.Index == index {
+			return instance.State, time.Duration(instance.Uptime) * time.Second, nil
+		}
+	}
+
+	return "DOWN", 0, nil
+}
+
+// GetRunningInstances returns the indexes of the instances of the app that are running or starting, see
+// isRunningState, in ascending order
+func (checker CfJavaPluginUtilImpl) GetRunningInstances(app string) ([]int, error) {
+	guid, err := checker.readAppGUID(app)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := checker.cf("curl", "/v3/apps/"+guid+"/processes/web/stats")
+	if err != nil {
+		return nil, errors.New("error occured while reading the instances of app: '" + app + "'")
+	}
+	var stats cfProcessStats
+	json.Unmarshal([]byte(output), &stats)
+
+	var running []int
+	for _, instance := range stats.Resources {
+		if isRunningState(instance.State) {
+			running = append(running, instance.Index)
+		}
+	}
+	sort.Ints(running)
+
+	return running, nil
+}
+
+// GetInstances returns the state, uptime and memory of each instance of the app, in ascending order of their indexes
+func (checker CfJavaPluginUtilImpl) GetInstances(app string) ([]InstanceInfo, error) {
+	guid, err := checker.readAppGUID(app)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := checker.cf("curl", "/v3/apps/"+guid+"/processes/web/stats")
+	if err != nil {
+		return nil, errors.New("error occured while reading the instances of app: '" + app + "'")
+	}
+	var stats cfProcessStats
+	json.Unmarshal([]byte(output), &stats)
+
+	var instances []InstanceInfo
+	for _, instance := range stats.Resources {
+		instances = append(instances, InstanceInfo{
+			Index:       instance.Index,
+			State:       instance.State,
+			Uptime:      time.Duration(instance.Uptime) * time.Second,
+			MemoryQuota: instance.MemQuota,
+			MemoryUsage: instance.Usage.Mem,
+		})
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Index < instances[j].Index })
+
+	return instances, nil
+}
+
+// GetRecentLogs returns the lines of the recent logs of the app, as printed by cf logs --recent
+func (checker CfJavaPluginUtilImpl) GetRecentLogs(app string) ([]string, error) {
+	output, err := checker.CliConnection.CliCommandWithoutTerminalOutput("logs", app, "--recent")
+	if err != nil {
+		return nil, errors.New("error occured while reading the recent logs of app: '" + app + "'")
+	}
+
+	return output, nil
+}
+
+func (checker CfJavaPluginUtilImpl) checkUserPathAvailability(args []string, path string) (bool, error) {
+	output, err := checker.cf(sshCommand(args, "[ -d \""+path+"\" ] && [ -r \""+path+"\" ] && [ -w \""+path+"\" ] && echo \"exists and read-writeable\"")...)
 	if err != nil {
 		return false, err
 	}
 
-	if strings.Contains(string(output[:]), "exists and read-writeable") {
+	if strings.Contains(output, "exists and read-writeable") {
 		return true, nil
 	}
 
 	return false, nil
 }
 
-func (checker CfJavaPluginUtilImpl) CheckRequiredTools(app string) (bool, error) {
-	guid, err := exec.Command("cf", "app", app, "--guid").Output()
+// CheckRequiredTools checks that ssh is enabled for the app and that the container of the app instance the args of
+// cf ssh select has one of the tools creating heap dumps
+func (checker CfJavaPluginUtilImpl) CheckRequiredTools(app string, args []string) (bool, error) {
+	guid, err := checker.readAppGUID(app)
 	if err != nil {
 		return false, err
 	}
-	output, err := exec.Command("cf", "curl", "/v3/apps/"+strings.TrimSuffix(string(guid), "\n")+"/ssh_enabled").Output()
+	output, err := checker.cf("curl", "/v3/apps/"+guid+"/ssh_enabled")
 	if err != nil {
 		return false, err
 	}
@@ -106,16 +557,16 @@ func (checker CfJavaPluginUtilImpl) CheckRequiredTools(app string) (bool, error)
 	json.Unmarshal([]byte(output), &result)
 
 	if enabled, ok := result["enabled"].(bool); !ok || !enabled {
-		return false, errors.New("ssh is not enabled for app: '" + app + "', please run below 2 shell commands to enable ssh and try again(please note application should be restarted before take effect):\ncf enable-ssh " + app + "\ncf restart " + app)
+		return false, errors.New("ssh is not enabled for app: '" + app + "', please run below 2 shell commands to enable ssh and try again(please note application should be restarted before take effect):\ncf enable-ssh " + ShellWord(app) + "\ncf restart " + ShellWord(app))
 	}
 
-	output, err = exec.Command("cf", "ssh", app, "-c", "find -executable | grep -E '(.*jmap$)|(.*jvmmon$)'").Output()
+	output, err = checker.cf(sshCommand(args, requiredToolsSearch())...)
 	if err != nil {
-		return false, errors.New("unknown error occured while checking existence of required tools jvmmon/jmap")
+		return false, errors.New("unknown error occured while checking existence of required tools jvmmon/jmap/jcmd/jattach")
 
 	}
-	if !strings.Contains(string(output[:]), "/") {
-		return false, errors.New(`jvmmon or jmap are required for generating heap dump, you can modify your application manifest.yaml on the 'JBP_CONFIG_OPEN_JDK_JRE' environment variable. This could be done like this:
+	if !strings.Contains(output, "/") {
+		return false, errors.New(`jvmmon, jmap, jcmd or jattach are required for generating heap dump, you can modify your application manifest.yaml on the 'JBP_CONFIG_OPEN_JDK_JRE' environment variable. This could be done like this:
 		---
 		applications:
 		- name: <APP_NAME>
@@ -131,63 +582,372 @@ func (checker CfJavaPluginUtilImpl) CheckRequiredTools(app string) (bool, error)
 	return true, nil
 }
 
-func (checker CfJavaPluginUtilImpl) GetAvailablePath(data string, userpath string) (string, error) {
-	if len(userpath) > 0 {
-		valid, _ := checkUserPathAvailability(data, userpath)
-		if valid {
-			return userpath, nil
+// requiredToolsSearch returns the command printing the path of one of the tools creating heap dumps, looked up in the
+// ToolLocations first, so that the search across the working directory only runs if the JDK is not installed there
+func requiredToolsSearch() string {
+	return "(for T in jmap jvmmon jcmd jattach; do " + ProbeToolLocations("${T}") + "; done; " +
+		"find . \\( -name jmap -o -name jvmmon -o -name jcmd -o -name jattach \\) -perm -100 2>/dev/null) | head -n 1"
+}
+
+// portableShellDetection is the command printing whether the container lacks the utilities the default remote
+// commands rely on, i.e., pgrep, pidof and a find supporting -executable, as is the case in busybox-based or
+// distroless images
+const portableShellDetection = "command -v pgrep >/dev/null && command -v pidof >/dev/null && find . -maxdepth 0 -executable >/dev/null 2>&1 && echo full || echo portable"
+
+// runtimeDetection is the command printing whether the app in the container runs on HotSpot, on OpenJ9, e.g., IBM
+// Semeru, or is a GraalVM native image, which has no java process at all
+const runtimeDetection = "JAVA_PID=$(grep -l '^java$' /proc/[0-9]*/comm 2>/dev/null | head -n 1 | cut -d / -f 3); " +
+	"if [ -n \"${JAVA_PID}\" ]; then grep -q libj9vm /proc/${JAVA_PID}/maps 2>/dev/null && echo " + RuntimeOpenJ9 + " || echo " + RuntimeHotSpot + "; exit 0; fi; " +
+	"for P in /proc/[0-9]*; do grep -q -a com.oracle.svm ${P}/exe 2>/dev/null && { echo " + RuntimeNativeImage + "; exit 0; }; done; " +
+	"echo " + RuntimeHotSpot
+
+// InspectContainer reports, in a single ssh session, whether the container needs the portable shell dialect and the
+// runtime of the app, see DetectRuntime
+func (checker CfJavaPluginUtilImpl) InspectContainer(args []string) (bool, string, error) {
+	output, err := checker.cf(sshCommand(args, portableShellDetection+"; ("+runtimeDetection+")")...)
+	if err != nil {
+		return false, "", errors.New("error occured while checking the utilities and the runtime of the app in the container")
+	}
+
+	return strings.Contains(output, "portable"), parseRuntime(output), nil
+}
+
+// DetectRuntime tells whether the app in the container runs on HotSpot, on OpenJ9, e.g., IBM Semeru, or is a GraalVM
+// native image, which has no java process at all
+func (checker CfJavaPluginUtilImpl) DetectRuntime(args []string) (string, error) {
+	output, err := checker.cf(sshCommand(args, runtimeDetection)...)
+	if err != nil {
+		return "", errors.New("error occured while checking the runtime of the app in the container")
+	}
+
+	return parseRuntime(output), nil
+}
+
+func parseRuntime(output string) string {
+	for _, runtime := range []string{RuntimeOpenJ9, RuntimeNativeImage} {
+		if strings.Contains(output, runtime) {
+			return runtime
 		}
+	}
 
-		return "", errors.New("the container path specified doesn't exist or have no read and write access, please check and try again later")
+	return RuntimeHotSpot
+}
+
+// findTool returns the command printing the path of the executable with the given name in the ToolLocations or,
+// failing that, the first one below the working directory
+func findTool(name string) string {
+	return "(" + ProbeToolLocations(name) + "; find . -name " + name + " -perm -100 2>/dev/null) | head -n 1"
+}
+
+// FindTools tells which of the given tools are available in the container, either as executables below the
+// working directory, like the JDK tools, or on the PATH
+func (checker CfJavaPluginUtilImpl) FindTools(args []string, tools []string) (map[string]bool, error) {
+	cmd := "for T in " + strings.Join(tools, " ") + "; do if [ -n \"$(" + findTool("${T}") + ")\" ] || command -v ${T} > /dev/null; then echo ${T}; fi; done"
+
+	output, err := checker.cf(sshCommand(args, cmd)...)
+	if err != nil {
+		return nil, errors.New("error occured while looking for tools in the container")
 	}
 
-	env, err := readAppEnv(data)
+	found := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		found[strings.TrimSpace(line)] = true
+	}
+
+	return found, nil
+}
+
+// ResolveTools returns the path of each of the given tools in the container, the first executable with its name
+// below the working directory, or an empty path if there is none
+func (checker CfJavaPluginUtilImpl) ResolveTools(args []string, tools []string) (map[string]string, error) {
+	cmd := "for T in " + strings.Join(tools, " ") + "; do echo \"${T} $(" + findTool("${T}") + ")\"; done"
+
+	output, err := checker.cf(sshCommand(args, cmd)...)
 	if err != nil {
-		return "/tmp", nil
+		return nil, errors.New("error occured while looking for tools in the container")
+	}
+
+	paths := map[string]string{}
+	for _, tool := range tools {
+		paths[tool] = ""
+	}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if _, ok := paths[fields[0]]; ok && len(fields) == 2 {
+			paths[fields[0]] = strings.TrimSpace(fields[1])
+		}
+	}
+
+	return paths, nil
+}
+
+// FindGCLogs returns the GC log files the JVM of the app writes, as configured with -Xlog or -Xloggc on its command
+// line or in JAVA_TOOL_OPTIONS. File names with a %t placeholder are returned as patterns matching any time.
+func (checker CfJavaPluginUtilImpl) FindGCLogs(args []string) ([]string, error) {
+	cmd := "JAVA_PID=$(grep -l '^java$' /proc/[0-9]*/comm 2>/dev/null | head -n 1 | cut -d / -f 3); " +
+		"if [ -z \"${JAVA_PID}\" ]; then echo \"No 'java' process found running. Are you sure this is a Java app?\" >&2; exit 1; fi; " +
+		"echo ${JAVA_PID}; readlink /proc/${JAVA_PID}/cwd; tr '\\0' '\\n' < /proc/${JAVA_PID}/cmdline; " +
+		"tr '\\0' '\\n' < /proc/${JAVA_PID}/environ | sed -n 's/^JAVA_TOOL_OPTIONS=//p' | tr ' ' '\\n'"
+
+	output, err := checker.cf(sshCommand(args, cmd)...)
+	if err != nil {
+		return nil, errors.New("error occured while reading the command line of the JVM in the container")
+	}
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 2 {
+		return nil, errors.New("unexpected command line of the JVM in the container: " + output)
+	}
+
+	return gcLogFiles(strings.TrimSpace(lines[0]), strings.TrimSpace(lines[1]), lines[2:]), nil
+}
+
+// gcLogFiles extracts the GC log files from the arguments of the JVM with the given PID and working directory
+func gcLogFiles(pid string, cwd string, jvmArgs []string) []string {
+	var files []string
+	for _, arg := range jvmArgs {
+		arg = strings.TrimSpace(arg)
+
+		file := ""
+		if strings.HasPrefix(arg, "-Xloggc:") {
+			file = strings.TrimPrefix(arg, "-Xloggc:")
+		} else if strings.HasPrefix(arg, "-Xlog:") {
+			// -Xlog:[what][:[output][:[decorators][:output-options]]]
+			parts := strings.SplitN(strings.TrimPrefix(arg, "-Xlog:"), ":", 3)
+			if len(parts) < 2 || !strings.Contains(parts[0], "gc") {
+				continue
+			}
+			file = strings.Trim(strings.TrimPrefix(parts[1], "file="), "\"")
+			if file == "stdout" || file == "stderr" {
+				continue
+			}
+		}
+		if file == "" {
+			continue
+		}
+
+		file = strings.ReplaceAll(strings.ReplaceAll(file, "%p", pid), "%t", "*")
+		if !strings.HasPrefix(file, "/") {
+			file = cwd + "/" + file
+		}
+		files = append(files, file)
+	}
+
+	return files
+}
+
+// GetClassHistogram returns the class histogram of the live objects in the JVM of the app, created with jcmd or,
+// failing that, with jmap. Both trigger a full garbage collection.
+func (checker CfJavaPluginUtilImpl) GetClassHistogram(args []string) (string, error) {
+	cmd := "JAVA_PID=$(grep -l '^java$' /proc/[0-9]*/comm 2>/dev/null | head -n 1 | cut -d / -f 3); " +
+		"if [ -z \"${JAVA_PID}\" ]; then echo \"No 'java' process found running. Are you sure this is a Java app?\" >&2; exit 1; fi; " +
+		"JCMD_COMMAND=$(" + findTool("jcmd") + "); if [ -n \"${JCMD_COMMAND}\" ]; then ${JCMD_COMMAND} ${JAVA_PID} GC.class_histogram; exit $?; fi; " +
+		"JMAP_COMMAND=$(" + findTool("jmap") + "); if [ -n \"${JMAP_COMMAND}\" ]; then ${JMAP_COMMAND} -histo:live ${JAVA_PID}; exit $?; fi; " +
+		"echo 'jcmd or jmap is required for creating class histograms, please make sure that the app runs on a full JDK' >&2; exit 1"
+
+	output, err := checker.cf(sshCommand(args, cmd)...)
+	if err != nil {
+		return "", errors.New("error occured while creating the class histogram of the JVM in the container, please make sure that the app runs on a full JDK")
+	}
+
+	return output, nil
+}
+
+// GetAppVersion returns a label of the deployed build of the app, taken from the SOURCE_VERSION environment variable
+// set by many CI pipelines or, failing that, from the application_version in VCAP_APPLICATION. The label is empty
+// if neither is available.
+func (checker CfJavaPluginUtilImpl) GetAppVersion(app string) (string, error) {
+	env, err := checker.readAppEnv(app)
+	if err != nil {
+		return "", err
 	}
 
 	var cfAppEnv CFAppEnv
 	json.Unmarshal(env, &cfAppEnv)
 
-	for _, v := range cfAppEnv.SystemEnvJSON.VcapServices.FsStorage {
-		for _, v2 := range v.VolumeMounts {
-			if v2.Mode == "rw" {
-				return v2.ContainerDir, nil
+	if version := cfAppEnv.EnvironmentVariables.SourceVersion; version != "" {
+		return version, nil
+	}
+	return cfAppEnv.ApplicationEnvJSON.VcapApplication.ApplicationVersion, nil
+}
+
+// localPathCandidates are the directories of the container considered for dump files when no volume is mounted
+var localPathCandidates = []string{"${TMPDIR:-/tmp}", "/tmp", "/home/vcap/tmp", "/home/vcap/app"}
+
+// probePaths returns the free space in kilobytes of those of the given directories that exist and are writable
+// in the container of the app instance the args of cf ssh select, in the given order
+func (checker CfJavaPluginUtilImpl) probePaths(args []string, paths []string) ([]string, map[string]int64, error) {
+	cmd := "for D in " + strings.Join(paths, " ") + "; do if [ -d \"${D}\" ] && [ -w \"${D}\" ]; then echo \"$(df -Pk \"${D}\" | tail -n 1 | awk '{print $4}') ${D}\"; fi; done"
+	output, err := checker.cf(sshCommand(args, cmd)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var writable []string
+	free := map[string]int64{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		kilobytes, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, seen := free[fields[1]]; !seen {
+			writable = append(writable, fields[1])
+		}
+		free[fields[1]] = kilobytes
+	}
+
+	return writable, free, nil
+}
+
+// largestPath returns the one of the given directories with the most free space, or an empty string if none is writable
+func largestPath(paths []string, free map[string]int64) string {
+	best := ""
+	for _, path := range paths {
+		if _, ok := free[path]; ok && (best == "" || free[path] > free[best]) {
+			best = path
+		}
+	}
+
+	return best
+}
+
+// GetAvailablePath returns the directory of the container to write dump files to: the given user path if it is
+// writable, else the writable volume mount with the most free space, else the local directory with the most free
+// space. The user path AutoLargestPath picks the directory with the most free space among all of them. The directories
+// are checked in the container of the app instance the args of cf ssh select, where the files will be written.
+func (checker CfJavaPluginUtilImpl) GetAvailablePath(data string, args []string, userpath string) (string, error) {
+	if len(userpath) > 0 && userpath != AutoLargestPath {
+		valid, _ := checker.checkUserPathAvailability(args, userpath)
+		if valid {
+			return userpath, nil
+		}
+
+		return "", errors.New("the container path specified doesn't exist or have no read and write access, please check and try again later")
+	}
+
+	var mounts []string
+	env, err := checker.readAppEnv(data)
+	if err == nil {
+		var cfAppEnv CFAppEnv
+		json.Unmarshal(env, &cfAppEnv)
+
+		for _, v := range cfAppEnv.SystemEnvJSON.VcapServices.FsStorage {
+			for _, v2 := range v.VolumeMounts {
+				if v2.Mode == "rw" {
+					mounts = append(mounts, v2.ContainerDir)
+				}
 			}
 		}
 	}
 
-	return "/tmp", nil
+	writable, free, err := checker.probePaths(args, append(append([]string{}, mounts...), localPathCandidates...))
+	if err != nil {
+		// Without a look into the container, we trust the service bindings
+		if len(mounts) > 0 {
+			return mounts[0], nil
+		}
+		return "/tmp", nil
+	}
+
+	best := ""
+	if userpath != AutoLargestPath {
+		best = largestPath(mounts, free)
+	}
+	if best == "" {
+		best = largestPath(writable, free)
+	}
+	if best == "" {
+		return "", errors.New("no writable directory found in the container, please specify one with the flag `container-dir`")
+	}
+
+	return best, nil
 }
 
-func (checker CfJavaPluginUtilImpl) CopyOverCat(args []string, src string, dest string) error {
-	f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+func (checker CfJavaPluginUtilImpl) CopyOverCat(args []string, src string, dest string, options CopyOptions) error {
+	dir := filepath.Dir(dest)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if !options.CreateLocalDir {
+			return errors.New("The local directory " + dir + " does not exist. Please create it, or omit the flag `no-create` to have it created for you.")
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errors.New("Error creating local directory " + dir + ". Please check that you are allowed to create directories at the given local path.")
+		}
+	}
+
+	// Never write into an existing file unless asked to, and then always start from an empty one, unless resuming
+	flag := os.O_CREATE | os.O_WRONLY | os.O_EXCL
+	if options.Resume {
+		flag = os.O_CREATE | os.O_RDWR
+	} else if options.Force {
+		flag = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(dest, flag, 0666)
+	if os.IsExist(err) {
+		return errors.New("The local file " + dest + " already exists. Please remove it, or use the flag `force` to overwrite it.")
+	}
 	if err != nil {
 		return errors.New("Error creating local file at  " + dest + ". Please check that you are allowed to create files at the given local path.")
 	}
 	defer f.Close()
 
-	args = append(args, "cat "+src)
-	cat := exec.Command("cf", args...)
+	// The size and checksums may have been computed already in the session that created the file
+	manifest := options.Manifest
+	if manifest == nil {
+		manifest = &FileManifest{}
+		manifest.Size, err = checker.remoteFileSize(args, src)
+		if err != nil {
+			return err
+		}
+		manifest.Checksums, err = checker.remoteChunkChecksums(args, src, chunkCount(manifest.Size))
+		if err != nil {
+			return err
+		}
+	}
+	size, checksums := manifest.Size, manifest.Checksums
 
-	cat.Stdout = f
+	// Better to fail now than once the local disk is full
+	if err := checkLocalSpace(f, dir, src, size); err != nil {
+		return err
+	}
+	chunks := int64(len(checksums))
 
-	err = cat.Start()
-	if err != nil {
-		return errors.New("error occured during copying dump file: " + src + ", please try again.")
+	var out io.Writer = f
+	if options.LimitRate > 0 {
+		out = newThrottledWriter(f, options.LimitRate)
 	}
 
-	err = cat.Wait()
+	for i := int64(0); i < chunks; i++ {
+		if options.Resume && localChunkMatches(f, i, checksums[i]) {
+			continue
+		}
+		err = copyChunk(args, src, f, out, i, chunks, checksums[i])
+		if err != nil {
+			return err
+		}
+		if options.Progress != nil {
+			transferred := (i + 1) * transferChunkSize
+			if transferred > size {
+				transferred = size
+			}
+			options.Progress(transferred, size)
+		}
+	}
+
+	err = f.Truncate(size)
 	if err != nil {
-		return errors.New("error occured while waiting for the copying complete")
+		return errors.New("error occured while finalizing the local file " + dest)
 	}
 
 	return nil
 }
 
 func (checker CfJavaPluginUtilImpl) DeleteRemoteFile(args []string, path string) error {
-	args = append(args, "rm "+path)
-	_, err := exec.Command("cf", args...).Output()
+	_, err := checker.cf(sshCommand(args, "rm "+path)...)
 
 	if err != nil {
 		return errors.New("error occured while removing dump file generated")
@@ -197,16 +957,73 @@ func (checker CfJavaPluginUtilImpl) DeleteRemoteFile(args []string, path string)
 	return nil
 }
 
+// DeleteRemotePaths removes the given files and directories from the container. It runs in a cf process of its own,
+// so that it works while the cf CLI is being interrupted, e.g., with Ctrl+C, too.
+func (checker CfJavaPluginUtilImpl) DeleteRemotePaths(args []string, paths []string) error {
+	quoted := make([]string, len(paths))
+	for i, path := range paths {
+		quoted[i] = "'" + path + "'"
+	}
+
+	if err := CfCommand(sshCommand(args, "rm -rf "+strings.Join(quoted, " "))...).Run(); err != nil {
+		return errors.New("error occured while removing " + strings.Join(paths, ", ") + " from the container")
+	}
+
+	return nil
+}
+
+// remoteProcessLookup defines the shell functions children, printing the PIDs of the children of a process, and
+// matching, printing the PIDs of the processes whose command line matches a pattern. They use pgrep, or read /proc
+// like the portable shell dialect in containers lacking it, see portableShellDetection.
+const remoteProcessLookup = "if command -v pgrep > /dev/null; then " +
+	"children() { pgrep -P $1; }; matching() { pgrep -f \"$1\"; }; " +
+	"else " +
+	"children() { for S in /proc/[0-9]*/stat; do if [ \"$(sed 's/.*) [^ ]* \\([0-9]*\\) .*/\\1/' ${S} 2> /dev/null)\" = \"$1\" ]; then P=${S#/proc/}; echo ${P%/stat}; fi; done; }; " +
+	"matching() { for C in /proc/[0-9]*/cmdline; do if tr '\\0' ' ' < ${C} 2> /dev/null | grep -q -E -e \"$1\"; then P=${C#/proc/}; echo ${P%/cmdline}; fi; done; }; " +
+	"fi"
+
+// StopRemoteProcesses terminates the processes in the container whose command line matches the pattern, along with all
+// their descendants, like the JDK tools a remote command runs. It runs in a cf process of its own like
+// DeleteRemotePaths, and the parents are terminated before their children, so that they start no further commands.
+// It fails if no process could be terminated, e.g., as none matches the pattern any more.
+func (checker CfJavaPluginUtilImpl) StopRemoteProcesses(args []string, pattern string) error {
+	stop := remoteProcessLookup + "; " +
+		"stop() { CHILDREN=$(children $1); kill -TERM $1 2> /dev/null && echo \"STOPPED $1\"; for C in ${CHILDREN}; do stop ${C}; done; }; " +
+		"for P in $(matching '" + pattern + "'); do stop ${P}; done"
+
+	output, err := CfCommand(sshCommand(args, stop)...).Output()
+	if err != nil {
+		return errors.New("error occured while stopping the remote command in the container: " + err.Error())
+	}
+	if !strings.Contains(string(output), "STOPPED ") {
+		return errors.New("the remote command was not found running in the container, it may have ended already")
+	}
+
+	return nil
+}
+
 func (checker CfJavaPluginUtilImpl) FindDumpFile(args []string, fullpath string, fspath string) (string, error) {
-	cmd := " [ -f '" + fullpath + "' ] && echo '" + fullpath + "' ||  find " + fspath + " -name 'java_pid*.hprof' -printf '%T@ %p\\0' | sort -zk 1nr | sed -z 's/^[^ ]* //' | tr '\\0' '\\n' | head -n 1  "
+	cmd := " [ -f '" + fullpath + "' ] && echo '" + fullpath + "' ||  find " + fspath + " -maxdepth 1 -name 'java_pid*.hprof' -printf '%T@ %p\\0' | sort -zk 1nr | sed -z 's/^[^ ]* //' | tr '\\0' '\\n' | head -n 1  "
 
-	args = append(args, cmd)
-	output, err := exec.Command("cf", args...).Output()
+	output, err := checker.cf(sshCommand(args, cmd)...)
 
 	if err != nil {
 		return "", errors.New("error while checking the generated file")
 	}
 
-	return strings.Trim(string(output[:]), "\n"), nil
+	return strings.Trim(output, "\n"), nil
+
+}
+
+// FindRemoteFile returns the most recently modified file in the container matching the given path or shell pattern,
+// or an empty string if there is none
+func (checker CfJavaPluginUtilImpl) FindRemoteFile(args []string, pattern string) (string, error) {
+	cmd := "ls -1td " + pattern + " 2>/dev/null | head -n 1"
+
+	output, err := checker.cf(sshCommand(args, cmd)...)
+	if err != nil {
+		return "", errors.New("error while looking for the file " + pattern + " in the container")
+	}
 
+	return strings.Trim(output, "\n"), nil
 }
@@ -0,0 +1,298 @@
+package utils
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeCliConnection answers the cf commands with the output of the response whose key is the longest prefix of the
+// command, joined with spaces, and records the commands
+type fakeCliConnection struct {
+	responses map[string]string
+	commands  [][]string
+}
+
+func (conn *fakeCliConnection) CliCommandWithoutTerminalOutput(args ...string) ([]string, error) {
+	conn.commands = append(conn.commands, args)
+	command := strings.Join(args, " ")
+	match := ""
+	for prefix := range conn.responses {
+		if strings.HasPrefix(command, prefix) && len(prefix) > len(match) {
+			match = prefix
+		}
+	}
+	if match == "" {
+		return nil, errors.New("unexpected command: " + command)
+	}
+
+	return strings.Split(conn.responses[match], "\n"), nil
+}
+
+// sshCommands returns the cf ssh commands run, without their remote command
+func (conn *fakeCliConnection) sshCommands() [][]string {
+	var commands [][]string
+	for _, command := range conn.commands {
+		if command[0] == "ssh" {
+			commands = append(commands, command[:len(command)-1])
+		}
+	}
+
+	return commands
+}
+
+// shellCliConnection runs the remote commands of cf ssh with the local shell in dir, as the container would, and
+// answers the other cf commands like fakeCliConnection
+type shellCliConnection struct {
+	fakeCliConnection
+	dir string
+}
+
+func (conn *shellCliConnection) CliCommandWithoutTerminalOutput(args ...string) ([]string, error) {
+	if args[0] != "ssh" {
+		return conn.fakeCliConnection.CliCommandWithoutTerminalOutput(args...)
+	}
+	conn.commands = append(conn.commands, args)
+	cmd := exec.Command("sh", "-c", args[len(args)-1])
+	cmd.Dir = conn.dir
+	output, err := cmd.Output()
+
+	return strings.Split(string(output), "\n"), err
+}
+
+func TestGetAvailablePathProbesTheTargetedInstance(t *testing.T) {
+	conn := &fakeCliConnection{responses: map[string]string{
+		"app my_app --guid":               "my-app-guid",
+		"curl /v3/apps/my-app-guid/env":   `{}`,
+		"ssh my_app --app-instance-index": "1000 /tmp\n5000 /home/vcap/app",
+	}}
+	checker := CfJavaPluginUtilImpl{CliConnection: conn}
+	args := []string{"ssh", "my_app", "--app-instance-index", "2", "--command"}
+
+	path, err := checker.GetAvailablePath("my_app", args, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/home/vcap/app" {
+		t.Errorf("expected the directory with the most free space, got %q", path)
+	}
+	if !reflect.DeepEqual(conn.sshCommands(), [][]string{args}) {
+		t.Errorf("expected the paths to be probed on instance 2, got %v", conn.sshCommands())
+	}
+}
+
+func TestGetAvailablePathChecksTheUserPathOnTheTargetedInstance(t *testing.T) {
+	conn := &fakeCliConnection{responses: map[string]string{
+		"ssh my_app --app-instance-index 1": "exists and read-writeable",
+	}}
+	checker := CfJavaPluginUtilImpl{CliConnection: conn}
+	args := []string{"ssh", "my_app", "--app-instance-index", "1", "--command"}
+
+	path, err := checker.GetAvailablePath("my_app", args, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/data" {
+		t.Errorf("expected the user path, got %q", path)
+	}
+	if !reflect.DeepEqual(conn.sshCommands(), [][]string{args}) {
+		t.Errorf("expected the user path to be checked on instance 1, got %v", conn.sshCommands())
+	}
+}
+
+func TestCheckAppInstanceQuotesTheAppNameInTheCommandsSuggested(t *testing.T) {
+	conn := &fakeCliConnection{responses: map[string]string{
+		"app my app $HOME --guid":                       "my-app-guid",
+		"curl /v3/apps/my-app-guid":                     `{"state": "STARTED"}`,
+		"curl /v3/apps/my-app-guid/processes/web/stats": `{"resources": [{"index": 0, "state": "CRASHED"}]}`,
+	}}
+
+	err := CfJavaPluginUtilImpl{CliConnection: conn}.CheckAppInstance("my app $HOME", 0)
+	if err == nil || !strings.Contains(err.Error(), "check `cf app 'my app $HOME'` and `cf logs 'my app $HOME' --recent`") {
+		t.Errorf("expected the app name to be quoted in the commands suggested, got %v", err)
+	}
+}
+
+func TestCheckRequiredToolsQuotesTheAppNameInTheCommandsSuggested(t *testing.T) {
+	conn := &fakeCliConnection{responses: map[string]string{
+		"app my app $HOME --guid":               "my-app-guid",
+		"curl /v3/apps/my-app-guid/ssh_enabled": `{"enabled": false}`,
+	}}
+
+	_, err := CfJavaPluginUtilImpl{CliConnection: conn}.CheckRequiredTools("my app $HOME", []string{"ssh", "my app $HOME", "--command"})
+	if err == nil || !strings.HasSuffix(err.Error(), "\ncf enable-ssh 'my app $HOME'\ncf restart 'my app $HOME'") {
+		t.Errorf("expected the app name to be quoted in the commands suggested, got %v", err)
+	}
+}
+
+func TestGetAppsListsTheAppsOfTheTargetedSpace(t *testing.T) {
+	conn := &fakeCliConnection{responses: map[string]string{
+		"curl /v3/apps?order_by=name&per_page=5000&space_guids=space-guid": `{"resources": [{"name": "my_app", "guid": "my-app-guid", "state": "STARTED"}]}`,
+	}}
+	checker := CfJavaPluginUtilImpl{CliConnection: conn, SpaceGUID: func() (string, error) { return "space-guid", nil }}
+
+	apps, err := checker.GetApps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(apps, []AppSummary{{Name: "my_app", GUID: "my-app-guid", State: "STARTED"}}) {
+		t.Errorf("expected the app of the space, got %+v", apps)
+	}
+	if len(conn.commands) != 1 {
+		t.Errorf("expected only the apps to be read, got %v", conn.commands)
+	}
+}
+
+func TestGetAppsFailsWithoutTargetedSpace(t *testing.T) {
+	for name, checker := range map[string]CfJavaPluginUtilImpl{
+		"no space targeted":         {SpaceGUID: func() (string, error) { return "", nil }},
+		"space not readable":        {SpaceGUID: func() (string, error) { return "", errors.New("not logged in") }},
+		"connection without spaces": {},
+	} {
+		checker.CliConnection = &fakeCliConnection{}
+		if _, err := checker.GetApps(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestCheckRequiredToolsFindsTheToolsInTheToolLocations(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the remote commands run with the local shell")
+	}
+	defer func(locations []string) { ToolLocations = locations }(ToolLocations)
+
+	// The container of a Cloud Native Buildpack, with the JDK installed under /layers only
+	root := t.TempDir()
+	ToolLocations = []string{"${JAVA_HOME:+${JAVA_HOME}/bin}", "app/.java-buildpack/*/bin", root + "/layers/*/jre/bin", root + "/layers/*/jdk/bin"}
+	jdk := filepath.Join(root, "layers", "paketo-buildpacks_bellsoft-liberica", "jdk", "bin")
+	workspace := filepath.Join(root, "workspace")
+	for _, dir := range []string{jdk, workspace} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(jdk, "jcmd"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := &shellCliConnection{fakeCliConnection: fakeCliConnection{responses: map[string]string{
+		"app my_app --guid":                     "my-app-guid",
+		"curl /v3/apps/my-app-guid/ssh_enabled": `{"enabled": true}`,
+	}}, dir: workspace}
+	defer os.Setenv("JAVA_HOME", os.Getenv("JAVA_HOME"))
+	os.Unsetenv("JAVA_HOME")
+
+	present, err := CfJavaPluginUtilImpl{CliConnection: conn}.CheckRequiredTools("my_app", []string{"ssh", "my_app", "--command"})
+	if err != nil || !present {
+		t.Errorf("expected the jcmd under /layers to be found, got %v, %v", present, err)
+	}
+	if command := conn.commands[len(conn.commands)-1]; !strings.Contains(command[len(command)-1], ProbeToolLocations("${T}")) {
+		t.Errorf("expected the tool locations to be probed, got %q", command)
+	}
+
+	if err := os.Remove(filepath.Join(jdk, "jcmd")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (CfJavaPluginUtilImpl{CliConnection: conn}).CheckRequiredTools("my_app", []string{"ssh", "my_app", "--command"}); err == nil {
+		t.Error("expected an error without any of the tools")
+	}
+}
+
+// startRemoteScript starts a shell running the script cf-java-<id>.sh, which runs a sleep, like the remote scripts
+// of the plugin run the JDK tools
+func startRemoteScript(t *testing.T, id string) *exec.Cmd {
+	script := filepath.Join(t.TempDir(), "cf-java-"+id+".sh")
+	if err := ioutil.WriteFile(script, []byte("sleep 60\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("/bin/sh", script)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill() })
+
+	return cmd
+}
+
+func TestStopRemoteProcesses(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the processes are read from /proc")
+	}
+	// The container without pgrep has only the utilities of the PATH of the fallback
+	tools := t.TempDir()
+	for _, tool := range []string{"sed", "tr", "grep"} {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			t.Skip(tool + " not found")
+		}
+		if err := os.Symlink(path, filepath.Join(tools, tool)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := exec.LookPath("pgrep"); err != nil {
+		t.Skip("pgrep not found")
+	}
+
+	for name, path := range map[string]string{"with pgrep": os.Getenv("PATH"), "without pgrep": tools} {
+		t.Run(name, func(t *testing.T) {
+			fakeCf(t, `shift 3; PATH='`+path+`' /bin/sh -c "$1"`)
+			script := startRemoteScript(t, "abc")
+			other := startRemoteScript(t, "def")
+
+			if err := (CfJavaPluginUtilImpl{}).StopRemoteProcesses([]string{"ssh", "my_app", "--command"}, "cf-java-abc[.]sh"); err != nil {
+				t.Fatal(err)
+			}
+			if err := script.Wait(); err == nil || !strings.Contains(err.Error(), "terminated") {
+				t.Errorf("expected the script to be terminated, got %v", err)
+			}
+			if other.ProcessState != nil {
+				t.Error("expected the other script to keep running")
+			}
+
+			err := CfJavaPluginUtilImpl{}.StopRemoteProcesses([]string{"ssh", "my_app", "--command"}, "cf-java-abc[.]sh")
+			if err == nil || !strings.Contains(err.Error(), "not found running") {
+				t.Errorf("expected an error as the script is not running any more, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStopRemoteProcessesReportsTheFailureOfTheSession(t *testing.T) {
+	fakeCf(t, `exit 255`)
+
+	err := CfJavaPluginUtilImpl{}.StopRemoteProcesses([]string{"ssh", "my_app", "--command"}, "cf-java-abc[.]sh")
+	if err == nil || !strings.Contains(err.Error(), "exit status 255") {
+		t.Errorf("expected the exit status to be reported, got %v", err)
+	}
+}
+
+func TestGetRunningInstancesAcceptsTheInstancesOfCheckAppInstance(t *testing.T) {
+	conn := &fakeCliConnection{responses: map[string]string{
+		"app my_app --guid":         "my-app-guid",
+		"curl /v3/apps/my-app-guid": `{"state": "STARTED"}`,
+		"curl /v3/apps/my-app-guid/processes/web/stats": `{"resources": [` +
+			`{"index": 0, "state": "RUNNING"}, {"index": 1, "state": "STARTING"}, {"index": 2, "state": "CRASHED"}, {"index": 3, "state": "DOWN"}]}`,
+	}}
+	checker := CfJavaPluginUtilImpl{CliConnection: conn}
+
+	running, err := checker.GetRunningInstances("my_app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(running, []int{0, 1}) {
+		t.Errorf("expected the running and the starting instance, got %v", running)
+	}
+	for index := 0; index < 4; index++ {
+		accepted := checker.CheckAppInstance("my_app", index) == nil
+		if accepted != (index < 2) {
+			t.Errorf("expected CheckAppInstance to accept instance %d only if GetRunningInstances lists it", index)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+)
+
+// InsufficientSpaceError reports that a file does not fit into the free space of the local directory to download it
+// into, which is checked before downloading it
+type InsufficientSpaceError struct {
+	Message string
+}
+
+func (e InsufficientSpaceError) Error() string {
+	return e.Message
+}
+
+// checkLocalSpace returns an InsufficientSpaceError if the local file f, which may hold a part of the file already,
+// cannot grow to size bytes in the free space of dir. The check is skipped if the free space cannot be determined.
+func checkLocalSpace(f *os.File, dir string, src string, size int64) error {
+	available, err := localFreeSpace(dir)
+	if err != nil {
+		return nil
+	}
+
+	required := size
+	if info, err := f.Stat(); err == nil {
+		required -= info.Size()
+	}
+	if required <= available {
+		return nil
+	}
+
+	return &InsufficientSpaceError{Message: fmt.Sprintf("Not enough space in the local directory %s for %s: it requires %s, but only %s are available. Please free up space, or download it into another directory.", dir, src, formatSize(required), formatSize(available))}
+}
+
+// formatSize returns the number of bytes in the largest binary unit it has at least one of, e.g., 1.5G
+func formatSize(bytes int64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	size := float64(bytes)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	return fmt.Sprintf("%.1f%s", size, units[unit])
+}
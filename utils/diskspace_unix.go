@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import "syscall"
+
+// localFreeSpace returns the bytes available to the user in the filesystem of the local directory dir
+func localFreeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
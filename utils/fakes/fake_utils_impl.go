@@ -2,7 +2,13 @@ package fakes
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"utils"
 )
 
 type FakeCfJavaPluginUtil struct {
@@ -11,18 +17,43 @@ type FakeCfJavaPluginUtil struct {
 	Container_path_valid bool
 	Fspath               string
 	LocalPathValid       bool
+	LocalDirMissing      bool
+	LocalFileExists      bool
+	RemoteFile           string
+	HeapDumpCorrupt      bool
+	AppState             string
+	InstanceCount        int
+	PortableShell        bool
+	Runtime              string
+	Tools                []string
+	GCLogs               []string
+	ClassHistogram       string
+	AppNames             map[string]string
+	DropletGUID          string
+	InstanceState        string
+	InstanceUptime       time.Duration
+	TransferFails        bool
+	LocalDiskFull        bool
+	ToolPaths            map[string]string
+	AppVersion           string
 	UUID                 string
 	OutputFileName       string
+	RecentLogs           []string
+	Droplet              utils.DropletInfo
+	AppEnvironment       map[string]string
+	Instances            []utils.InstanceInfo
+	AppRoutes            map[string]string
+	Apps                 []utils.AppSummary
 }
 
-func (fakeUtil FakeCfJavaPluginUtil) CheckRequiredTools(app string) (bool, error) {
+func (fakeUtil FakeCfJavaPluginUtil) CheckRequiredTools(app string, args []string) (bool, error) {
 
 	if !fakeUtil.SshEnabled {
-		return false, errors.New("ssh is not enabled for app: '" + app + "', please run below 2 shell commands to enable ssh and try again(please note application should be restarted before take effect):\ncf enable-ssh " + app + "\ncf restart " + app)
+		return false, errors.New("ssh is not enabled for app: '" + app + "', please run below 2 shell commands to enable ssh and try again(please note application should be restarted before take effect):\ncf enable-ssh " + utils.ShellWord(app) + "\ncf restart " + utils.ShellWord(app))
 	}
 
 	if !fakeUtil.Jmap_jvmmon_present {
-		return false, errors.New(`jvmmon or jmap are required for generating heap dump, you can modify your application manifest.yaml on the 'JBP_CONFIG_OPEN_JDK_JRE' environment variable. This could be done like this:
+		return false, errors.New(`jvmmon, jmap, jcmd or jattach are required for generating heap dump, you can modify your application manifest.yaml on the 'JBP_CONFIG_OPEN_JDK_JRE' environment variable. This could be done like this:
 		---
 		applications:
 		- name: <APP_NAME>
@@ -38,8 +69,8 @@ func (fakeUtil FakeCfJavaPluginUtil) CheckRequiredTools(app string) (bool, error
 	return true, nil
 }
 
-func (fake FakeCfJavaPluginUtil) GetAvailablePath(data string, userpath string) (string, error) {
-	if !fake.Container_path_valid && len(userpath) > 0 {
+func (fake FakeCfJavaPluginUtil) GetAvailablePath(data string, args []string, userpath string) (string, error) {
+	if !fake.Container_path_valid && len(userpath) > 0 && userpath != utils.AutoLargestPath {
 		return "", errors.New("the container path specified doesn't exist or have no read and write access, please check and try again later")
 	}
 
@@ -50,17 +81,50 @@ func (fake FakeCfJavaPluginUtil) GetAvailablePath(data string, userpath string)
 	return "/tmp", nil
 }
 
-func (fake FakeCfJavaPluginUtil) CopyOverCat(args []string, src string, dest string) error {
+func (fake FakeCfJavaPluginUtil) CopyOverCat(args []string, src string, dest string, options utils.CopyOptions) error {
 
 	if !fake.LocalPathValid {
 		return errors.New("Error occured during create desination file: " + dest + ", please check you are allowed to create file in the path.")
 	}
 
+	if fake.LocalDirMissing && !options.CreateLocalDir {
+		return errors.New("The local directory " + filepath.Dir(dest) + " does not exist. Please create it, or omit the flag `no-create` to have it created for you.")
+	}
+
+	if fake.LocalFileExists && !options.Force && !options.Resume {
+		return errors.New("The local file " + dest + " already exists. Please remove it, or use the flag `force` to overwrite it.")
+	}
+
+	if fake.LocalDiskFull {
+		return &utils.InsufficientSpaceError{Message: "Not enough space in the local directory " + filepath.Dir(dest) + " for " + src + ": it requires 2.0G, but only 1.0G are available. Please free up space, or download it into another directory."}
+	}
+
+	if fake.TransferFails && !options.Resume {
+		return &utils.TransferError{Message: "error occured during copying dump file: " + src + ", chunk 2/3 could not be verified after 3 attempts, please try again."}
+	}
+
+	return nil
+}
+
+func (fake FakeCfJavaPluginUtil) StreamFile(args []string, src string, out io.Writer, options utils.CopyOptions) error {
+	if fake.TransferFails {
+		return &utils.TransferError{Message: "error occured during copying dump file: " + src + ", chunk 2/3 could not be verified after 3 attempts, please try again."}
+	}
+
+	_, err := fmt.Fprint(out, "JAVA PROFILE 1.0.2")
+	return err
+}
+
+func (fake FakeCfJavaPluginUtil) UploadFile(args []string, src string, dest string) error {
+	if !fake.Container_path_valid {
+		return errors.New("error occured while uploading the file " + src + " to " + dest)
+	}
+
 	return nil
 }
 
 func (fake FakeCfJavaPluginUtil) DeleteRemoteFile(args []string, path string) error {
-	if path != fake.Fspath+"/"+fake.OutputFileName {
+	if path != fake.Fspath+"/"+fake.OutputFileName && path != fake.RemoteFile {
 		return errors.New("error occured while removing dump file generated")
 
 	}
@@ -68,10 +132,18 @@ func (fake FakeCfJavaPluginUtil) DeleteRemoteFile(args []string, path string) er
 	return nil
 }
 
+func (fake FakeCfJavaPluginUtil) DeleteRemotePaths(args []string, paths []string) error {
+	return nil
+}
+
+func (fake FakeCfJavaPluginUtil) StopRemoteProcesses(args []string, pattern string) error {
+	return nil
+}
+
 func (fake FakeCfJavaPluginUtil) FindDumpFile(args []string, fullpath string, fspath string) (string, error) {
 
-	expectedFullPath := fake.Fspath + "/" + args[1] + "-heapdump-" + fake.UUID + ".hprof"
-	if fspath != fake.Fspath || fullpath != expectedFullPath {
+	// The name of the app is only part of the file name as far as it is safe there
+	if fspath != fake.Fspath || !strings.HasPrefix(fullpath, fake.Fspath+"/") || !strings.Contains(fullpath, "-heapdump") {
 		return "", errors.New("error while checking the generated file")
 	}
 	output := fspath + "/" + fake.OutputFileName
@@ -79,3 +151,180 @@ func (fake FakeCfJavaPluginUtil) FindDumpFile(args []string, fullpath string, fs
 	return strings.Trim(string(output[:]), "\n"), nil
 
 }
+
+func (fake FakeCfJavaPluginUtil) FindRemoteFile(args []string, pattern string) (string, error) {
+	if fake.RemoteFile == "" {
+		return "", nil
+	}
+
+	for _, p := range strings.Fields(pattern) {
+		if matched, _ := filepath.Match(p, fake.RemoteFile); matched || strings.HasPrefix(fake.RemoteFile, strings.TrimRight(p, "*")) {
+			return fake.RemoteFile, nil
+		}
+	}
+
+	return "", nil
+}
+
+func (fake FakeCfJavaPluginUtil) ValidateHeapDump(path string) (utils.HeapDumpSummary, error) {
+	if fake.HeapDumpCorrupt {
+		return utils.HeapDumpSummary{}, errors.New("The heap dump " + path + " is truncated: the last record is incomplete")
+	}
+
+	return utils.HeapDumpSummary{Version: "1.0.2", Size: 1024 * 1024, Records: 42}, nil
+}
+
+func (fake FakeCfJavaPluginUtil) RedactHeapDump(path string) (int, error) {
+	if fake.HeapDumpCorrupt {
+		return 0, errors.New("error occured while redacting the heap dump " + path + ": unexpected EOF")
+	}
+
+	return 7, nil
+}
+
+func (fake FakeCfJavaPluginUtil) CheckAppInstance(app string, index int) error {
+	if fake.AppState == "STOPPED" {
+		return errors.New("app '" + app + "' is stopped; start it before collecting diagnostics")
+	}
+	if fake.AppState != "" && fake.AppState != "STARTED" {
+		return errors.New("app '" + app + "' is not started (state: " + fake.AppState + ")")
+	}
+
+	if fake.Instances != nil {
+		running := 0
+		for _, instance := range fake.Instances {
+			if instance.State == "RUNNING" || instance.State == "STARTING" {
+				running++
+			}
+		}
+		if running == 0 {
+			return errors.New("app '" + app + "' has no running instance, e.g., as its instances crashed; check `cf app " + utils.ShellWord(app) + "` and `cf logs " + utils.ShellWord(app) + " --recent`, and start it before collecting diagnostics")
+		}
+		for _, instance := range fake.Instances {
+			if instance.Index == index && (instance.State == "CRASHED" || instance.State == "DOWN") {
+				return fmt.Errorf("instance %d of app '%s' is not running (state: %s)", index, app, instance.State)
+			}
+		}
+	}
+
+	if fake.InstanceCount > 0 && index >= fake.InstanceCount {
+		return fmt.Errorf("instance %d requested but app '%s' has %d instances", index, app, fake.InstanceCount)
+	}
+
+	return nil
+}
+
+func (fake FakeCfJavaPluginUtil) GetAppName(guid string) (string, error) {
+	name, ok := fake.AppNames[guid]
+	if !ok {
+		return "", errors.New("no app found with GUID: '" + guid + "'")
+	}
+
+	return name, nil
+}
+
+func (fake FakeCfJavaPluginUtil) GetAppNameByRoute(route string) (string, error) {
+	name, ok := fake.AppRoutes[route]
+	if !ok {
+		return "", errors.New("no app found for route: '" + route + "', please check that it is mapped to an app in the targeted space")
+	}
+
+	return name, nil
+}
+
+func (fake FakeCfJavaPluginUtil) GetApps() ([]utils.AppSummary, error) {
+	return fake.Apps, nil
+}
+
+func (fake FakeCfJavaPluginUtil) GetInstanceState(app string, index int) (string, time.Duration, error) {
+	if fake.InstanceState == "" {
+		return "RUNNING", fake.InstanceUptime, nil
+	}
+
+	return fake.InstanceState, fake.InstanceUptime, nil
+}
+
+func (fake FakeCfJavaPluginUtil) GetAppDroplet(app string) (string, string, error) {
+	return app + "-guid", fake.DropletGUID, nil
+}
+
+func (fake FakeCfJavaPluginUtil) InspectContainer(args []string) (bool, string, error) {
+	runtime, err := fake.DetectRuntime(args)
+	return fake.PortableShell, runtime, err
+}
+
+func (fake FakeCfJavaPluginUtil) DetectRuntime(args []string) (string, error) {
+	if fake.Runtime == "" {
+		return utils.RuntimeHotSpot, nil
+	}
+
+	return fake.Runtime, nil
+}
+
+func (fake FakeCfJavaPluginUtil) FindTools(args []string, tools []string) (map[string]bool, error) {
+	found := map[string]bool{}
+	for _, tool := range fake.Tools {
+		found[tool] = true
+	}
+
+	return found, nil
+}
+
+func (fake FakeCfJavaPluginUtil) ResolveTools(args []string, tools []string) (map[string]string, error) {
+	paths := map[string]string{}
+	for _, tool := range tools {
+		paths[tool] = fake.ToolPaths[tool]
+	}
+
+	return paths, nil
+}
+
+func (fake FakeCfJavaPluginUtil) FindGCLogs(args []string) ([]string, error) {
+	return fake.GCLogs, nil
+}
+
+func (fake FakeCfJavaPluginUtil) GetClassHistogram(args []string) (string, error) {
+	if fake.ClassHistogram == "" {
+		return "", errors.New("jcmd or jmap is required for creating class histograms, please make sure that the app runs on a full JDK")
+	}
+
+	return fake.ClassHistogram, nil
+}
+
+func (fake FakeCfJavaPluginUtil) GetAppVersion(app string) (string, error) {
+	return fake.AppVersion, nil
+}
+
+func (fake FakeCfJavaPluginUtil) GetDropletInfo(app string) (utils.DropletInfo, error) {
+	return fake.Droplet, nil
+}
+
+func (fake FakeCfJavaPluginUtil) GetAppEnvironment(app string) (map[string]string, error) {
+	return fake.AppEnvironment, nil
+}
+
+func (fake FakeCfJavaPluginUtil) GetRecentLogs(app string) ([]string, error) {
+	return fake.RecentLogs, nil
+}
+
+func (fake FakeCfJavaPluginUtil) GetInstances(app string) ([]utils.InstanceInfo, error) {
+	if fake.Instances != nil {
+		return fake.Instances, nil
+	}
+
+	instances := []utils.InstanceInfo{{Index: 0, State: "RUNNING"}}
+	for index := 1; index < fake.InstanceCount; index++ {
+		instances = append(instances, utils.InstanceInfo{Index: index, State: "RUNNING"})
+	}
+
+	return instances, nil
+}
+
+func (fake FakeCfJavaPluginUtil) GetRunningInstances(app string) ([]int, error) {
+	running := []int{0}
+	for index := 1; index < fake.InstanceCount; index++ {
+		running = append(running, index)
+	}
+
+	return running, nil
+}
@@ -0,0 +1,349 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// hprofMagic is the prefix of the null-terminated header every heap dump in the HPROF format starts with
+const hprofMagic = "JAVA PROFILE "
+
+// HeapDumpSummary describes a heap dump file in the HPROF format
+type HeapDumpSummary struct {
+	// Version is the version of the HPROF format, e.g., 1.0.2
+	Version string
+	// Size is the size of the file in bytes
+	Size int64
+	// Records is the amount of top-level records in the file
+	Records int
+}
+
+// ValidateHeapDump checks that the file at path is a complete heap dump in the HPROF format, i.e., that it
+// starts with the HPROF header and that its records add up to the size of the file
+func (checker CfJavaPluginUtilImpl) ValidateHeapDump(path string) (HeapDumpSummary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return HeapDumpSummary{}, errors.New("error occured while opening the heap dump file: " + path)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return HeapDumpSummary{}, errors.New("error occured while opening the heap dump file: " + path)
+	}
+
+	reader := bufio.NewReader(f)
+
+	header, err := reader.ReadString(0)
+	if err != nil || !strings.HasPrefix(header, hprofMagic) {
+		return HeapDumpSummary{}, errors.New("The file " + path + " is not a heap dump in the HPROF format, or it is corrupt")
+	}
+	summary := HeapDumpSummary{
+		Version: strings.TrimSuffix(strings.TrimPrefix(header, hprofMagic), "\x00"),
+		Size:    info.Size(),
+	}
+
+	// Identifier size (u4) and timestamp (u8)
+	if _, err := reader.Discard(12); err != nil {
+		return summary, errors.New("The heap dump " + path + " is truncated: the header is incomplete")
+	}
+
+	// Each record is made of a tag (u1), a timestamp (u4), the length of the body (u4) and the body
+	recordHeader := make([]byte, 9)
+	for {
+		_, err := io.ReadFull(reader, recordHeader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return summary, errors.New("The heap dump " + path + " is truncated: the last record is incomplete")
+		}
+
+		length := int(binary.BigEndian.Uint32(recordHeader[5:]))
+		if discarded, _ := reader.Discard(length); discarded != length {
+			return summary, errors.New("The heap dump " + path + " is truncated: the last record is incomplete")
+		}
+		summary.Records++
+	}
+
+	if summary.Records == 0 {
+		return summary, errors.New("The heap dump " + path + " is truncated: it contains no records")
+	}
+
+	return summary, nil
+}
+
+const (
+	// hprofHeapDump and hprofHeapDumpSegment are the top-level records holding the objects of the heap
+	hprofHeapDump        = 0x0C
+	hprofHeapDumpSegment = 0x1C
+	// hprofTypeObject, hprofTypeChar and hprofTypeByte are the basic types of values in heap dumps
+	hprofTypeObject = 2
+	hprofTypeChar   = 5
+	hprofTypeByte   = 8
+)
+
+// hprofTypeSizes are the sizes in bytes of the basic types of values in heap dumps, except for objects,
+// which take the size of an identifier
+var hprofTypeSizes = map[byte]int64{4: 1, 5: 2, 6: 4, 7: 8, 8: 1, 9: 2, 10: 4, 11: 8}
+
+// hprofRedactor copies a heap dump, replacing the contents of char and byte arrays with zeros
+type hprofRedactor struct {
+	in     *bufio.Reader
+	out    *bufio.Writer
+	idSize int64
+	// fixedSizes are the sizes of the sub-records of fixed size, e.g., GC roots, without their tag
+	fixedSizes map[byte]int64
+	redacted   int
+}
+
+// copy copies the next n bytes unchanged and returns them
+func (r *hprofRedactor) copy(n int64) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.in, buf); err != nil {
+		return nil, err
+	}
+	_, err := r.out.Write(buf)
+	return buf, err
+}
+
+// pass copies the next n bytes unchanged
+func (r *hprofRedactor) pass(n int64) error {
+	_, err := io.CopyN(r.out, r.in, n)
+	return err
+}
+
+// zero replaces the next n bytes with zeros
+func (r *hprofRedactor) zero(n int64) error {
+	if discarded, err := r.in.Discard(int(n)); int64(discarded) != n {
+		return err
+	}
+	_, err := io.CopyN(r.out, zeroReader{}, n)
+	return err
+}
+
+// u4 copies the next unsigned 4-byte integer and returns it
+func (r *hprofRedactor) u4() (int64, error) {
+	buf, err := r.copy(4)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint32(buf)), nil
+}
+
+// u2 copies the next unsigned 2-byte integer and returns it
+func (r *hprofRedactor) u2() (int64, error) {
+	buf, err := r.copy(2)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint16(buf)), nil
+}
+
+// typeSize returns the size of a value of the given basic type
+func (r *hprofRedactor) typeSize(basicType byte) (int64, error) {
+	if basicType == hprofTypeObject {
+		return r.idSize, nil
+	}
+	size, ok := hprofTypeSizes[basicType]
+	if !ok {
+		return 0, errors.New("unknown basic type " + strconv.Itoa(int(basicType)))
+	}
+	return size, nil
+}
+
+// subRecord copies the next sub-record of a heap dump record, redacting char and byte arrays, and returns its size
+func (r *hprofRedactor) subRecord() (int64, error) {
+	tagBuf, err := r.copy(1)
+	if err != nil {
+		return 0, err
+	}
+	id := r.idSize
+
+	if size, ok := r.fixedSizes[tagBuf[0]]; ok {
+		return 1 + size, r.pass(size)
+	}
+
+	switch tagBuf[0] {
+	case 0x20: // Class dump
+		size := int64(1)
+		if err := r.pass(7*id + 8); err != nil {
+			return 0, err
+		}
+		size += 7*id + 8
+		// Constant pool entries (index u2, type u1, value), static fields (name id, type u1, value)
+		// and instance fields (name id, type u1)
+		for _, entry := range []struct {
+			prefix    int64
+			withValue bool
+		}{{2, true}, {id, true}, {id, false}} {
+			count, err := r.u2()
+			if err != nil {
+				return 0, err
+			}
+			size += 2
+			for i := int64(0); i < count; i++ {
+				buf, err := r.copy(entry.prefix + 1)
+				if err != nil {
+					return 0, err
+				}
+				size += entry.prefix + 1
+				if entry.withValue {
+					valueSize, err := r.typeSize(buf[entry.prefix])
+					if err != nil {
+						return 0, err
+					}
+					if err := r.pass(valueSize); err != nil {
+						return 0, err
+					}
+					size += valueSize
+				}
+			}
+		}
+		return size, nil
+	case 0x21: // Instance dump
+		if err := r.pass(2*id + 4); err != nil {
+			return 0, err
+		}
+		length, err := r.u4()
+		if err != nil {
+			return 0, err
+		}
+		return 1 + 2*id + 8 + length, r.pass(length)
+	case 0x22: // Object array dump
+		if err := r.pass(id + 4); err != nil {
+			return 0, err
+		}
+		count, err := r.u4()
+		if err != nil {
+			return 0, err
+		}
+		return 1 + 2*id + 8 + count*id, r.pass(id + count*id)
+	case 0x23: // Primitive array dump
+		if err := r.pass(id + 4); err != nil {
+			return 0, err
+		}
+		count, err := r.u4()
+		if err != nil {
+			return 0, err
+		}
+		typeBuf, err := r.copy(1)
+		if err != nil {
+			return 0, err
+		}
+		elementSize, err := r.typeSize(typeBuf[0])
+		if err != nil {
+			return 0, err
+		}
+		if typeBuf[0] == hprofTypeChar || typeBuf[0] == hprofTypeByte {
+			err = r.zero(count * elementSize)
+			r.redacted++
+		} else {
+			err = r.pass(count * elementSize)
+		}
+		return 1 + id + 9 + count*elementSize, err
+	}
+
+	return 0, errors.New("unknown heap dump sub-record " + strconv.Itoa(int(tagBuf[0])))
+}
+
+// zeroReader reads an endless stream of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// RedactHeapDump replaces the contents of all char and byte arrays in the heap dump at path, which hold the contents
+// of strings and buffers, with zeros, keeping the objects, their references and sizes. It returns the number of
+// arrays redacted.
+func (checker CfJavaPluginUtilImpl) RedactHeapDump(path string) (int, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, errors.New("error occured while opening the heap dump file: " + path)
+	}
+	defer in.Close()
+
+	redactedPath := path + ".redacted"
+	out, err := os.Create(redactedPath)
+	if err != nil {
+		return 0, errors.New("error occured while creating the redacted heap dump file: " + redactedPath)
+	}
+	defer os.Remove(redactedPath)
+	defer out.Close()
+
+	r := &hprofRedactor{in: bufio.NewReader(in), out: bufio.NewWriter(out)}
+	if err := r.redact(); err != nil {
+		return 0, errors.New("error occured while redacting the heap dump " + path + ": " + err.Error())
+	}
+
+	if err := r.out.Flush(); err != nil {
+		return 0, errors.New("error occured while writing the redacted heap dump file: " + redactedPath)
+	}
+	if err := out.Close(); err != nil {
+		return 0, errors.New("error occured while writing the redacted heap dump file: " + redactedPath)
+	}
+	if err := os.Rename(redactedPath, path); err != nil {
+		return 0, errors.New("error occured while replacing the heap dump " + path + " with its redacted copy")
+	}
+
+	return r.redacted, nil
+}
+
+// redact copies the whole heap dump, redacting the arrays in its heap dump records
+func (r *hprofRedactor) redact() error {
+	header, err := r.in.ReadString(0)
+	if err != nil || !strings.HasPrefix(header, hprofMagic) {
+		return errors.New("not a heap dump in the HPROF format")
+	}
+	if _, err := r.out.WriteString(header); err != nil {
+		return err
+	}
+
+	idSize, err := r.u4()
+	if err != nil {
+		return err
+	}
+	r.idSize = idSize
+	r.fixedSizes = map[byte]int64{0xFF: idSize, 0x01: 2 * idSize, 0x02: idSize + 8, 0x03: idSize + 8, 0x04: idSize + 4, 0x05: idSize, 0x06: idSize + 4, 0x07: idSize, 0x08: idSize + 8}
+	if err := r.pass(8); err != nil {
+		return err
+	}
+
+	for {
+		recordHeader, err := r.copy(9)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		length := int64(binary.BigEndian.Uint32(recordHeader[5:]))
+		if recordHeader[0] != hprofHeapDump && recordHeader[0] != hprofHeapDumpSegment {
+			if err := r.pass(length); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for length > 0 {
+			size, err := r.subRecord()
+			if err != nil {
+				return err
+			}
+			length -= size
+		}
+		if length < 0 {
+			return errors.New("a heap dump sub-record exceeds its record")
+		}
+	}
+}
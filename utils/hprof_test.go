@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hprofBuilder writes a synthetic heap dump in the HPROF format with identifiers of 8 bytes
+type hprofBuilder struct {
+	bytes.Buffer
+	// redacted writes zeros for the contents of char and byte arrays, as RedactHeapDump does
+	redacted bool
+}
+
+func (b *hprofBuilder) u1(v byte)    { b.WriteByte(v) }
+func (b *hprofBuilder) u2(v uint16)  { binary.Write(b, binary.BigEndian, v) }
+func (b *hprofBuilder) u4(v uint32)  { binary.Write(b, binary.BigEndian, v) }
+func (b *hprofBuilder) u8(v uint64)  { binary.Write(b, binary.BigEndian, v) }
+func (b *hprofBuilder) id(v uint64)  { b.u8(v) }
+func (b *hprofBuilder) raw(v []byte) { b.Write(v) }
+
+func (b *hprofBuilder) header() {
+	b.WriteString(hprofMagic + "1.0.2\x00")
+	b.u4(8)
+	b.u8(1700000000000)
+}
+
+// record writes a top-level record with the body written by the given function
+func (b *hprofBuilder) record(tag byte, body func(*hprofBuilder)) {
+	content := &hprofBuilder{redacted: b.redacted}
+	body(content)
+	b.u1(tag)
+	b.u4(0)
+	b.u4(uint32(content.Len()))
+	b.Write(content.Bytes())
+}
+
+// primitiveArray writes a primitive array dump, with its contents zeroed if redacting char or byte arrays
+func (b *hprofBuilder) primitiveArray(id uint64, basicType byte, count uint32, contents []byte) {
+	b.u1(0x23)
+	b.id(id)
+	b.u4(0)
+	b.u4(count)
+	b.u1(basicType)
+	if b.redacted && (basicType == hprofTypeChar || basicType == hprofTypeByte) {
+		contents = make([]byte, len(contents))
+	}
+	b.raw(contents)
+}
+
+// sampleHeapDump returns a heap dump with a UTF8 record, two heap dump segments holding a GC root, a class dump, an
+// instance dump, an object array and char, byte and int arrays, and the end of the heap dump
+func sampleHeapDump(redacted bool) []byte {
+	b := &hprofBuilder{redacted: redacted}
+	b.header()
+	b.record(0x01, func(r *hprofBuilder) {
+		r.id(100)
+		r.WriteString("java.lang.String")
+	})
+	b.record(hprofHeapDumpSegment, func(r *hprofBuilder) {
+		// GC root of an unknown kind
+		r.u1(0xFF)
+		r.id(1)
+		// Class dump with a constant of type int, a static field of type object and an instance field of type int
+		r.u1(0x20)
+		r.id(10)
+		r.u4(0)
+		for i := 0; i < 6; i++ {
+			r.id(uint64(11 + i))
+		}
+		r.u4(24)
+		r.u2(1)
+		r.u2(7)
+		r.u1(10)
+		r.u4(42)
+		r.u2(1)
+		r.id(100)
+		r.u1(hprofTypeObject)
+		r.id(2)
+		r.u2(1)
+		r.id(101)
+		r.u1(10)
+		// Instance dump with the value of the int field
+		r.u1(0x21)
+		r.id(2)
+		r.u4(0)
+		r.id(10)
+		r.u4(4)
+		r.u4(1234)
+		// Object array of two elements
+		r.u1(0x22)
+		r.id(3)
+		r.u4(0)
+		r.u4(2)
+		r.id(10)
+		r.id(2)
+		r.id(0)
+		r.primitiveArray(4, hprofTypeChar, 3, []byte{0, 's', 0, 'e', 0, 'c'})
+		r.primitiveArray(5, hprofTypeByte, 4, []byte("pass"))
+		r.primitiveArray(6, 10, 2, []byte{0, 0, 0, 7, 0, 0, 0, 9})
+	})
+	b.record(hprofHeapDumpSegment, func(r *hprofBuilder) {
+		r.primitiveArray(7, hprofTypeByte, 5, []byte("token"))
+	})
+	b.record(0x2C, func(r *hprofBuilder) {})
+
+	return b.Bytes()
+}
+
+func writeHeapDump(t *testing.T, content []byte) string {
+	path := filepath.Join(t.TempDir(), "heapdump.hprof")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRedactHeapDumpZeroesCharAndByteArrays(t *testing.T) {
+	path := writeHeapDump(t, sampleHeapDump(false))
+
+	redacted, err := CfJavaPluginUtilImpl{}.RedactHeapDump(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redacted != 3 {
+		t.Errorf("expected 3 arrays redacted, got %d", redacted)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := sampleHeapDump(true)
+	if !bytes.Equal(content, expected) {
+		t.Errorf("expected the redacted heap dump to keep all records and lengths and zero only the char and byte arrays\nexpected: %x\ngot:      %x", expected, content)
+	}
+	for _, secret := range []string{"pass", "token", "s\x00e\x00c"} {
+		if bytes.Contains(content, []byte(secret)) {
+			t.Errorf("expected %q to be zeroed", secret)
+		}
+	}
+	if !bytes.Contains(content, []byte("java.lang.String")) {
+		t.Error("expected the UTF8 record to be kept")
+	}
+
+	if _, err := os.Stat(path + ".redacted"); !os.IsNotExist(err) {
+		t.Error("expected the temporary redacted file to be removed")
+	}
+	if summary, err := (CfJavaPluginUtilImpl{}).ValidateHeapDump(path); err != nil || summary.Records != 4 {
+		t.Errorf("expected the redacted heap dump to be valid with 4 records, got %v, %v", summary, err)
+	}
+}
+
+func TestRedactHeapDumpRejectsUnknownSubRecords(t *testing.T) {
+	b := &hprofBuilder{}
+	b.header()
+	b.record(hprofHeapDump, func(r *hprofBuilder) {
+		r.u1(0x42)
+		r.id(1)
+	})
+	original := b.Bytes()
+	path := writeHeapDump(t, original)
+
+	_, err := CfJavaPluginUtilImpl{}.RedactHeapDump(path)
+	if err == nil || !strings.Contains(err.Error(), "unknown heap dump sub-record 66") {
+		t.Errorf("expected an error about the unknown sub-record, got %v", err)
+	}
+	content, _ := os.ReadFile(path)
+	if !bytes.Equal(content, original) {
+		t.Error("expected the heap dump to be left as it is")
+	}
+}
+
+func TestValidateHeapDump(t *testing.T) {
+	valid := sampleHeapDump(false)
+	headerOnly := &hprofBuilder{}
+	headerOnly.header()
+
+	for _, test := range []struct {
+		name    string
+		content []byte
+		err     string
+	}{
+		{"not a heap dump", []byte("PK\x03\x04"), "is not a heap dump in the HPROF format"},
+		{"truncated header", valid[:len(hprofMagic)+6+4], "is truncated: the header is incomplete"},
+		{"record cut off mid-body", valid[:len(valid)-20], "is truncated: the last record is incomplete"},
+		{"record header cut off", valid[:len(valid)-5], "is truncated: the last record is incomplete"},
+		{"no records", headerOnly.Bytes(), "is truncated: it contains no records"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeHeapDump(t, test.content)
+			_, err := CfJavaPluginUtilImpl{}.ValidateHeapDump(path)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		path := writeHeapDump(t, valid)
+		summary, err := CfJavaPluginUtilImpl{}.ValidateHeapDump(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := HeapDumpSummary{Version: "1.0.2", Size: int64(len(valid)), Records: 4}
+		if summary != expected {
+			t.Errorf("expected %+v, got %+v", expected, summary)
+		}
+	})
+}
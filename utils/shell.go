@@ -0,0 +1,18 @@
+package utils
+
+import "strings"
+
+// ShellQuote returns the value quoted for the shell, so that it is taken as one word, without any of its characters
+// interpreted
+func ShellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "'\\''") + "'"
+}
+
+// ShellWord returns the value quoted for the shell only if the shell would otherwise split or expand it, to keep the
+// commands printed for the user readable
+func ShellWord(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n'\"\\$`*?[]{}()<>|&;#~!") {
+		return ShellQuote(value)
+	}
+	return value
+}
@@ -0,0 +1,26 @@
+package utils
+
+import "testing"
+
+func TestShellWord(t *testing.T) {
+	for value, expected := range map[string]string{
+		"my_app":           "my_app",
+		"my-app.v2":        "my-app.v2",
+		"/tmp/dump.hprof":  "/tmp/dump.hprof",
+		"":                 "''",
+		"my app":           "'my app'",
+		"Mein Büro $(id)":  "'Mein Büro $(id)'",
+		"$HOME":            "'$HOME'",
+		"/tmp/*.hprof":     "'/tmp/*.hprof'",
+		"it's":             `'it'\''s'`,
+		"a;reboot":         "'a;reboot'",
+		"~/dumps":          "'~/dumps'",
+		"`reboot`":         "'`reboot`'",
+		"gc*=info":         "'gc*=info'",
+		"C:\\Users\\dumps": `'C:\Users\dumps'`,
+	} {
+		if quoted := ShellWord(value); quoted != expected {
+			t.Errorf("expected %q to be quoted as %s, got %s", value, expected, quoted)
+		}
+	}
+}
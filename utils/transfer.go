@@ -0,0 +1,325 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// transferBlockSize is the block size used with dd when reading chunks of a remote file
+	transferBlockSize = 1024 * 1024
+	// transferChunkSize is the size of the chunks remote files are split into for the download.
+	// Each chunk is verified against a checksum computed in the container and, should the
+	// verification fail, is retried on its own instead of restarting the whole transfer.
+	transferChunkSize = 64 * transferBlockSize
+	// transferChunkRetries is how often the download of a single chunk is attempted
+	transferChunkRetries = 3
+)
+
+// sshCommand returns the cf ssh arguments to execute remoteCommand, without modifying args
+func sshCommand(args []string, remoteCommand string) []string {
+	command := make([]string, 0, len(args)+1)
+	command = append(command, args...)
+	return append(command, remoteCommand)
+}
+
+func (checker CfJavaPluginUtilImpl) remoteFileSize(args []string, src string) (int64, error) {
+	output, err := checker.cf(sshCommand(args, "stat -c '%s' "+src)...)
+	if err != nil {
+		return 0, errors.New("error occured while reading the size of file: " + src)
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return 0, errors.New("unexpected size '" + strings.TrimSpace(output) + "' reported for file: " + src)
+	}
+
+	return size, nil
+}
+
+// chunkCount returns the number of chunks a file of the given size is split into, the last one possibly shorter
+func chunkCount(size int64) int64 {
+	return (size + transferChunkSize - 1) / transferChunkSize
+}
+
+func chunkReadCommand(src string, index int64) string {
+	blocks := int64(transferChunkSize / transferBlockSize)
+	return fmt.Sprintf("dd if=%s bs=%d skip=%d count=%d 2>/dev/null", src, transferBlockSize, index*blocks, blocks)
+}
+
+// FileManifest holds the size of a remote file and the md5 checksums of its chunks, as needed for the download
+type FileManifest struct {
+	Size      int64
+	Checksums []string
+}
+
+// manifestPrefix starts the line printed by ManifestCommand
+const manifestPrefix = "FILE_MANIFEST "
+
+// ManifestCommand returns the remote command printing the manifest of src on a line of its own, to be appended to the
+// commands creating the file so that the download needs no further session to prepare. The chunks are read the same
+// way as by chunkReadCommand.
+func ManifestCommand(src string) string {
+	blocks := int64(transferChunkSize / transferBlockSize)
+	return fmt.Sprintf("SIZE=$(wc -c < %s); CHECKSUMS=; i=0; while [ $((i*%d)) -lt ${SIZE} ]; do CHECKSUMS=\"${CHECKSUMS} $(dd if=%s bs=%d skip=$((i*%d)) count=%d 2>/dev/null | md5sum | cut -d ' ' -f 1)\"; i=$((i+1)); done; echo \"%s${SIZE}${CHECKSUMS}\"",
+		src, transferChunkSize, src, transferBlockSize, blocks, blocks, manifestPrefix)
+}
+
+// ParseManifest looks for the manifest printed by ManifestCommand in the output of a remote command, and returns it
+// along with the other lines of the output
+func ParseManifest(output []string) (*FileManifest, []string) {
+	var manifest *FileManifest
+	var rest []string
+	for _, line := range output {
+		fields := strings.Fields(strings.TrimPrefix(line, manifestPrefix))
+		if !strings.HasPrefix(line, manifestPrefix) || len(fields) == 0 {
+			rest = append(rest, line)
+			continue
+		}
+
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || int64(len(fields)-1) != chunkCount(size) {
+			rest = append(rest, line)
+			continue
+		}
+		manifest = &FileManifest{Size: size, Checksums: fields[1:]}
+	}
+
+	return manifest, rest
+}
+
+// remoteChunkChecksums computes in a single ssh session the md5 checksums of all the chunks of src
+func (checker CfJavaPluginUtilImpl) remoteChunkChecksums(args []string, src string, chunks int64) ([]string, error) {
+	if chunks == 0 {
+		return []string{}, nil
+	}
+
+	blocks := int64(transferChunkSize / transferBlockSize)
+	cmd := fmt.Sprintf("i=0; while [ $i -lt %d ]; do dd if=%s bs=%d skip=$((i*%d)) count=%d 2>/dev/null | md5sum | cut -d ' ' -f 1; i=$((i+1)); done", chunks, src, transferBlockSize, blocks, blocks)
+
+	output, err := checker.cf(sshCommand(args, cmd)...)
+	if err != nil {
+		return nil, errors.New("error occured while computing the checksums of file: " + src)
+	}
+
+	checksums := strings.Fields(output)
+	if int64(len(checksums)) != chunks {
+		return nil, fmt.Errorf("expected %d checksums for file %s, got %d", chunks, src, len(checksums))
+	}
+
+	return checksums, nil
+}
+
+// TransferError reports that the download of a file failed midway, e.g., because the ssh session broke off, so that
+// it can be resumed
+type TransferError struct {
+	Message string
+}
+
+func (e TransferError) Error() string {
+	return e.Message
+}
+
+// localChunkMatches tells whether the chunk with the given index of the local file f, downloaded before, matches the
+// expected checksum, so that resuming the download can skip it
+func localChunkMatches(f *os.File, index int64, checksum string) bool {
+	hash := md5.New()
+	n, err := io.Copy(hash, io.NewSectionReader(f, index*transferChunkSize, transferChunkSize))
+	return err == nil && n > 0 && hex.EncodeToString(hash.Sum(nil)) == checksum
+}
+
+// copyChunk downloads the chunk with the given index of src into the matching position of f,
+// retrying the chunk if its content does not match the expected checksum. The content is written
+// through out, which is either f itself or a wrapper around it. As the output of the CliConnection
+// comes split in lines of text, the binary content is streamed from a separate cf process instead.
+func copyChunk(args []string, src string, f *os.File, out io.Writer, index int64, chunks int64, checksum string) error {
+	for attempt := 1; attempt <= transferChunkRetries; attempt++ {
+		_, err := f.Seek(index*transferChunkSize, io.SeekStart)
+		if err != nil {
+			return errors.New("error occured while writing the local file: " + f.Name())
+		}
+
+		hash := md5.New()
+		dd := CfCommand(sshCommand(args, chunkReadCommand(src, index))...)
+		dd.Stdout = io.MultiWriter(out, hash)
+
+		err = dd.Run()
+		if err == nil && hex.EncodeToString(hash.Sum(nil)) == checksum {
+			return nil
+		}
+
+		if attempt < transferChunkRetries {
+			fmt.Printf("Verification of chunk %d/%d of %s failed, retrying\n", index+1, chunks, src)
+		}
+	}
+
+	return &TransferError{Message: fmt.Sprintf("error occured during copying dump file: %s, chunk %d/%d could not be verified after %d attempts, please try again.", src, index+1, chunks, transferChunkRetries)}
+}
+
+// StreamFile writes the content of src to out, e.g., stdout to pipe it into other tools. As out cannot be rewound to
+// retry a chunk, each chunk is read into memory and verified before it is written out.
+func (checker CfJavaPluginUtilImpl) StreamFile(args []string, src string, out io.Writer, options CopyOptions) error {
+	manifest := options.Manifest
+	if manifest == nil {
+		size, err := checker.remoteFileSize(args, src)
+		if err != nil {
+			return err
+		}
+		checksums, err := checker.remoteChunkChecksums(args, src, chunkCount(size))
+		if err != nil {
+			return err
+		}
+		manifest = &FileManifest{Size: size, Checksums: checksums}
+	}
+	chunks := int64(len(manifest.Checksums))
+
+	if options.LimitRate > 0 {
+		out = newThrottledWriter(out, options.LimitRate)
+	}
+
+	var chunk bytes.Buffer
+	for i := int64(0); i < chunks; i++ {
+		verified := false
+		for attempt := 1; attempt <= transferChunkRetries && !verified; attempt++ {
+			chunk.Reset()
+			hash := md5.New()
+			dd := CfCommand(sshCommand(args, chunkReadCommand(src, i))...)
+			dd.Stdout = io.MultiWriter(&chunk, hash)
+
+			verified = dd.Run() == nil && hex.EncodeToString(hash.Sum(nil)) == manifest.Checksums[i]
+			if !verified && attempt < transferChunkRetries {
+				fmt.Fprintf(os.Stderr, "Verification of chunk %d/%d of %s failed, retrying\n", i+1, chunks, src)
+			}
+		}
+		if !verified {
+			return &TransferError{Message: fmt.Sprintf("error occured during streaming file: %s, chunk %d/%d could not be verified after %d attempts", src, i+1, chunks, transferChunkRetries)}
+		}
+
+		if _, err := chunk.WriteTo(out); err != nil {
+			return errors.New("error occured while writing " + src + " to the output: " + err.Error())
+		}
+		if options.Progress != nil {
+			transferred := (i + 1) * transferChunkSize
+			if transferred > manifest.Size {
+				transferred = manifest.Size
+			}
+			options.Progress(transferred, manifest.Size)
+		}
+	}
+
+	return nil
+}
+
+// UploadFile copies the local file src to dest in the container and verifies the copy against the checksum of src.
+// Like the download, it streams the content through a separate cf process, as the CliConnection takes no input. The
+// content is encoded in base64 on the way, so that no byte of it can be taken for a control character of the session.
+func (checker CfJavaPluginUtilImpl) UploadFile(args []string, src string, dest string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return errors.New("error occured while reading the local file: " + src)
+	}
+	defer f.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return errors.New("error occured while reading the local file: " + src)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return errors.New("error occured while reading the local file: " + src)
+	}
+
+	if err := uploadStream(args, f, dest); err != nil {
+		return errors.New("error occured while uploading the file " + src + " to " + dest + " in the container")
+	}
+
+	output, err := checker.cf(sshCommand(args, "md5sum "+dest+" | cut -d ' ' -f 1")...)
+	if err != nil || strings.TrimSpace(output) != hex.EncodeToString(hash.Sum(nil)) {
+		return errors.New("error occured while uploading the file " + src + " to " + dest + ": the copy in the container could not be verified, please try again.")
+	}
+
+	return nil
+}
+
+// UploadScript writes the given script into dest in the container, e.g., a path below ${TMPDIR}, which the remote shell
+// expands. It takes the way of UploadFile rather than the command line of cf ssh, which is limited in length.
+func UploadScript(args []string, script string, dest string) error {
+	if err := uploadStream(args, strings.NewReader(script), dest); err != nil {
+		return errors.New("error occured while uploading the remote command into the container")
+	}
+
+	return nil
+}
+
+// uploadStream writes the content of src into dest in the container through the stdin of a cf process, encoded in
+// base64, and removes dest again should the copy fail
+func uploadStream(args []string, src io.Reader, dest string) error {
+	encoded, encoder := io.Pipe()
+	go func() {
+		base64Encoder := base64.NewEncoder(base64.StdEncoding, encoder)
+		_, err := io.Copy(base64Encoder, src)
+		if err == nil {
+			err = base64Encoder.Close()
+		}
+		encoder.CloseWithError(err)
+	}()
+
+	upload := CfCommand(sshCommand(args, "base64 -d > "+dest+" || { rm -f "+dest+"; exit 1; }")...)
+	upload.Stdin = encoded
+	err := upload.Run()
+	encoded.Close()
+
+	return err
+}
+
+// throttledWriter limits the rate at which data is written to the underlying writer.
+// As the download is piped through it, slowing down the writes slows down the ssh session.
+type throttledWriter struct {
+	out     io.Writer
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func newThrottledWriter(out io.Writer, rate int64) *throttledWriter {
+	return &throttledWriter{out: out, rate: rate, start: time.Now()}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	// Write in slices of a tenth of the rate, so that the throughput is smooth rather than bursty
+	slice := int(t.rate / 10)
+	if slice < 1 {
+		slice = 1
+	}
+
+	total := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > slice {
+			n = slice
+		}
+
+		written, err := t.out.Write(p[:n])
+		total += written
+		t.written += int64(written)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+
+		expected := time.Duration(float64(t.written) / float64(t.rate) * float64(time.Second))
+		if elapsed := time.Since(t.start); elapsed < expected {
+			time.Sleep(expected - elapsed)
+		}
+	}
+
+	return total, nil
+}
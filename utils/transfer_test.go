@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeCf puts a cf script in front of the PATH for the processes of CfCommand. The script appends its arguments to
+// the file "calls" in dir and runs the given shell commands, with the number of the call in ${CALL}.
+func fakeCf(t *testing.T, commands string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake cf is a shell script")
+	}
+
+	dir := t.TempDir()
+	script := "#!/bin/sh\n" +
+		"echo \"$*\" >> '" + dir + "/calls'\n" +
+		"CALL=$(wc -l < '" + dir + "/calls' | tr -d ' ')\n" +
+		commands + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "cf"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+
+	return dir
+}
+
+// fakeCfCalls returns the arguments of the calls of the fake cf
+func fakeCfCalls(t *testing.T, dir string) []string {
+	calls, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Split(strings.TrimSuffix(string(calls), "\n"), "\n")
+}
+
+func md5Hex(content string) string {
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestChunkCount(t *testing.T) {
+	for _, test := range []struct {
+		size   int64
+		chunks int64
+	}{
+		{0, 0},
+		{1, 1},
+		{transferChunkSize - 1, 1},
+		{transferChunkSize, 1},
+		{transferChunkSize + 1, 2},
+		{3 * transferChunkSize, 3},
+		{3*transferChunkSize + 42, 4},
+	} {
+		if chunks := chunkCount(test.size); chunks != test.chunks {
+			t.Errorf("expected %d chunks for %d bytes, got %d", test.chunks, test.size, chunks)
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	manifest, rest := ParseManifest([]string{"Dumping heap", manifestPrefix + "42 abc", "done"})
+	if !reflect.DeepEqual(manifest, &FileManifest{Size: 42, Checksums: []string{"abc"}}) {
+		t.Errorf("expected the manifest of a file of 42 bytes in one chunk, got %+v", manifest)
+	}
+	if !reflect.DeepEqual(rest, []string{"Dumping heap", "done"}) {
+		t.Errorf("expected the other lines of the output, got %q", rest)
+	}
+
+	manifest, _ = ParseManifest([]string{manifestPrefix + "0"})
+	if !reflect.DeepEqual(manifest, &FileManifest{Size: 0, Checksums: []string{}}) {
+		t.Errorf("expected the manifest of an empty file, got %+v", manifest)
+	}
+
+	for _, line := range []string{
+		manifestPrefix,
+		manifestPrefix + "   ",
+		manifestPrefix + "big abc",
+		manifestPrefix + "-1 abc",
+		manifestPrefix + "42",
+		manifestPrefix + "42 abc def",
+		strings.TrimSpace(manifestPrefix) + "42 abc",
+	} {
+		manifest, rest := ParseManifest([]string{line})
+		if manifest != nil {
+			t.Errorf("expected no manifest in %q, got %+v", line, manifest)
+		}
+		if !reflect.DeepEqual(rest, []string{line}) {
+			t.Errorf("expected %q to be kept in the output, got %q", line, rest)
+		}
+	}
+}
+
+func TestCopyChunkRetriesOnChecksumMismatch(t *testing.T) {
+	dir := fakeCf(t, `if [ "${CALL}" -eq 1 ]; then printf 'CONTENT'; else printf 'content'; fi`)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "dump"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	args := []string{"ssh", "my_app", "--command"}
+	if err := copyChunk(args, "/tmp/dump", f, f, 0, 1, md5Hex("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := ioutil.ReadFile(f.Name())
+	if string(content) != "content" {
+		t.Errorf("expected the retried chunk to overwrite the corrupted one, got %q", content)
+	}
+	calls := fakeCfCalls(t, dir)
+	expected := "ssh my_app --command " + chunkReadCommand("/tmp/dump", 0)
+	if !reflect.DeepEqual(calls, []string{expected, expected}) {
+		t.Errorf("expected the chunk to be read twice, got %q", calls)
+	}
+}
+
+func TestCopyChunkFailsWithTransferErrorAfterTheLastRetry(t *testing.T) {
+	dir := fakeCf(t, `printf 'corrupted'`)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "dump"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	err = copyChunk([]string{"ssh", "my_app", "--command"}, "/tmp/dump", f, f, 1, 3, md5Hex("content"))
+	var transferErr *TransferError
+	if !errors.As(err, &transferErr) {
+		t.Fatalf("expected a *TransferError, got %#v", err)
+	}
+	if !strings.Contains(transferErr.Message, "chunk 2/3 could not be verified after 3 attempts") {
+		t.Errorf("expected the error to name the chunk, got %q", transferErr.Message)
+	}
+	if calls := fakeCfCalls(t, dir); len(calls) != transferChunkRetries {
+		t.Errorf("expected %d attempts, got %q", transferChunkRetries, calls)
+	}
+}
+
+func TestUploadScriptWritesTheScriptThroughStdin(t *testing.T) {
+	dir := fakeCf(t, `cat > "$(dirname "$0")/stdin"`)
+
+	script := strings.Repeat("echo 'a rather long command'; ", 10000)
+	if err := UploadScript([]string{"ssh", "my_app", "--command"}, script, "${TMPDIR:-/tmp}/cf-java-abc.sh"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "ssh my_app --command base64 -d > ${TMPDIR:-/tmp}/cf-java-abc.sh || { rm -f ${TMPDIR:-/tmp}/cf-java-abc.sh; exit 1; }"
+	if calls := fakeCfCalls(t, dir); !reflect.DeepEqual(calls, []string{expected}) {
+		t.Errorf("expected the script to be written by a single short command, got %q", calls)
+	}
+	stdin, _ := ioutil.ReadFile(filepath.Join(dir, "stdin"))
+	if decoded, err := base64.StdEncoding.DecodeString(string(stdin)); err != nil || string(decoded) != script {
+		t.Errorf("expected the script encoded in base64 on stdin, got %d bytes, %v", len(decoded), err)
+	}
+}
+
+func TestUploadScriptFailsWhenTheCopyFails(t *testing.T) {
+	fakeCf(t, `cat > /dev/null; exit 1`)
+
+	if err := UploadScript([]string{"ssh", "my_app", "--command"}, "jmap", "/tmp/cf-java-abc.sh"); err == nil {
+		t.Error("expected an error")
+	}
+}